@@ -0,0 +1,512 @@
+// calibration.go
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The models' own output for an analysis, kept when calibration changed it
+type ModelMoodOutput struct {
+	Sentiment string          `json:"sentiment"`
+	Score     float64         `json:"score"`
+	Emotions  []EmotionResult `json:"emotions"`
+}
+
+// A user's correction of one analysis. The model's output is copied so the
+// correction stays a valid training example after the entry is reanalysed.
+type MoodCorrection struct {
+	ID             int             `json:"id"`
+	UserID         int             `json:"user_id"`
+	EntryID        int             `json:"entry_id"`
+	AnalysisID     int             `json:"analysis_id"`
+	ModelSentiment string          `json:"model_sentiment"`
+	ModelScore     float64         `json:"model_score"`
+	ModelEmotions  []EmotionResult `json:"model_emotions"`
+	Sentiment      *string         `json:"sentiment"` // right label, nil if not reviewed
+	Emotions       []string        `json:"emotions"`  // emotions that apply, nil if not reviewed
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+type CorrectionRequest struct {
+	Sentiment *string  `json:"sentiment"`
+	Emotions  []string `json:"emotions"`
+}
+
+// One row of the labelled dataset export
+type LabelledExample struct {
+	EntryID        int             `json:"entry_id"`
+	Text           string          `json:"text"` // the revision that was analysed
+	ModelSentiment string          `json:"model_sentiment"`
+	ModelScore     float64         `json:"model_score"`
+	ModelEmotions  []EmotionResult `json:"model_emotions"`
+	Sentiment      *string         `json:"sentiment"`
+	Emotions       []string        `json:"emotions"`
+	CorrectedAt    time.Time       `json:"corrected_at"`
+}
+
+// Sentiment classes in the order of the calibration weights
+var sentimentClasses = []string{"negative", "neutral", "positive"}
+
+// Corrections needed before sentiment, or a single emotion label, is
+// recalibrated
+const minCalibrationSamples = 5
+
+// Strength of the pull towards the uncalibrated model (L2 penalty)
+const calibrationPrior = 0.5
+
+const calibrationIterations = 500
+
+// Slope of the prior softmax; with a neutral bias of slope*neutralScoreBand
+// it labels scores the way the model does
+const sentimentPriorSlope = 10.0
+
+// A per-user multinomial logistic layer over the model's signed sentiment
+// score: logit(class) = bias + slope*score
+type sentimentCalibration struct {
+	Weights [3][2]float64 `json:"weights"` // [class][bias, slope]
+}
+
+// Platt scaling of one emotion's score: sigmoid(a*logit(p) + b)
+type plattScaler struct {
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+}
+
+type MoodCalibration struct {
+	Corrections      int                    `json:"corrections"`
+	SentimentSamples int                    `json:"sentiment_samples"`
+	Sentiment        *sentimentCalibration  `json:"sentiment"` // null until enough samples
+	Emotions         map[string]plattScaler `json:"emotions"`  // labels with enough samples
+}
+
+func sentimentPriorWeights() [3][2]float64 {
+	return [3][2]float64{
+		{0, -sentimentPriorSlope},
+		{sentimentPriorSlope * neutralScoreBand, 0},
+		{0, sentimentPriorSlope},
+	}
+}
+
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// Log-odds of a probability, clamped away from 0 and 1
+func logit(p float64) float64 {
+	p = math.Min(math.Max(p, 1e-4), 1-1e-4)
+	return math.Log(p / (1 - p))
+}
+
+func (c *sentimentCalibration) probabilities(score float64) [3]float64 {
+	var logits [3]float64
+	maxLogit := math.Inf(-1)
+	for k, w := range c.Weights {
+		logits[k] = w[0] + w[1]*score
+		maxLogit = math.Max(maxLogit, logits[k])
+	}
+	var sum float64
+	var probs [3]float64
+	for k := range logits {
+		probs[k] = math.Exp(logits[k] - maxLogit)
+		sum += probs[k]
+	}
+	for k := range probs {
+		probs[k] /= sum
+	}
+	return probs
+}
+
+// Fit the sentiment layer by gradient descent on cross-entropy plus the
+// prior penalty
+func fitSentimentCalibration(scores []float64, labels []int) *sentimentCalibration {
+	prior := sentimentPriorWeights()
+	c := &sentimentCalibration{Weights: prior}
+	rate := 1 / (float64(len(scores)) + calibrationPrior)
+
+	for iter := 0; iter < calibrationIterations; iter++ {
+		var grad [3][2]float64
+		for i, score := range scores {
+			probs := c.probabilities(score)
+			for k := range probs {
+				diff := probs[k]
+				if k == labels[i] {
+					diff--
+				}
+				grad[k][0] += diff
+				grad[k][1] += diff * score
+			}
+		}
+		for k := range grad {
+			for j := range grad[k] {
+				grad[k][j] += calibrationPrior * (c.Weights[k][j] - prior[k][j])
+				c.Weights[k][j] -= rate * grad[k][j]
+			}
+		}
+	}
+	return c
+}
+
+// Fit one emotion's Platt scaler
+func fitPlattScaler(scores []float64, present []bool) plattScaler {
+	s := plattScaler{A: 1}
+	rate := 1 / (float64(len(scores)) + calibrationPrior)
+
+	for iter := 0; iter < calibrationIterations; iter++ {
+		var gradA, gradB float64
+		for i, p := range scores {
+			x := logit(p)
+			diff := sigmoid(s.A*x + s.B)
+			if present[i] {
+				diff--
+			}
+			gradA += diff * x
+			gradB += diff
+		}
+		gradA += calibrationPrior * (s.A - 1)
+		gradB += calibrationPrior * s.B
+		s.A -= rate * gradA
+		s.B -= rate * gradB
+	}
+	return s
+}
+
+// Fit the user's calibration from their corrections
+func buildMoodCalibration(corrections []MoodCorrection) *MoodCalibration {
+	calibration := &MoodCalibration{
+		Corrections: len(corrections),
+		Emotions:    make(map[string]plattScaler),
+	}
+
+	var scores []float64
+	var labels []int
+	emotionScores := make(map[string][]float64)
+	emotionPresent := make(map[string][]bool)
+
+	for _, c := range corrections {
+		if c.Sentiment != nil {
+			for k, class := range sentimentClasses {
+				if class == *c.Sentiment {
+					scores = append(scores, c.ModelScore)
+					labels = append(labels, k)
+				}
+			}
+		}
+
+		if c.Emotions != nil {
+			applies := make(map[string]bool)
+			for _, e := range c.Emotions {
+				applies[e] = true
+			}
+			for _, e := range c.ModelEmotions {
+				emotionScores[e.Label] = append(emotionScores[e.Label], e.Score)
+				emotionPresent[e.Label] = append(emotionPresent[e.Label], applies[e.Label])
+			}
+		}
+	}
+
+	calibration.SentimentSamples = len(scores)
+	if len(scores) >= minCalibrationSamples {
+		calibration.Sentiment = fitSentimentCalibration(scores, labels)
+	}
+	for label, s := range emotionScores {
+		if len(s) >= minCalibrationSamples {
+			calibration.Emotions[label] = fitPlattScaler(s, emotionPresent[label])
+		}
+	}
+
+	return calibration
+}
+
+// The user's calibration, or an inactive one if it can't be loaded
+func loadMoodCalibration(userID int) *MoodCalibration {
+	corrections, err := store.Corrections.ListByUser(userID)
+	if err != nil {
+		log.Printf("Failed to load corrections for user %d, analysing uncalibrated: %v", userID, err)
+		return &MoodCalibration{Emotions: map[string]plattScaler{}}
+	}
+	return buildMoodCalibration(corrections)
+}
+
+func (c *MoodCalibration) active() bool {
+	return c.Sentiment != nil || len(c.Emotions) > 0
+}
+
+// Model version string, noting how many corrections calibrated the result
+func (c *MoodCalibration) modelVersion() string {
+	return c.withCalibration(analysisModelVersion())
+}
+
+// Note the calibration, if active, in a model version
+func (c *MoodCalibration) withCalibration(version string) string {
+	if !c.active() {
+		return version
+	}
+	return fmt.Sprintf("%s;calibration=%d", version, c.Corrections)
+}
+
+// Re-weight the models' output. Returns the calibrated values and the
+// original output, which is nil when calibration is inactive.
+func (c *MoodCalibration) apply(sentiment string, score float64, emotions []EmotionResult) (string, float64, []EmotionResult, *ModelMoodOutput) {
+	if !c.active() {
+		return sentiment, score, emotions, nil
+	}
+	original := &ModelMoodOutput{Sentiment: sentiment, Score: score, Emotions: emotions}
+
+	// Same convention as classifySentiment: the winning probability, signed,
+	// and zero for neutral
+	if c.Sentiment != nil {
+		probs := c.Sentiment.probabilities(score)
+		best := 0
+		for k := range probs {
+			if probs[k] > probs[best] {
+				best = k
+			}
+		}
+		sentiment = sentimentClasses[best]
+		switch sentiment {
+		case "negative":
+			score = -probs[best]
+		case "positive":
+			score = probs[best]
+		default:
+			score = 0
+		}
+	}
+
+	calibrated := make([]EmotionResult, 0, len(emotions))
+	for _, e := range emotions {
+		if s, ok := c.Emotions[e.Label]; ok {
+			e.Score = sigmoid(s.A*logit(e.Score) + s.B)
+		}
+		calibrated = append(calibrated, e)
+	}
+	sort.SliceStable(calibrated, func(i, j int) bool {
+		return calibrated[i].Score > calibrated[j].Score
+	})
+
+	return sentiment, score, calibrated, original
+}
+
+// Validate a correction request
+func parseCorrectionRequest(req CorrectionRequest) (*string, []string, error) {
+	if req.Sentiment == nil && req.Emotions == nil {
+		return nil, nil, fmt.Errorf("Provide a sentiment, emotions or both")
+	}
+
+	var sentiment *string
+	if req.Sentiment != nil {
+		label := strings.ToLower(strings.TrimSpace(*req.Sentiment))
+		valid := false
+		for _, class := range sentimentClasses {
+			valid = valid || class == label
+		}
+		if !valid {
+			return nil, nil, fmt.Errorf("Sentiment must be negative, neutral or positive")
+		}
+		sentiment = &label
+	}
+
+	var emotions []string
+	if req.Emotions != nil {
+		emotions = []string{}
+		seen := make(map[string]bool)
+		for _, e := range req.Emotions {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if !emotionLabels[e] {
+				return nil, nil, fmt.Errorf("Unknown emotion %q", e)
+			}
+			if !seen[e] {
+				seen[e] = true
+				emotions = append(emotions, e)
+			}
+		}
+		sort.Strings(emotions)
+	}
+
+	return sentiment, emotions, nil
+}
+
+// Correct the entry's current analysis. Correcting it again replaces the
+// earlier correction.
+func correctMoodAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := loadOwnedEntry(w, r)
+	if !ok {
+		return
+	}
+
+	var req CorrectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	sentiment, emotions, err := parseCorrectionRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	analysis, err := getMoodAnalysis(entry.ID)
+	if err != nil {
+		http.Error(w, "Mood analysis not found", http.StatusNotFound)
+		return
+	}
+
+	// Train on what the models said, not on an earlier calibration of it
+	output := analysis.ModelOutput
+	if output == nil {
+		output = &ModelMoodOutput{
+			Sentiment: analysis.OverallSentiment,
+			Score:     analysis.SentimentScore,
+			Emotions:  analysis.Emotions,
+		}
+	}
+
+	correction := &MoodCorrection{
+		UserID:         entry.UserID,
+		EntryID:        entry.ID,
+		AnalysisID:     analysis.ID,
+		ModelSentiment: output.Sentiment,
+		ModelScore:     output.Score,
+		ModelEmotions:  output.Emotions,
+		Sentiment:      sentiment,
+		Emotions:       emotions,
+	}
+	if err := store.Corrections.Save(correction); err != nil {
+		http.Error(w, "Failed to save correction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(correction)
+}
+
+// List the user's corrections, newest first
+func listCorrectionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	corrections, err := store.Corrections.ListByUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch corrections", http.StatusInternalServerError)
+		return
+	}
+	if corrections == nil {
+		corrections = []MoodCorrection{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(corrections)
+}
+
+func deleteCorrectionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	correctionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid correction ID", http.StatusBadRequest)
+		return
+	}
+
+	correction, err := store.Corrections.GetByID(correctionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Correction not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch correction", http.StatusInternalServerError)
+		return
+	}
+	if correction.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	if err := store.Corrections.Delete(correction.ID); err != nil {
+		http.Error(w, "Failed to delete correction", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The user's current calibration, as fitted from their corrections
+func getCalibrationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	corrections, err := store.Corrections.ListByUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch corrections", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildMoodCalibration(corrections))
+}
+
+// Download the corrections as a labelled dataset: ?format=jsonl|csv
+func exportCorrectionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" {
+		http.Error(w, "Invalid format, expected jsonl or csv", http.StatusBadRequest)
+		return
+	}
+
+	examples, err := store.Corrections.Dataset(userID)
+	if err != nil {
+		http.Error(w, "Failed to export corrections", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mood-corrections.%s"`, format))
+
+	if format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, example := range examples {
+			encoder.Encode(example)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"entry_id", "text", "model_sentiment", "model_score", "model_emotions",
+		"sentiment", "emotions", "corrected_at"})
+	for _, example := range examples {
+		var modelEmotions []string
+		for _, e := range example.ModelEmotions {
+			modelEmotions = append(modelEmotions, fmt.Sprintf("%s:%.4f", e.Label, e.Score))
+		}
+		sentiment := ""
+		if example.Sentiment != nil {
+			sentiment = *example.Sentiment
+		}
+		writer.Write([]string{
+			strconv.Itoa(example.EntryID),
+			example.Text,
+			example.ModelSentiment,
+			strconv.FormatFloat(example.ModelScore, 'f', 4, 64),
+			strings.Join(modelEmotions, ";"),
+			sentiment,
+			strings.Join(example.Emotions, ";"),
+			example.CorrectedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestLogitSigmoidRoundTrip(t *testing.T) {
+	tests := []struct {
+		p    float64
+		want float64 // p after the round trip, clamped into [1e-4, 1-1e-4]
+	}{
+		{0, 1e-4},
+		{1e-6, 1e-4},
+		{0.2, 0.2},
+		{0.5, 0.5},
+		{0.99, 0.99},
+		{1, 1 - 1e-4},
+	}
+
+	for _, tt := range tests {
+		x := logit(tt.p)
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			t.Errorf("logit(%v) = %v, want a finite value", tt.p, x)
+			continue
+		}
+		if got := sigmoid(x); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("sigmoid(logit(%v)) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+// Uncalibrated, the prior labels scores the way classifySentiment does
+func TestSentimentPriorProbabilities(t *testing.T) {
+	prior := &sentimentCalibration{Weights: sentimentPriorWeights()}
+	tests := []struct {
+		score float64
+		want  string
+	}{
+		{-0.9, "negative"},
+		{-0.5, "negative"},
+		{-0.05, "neutral"},
+		{0, "neutral"},
+		{0.05, "neutral"},
+		{0.5, "positive"},
+		{0.9, "positive"},
+	}
+
+	for _, tt := range tests {
+		probs := prior.probabilities(tt.score)
+		best, sum := 0, 0.0
+		for k, p := range probs {
+			sum += p
+			if p > probs[best] {
+				best = k
+			}
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("probabilities(%v) sum to %v, want 1", tt.score, sum)
+		}
+		if got := sentimentClasses[best]; got != tt.want {
+			t.Errorf("probabilities(%v) favour %s, want %s", tt.score, got, tt.want)
+		}
+	}
+}
+
+// n corrections of a model score to a sentiment
+func sentimentCorrections(n int, score float64, sentiment string) []MoodCorrection {
+	corrections := make([]MoodCorrection, n)
+	for i := range corrections {
+		corrections[i] = MoodCorrection{ModelSentiment: "neutral", ModelScore: score, Sentiment: stringPtr(sentiment)}
+	}
+	return corrections
+}
+
+func TestBuildMoodCalibration(t *testing.T) {
+	emotionCorrections := make([]MoodCorrection, minCalibrationSamples)
+	for i := range emotionCorrections {
+		emotionCorrections[i] = MoodCorrection{
+			ModelEmotions: []EmotionResult{{Label: "fear", Score: 0.8}, {Label: "joy", Score: 0.1}},
+			Emotions:      []string{"joy"},
+		}
+	}
+
+	tests := []struct {
+		name              string
+		corrections       []MoodCorrection
+		wantSamples       int
+		wantSentiment     bool
+		wantEmotions      []string
+		wantActive        bool
+		wantVersionSuffix string
+	}{
+		{"no corrections", nil, 0, false, nil, false, ""},
+		{"too few", sentimentCorrections(minCalibrationSamples-1, 0.5, "negative"), minCalibrationSamples - 1, false, nil, false, ""},
+		{"emotions only, not counted for sentiment", emotionCorrections, 0, false, []string{"fear", "joy"}, true, ";calibration=5"},
+		{"enough sentiment", sentimentCorrections(minCalibrationSamples, 0.5, "negative"), minCalibrationSamples, true, nil, true, ";calibration=5"},
+		{"unknown sentiment label ignored", sentimentCorrections(minCalibrationSamples, 0.5, "ecstatic"), 0, false, nil, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := buildMoodCalibration(tt.corrections)
+			if c.Corrections != len(tt.corrections) || c.SentimentSamples != tt.wantSamples {
+				t.Errorf("got %d corrections and %d samples, want %d and %d",
+					c.Corrections, c.SentimentSamples, len(tt.corrections), tt.wantSamples)
+			}
+			if (c.Sentiment != nil) != tt.wantSentiment {
+				t.Errorf("sentiment calibrated = %v, want %v", c.Sentiment != nil, tt.wantSentiment)
+			}
+			var labels []string
+			for _, label := range []string{"anger", "disgust", "fear", "joy", "neutral", "sadness", "surprise"} {
+				if _, ok := c.Emotions[label]; ok {
+					labels = append(labels, label)
+				}
+			}
+			if !reflect.DeepEqual(labels, tt.wantEmotions) {
+				t.Errorf("calibrated emotions %v, want %v", labels, tt.wantEmotions)
+			}
+			if c.active() != tt.wantActive {
+				t.Errorf("active() = %v, want %v", c.active(), tt.wantActive)
+			}
+			if got := c.withCalibration("models"); got != "models"+tt.wantVersionSuffix {
+				t.Errorf("withCalibration() = %q, want %q", got, "models"+tt.wantVersionSuffix)
+			}
+		})
+	}
+}
+
+func TestMoodCalibrationApply(t *testing.T) {
+	emotions := []EmotionResult{{Label: "fear", Score: 0.8}, {Label: "joy", Score: 0.1}}
+
+	// Inactive calibration passes the output through
+	inactive := buildMoodCalibration(nil)
+	sentiment, score, got, original := inactive.apply("positive", 0.7, emotions)
+	if sentiment != "positive" || score != 0.7 || !reflect.DeepEqual(got, emotions) || original != nil {
+		t.Errorf("inactive apply changed the output: %s %v %v %v", sentiment, score, got, original)
+	}
+
+	// A user who keeps calling mildly positive entries negative
+	c := buildMoodCalibration(sentimentCorrections(20, 0.3, "negative"))
+	sentiment, score, _, original = c.apply("positive", 0.3, emotions)
+	if sentiment != "negative" || score >= 0 || score < -1 {
+		t.Errorf("apply(positive, 0.3) = %s, %v, want negative with a score in [-1, 0)", sentiment, score)
+	}
+	if original == nil || original.Sentiment != "positive" || original.Score != 0.3 {
+		t.Errorf("original output = %+v, want the model's positive 0.3", original)
+	}
+
+	// Fear the user never agrees with drops below joy they always confirm
+	emotionCorrections := make([]MoodCorrection, 20)
+	for i := range emotionCorrections {
+		emotionCorrections[i] = MoodCorrection{ModelEmotions: emotions, Emotions: []string{"joy"}}
+	}
+	c = buildMoodCalibration(emotionCorrections)
+	_, _, got, _ = c.apply("neutral", 0, emotions)
+	if len(got) != 2 || got[0].Label != "joy" || got[1].Label != "fear" {
+		t.Errorf("calibrated emotions = %+v, want joy ranked above fear", got)
+	}
+	if emotions[0].Score != 0.8 {
+		t.Errorf("apply modified its input: %+v", emotions)
+	}
+}
+
+func TestParseCorrectionRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		req           CorrectionRequest
+		wantSentiment *string
+		wantEmotions  []string
+		wantErr       bool
+	}{
+		{"empty", CorrectionRequest{}, nil, nil, true},
+		{"sentiment normalised", CorrectionRequest{Sentiment: stringPtr("  Positive ")}, stringPtr("positive"), nil, false},
+		{"unknown sentiment", CorrectionRequest{Sentiment: stringPtr("great")}, nil, nil, true},
+		{"empty sentiment", CorrectionRequest{Sentiment: stringPtr("")}, nil, nil, true},
+		{"no emotions apply", CorrectionRequest{Emotions: []string{}}, nil, []string{}, false},
+		{"emotions sorted and deduplicated", CorrectionRequest{Emotions: []string{"Joy", "fear", "joy "}}, nil, []string{"fear", "joy"}, false},
+		{"unknown emotion", CorrectionRequest{Emotions: []string{"joy", "boredom"}}, nil, nil, true},
+		{"multibyte emotion", CorrectionRequest{Emotions: []string{"colère"}}, nil, nil, true},
+		{"both", CorrectionRequest{Sentiment: stringPtr("neutral"), Emotions: []string{"sadness"}}, stringPtr("neutral"), []string{"sadness"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sentiment, emotions, err := parseCorrectionRequest(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(sentiment, tt.wantSentiment) || !reflect.DeepEqual(emotions, tt.wantEmotions) {
+				t.Errorf("got %v, %q, want %v, %q", sentiment, emotions, tt.wantSentiment, tt.wantEmotions)
+			}
+		})
+	}
+}
@@ -0,0 +1,614 @@
+// chat.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A conversation with the user's journal
+type ChatConversation struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ChatMessage struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	Role           string    `json:"role"` // "user" or "assistant"
+	Content        string    `json:"content"`
+	Citations      []int     `json:"citations"` // entry IDs cited in an answer
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ChatRequest struct {
+	ConversationID int    `json:"conversation_id"` // 0 starts a new conversation
+	Message        string `json:"message"`
+}
+
+// An entry retrieved as context for an answer
+type ChatSource struct {
+	EntryID int     `json:"entry_id"`
+	Title   string  `json:"title"`
+	Date    string  `json:"date"`
+	Score   float64 `json:"score"`
+	Passage string  `json:"passage,omitempty"` // the part of a long entry that matched
+}
+
+const (
+	chatMaxSources      = 6
+	chatHistoryMessages = 6
+	chatExcerptChars    = 600
+	chatMaxMessageChars = 2000
+)
+
+// Entries below this cosine similarity aren't treated as relevant
+const chatMinSimilarity = 0.3
+
+// Citations in answers look like [entry 12]
+var citationPattern = regexp.MustCompile(`\[entry (\d+)\]`)
+
+// Retrieve the entries most relevant to the question. Vector search is
+// combined with keyword overlap, since stored embeddings may come from the
+// fallback embedder and miss exact names and places.
+func retrieveChatSources(ctx context.Context, userID int, question string) ([]Entry, []ChatSource, error) {
+	scores := make(map[int]float64)
+	byID := make(map[int]Entry)
+	passages := make(map[int]string)
+
+	// Vector search, unless the user has turned embeddings off
+	if privacyFrom(ctx).Embeddings {
+		if embedding, err := generateEmbedding(ctx, question); err == nil {
+			similar, err := findSimilarEntries(userID, embedding, chatMaxSources)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, s := range similar {
+				if s.Similarity >= chatMinSimilarity {
+					scores[s.Entry.ID] = s.Similarity
+					byID[s.Entry.ID] = s.Entry
+					passages[s.Entry.ID] = s.Passage
+				}
+			}
+		}
+	}
+
+	// Keyword overlap, scored as the fraction of question terms matched
+	terms := contentTerms(question)
+	if len(terms) > 0 {
+		entries, err := store.Entries.ListByUser(userID, EntryFilter{})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			matched := 0
+			for term := range contentTerms(entry.Title + " " + entry.Text) {
+				if terms[term] {
+					matched++
+				}
+			}
+			if matched == 0 {
+				continue
+			}
+			score := float64(matched) / float64(len(terms))
+			if score > scores[entry.ID] {
+				scores[entry.ID] = score
+			}
+			byID[entry.ID] = entry
+		}
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] > ids[j]
+	})
+	// Present the chosen entries newest first so "when did I last..."
+	// questions read naturally. Flagged entries never go into the prompt.
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		if isFlaggedEntry(ctx, byID[id]) {
+			continue
+		}
+		entries = append(entries, byID[id])
+		if len(entries) == chatMaxSources {
+			break
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date > entries[j].Date
+	})
+
+	sources := make([]ChatSource, 0, len(entries))
+	for _, entry := range entries {
+		sources = append(sources, ChatSource{
+			EntryID: entry.ID,
+			Title:   entry.Title,
+			Date:    entry.Date,
+			Score:   scores[entry.ID],
+			Passage: passages[entry.ID],
+		})
+	}
+	return entries, sources, nil
+}
+
+// Earlier messages that may go into a generative prompt. A flagged message
+// is left out, and so is the answer to a flagged question, which is the
+// support message.
+func screenChatHistory(ctx context.Context, messages []ChatMessage) []ChatMessage {
+	screened := make([]ChatMessage, 0, len(messages))
+	skipAnswer := false
+	for _, m := range messages {
+		if m.Role == "assistant" && skipAnswer {
+			skipAnswer = false
+			continue
+		}
+		flagged := assessRisk(ctx, m.Content).Flagged()
+		skipAnswer = m.Role == "user" && flagged
+		if !flagged {
+			screened = append(screened, m)
+		}
+	}
+	return screened
+}
+
+// Build the grounded prompt from the user's variant of the chat template:
+// retrieved entries, recent conversation and the question. A long entry is
+// excerpted at the passage that matched rather than from its start.
+func chatPrompt(userID int, entries []Entry, sources []ChatSource, history []ChatMessage, question string, today string) (*RenderedPrompt, error) {
+	type promptEntry struct {
+		ID                   int
+		Date, Title, Excerpt string
+	}
+	type promptMessage struct{ Speaker, Content string }
+
+	data := struct {
+		Today    string
+		Entries  []promptEntry
+		History  []promptMessage
+		Question string
+	}{Today: today, Question: question}
+
+	passages := make(map[int]string, len(sources))
+	for _, source := range sources {
+		passages[source.EntryID] = source.Passage
+	}
+
+	for _, entry := range entries {
+		text := entry.Text
+		if passage := passages[entry.ID]; passage != "" {
+			text = passage
+			if !strings.HasPrefix(entryAnalysisText(entry), passage) && !strings.HasPrefix(entry.Text, passage) {
+				text = "..." + text
+			}
+		}
+		if runes := []rune(text); len(runes) > chatExcerptChars {
+			text = string(runes[:chatExcerptChars]) + "..."
+		}
+		data.Entries = append(data.Entries, promptEntry{entry.ID, entry.Date, entry.Title, text})
+	}
+	for _, m := range history {
+		speaker := "User"
+		if m.Role == "assistant" {
+			speaker = "Assistant"
+		}
+		data.History = append(data.History, promptMessage{speaker, m.Content})
+	}
+
+	return renderPrompt("chat", userID, data)
+}
+
+// Stream a completion from the text-generation model, calling onToken for
+// each piece of text with redacted values restored. Falls back to a single
+// chunk if the endpoint answers without streaming.
+func streamText(ctx context.Context, prompt *RenderedPrompt, onToken func(string) error) (string, error) {
+	redacted, err := prepareExternalText(ctx, prompt.Text)
+	if err != nil {
+		return "", err
+	}
+
+	payload := map[string]interface{}{
+		"inputs":     redacted.Text,
+		"stream":     true,
+		"parameters": prompt.Params.payload(),
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := hfClient().stream(ctx, generationModel, jsonPayload, streamGenerationTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var answer strings.Builder
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		var result []struct {
+			GeneratedText string `json:"generated_text"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return "", err
+		}
+		if len(result) == 0 {
+			return "", fmt.Errorf("empty generation")
+		}
+		text := redacted.restore(strings.TrimSpace(result[0].GeneratedText))
+		return text, onToken(text)
+	}
+
+	// A placeholder can be split across tokens, so text is passed on once
+	// it can't be part of one
+	restorer := &streamRestorer{redaction: redacted}
+	send := func(text string) error {
+		if text == "" {
+			return nil
+		}
+		answer.WriteString(text)
+		return onToken(text)
+	}
+
+	// Text Generation Inference stream: "data: {"token": {...}}" lines
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var event struct {
+			Token struct {
+				Text    string `json:"text"`
+				Special bool   `json:"special"`
+			} `json:"token"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			continue
+		}
+		if event.Token.Special || event.Token.Text == "" {
+			continue
+		}
+
+		if err := send(restorer.write(event.Token.Text)); err != nil {
+			return answer.String(), err
+		}
+	}
+	if err := send(restorer.flush()); err != nil {
+		return answer.String(), err
+	}
+	if err := scanner.Err(); err != nil {
+		return answer.String(), err
+	}
+	if answer.Len() == 0 {
+		return "", fmt.Errorf("empty generation")
+	}
+
+	return strings.TrimSpace(answer.String()), nil
+}
+
+// Answer built from retrieval alone, when the model is unavailable or the
+// user has turned external processing or generative suggestions off
+func fallbackChatAnswer(sources []ChatSource, err error) string {
+	var setting string
+	switch {
+	case errors.Is(err, errExternalProcessingDisabled):
+		setting = "external processing"
+	case errors.Is(err, errGenerativeSuggestionsDisabled):
+		setting = "generative suggestions"
+	}
+	if len(sources) == 0 {
+		if setting != "" {
+			return "I couldn't find any entries related to that. Full answers need " + setting + ", which is turned off in your privacy settings."
+		}
+		return "I couldn't find any entries related to that, and the answer service is unavailable right now."
+	}
+
+	var b strings.Builder
+	if setting != "" {
+		b.WriteString("Full answers need " + setting + ", which is turned off in your privacy settings. These entries look most relevant: ")
+	} else {
+		b.WriteString("I can't write a full answer right now, but these entries look most relevant: ")
+	}
+	for i, s := range sources {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(fmt.Sprintf("%q on %s [entry %d]", s.Title, s.Date, s.EntryID))
+	}
+	b.WriteString(".")
+	return b.String()
+}
+
+// Entry IDs cited in the answer that were among the sources, in order
+func extractCitations(answer string, sources []ChatSource) []int {
+	allowed := make(map[int]bool)
+	for _, s := range sources {
+		allowed[s.EntryID] = true
+	}
+
+	seen := make(map[int]bool)
+	citations := []int{}
+	for _, m := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		id, err := strconv.Atoi(m[1])
+		if err != nil || !allowed[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		citations = append(citations, id)
+	}
+	return citations
+}
+
+// Server-sent events writer
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s *sseWriter) send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Title for a new conversation: the start of its first question
+func conversationTitle(question string) string {
+	title := strings.Join(strings.Fields(question), " ")
+	if runes := []rune(title); len(runes) > 60 {
+		title = string(runes[:60]) + "..."
+	}
+	return title
+}
+
+// Ask the journal a question. The answer streams back as server-sent
+// events: "conversation", "sources", a "token" per piece of text, then
+// "done" with the stored message, or "error".
+func chatHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	question := strings.TrimSpace(req.Message)
+	if question == "" {
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	}
+	if len([]rune(question)) > chatMaxMessageChars {
+		http.Error(w, "Message is too long", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Load or start the conversation
+	var conversation *ChatConversation
+	var history []ChatMessage
+	if req.ConversationID != 0 {
+		c, err := store.Chats.GetConversation(req.ConversationID)
+		if err != nil || c.UserID != userID {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+		conversation = c
+
+		messages, err := store.Chats.ListMessages(c.ID)
+		if err != nil {
+			http.Error(w, "Failed to load conversation", http.StatusInternalServerError)
+			return
+		}
+		if len(messages) > chatHistoryMessages {
+			messages = messages[len(messages)-chatHistoryMessages:]
+		}
+		history = messages
+	} else {
+		c, err := store.Chats.CreateConversation(userID, conversationTitle(question))
+		if err != nil {
+			http.Error(w, "Failed to start conversation", http.StatusInternalServerError)
+			return
+		}
+		conversation = c
+	}
+
+	userMessage := &ChatMessage{ConversationID: conversation.ID, Role: "user", Content: question, Citations: []int{}}
+	if err := store.Chats.AddMessage(userMessage); err != nil {
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		return
+	}
+
+	// Model calls carry the user, for redaction and their privacy setting
+	ctx := withModelUser(r.Context(), userID)
+
+	// A question in crisis language is answered with support resources and
+	// never goes to the generative model, nor do earlier flagged messages
+	risk := assessRisk(ctx, question)
+	history = screenChatHistory(ctx, history)
+
+	var entries []Entry
+	sources := []ChatSource{}
+	if !risk.Flagged() {
+		var err error
+		entries, sources, err = retrieveChatSources(ctx, userID, question)
+		if err != nil {
+			http.Error(w, "Failed to search entries", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sse := &sseWriter{w: w, flusher: flusher}
+	sse.send("conversation", map[string]int{"conversation_id": conversation.ID})
+	sse.send("sources", sources)
+
+	if risk.Flagged() {
+		answer := safetySuggestion(risk.Level)
+		sse.send("token", map[string]string{"text": answer})
+		saveChatAnswer(sse, conversation.ID, answer, sources)
+		return
+	}
+
+	// Without generative suggestions the answer is built from retrieval
+	// alone, so no model-written text is shown or stored
+	var answer string
+	err := errGenerativeSuggestionsDisabled
+	if privacyFrom(ctx).GenerativeSuggestions {
+		today := time.Now().In(loadLocation(userTimezone(userID))).Format(entryDateLayout)
+		var prompt *RenderedPrompt
+		if prompt, err = chatPrompt(userID, entries, sources, history, question, today); err == nil {
+			answer, err = streamText(ctx, prompt, func(token string) error {
+				return sse.send("token", map[string]string{"text": token})
+			})
+		}
+	}
+	if r.Context().Err() != nil {
+		// Client went away; keep whatever was generated
+		log.Printf("Chat stream for conversation %d cancelled by client", conversation.ID)
+	} else if err != nil {
+		if err != errGenerativeSuggestionsDisabled {
+			log.Printf("Chat generation failed for conversation %d: %v", conversation.ID, err)
+		}
+		if answer == "" {
+			answer = fallbackChatAnswer(sources, err)
+			sse.send("token", map[string]string{"text": answer})
+		}
+	}
+
+	saveChatAnswer(sse, conversation.ID, answer, sources)
+}
+
+// Store the assistant's answer and send the "done" event
+func saveChatAnswer(sse *sseWriter, conversationID int, answer string, sources []ChatSource) {
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return
+	}
+
+	assistantMessage := &ChatMessage{
+		ConversationID: conversationID,
+		Role:           "assistant",
+		Content:        answer,
+		Citations:      extractCitations(answer, sources),
+	}
+	if err := store.Chats.AddMessage(assistantMessage); err != nil {
+		log.Printf("Failed to save chat answer for conversation %d: %v", conversationID, err)
+		sse.send("error", map[string]string{"error": "Failed to save answer"})
+		return
+	}
+
+	sse.send("done", assistantMessage)
+}
+
+// Load the conversation named by the {id} route variable if the user owns it
+func loadOwnedConversation(w http.ResponseWriter, r *http.Request) (*ChatConversation, bool) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	conversationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	conversation, err := store.Chats.GetConversation(conversationID)
+	if err != nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return nil, false
+	}
+	if conversation.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return nil, false
+	}
+	return conversation, true
+}
+
+// List the user's conversations, most recently active first
+func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	conversations, err := store.Chats.ListConversations(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch conversations", http.StatusInternalServerError)
+		return
+	}
+	if conversations == nil {
+		conversations = []ChatConversation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// A conversation with all of its messages, oldest first
+func getConversationHandler(w http.ResponseWriter, r *http.Request) {
+	conversation, ok := loadOwnedConversation(w, r)
+	if !ok {
+		return
+	}
+
+	messages, err := store.Chats.ListMessages(conversation.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []ChatMessage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ChatConversation
+		Messages []ChatMessage `json:"messages"`
+	}{*conversation, messages})
+}
+
+func deleteConversationHandler(w http.ResponseWriter, r *http.Request) {
+	conversation, ok := loadOwnedConversation(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.Chats.DeleteConversation(conversation.ID); err != nil {
+		http.Error(w, "Failed to delete conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFallbackChatAnswer(t *testing.T) {
+	sources := []ChatSource{{EntryID: 3, Title: "Ça va", Date: "2026-10-18"}, {EntryID: 5, Title: "Été", Date: "2026-07-01"}}
+
+	tests := []struct {
+		name    string
+		sources []ChatSource
+		err     error
+		want    []string
+	}{
+		{"no sources, model down", nil, errors.New("503"), []string{"couldn't find any entries", "unavailable"}},
+		{"no sources, external processing off", nil, errExternalProcessingDisabled, []string{"couldn't find any entries", "external processing"}},
+		{"no sources, generative suggestions off", nil, errGenerativeSuggestionsDisabled, []string{"generative suggestions"}},
+		{"sources, model down", sources, errCircuitOpen, []string{"can't write a full answer", `"Ça va" on 2026-10-18 [entry 3]; "Été" on 2026-07-01 [entry 5].`}},
+		{"sources, generative suggestions off", sources, errGenerativeSuggestionsDisabled, []string{"generative suggestions, which is turned off", "[entry 5]"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fallbackChatAnswer(tt.sources, tt.err)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("fallbackChatAnswer() = %q, lacks %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+// With generative suggestions off, chat never calls the generation model
+// and stores the retrieval answer
+func TestChatWithoutGenerativeSuggestions(t *testing.T) {
+	t.Setenv("RISK_MODEL", "")
+	_, s := openTestStore(t, filepath.Join(t.TempDir(), "journal.db"), &masterKeys{})
+	previousStore := store
+	store = s
+	t.Cleanup(func() { store = previousStore })
+
+	var calls int32
+	hfClient()
+	previousClient := sharedClient
+	sharedClient = newTestModelClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	t.Cleanup(func() { sharedClient = previousClient })
+
+	user, err := s.Users.Create("Zoë", "zoe@example.com", "hash", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := PrivacySettings{MoodAnalysis: true, ExternalProcessing: true}
+	if err := s.Users.UpdatePrivacy(user.ID, settings); err != nil {
+		t.Fatal(err)
+	}
+	entry := &Entry{UserID: user.ID, Title: "Marché", Text: "Au marché avec ma sœur", Date: "2026-10-18", Timezone: "UTC"}
+	if err := s.Entries.Create(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(`{"message": "Quand suis-je allée au marché ?"}`))
+	req.Header.Set("X-User-ID", strconv.Itoa(user.ID))
+	rec := httptest.NewRecorder()
+	chatHandler(rec, req)
+
+	if calls != 0 {
+		t.Errorf("%d model calls, want none", calls)
+	}
+	if !strings.Contains(rec.Body.String(), "event: done") {
+		t.Fatalf("stream didn't finish: %s", rec.Body.String())
+	}
+	conversations, err := s.Chats.ListConversations(user.ID)
+	if err != nil || len(conversations) != 1 {
+		t.Fatalf("conversations %+v, %v", conversations, err)
+	}
+	messages, err := s.Chats.ListMessages(conversations[0].ID)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("messages %+v, %v", messages, err)
+	}
+	if answer := messages[1].Content; messages[1].Role != "assistant" || !strings.Contains(answer, "generative suggestions") {
+		t.Errorf("stored answer %q, want the retrieval answer", answer)
+	}
+}
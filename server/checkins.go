@@ -0,0 +1,271 @@
+// checkins.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A mood the user reported themselves, either about an entry or standalone
+type MoodCheckIn struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	EntryID    *int      `json:"entry_id"` // nil for a standalone check-in
+	Date       string    `json:"date"`     // the entry's date when attached to one
+	Rating     int       `json:"rating"`   // 1-10
+	Energy     *int      `json:"energy"`   // 1-10
+	SleepHours *float64  `json:"sleep_hours"`
+	Emotions   []string  `json:"emotions"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type CheckInRequest struct {
+	EntryID    *int     `json:"entry_id"`
+	Date       string   `json:"date"` // defaults to today in the user's timezone
+	Rating     int      `json:"rating"`
+	Energy     *int     `json:"energy"`
+	SleepHours *float64 `json:"sleep_hours"`
+	Emotions   []string `json:"emotions"`
+	Note       string   `json:"note"`
+}
+
+// Check-ins aggregated over one trend bucket
+type SelfReportedMood struct {
+	CheckInCount      int            `json:"check_in_count"`
+	AverageRating     float64        `json:"average_rating"`
+	Score             float64        `json:"score"` // average rating on the model's -1 to 1 scale
+	AverageEnergy     *float64       `json:"average_energy"`
+	AverageSleepHours *float64       `json:"average_sleep_hours"`
+	Emotions          map[string]int `json:"emotions"` // check-ins naming each emotion
+
+	ratingSum float64
+}
+
+// The emotion model's labels. Check-ins and corrections name these so they
+// can be compared with the model's output.
+var emotionLabels = makeWordSet("anger disgust fear joy neutral sadness surprise")
+
+const maxCheckInNoteChars = 1000
+
+// Map a 1-10 rating onto the -1 to 1 sentiment score scale
+func ratingScore(rating float64) float64 {
+	return (rating - 5.5) / 4.5
+}
+
+// Validate a check-in request and copy it onto checkIn. The date is
+// resolved separately since it depends on the entry.
+func applyCheckInRequest(checkIn *MoodCheckIn, req CheckInRequest) error {
+	if req.Rating < 1 || req.Rating > 10 {
+		return fmt.Errorf("Rating must be between 1 and 10")
+	}
+	if req.Energy != nil && (*req.Energy < 1 || *req.Energy > 10) {
+		return fmt.Errorf("Energy must be between 1 and 10")
+	}
+	if req.SleepHours != nil && (*req.SleepHours < 0 || *req.SleepHours > 24) {
+		return fmt.Errorf("Sleep hours must be between 0 and 24")
+	}
+	if len([]rune(req.Note)) > maxCheckInNoteChars {
+		return fmt.Errorf("Note must be at most %d characters", maxCheckInNoteChars)
+	}
+
+	emotions := []string{}
+	seen := make(map[string]bool)
+	for _, e := range req.Emotions {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !emotionLabels[e] {
+			return fmt.Errorf("Unknown emotion %q", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			emotions = append(emotions, e)
+		}
+	}
+	sort.Strings(emotions)
+
+	checkIn.Rating = req.Rating
+	checkIn.Energy = req.Energy
+	checkIn.SleepHours = req.SleepHours
+	checkIn.Emotions = emotions
+	checkIn.Note = strings.TrimSpace(req.Note)
+	return nil
+}
+
+// Attach the check-in to one of the user's entries and take its date, or
+// resolve the standalone date in the user's timezone
+func resolveCheckInTarget(w http.ResponseWriter, userID int, checkIn *MoodCheckIn, req CheckInRequest) bool {
+	if req.EntryID != nil {
+		entry, err := store.Entries.GetByID(*req.EntryID)
+		if err != nil || entry.UserID != userID {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return false
+		}
+		if existing, err := store.CheckIns.GetByEntry(entry.ID); err == nil && existing.ID != checkIn.ID {
+			http.Error(w, "Entry already has a check-in", http.StatusConflict)
+			return false
+		}
+		checkIn.EntryID = &entry.ID
+		checkIn.Date = entry.Date
+		return true
+	}
+
+	checkIn.EntryID = nil
+	loc := loadLocation(userTimezone(userID))
+	if req.Date == "" {
+		checkIn.Date = time.Now().In(loc).Format(entryDateLayout)
+		return true
+	}
+	date, err := parseEntryDate(req.Date, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	checkIn.Date = date
+	return true
+}
+
+// Load the check-in named by the {id} route variable if the user owns it
+func loadOwnedCheckIn(w http.ResponseWriter, r *http.Request) (*MoodCheckIn, bool) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	checkInID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid check-in ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	checkIn, err := store.CheckIns.GetByID(checkInID)
+	if err != nil {
+		http.Error(w, "Check-in not found", http.StatusNotFound)
+		return nil, false
+	}
+	if checkIn.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return nil, false
+	}
+
+	return checkIn, true
+}
+
+// List check-ins, newest first: ?from=&to=&entry=
+func listCheckInsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	query := r.URL.Query()
+
+	if v := query.Get("entry"); v != "" {
+		entryID, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+			return
+		}
+		checkIns := []MoodCheckIn{}
+		checkIn, err := store.CheckIns.GetByEntry(entryID)
+		if err == nil && checkIn.UserID == userID {
+			checkIns = append(checkIns, *checkIn)
+		} else if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Failed to fetch check-ins", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(checkIns)
+		return
+	}
+
+	from, to, err := parseDateRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	checkIns, err := store.CheckIns.ListByUser(userID, from, to)
+	if err != nil {
+		http.Error(w, "Failed to fetch check-ins", http.StatusInternalServerError)
+		return
+	}
+	if checkIns == nil {
+		checkIns = []MoodCheckIn{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkIns)
+}
+
+func createCheckInHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req CheckInRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	checkIn := &MoodCheckIn{UserID: userID}
+	if err := applyCheckInRequest(checkIn, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !resolveCheckInTarget(w, userID, checkIn, req) {
+		return
+	}
+
+	if err := store.CheckIns.Create(checkIn); err != nil {
+		http.Error(w, "Failed to save check-in", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(checkIn)
+}
+
+// Replace a check-in's fields; it can be moved to another entry or detached
+func updateCheckInHandler(w http.ResponseWriter, r *http.Request) {
+	checkIn, ok := loadOwnedCheckIn(w, r)
+	if !ok {
+		return
+	}
+
+	var req CheckInRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := applyCheckInRequest(checkIn, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !resolveCheckInTarget(w, checkIn.UserID, checkIn, req) {
+		return
+	}
+
+	if err := store.CheckIns.Update(checkIn); err != nil {
+		http.Error(w, "Failed to update check-in", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkIn)
+}
+
+func deleteCheckInHandler(w http.ResponseWriter, r *http.Request) {
+	checkIn, ok := loadOwnedCheckIn(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.CheckIns.Delete(checkIn.ID); err != nil {
+		http.Error(w, "Failed to delete check-in", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
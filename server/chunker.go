@@ -0,0 +1,349 @@
+// chunker.go
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The sentiment, emotion and embedding models truncate their input at 512
+// tokens. Chunks are kept below that, with room for special tokens and for
+// the estimate being off.
+const chunkTokenBudget = 400
+
+// A span of the analysed text, by byte offsets
+type textChunk struct {
+	Index  int
+	Start  int
+	End    int
+	Text   string
+	Tokens int
+}
+
+// An embedding of one chunk of an entry
+type ChunkEmbedding struct {
+	Index     int
+	Start     int // byte offsets into entryAnalysisText
+	End       int
+	Embedding []float64
+}
+
+var (
+	paragraphBreak = regexp.MustCompile(`\n\s*\n`)
+	// End of a sentence: terminal punctuation, any closing quotes or
+	// brackets, then whitespace
+	sentenceEnd = regexp.MustCompile(`[.!?…]+["'”’)\]]*\s+`)
+)
+
+// The text the models see for an entry
+func entryAnalysisText(entry Entry) string {
+	return entry.Title + " " + entry.Text
+}
+
+// Rough subword token count. There is no tokenizer here, so take the larger
+// of two estimates: about 4/3 tokens per word, or 4 characters per token.
+func estimateTokens(text string) int {
+	byWords := (len(strings.Fields(text))*4 + 2) / 3
+	byChars := (utf8.RuneCountInString(text) + 3) / 4
+	if byChars > byWords {
+		return byChars
+	}
+	return byWords
+}
+
+// Spans of text[start:end] with surrounding whitespace trimmed, or nothing
+// if it is blank
+func trimSpan(text string, start, end int) (int, int, bool) {
+	for start < end {
+		r, size := utf8.DecodeRuneInString(text[start:end])
+		if !isSpace(r) {
+			break
+		}
+		start += size
+	}
+	for end > start {
+		r, size := utf8.DecodeLastRuneInString(text[start:end])
+		if !isSpace(r) {
+			break
+		}
+		end -= size
+	}
+	return start, end, start < end
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == ' '
+}
+
+// Split text[start:end] at the boundaries matched by sep, returning the
+// trimmed, non-blank pieces as [start, end) pairs
+func splitSpans(text string, start, end int, sep *regexp.Regexp) [][2]int {
+	var spans [][2]int
+	pos := start
+	for _, m := range sep.FindAllStringIndex(text[start:end], -1) {
+		if s, e, ok := trimSpan(text, pos, start+m[1]); ok {
+			spans = append(spans, [2]int{s, e})
+		}
+		pos = start + m[1]
+	}
+	if s, e, ok := trimSpan(text, pos, end); ok {
+		spans = append(spans, [2]int{s, e})
+	}
+	return spans
+}
+
+// Sentences of text[start:end]
+func splitSentences(text string, start, end int) [][2]int {
+	return splitSpans(text, start, end, sentenceEnd)
+}
+
+// Split a span that is over budget on its own into runs of whole words
+func splitWords(text string, start, end int) [][2]int {
+	var spans [][2]int
+	chunkStart, words := -1, 0
+	maxWords := chunkTokenBudget * 3 / 4
+
+	pos := start
+	for pos < end {
+		// Skip to the next word
+		for pos < end {
+			r, size := utf8.DecodeRuneInString(text[pos:end])
+			if !isSpace(r) {
+				break
+			}
+			pos += size
+		}
+		if pos >= end {
+			break
+		}
+		wordStart := pos
+		for pos < end {
+			r, size := utf8.DecodeRuneInString(text[pos:end])
+			if isSpace(r) {
+				break
+			}
+			pos += size
+		}
+
+		if chunkStart < 0 {
+			chunkStart = wordStart
+		}
+		words++
+		if words >= maxWords || estimateTokens(text[chunkStart:pos]) >= chunkTokenBudget {
+			spans = append(spans, [2]int{chunkStart, pos})
+			chunkStart, words = -1, 0
+		}
+	}
+	if chunkStart >= 0 {
+		spans = append(spans, [2]int{chunkStart, end})
+	}
+	return spans
+}
+
+// Split text into chunks within the token budget. Paragraphs are kept whole
+// where they fit, long ones are split between sentences, and a sentence too
+// long on its own is split between words. Neighbouring pieces are packed
+// together up to the budget.
+func chunkText(text string) []textChunk {
+	var units [][2]int
+	for _, para := range splitSpans(text, 0, len(text), paragraphBreak) {
+		if estimateTokens(text[para[0]:para[1]]) <= chunkTokenBudget {
+			units = append(units, para)
+			continue
+		}
+		for _, sentence := range splitSentences(text, para[0], para[1]) {
+			if estimateTokens(text[sentence[0]:sentence[1]]) <= chunkTokenBudget {
+				units = append(units, sentence)
+			} else {
+				units = append(units, splitWords(text, sentence[0], sentence[1])...)
+			}
+		}
+	}
+
+	var chunks []textChunk
+	for _, unit := range units {
+		if n := len(chunks); n > 0 {
+			last := &chunks[n-1]
+			if merged := estimateTokens(text[last.Start:unit[1]]); merged <= chunkTokenBudget {
+				last.End = unit[1]
+				last.Text = text[last.Start:last.End]
+				last.Tokens = merged
+				continue
+			}
+		}
+		chunks = append(chunks, textChunk{
+			Index:  len(chunks),
+			Start:  unit[0],
+			End:    unit[1],
+			Text:   text[unit[0]:unit[1]],
+			Tokens: estimateTokens(text[unit[0]:unit[1]]),
+		})
+	}
+	return chunks
+}
+
+// Sentiment of a text of any length. Each chunk is classified separately
+// and the scores are averaged, weighted by chunk length, so a long entry
+// isn't judged by its opening alone.
+func analyzeSentiment(ctx context.Context, text string) (string, float64, error) {
+	if privacyFrom(ctx).localOnly() {
+		return localSentiment(text)
+	}
+
+	chunks := chunkText(text)
+	if len(chunks) <= 1 {
+		return classifySentiment(ctx, text)
+	}
+
+	var weighted, total float64
+	var lastErr error
+	for _, chunk := range chunks {
+		_, score, err := classifySentiment(ctx, chunk.Text)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		weighted += score * float64(chunk.Tokens)
+		total += float64(chunk.Tokens)
+	}
+	if total == 0 {
+		return "", 0, lastErr
+	}
+	if lastErr != nil {
+		log.Printf("Sentiment of some chunks failed, using the rest: %v", lastErr)
+	}
+
+	score := weighted / total
+	return sentimentLabel(score), score, nil
+}
+
+// Emotions of a text of any length: each label's score averaged over the
+// chunks, weighted by chunk length. A label a chunk didn't return counts as
+// zero for that chunk.
+func analyzeEmotions(ctx context.Context, route emotionRoute, text string) ([]EmotionResult, error) {
+	if privacyFrom(ctx).localOnly() {
+		return localEmotions(route.Language, text)
+	}
+
+	chunks := chunkText(text)
+	if len(chunks) <= 1 {
+		return classifyEmotions(ctx, route, text)
+	}
+
+	weighted := make(map[string]float64)
+	var total float64
+	var lastErr error
+	for _, chunk := range chunks {
+		emotions, err := classifyEmotions(ctx, route, chunk.Text)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		for _, e := range emotions {
+			weighted[e.Label] += e.Score * float64(chunk.Tokens)
+		}
+		total += float64(chunk.Tokens)
+	}
+	if total == 0 {
+		return nil, lastErr
+	}
+	if lastErr != nil {
+		log.Printf("Emotions of some chunks failed, using the rest: %v", lastErr)
+	}
+
+	emotions := make([]EmotionResult, 0, len(weighted))
+	for label, score := range weighted {
+		emotions = append(emotions, EmotionResult{Label: label, Score: score / total})
+	}
+	sort.Slice(emotions, func(i, j int) bool {
+		if emotions[i].Score != emotions[j].Score {
+			return emotions[i].Score > emotions[j].Score
+		}
+		return emotions[i].Label < emotions[j].Label
+	})
+	return emotions, nil
+}
+
+// Embed a text chunk by chunk. Returns the whole text's embedding, the
+// length-weighted mean of its chunks' normalised, and each chunk's own when
+// there is more than one.
+func embedChunks(ctx context.Context, text string) ([]float64, []ChunkEmbedding, error) {
+	chunks := chunkText(text)
+	if len(chunks) <= 1 {
+		embedding, err := generateEmbedding(ctx, text)
+		return embedding, nil, err
+	}
+
+	var mean []float64
+	var embeddings []ChunkEmbedding
+	for _, chunk := range chunks {
+		embedding, err := generateEmbedding(ctx, chunk.Text)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mean == nil {
+			mean = make([]float64, len(embedding))
+		}
+		if len(embedding) != len(mean) {
+			continue
+		}
+		for i, v := range embedding {
+			mean[i] += v * float64(chunk.Tokens)
+		}
+		embeddings = append(embeddings, ChunkEmbedding{
+			Index:     chunk.Index,
+			Start:     chunk.Start,
+			End:       chunk.End,
+			Embedding: embedding,
+		})
+	}
+
+	var norm float64
+	for _, v := range mean {
+		norm += v * v
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for i := range mean {
+			mean[i] /= norm
+		}
+	}
+	return mean, embeddings, nil
+}
+
+// Embed an entry and store its whole-text and chunk embeddings, unless the
+// user has turned embeddings off
+func embedEntry(ctx context.Context, entry Entry) ([]float64, error) {
+	if !privacyFrom(ctx).Embeddings {
+		return nil, errEmbeddingsDisabled
+	}
+
+	text := entryAnalysisText(entry)
+	embedding, chunks, err := embedChunks(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+
+	// They may have been turned off while the entry was embedded
+	if !loadPrivacySettings(entry.UserID).Embeddings {
+		return nil, errEmbeddingsDisabled
+	}
+
+	if err := saveEntryEmbedding(entry.ID, entry.UserID, text, embedding); err != nil {
+		return nil, err
+	}
+	if err := store.Embeddings.SaveChunks(entry.ID, entry.UserID, chunks); err != nil {
+		return nil, err
+	}
+	return embedding, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{"empty", "", 0},
+		{"blank", "   \n\t", 2},
+		{"one word", "hello", 2},
+		{"short words count by word", "a b c d e f", 8},
+		{"long word counts by character", "antidisestablishmentarianism", 7},
+		{"multibyte counts runes, not bytes", strings.Repeat("é", 20), 5},
+		{"emoji", "😊😊😊😊 😢😢😢😢", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateTokens(tt.text); got != tt.want {
+				t.Errorf("estimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimSpan(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		want      string
+		wantFound bool
+	}{
+		{"empty", "", "", false},
+		{"blank", " \t\r\n", "", false},
+		{"no space", "word", "word", true},
+		{"spaces around", "  two words \n", "two words", true},
+		{"no-break spaces", " déjà vu ", "déjà vu", true},
+		{"multibyte at the edges", " 日本語 ", "日本語", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok := trimSpan(tt.text, 0, len(tt.text))
+			if ok != tt.wantFound {
+				t.Fatalf("trimSpan(%q) found = %v, want %v", tt.text, ok, tt.wantFound)
+			}
+			if ok && tt.text[start:end] != tt.want {
+				t.Errorf("trimSpan(%q) = %q, want %q", tt.text, tt.text[start:end], tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"one sentence", "Just one.", []string{"Just one."}},
+		{"terminal punctuation", "First! Second? Third… Fourth.", []string{"First!", "Second?", "Third…", "Fourth."}},
+		{"closing quotes stay with the sentence", `She said "stop." Then left.`, []string{`She said "stop."`, "Then left."}},
+		{"no space, no break", "3.5 hours.Then more", []string{"3.5 hours.Then more"}},
+		{"multibyte", "Ça va. Très bien! 😊", []string{"Ça va.", "Très bien!", "😊"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, span := range splitSentences(tt.text, 0, len(tt.text)) {
+				got = append(got, tt.text[span[0]:span[1]])
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("splitSentences(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// Text without its whitespace, to compare what chunks cover with the input
+func withoutSpace(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func TestChunkText(t *testing.T) {
+	sentence := "Today I walked along the river and thought about the week. "
+	longParagraph := strings.Repeat(sentence, 40)
+	multibyte := strings.Repeat("Aujourd'hui j'étais très fatigué après le travail. ", 40)
+	cjk := strings.Repeat("今日はとても疲れました。", 200)
+
+	tests := []struct {
+		name       string
+		text       string
+		wantChunks int // 0 to only check the invariants
+	}{
+		{"empty", "", 0},
+		{"blank", " \n\n ", 0},
+		{"short", "A short entry.", 1},
+		{"paragraphs packed together", "First paragraph.\n\nSecond paragraph.\n\n\nThird.", 1},
+		{"long paragraph split between sentences", longParagraph, 2},
+		{"several long paragraphs", longParagraph + "\n\n" + longParagraph + "\n\n" + "Short one.", 0},
+		{"multibyte sentences", multibyte, 0},
+		{"sentence with no breaks split between words", strings.Repeat("word ", 1000), 4},
+		{"cjk without spaces", cjk, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkText(tt.text)
+			if tt.wantChunks > 0 && len(chunks) != tt.wantChunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), tt.wantChunks)
+			}
+			if strings.TrimSpace(tt.text) == "" && len(chunks) != 0 {
+				t.Errorf("got %d chunks of blank text", len(chunks))
+			}
+
+			var covered strings.Builder
+			prevEnd := 0
+			for i, c := range chunks {
+				if c.Index != i {
+					t.Errorf("chunk %d has index %d", i, c.Index)
+				}
+				if c.Start < prevEnd || c.End <= c.Start || c.End > len(tt.text) {
+					t.Fatalf("chunk %d spans [%d, %d) after %d", i, c.Start, c.End, prevEnd)
+				}
+				if c.Text != tt.text[c.Start:c.End] {
+					t.Errorf("chunk %d text doesn't match its offsets", i)
+				}
+				if !utf8.ValidString(c.Text) {
+					t.Errorf("chunk %d splits a character: %q", i, c.Text)
+				}
+				if c.Tokens != estimateTokens(c.Text) {
+					t.Errorf("chunk %d has %d tokens, estimated %d", i, c.Tokens, estimateTokens(c.Text))
+				}
+				if c.Tokens > chunkTokenBudget && strings.ContainsFunc(c.Text, unicode.IsSpace) {
+					t.Errorf("chunk %d has %d tokens, over the budget of %d", i, c.Tokens, chunkTokenBudget)
+				}
+				covered.WriteString(c.Text)
+				prevEnd = c.End
+			}
+			if withoutSpace(covered.String()) != withoutSpace(tt.text) {
+				t.Errorf("chunks don't cover the text")
+			}
+		})
+	}
+}
+
+// A single word longer than the budget can't be split and stays whole
+func TestChunkTextOversizedWord(t *testing.T) {
+	word := strings.Repeat("ü", 4*chunkTokenBudget+40)
+	text := "Before. " + word + " After."
+
+	chunks := chunkText(text)
+	found := false
+	for _, c := range chunks {
+		if strings.Contains(c.Text, word) {
+			found = true
+		}
+		if c.Text != text[c.Start:c.End] || !utf8.ValidString(c.Text) {
+			t.Errorf("chunk %d is not a whole span of the text", c.Index)
+		}
+	}
+	if !found {
+		t.Errorf("the long word was split across chunks")
+	}
+}
@@ -0,0 +1,166 @@
+// dates.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Entry dates are calendar days (ISO-8601, YYYY-MM-DD) in the timezone the
+// entry was written in, so they sort and compare as plain strings
+const entryDateLayout = "2006-01-02"
+
+// Timezone for users who haven't set one
+const defaultTimezone = "UTC"
+
+// Date formats accepted from clients, besides entryDateLayout. The M/D/YYYY
+// forms are what the app used to store.
+var legacyDateLayouts = []string{
+	"1/2/2006",
+	"01/02/2006",
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+}
+
+// Validate an IANA timezone name such as "Europe/Berlin"
+func normalizeTimezone(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	// "Local" is the server's zone, which is what we're moving away from
+	if name == "" || name == "Local" {
+		return "", fmt.Errorf("invalid timezone %q", name)
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return "", fmt.Errorf("invalid timezone %q", name)
+	}
+	return name, nil
+}
+
+// Load a timezone, falling back to UTC for unknown or empty names
+func loadLocation(name string) *time.Location {
+	if loc, err := time.LoadLocation(name); err == nil && name != "" {
+		return loc
+	}
+	return time.UTC
+}
+
+// The user's timezone setting, or UTC if it can't be read
+func userTimezone(userID int) string {
+	user, err := store.Users.GetByID(userID)
+	if err != nil || user.Timezone == "" {
+		return defaultTimezone
+	}
+	return user.Timezone
+}
+
+// Parse an entry date in any accepted format into YYYY-MM-DD. Timestamps
+// are converted to their calendar day in loc.
+func parseEntryDate(value string, loc *time.Location) (string, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(entryDateLayout, value); err == nil {
+		return t.Format(entryDateLayout), nil
+	}
+	for _, layout := range legacyDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.In(loc).Format(entryDateLayout), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+}
+
+// Fill in an entry's timezone and date for creation. The timezone defaults to
+// the user's setting and the date to today in that timezone.
+func resolveEntryDate(userID int, entry *Entry) error {
+	if entry.Timezone == "" {
+		entry.Timezone = userTimezone(userID)
+	} else {
+		tz, err := normalizeTimezone(entry.Timezone)
+		if err != nil {
+			return err
+		}
+		entry.Timezone = tz
+	}
+	loc := loadLocation(entry.Timezone)
+
+	if entry.Date == "" {
+		entry.Date = time.Now().In(loc).Format(entryDateLayout)
+		return nil
+	}
+
+	date, err := parseEntryDate(entry.Date, loc)
+	if err != nil {
+		return err
+	}
+	entry.Date = date
+	return nil
+}
+
+// Parse ?from=&to= as an inclusive range of entry dates. Either may be empty.
+func parseDateRange(query url.Values) (string, string, error) {
+	var bounds [2]string
+	for i, key := range []string{"from", "to"} {
+		v := query.Get(key)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(entryDateLayout, v)
+		if err != nil {
+			return "", "", fmt.Errorf("Invalid '%s' date, expected YYYY-MM-DD", key)
+		}
+		bounds[i] = t.Format(entryDateLayout)
+	}
+
+	if bounds[0] != "" && bounds[1] != "" && bounds[0] > bounds[1] {
+		return "", "", fmt.Errorf("'from' must not be after 'to'")
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// Data migration: rewrite stored dates as YYYY-MM-DD. Existing entries were
+// dated in server local time, which is the best guess we have for them;
+// dates that don't parse fall back to the day the entry was created.
+func migrateEntryDates(tx *sql.Tx, dialect sqlDialect) error {
+	rows, err := tx.Query("SELECT id, date, created_at FROM entries")
+	if err != nil {
+		return err
+	}
+
+	type entryDate struct {
+		id   int
+		date string
+	}
+	var updates []entryDate
+	for rows.Next() {
+		var id int
+		var date string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &date, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+
+		migrated, err := parseEntryDate(date, time.Local)
+		if err != nil {
+			migrated = createdAt.In(time.Local).Format(entryDateLayout)
+			log.Printf("Entry %d has unparseable date %q, using %s", id, date, migrated)
+		}
+		if migrated != date {
+			updates = append(updates, entryDate{id, migrated})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	update := dialect.rebind("UPDATE entries SET date = ? WHERE id = ?")
+	for _, u := range updates {
+		if _, err := tx.Exec(update, u.date, u.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+// digests.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A reflective summary of one user's week or month
+type Digest struct {
+	ID           int              `json:"id"`
+	UserID       int              `json:"user_id"`
+	Period       string           `json:"period"`       // "week" or "month"
+	PeriodStart  string           `json:"period_start"` // YYYY-MM-DD, inclusive
+	PeriodEnd    string           `json:"period_end"`   // YYYY-MM-DD, inclusive
+	EntryCount   int              `json:"entry_count"`
+	AverageScore *float64         `json:"average_score"`
+	SentimentArc []SentimentTrend `json:"sentiment_arc"` // per day for weeks, per week for months
+	Emotions     []EmotionResult  `json:"emotions"`
+	Themes       []string         `json:"themes"`
+	Narrative    string           `json:"narrative"`
+	NarrativeBy  string           `json:"narrative_by"` // generation model, or "template"
+	CreatedAt    time.Time        `json:"created_at"`
+}
+
+// How often the digest job checks for finished periods, and the longest
+// one run may take
+const (
+	digestInterval   = time.Hour
+	digestJobTimeout = 50 * time.Minute
+)
+
+// Limits on what a digest keeps and sends to the model
+const (
+	digestTopEmotions   = 3
+	digestTopThemes     = 5
+	digestPromptEntries = 12
+	digestExcerptChars  = 300
+)
+
+// Granularity of the sentiment arc within each digest period
+var digestArcGranularity = map[string]string{
+	"week":  "day",
+	"month": "week",
+}
+
+// The most recent complete week and month before today, as inclusive
+// YYYY-MM-DD ranges
+func lastCompletePeriod(period string, today time.Time) (string, string) {
+	current := bucketStart(period, time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC))
+	start := addBuckets(period, current, -1)
+	end := current.AddDate(0, 0, -1)
+	return start.Format(entryDateLayout), end.Format(entryDateLayout)
+}
+
+// Compose a digest from the user's entries in the period. Returns nil if
+// there were no entries.
+func composeDigest(ctx context.Context, userID int, period, start, end string) (*Digest, error) {
+	entries, err := store.Entries.ListByUser(userID, EntryFilter{From: start, To: end})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	digest := &Digest{
+		UserID:       userID,
+		Period:       period,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+		EntryCount:   len(entries),
+		SentimentArc: []SentimentTrend{},
+		Emotions:     []EmotionResult{},
+		Themes:       []string{},
+	}
+
+	// Whole-period mood: a single bucket spanning the period
+	buckets, err := store.Insights.MoodBuckets(userID, period, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(buckets) == 1 && buckets[0].EntryCount > 0 {
+		avg := buckets[0].scoreSum / float64(buckets[0].EntryCount)
+		digest.AverageScore = &avg
+	}
+
+	trends, err := computeMoodTrends(userID, digestArcGranularity[period], start, end, 1)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range trends.Buckets {
+		if b.AverageScore == nil {
+			continue
+		}
+		digest.SentimentArc = append(digest.SentimentArc, SentimentTrend{
+			Period:    b.Period,
+			Sentiment: sentimentLabel(*b.AverageScore),
+			Score:     *b.AverageScore,
+			Count:     b.EntryCount,
+		})
+	}
+
+	// Dominant emotions across the period
+	if len(buckets) == 1 {
+		emotions := append([]EmotionResult{}, buckets[0].Emotions...)
+		sort.Slice(emotions, func(i, j int) bool {
+			return emotions[i].Score > emotions[j].Score
+		})
+		if len(emotions) > digestTopEmotions {
+			emotions = emotions[:digestTopEmotions]
+		}
+		digest.Emotions = emotions
+	}
+
+	// Entries with crisis language count towards the stats but are never
+	// quoted to the generative model
+	var promptEntries []Entry
+	for _, entry := range entries {
+		if !isFlaggedEntry(ctx, entry) {
+			promptEntries = append(promptEntries, entry)
+		}
+	}
+
+	// Recurring themes across the period's entries
+	var asSimilar []SimilarEntry
+	for _, entry := range promptEntries {
+		asSimilar = append(asSimilar, SimilarEntry{Entry: entry})
+	}
+	if themes := extractCommonThemes(asSimilar); len(themes) > 0 {
+		if len(themes) > digestTopThemes {
+			themes = themes[:digestTopThemes]
+		}
+		digest.Themes = themes
+	}
+
+	// Only the stats are left if every entry was flagged; don't ask the
+	// model to write from those alone
+	if len(promptEntries) == 0 {
+		digest.Narrative = templateNarrative(digest)
+		digest.NarrativeBy = "template"
+		return digest, nil
+	}
+
+	var narrative string
+	var prompt *RenderedPrompt
+	err = errGenerativeSuggestionsDisabled
+	if privacyFrom(ctx).GenerativeSuggestions {
+		if prompt, err = digestPrompt(userID, digest, promptEntries); err == nil {
+			narrative, err = generateText(ctx, prompt)
+		}
+	}
+	if err == nil {
+		digest.Narrative = narrative
+		digest.NarrativeBy = withPromptVersion(generationModel, prompt.TemplateID)
+	} else {
+		log.Printf("Digest narrative generation failed for user %d: %v", userID, err)
+		digest.Narrative = templateNarrative(digest)
+		digest.NarrativeBy = "template"
+	}
+
+	return digest, nil
+}
+
+// Describe the period's stats in words, for the prompt and the fallback
+func describeDigest(d *Digest) string {
+	var b strings.Builder
+
+	noun := "entries"
+	if d.EntryCount == 1 {
+		noun = "entry"
+	}
+	b.WriteString(fmt.Sprintf("%d journal %s between %s and %s. ", d.EntryCount, noun, d.PeriodStart, d.PeriodEnd))
+	if d.AverageScore != nil {
+		b.WriteString(fmt.Sprintf("Overall mood was %s (average score %.2f on a -1 to 1 scale). ",
+			sentimentLabel(*d.AverageScore), *d.AverageScore))
+	}
+
+	if len(d.SentimentArc) > 1 {
+		var arc []string
+		for _, point := range d.SentimentArc {
+			arc = append(arc, fmt.Sprintf("%s %s", point.Period, point.Sentiment))
+		}
+		b.WriteString("Mood over time: " + strings.Join(arc, ", ") + ". ")
+	}
+
+	if len(d.Emotions) > 0 {
+		var labels []string
+		for _, e := range d.Emotions {
+			labels = append(labels, e.Label)
+		}
+		b.WriteString("Dominant emotions: " + strings.Join(labels, ", ") + ". ")
+	}
+
+	if len(d.Themes) > 0 {
+		b.WriteString("Recurring themes: " + strings.Join(d.Themes, ", ") + ". ")
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// Prompt for the narrative: the stats plus short excerpts of the entries
+func digestPrompt(userID int, d *Digest, entries []Entry) (*RenderedPrompt, error) {
+	type promptEntry struct{ Date, Title, Excerpt string }
+
+	data := struct {
+		Period  string
+		Stats   string
+		Entries []promptEntry
+	}{Period: d.Period, Stats: describeDigest(d)}
+
+	for i, entry := range entries {
+		if i >= digestPromptEntries {
+			break
+		}
+		text := entry.Text
+		if runes := []rune(text); len(runes) > digestExcerptChars {
+			text = string(runes[:digestExcerptChars]) + "..."
+		}
+		data.Entries = append(data.Entries, promptEntry{entry.Date, entry.Title, text})
+	}
+
+	return renderPrompt("digest", userID, data)
+}
+
+// Narrative written from the stats alone, when the model is unavailable
+func templateNarrative(d *Digest) string {
+	return fmt.Sprintf("Your %s in review: %s", d.Period, describeDigest(d))
+}
+
+// Write any missing digests for the user's last complete week and month.
+// Digests are built from mood analyses, so users without them get none.
+func generateDigestsForUser(ctx context.Context, user User) {
+	if !user.MoodAnalysis {
+		return
+	}
+	ctx = withModelUser(ctx, user.ID)
+	today := time.Now().In(loadLocation(user.Timezone))
+
+	for _, period := range []string{"week", "month"} {
+		start, end := lastCompletePeriod(period, today)
+
+		if _, err := store.Digests.GetByPeriod(user.ID, period, start); err == nil {
+			continue
+		} else if err != sql.ErrNoRows {
+			log.Printf("Failed to check %s digest for user %d: %v", period, user.ID, err)
+			continue
+		}
+
+		digest, err := composeDigest(ctx, user.ID, period, start, end)
+		if err != nil {
+			log.Printf("Failed to compose %s digest for user %d: %v", period, user.ID, err)
+			continue
+		}
+		if digest == nil {
+			continue
+		}
+
+		if err := store.Digests.Save(digest); err != nil {
+			log.Printf("Failed to save %s digest for user %d: %v", period, user.ID, err)
+			continue
+		}
+		log.Printf("Created %s digest for user %d (%s to %s)", period, user.ID, start, end)
+	}
+}
+
+// Generate digests for every user. The run stops early if the server shuts
+// down.
+func generateDigests() {
+	ctx, cancel := context.WithTimeout(appContext, digestJobTimeout)
+	defer cancel()
+
+	users, err := store.Users.List()
+	if err != nil {
+		log.Printf("Digest job failed to list users: %v", err)
+		return
+	}
+
+	for _, user := range users {
+		if ctx.Err() != nil {
+			log.Printf("Digest job stopped: %v", ctx.Err())
+			return
+		}
+		generateDigestsForUser(ctx, user)
+	}
+}
+
+// Schedule the digest job. It runs hourly rather than at a fixed time
+// because each user's week ends at midnight in their own timezone.
+func scheduleDigests() {
+	go func() {
+		generateDigests()
+
+		ticker := time.NewTicker(digestInterval)
+		for range ticker.C {
+			generateDigests()
+		}
+	}()
+}
+
+// List the user's digests, newest first: ?period=week|month&limit=12
+func listDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	query := r.URL.Query()
+
+	period := query.Get("period")
+	if period != "" && period != "week" && period != "month" {
+		http.Error(w, "Invalid period, expected week or month", http.StatusBadRequest)
+		return
+	}
+
+	limit := 12
+	if v := query.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+	}
+
+	digests, err := store.Digests.ListByUser(userID, period, limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch digests", http.StatusInternalServerError)
+		return
+	}
+	if digests == nil {
+		digests = []Digest{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(digests)
+}
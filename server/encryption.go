@@ -0,0 +1,878 @@
+// encryption.go
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry titles and text, current and archived, the text derived from them
+// and users' notes (see encryptedColumns) are encrypted with AES-256-GCM
+// under a data key of their user's. Values grouped in SQL are stored as a
+// keyed hash instead (see hashedColumns). Data keys are stored wrapped by the
+// server's master key (ENCRYPTION_MASTER_KEY), which never touches the
+// database. Without a master key content is stored as is.
+
+// Stored values start with this, then the data key version and the base64
+// nonce and ciphertext: enc:v1:3:AbC...
+const encryptedPrefix = "enc:v1:"
+
+// Keyed hashes start with this, then the data key version and the hex
+// HMAC-SHA256: mac:v1:3:9f2c...
+const hashedPrefix = "mac:v1:"
+
+const (
+	masterKeyBytes = 32
+	dataKeyBytes   = 32
+)
+
+var errNoMasterKey = errors.New("entry content is encrypted but ENCRYPTION_MASTER_KEY is not set")
+
+type masterKey struct {
+	ID   string // first bytes of the key's SHA-256, to tell keys apart
+	aead cipher.AEAD
+}
+
+// Master keys from the environment: the current one wraps new data keys,
+// previous ones (ENCRYPTION_PREVIOUS_MASTER_KEYS, comma-separated) only
+// unwrap keys not yet rotated. Keys are base64-encoded 32 bytes.
+type masterKeys struct {
+	current  *masterKey
+	previous []*masterKey
+}
+
+func parseMasterKey(encoded string) (*masterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(raw) != masterKeyBytes {
+		return nil, fmt.Errorf("master key must be %d bytes, base64-encoded", masterKeyBytes)
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &masterKey{ID: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// Load the master keys. No current key means encryption is off.
+func loadMasterKeys() (*masterKeys, error) {
+	keys := &masterKeys{}
+	if encoded := os.Getenv("ENCRYPTION_MASTER_KEY"); encoded != "" {
+		key, err := parseMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_MASTER_KEY: %v", err)
+		}
+		keys.current = key
+	}
+	for _, encoded := range strings.Split(os.Getenv("ENCRYPTION_PREVIOUS_MASTER_KEYS"), ",") {
+		if strings.TrimSpace(encoded) == "" {
+			continue
+		}
+		key, err := parseMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_PREVIOUS_MASTER_KEYS: %v", err)
+		}
+		keys.previous = append(keys.previous, key)
+	}
+	return keys, nil
+}
+
+func (m *masterKeys) enabled() bool {
+	return m != nil && m.current != nil
+}
+
+func (m *masterKeys) byID(id string) *masterKey {
+	if m.current != nil && m.current.ID == id {
+		return m.current
+	}
+	for _, key := range m.previous {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// A new random master key, base64-encoded
+func generateMasterKey() (string, error) {
+	raw := make([]byte, masterKeyBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt with a random nonce, returning nonce and ciphertext together
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
+
+// A wrapped key is bound to its user and version, so it can't be moved to
+// another row
+func wrappingData(userID, version int) []byte {
+	return []byte(fmt.Sprintf("data-key:%d:%d", userID, version))
+}
+
+func (k *masterKey) wrap(userID, version int, dataKey []byte) (string, error) {
+	sealed, err := seal(k.aead, dataKey, wrappingData(userID, version))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *masterKey) unwrap(userID, version int, wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return open(k.aead, sealed, wrappingData(userID, version))
+}
+
+// One user's unwrapped data keys, for encrypting and decrypting their
+// fields. Loaded per operation, so a rotation elsewhere is seen at once.
+type userKeys struct {
+	userID  int
+	current int // version new values are encrypted with; 0 if there is none
+	aeads   map[int]cipher.AEAD
+	hashKey []byte // the current version's key for keyed hashes
+}
+
+// The key for keyed hashes under a data key, so the data key itself is
+// only ever used for encryption
+func deriveHashKey(dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte("keyed-hash"))
+	return mac.Sum(nil)
+}
+
+// A field is bound to its user and column, so ciphertext can't be moved
+// between users or from title to text
+func fieldData(userID int, field string) []byte {
+	return []byte(fmt.Sprintf("entry:%d:%s", userID, field))
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Encrypt a field with the current data key. Without one it is left as is.
+func (k *userKeys) seal(field, value string) (string, error) {
+	if k.current == 0 {
+		return value, nil
+	}
+	sealed, err := seal(k.aeads[k.current], []byte(value), fieldData(k.userID, field))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + strconv.Itoa(k.current) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a stored field. Values stored before encryption pass through.
+func (k *userKeys) open(field, value string) (string, error) {
+	if !isEncrypted(value) {
+		return value, nil
+	}
+	rest := strings.TrimPrefix(value, encryptedPrefix)
+	i := strings.Index(rest, ":")
+	if i < 0 {
+		return "", errors.New("malformed encrypted value")
+	}
+	version, err := strconv.Atoi(rest[:i])
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+	aead, ok := k.aeads[version]
+	if !ok {
+		if len(k.aeads) == 0 && k.current == 0 {
+			return "", errNoMasterKey
+		}
+		return "", fmt.Errorf("data key %d of user %d not found", version, k.userID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(rest[i+1:])
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, sealed, fieldData(k.userID, field))
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s for user %d: %v", field, k.userID, err)
+	}
+	return string(plaintext), nil
+}
+
+// Keyed hash of a field with the current data key, equal for equal values
+// of the user's until the key is rotated. Without a key the value is stored
+// as is.
+func (k *userKeys) hash(field, value string) string {
+	if k.current == 0 {
+		return value
+	}
+	mac := hmac.New(sha256.New, k.hashKey)
+	mac.Write(fieldData(k.userID, field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hashedPrefix + strconv.Itoa(k.current) + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Encrypt a JSON value for a JSON column, which holds the result as a JSON
+// string. Without a data key the JSON is stored as is.
+func (k *userKeys) sealJSON(field string, data []byte) (string, error) {
+	sealed, err := k.seal(field, string(data))
+	if err != nil || !isEncrypted(sealed) {
+		return sealed, err
+	}
+	quoted, err := json.Marshal(sealed)
+	return string(quoted), err
+}
+
+// Decrypt a value stored by sealJSON, returning its JSON
+func (k *userKeys) openJSON(field, stored string) (string, error) {
+	if !strings.HasPrefix(stored, `"`+encryptedPrefix) {
+		return stored, nil
+	}
+	var sealed string
+	if err := json.Unmarshal([]byte(stored), &sealed); err != nil {
+		return "", fmt.Errorf("malformed encrypted %s: %v", field, err)
+	}
+	return k.open(field, sealed)
+}
+
+// Encrypt a title and text for storage
+func (k *userKeys) sealContent(title, text string) (string, string, error) {
+	sealedTitle, err := k.seal("title", title)
+	if err != nil {
+		return "", "", err
+	}
+	sealedText, err := k.seal("text", text)
+	if err != nil {
+		return "", "", err
+	}
+	return sealedTitle, sealedText, nil
+}
+
+// Decrypt a stored title and text in place
+func (k *userKeys) openContent(title, text *string) error {
+	var err error
+	if *title, err = k.open("title", *title); err != nil {
+		return err
+	}
+	*text, err = k.open("text", *text)
+	return err
+}
+
+// The user's data keys, for reading. A user without any gets an empty set,
+// which reads unencrypted values only.
+func (s *sqlStore) readingKeys(userID int) (*userKeys, error) {
+	keys := &userKeys{userID: userID, aeads: make(map[int]cipher.AEAD)}
+	if !s.masterKeys.enabled() {
+		return keys, nil
+	}
+
+	rows, err := s.query(`
+		SELECT version, wrapped_key, master_key_id FROM user_data_keys
+		WHERE user_id = ? ORDER BY version`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var wrapped, masterID string
+		if err := rows.Scan(&version, &wrapped, &masterID); err != nil {
+			return nil, err
+		}
+		master := s.masterKeys.byID(masterID)
+		if master == nil {
+			return nil, fmt.Errorf("data key %d of user %d is wrapped by unknown master key %s", version, userID, masterID)
+		}
+		dataKey, err := master.unwrap(userID, version, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("unwrapping data key %d of user %d: %v", version, userID, err)
+		}
+		aead, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		keys.aeads[version] = aead
+		keys.current = version
+		keys.hashKey = deriveHashKey(dataKey)
+	}
+	return keys, rows.Err()
+}
+
+// The user's data keys, for writing. The first write after a master key is
+// set creates the user's first data key.
+func (s *sqlStore) writingKeys(userID int) (*userKeys, error) {
+	keys, err := s.readingKeys(userID)
+	if err != nil || !s.masterKeys.enabled() || keys.current != 0 {
+		return keys, err
+	}
+	if err := s.addDataKey(userID, 1); err != nil {
+		return nil, err
+	}
+	return s.readingKeys(userID)
+}
+
+// Generate and store a data key for the user. A concurrent write of the
+// same version wins; the caller rereads the keys either way.
+func (s *sqlStore) addDataKey(userID, version int) error {
+	dataKey := make([]byte, dataKeyBytes)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	wrapped, err := s.masterKeys.current.wrap(userID, version, dataKey)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`
+		INSERT INTO user_data_keys (user_id, version, wrapped_key, master_key_id, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, version) DO NOTHING`,
+		userID, version, wrapped, s.masterKeys.current.ID, time.Now().UTC())
+	return err
+}
+
+// Fields bound into the ciphertext of text derived from entries and of
+// notes, and into keyed hashes
+const (
+	fieldAnalysisSummary     = "analysis.summary"
+	fieldAnalysisSuggestions = "analysis.suggestions"
+	fieldAnalysisStructured  = "analysis.structured_suggestion"
+	fieldDigestThemes        = "digest.themes"
+	fieldDigestNarrative     = "digest.narrative"
+	fieldChatTitle           = "chat.title"
+	fieldChatContent         = "chat.content"
+	fieldModelOutput         = "model_cache.output"
+	fieldFeedbackSuggestion  = "feedback.suggestion"
+	fieldFeedbackKey         = "feedback.suggestion_key"
+	fieldFeedbackFollowUp    = "feedback.follow_up"
+	fieldCheckInNote         = "checkin.note"
+)
+
+// A column encrypted under its user's data key
+type encryptedColumn struct {
+	table  string
+	column string
+	field  string // bound into the ciphertext; see fieldData
+	join   string // joins the table, as t, to the owner's ID
+	owner  string
+	json   bool   // holds the ciphertext as a JSON string; see sealJSON
+	filter string // condition on the rows that are encrypted, if not all
+}
+
+// Every column encrypted at rest. Revisions are copied from entries, so
+// they share their fields.
+var encryptedColumns = []encryptedColumn{
+	{table: "entries", column: "title", field: "title", owner: "t.user_id"},
+	{table: "entries", column: "text", field: "text", owner: "t.user_id"},
+	{table: "entry_revisions", column: "title", field: "title", join: "JOIN entries o ON t.entry_id = o.id", owner: "o.user_id"},
+	{table: "entry_revisions", column: "text", field: "text", join: "JOIN entries o ON t.entry_id = o.id", owner: "o.user_id"},
+	{table: "mood_analysis", column: "summary", field: fieldAnalysisSummary, join: "JOIN entries o ON t.entry_id = o.id", owner: "o.user_id"},
+	{table: "mood_analysis", column: "suggestions", field: fieldAnalysisSuggestions, join: "JOIN entries o ON t.entry_id = o.id", owner: "o.user_id"},
+	{table: "mood_analysis", column: "structured_suggestion", field: fieldAnalysisStructured, join: "JOIN entries o ON t.entry_id = o.id", owner: "o.user_id", json: true},
+	{table: "digests", column: "themes", field: fieldDigestThemes, owner: "t.user_id", json: true},
+	{table: "digests", column: "narrative", field: fieldDigestNarrative, owner: "t.user_id"},
+	{table: "chat_conversations", column: "title", field: fieldChatTitle, owner: "t.user_id"},
+	{table: "chat_messages", column: "content", field: fieldChatContent, join: "JOIN chat_conversations o ON t.conversation_id = o.id", owner: "o.user_id"},
+	// Outputs of requests without a user carry no one's text
+	{table: "model_cache", column: "output", field: fieldModelOutput, owner: "t.user_id", filter: "t.user_id <> 0"},
+	{table: "suggestion_feedback", column: "suggestion", field: fieldFeedbackSuggestion, owner: "t.user_id"},
+	{table: "suggestion_feedback", column: "follow_up", field: fieldFeedbackFollowUp, owner: "t.user_id"},
+	{table: "mood_checkins", column: "note", field: fieldCheckInNote, owner: "t.user_id"},
+}
+
+// A column holding a keyed hash of an encrypted column's value, so equal
+// values can still be grouped in SQL. The field is bound into the hash.
+type hashedColumn struct {
+	encryptedColumn
+	source encryptedColumn     // the column, of the same row, whose value is hashed
+	derive func(string) string // applied to the value before hashing
+}
+
+// Every keyed hash column. Ratings are grouped by suggestion.
+var hashedColumns = []hashedColumn{
+	{
+		encryptedColumn: encryptedColumn{table: "suggestion_feedback", column: "suggestion_key", field: fieldFeedbackKey, owner: "t.user_id"},
+		source:          encryptedColumn{table: "suggestion_feedback", column: "suggestion", field: fieldFeedbackSuggestion},
+		derive:          suggestionKey,
+	},
+}
+
+func (c encryptedColumn) name() string {
+	return c.table + "." + c.column
+}
+
+// The rows of the column, with their owners
+func (c encryptedColumn) from() string {
+	return strings.TrimSpace(c.table + " t " + c.join)
+}
+
+// The stored value as text, for comparing in SQL; alias is "t." or empty
+func (c encryptedColumn) value(alias string) string {
+	if c.json {
+		return "CAST(" + alias + c.column + " AS TEXT)"
+	}
+	return alias + c.column
+}
+
+// Condition on the column's encrypted rows whose value doesn't start with
+// prefix
+func (c encryptedColumn) lacks(prefix string) string {
+	if c.json {
+		prefix = `"` + prefix
+	}
+	condition := fmt.Sprintf("t.%s IS NOT NULL AND SUBSTR(%s, 1, %d) <> '%s'",
+		c.column, c.value("t."), len(prefix), prefix)
+	if c.filter != "" {
+		condition += " AND " + c.filter
+	}
+	return condition
+}
+
+// The ciphertext of a stored value, or the value if it isn't encrypted
+func (c encryptedColumn) sealed(stored string) string {
+	var sealed string
+	if c.json && strings.HasPrefix(stored, `"`+encryptedPrefix) && json.Unmarshal([]byte(stored), &sealed) == nil {
+		return sealed
+	}
+	return stored
+}
+
+func (c encryptedColumn) seal(keys *userKeys, value string) (string, error) {
+	if c.json {
+		return keys.sealJSON(c.field, []byte(value))
+	}
+	return keys.seal(c.field, value)
+}
+
+func (c encryptedColumn) open(keys *userKeys, stored string) (string, error) {
+	if c.json {
+		return keys.openJSON(c.field, stored)
+	}
+	return keys.open(c.field, stored)
+}
+
+// State of encryption at rest, for the key tool and startup checks
+type EncryptionStatus struct {
+	Enabled     bool
+	MasterKeyID string
+	// Data keys by the ID of the master key wrapping them
+	DataKeys map[string]int
+	// Master key IDs wrapping data keys that no configured key matches
+	UnknownMasterKeys []string
+	// Values stored unencrypted, or unhashed, by table.column
+	Plaintext map[string]int
+}
+
+func (s *EncryptionStatus) plaintextValues() int {
+	total := 0
+	for _, n := range s.Plaintext {
+		total += n
+	}
+	return total
+}
+
+// Encryption keys
+type sqlKeyRepository struct{ *sqlStore }
+
+func (r *sqlKeyRepository) EncryptExisting() (int, error) {
+	if !r.masterKeys.enabled() {
+		return 0, errors.New("ENCRYPTION_MASTER_KEY is not set")
+	}
+
+	var queries []string
+	for _, c := range encryptedColumns {
+		queries = append(queries, "SELECT DISTINCT "+c.owner+" FROM "+c.from()+" WHERE "+c.lacks(encryptedPrefix))
+	}
+	for _, c := range hashedColumns {
+		queries = append(queries, "SELECT DISTINCT "+c.owner+" FROM "+c.from()+" WHERE "+c.lacks(hashedPrefix))
+	}
+
+	seen := make(map[int]bool)
+	var userIDs []int
+	for _, query := range queries {
+		rows, err := r.query(query)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var userID int
+			if err := rows.Scan(&userID); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	encrypted := 0
+	for _, userID := range userIDs {
+		keys, err := r.writingKeys(userID)
+		if err != nil {
+			return encrypted, err
+		}
+		n, err := r.reencrypt(keys, func(value string) bool { return !isEncrypted(value) })
+		encrypted += n
+		if err != nil {
+			return encrypted, err
+		}
+		n, err = r.rehash(keys, func(stored string) bool { return !strings.HasPrefix(stored, hashedPrefix) })
+		encrypted += n
+		if err != nil {
+			return encrypted, err
+		}
+	}
+	return encrypted, nil
+}
+
+// Re-encrypt the user's values where stale reports their ciphertext, or
+// plaintext, needs it, with the current key of keys. A value changed since
+// it was read is left for the next run.
+func (r *sqlKeyRepository) reencrypt(keys *userKeys, stale func(value string) bool) (int, error) {
+	type update struct {
+		column encryptedColumn
+		id     int
+		stored string
+		sealed string
+	}
+	var updates []update
+	for _, c := range encryptedColumns {
+		where := c.owner + " = ? AND t." + c.column + " IS NOT NULL"
+		if c.filter != "" {
+			where += " AND " + c.filter
+		}
+		rows, err := r.query("SELECT t.id, "+c.value("t.")+" FROM "+c.from()+" WHERE "+where, keys.userID)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			u := update{column: c}
+			if err := rows.Scan(&u.id, &u.stored); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if stale(c.sealed(u.stored)) {
+				updates = append(updates, u)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Encrypted before the transaction, which holds the only SQLite writer
+	for i := range updates {
+		u := &updates[i]
+		value, err := u.column.open(keys, u.stored)
+		if err != nil {
+			return 0, fmt.Errorf("%s %d: %v", u.column.name(), u.id, err)
+		}
+		if u.sealed, err = u.column.seal(keys, value); err != nil {
+			return 0, err
+		}
+	}
+
+	var updated int64
+	err := r.withTx(func(tx *sqlTx) error {
+		for _, u := range updates {
+			result, err := tx.exec(
+				"UPDATE "+u.column.table+" SET "+u.column.column+" = ? WHERE id = ? AND "+u.column.value("")+" = ?",
+				u.sealed, u.id, u.stored)
+			if err != nil {
+				return err
+			}
+			n, _ := result.RowsAffected()
+			updated += n
+		}
+		return nil
+	})
+	return int(updated), err
+}
+
+// Hash the user's values of hashedColumns again where stale reports the
+// stored hash, or plaintext, needs it, with the current key of keys. As in
+// reencrypt, a value changed since it was read is left for the next run.
+func (r *sqlKeyRepository) rehash(keys *userKeys, stale func(stored string) bool) (int, error) {
+	type update struct {
+		column hashedColumn
+		id     int
+		stored string
+		hashed string
+	}
+	var updates []update
+	for _, c := range hashedColumns {
+		rows, err := r.query("SELECT t.id, t."+c.column+", t."+c.source.column+" FROM "+c.from()+" WHERE "+c.owner+" = ?", keys.userID)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			u := update{column: c}
+			var source string
+			if err := rows.Scan(&u.id, &u.stored, &source); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if !stale(u.stored) {
+				continue
+			}
+			value, err := c.source.open(keys, source)
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("%s %d: %v", c.source.name(), u.id, err)
+			}
+			u.hashed = keys.hash(c.field, c.derive(value))
+			updates = append(updates, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	var updated int64
+	err := r.withTx(func(tx *sqlTx) error {
+		for _, u := range updates {
+			result, err := tx.exec(
+				"UPDATE "+u.column.table+" SET "+u.column.column+" = ? WHERE id = ? AND "+u.column.column+" = ?",
+				u.hashed, u.id, u.stored)
+			if err != nil {
+				return err
+			}
+			n, _ := result.RowsAffected()
+			updated += n
+		}
+		return nil
+	})
+	return int(updated), err
+}
+
+func (r *sqlKeyRepository) RewrapDataKeys() (int, error) {
+	if !r.masterKeys.enabled() {
+		return 0, errors.New("ENCRYPTION_MASTER_KEY is not set")
+	}
+	current := r.masterKeys.current
+
+	rows, err := r.query(`
+		SELECT user_id, version, wrapped_key, master_key_id FROM user_data_keys
+		WHERE master_key_id <> ?`, current.ID)
+	if err != nil {
+		return 0, err
+	}
+	type dataKey struct {
+		userID, version   int
+		wrapped, masterID string
+	}
+	var stale []dataKey
+	for rows.Next() {
+		var k dataKey
+		if err := rows.Scan(&k.userID, &k.version, &k.wrapped, &k.masterID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, k := range stale {
+		master := r.masterKeys.byID(k.masterID)
+		if master == nil {
+			return rewrapped, fmt.Errorf("data key %d of user %d is wrapped by unknown master key %s", k.version, k.userID, k.masterID)
+		}
+		raw, err := master.unwrap(k.userID, k.version, k.wrapped)
+		if err != nil {
+			return rewrapped, fmt.Errorf("unwrapping data key %d of user %d: %v", k.version, k.userID, err)
+		}
+		wrapped, err := current.wrap(k.userID, k.version, raw)
+		if err != nil {
+			return rewrapped, err
+		}
+		if _, err := r.exec(`
+			UPDATE user_data_keys SET wrapped_key = ?, master_key_id = ?
+			WHERE user_id = ? AND version = ? AND master_key_id = ?`,
+			wrapped, current.ID, k.userID, k.version, k.masterID); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+func (r *sqlKeyRepository) RotateUserKey(userID int) (int, error) {
+	if !r.masterKeys.enabled() {
+		return 0, errors.New("ENCRYPTION_MASTER_KEY is not set")
+	}
+
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.addDataKey(userID, keys.current+1); err != nil {
+		return 0, err
+	}
+	if keys, err = r.readingKeys(userID); err != nil {
+		return 0, err
+	}
+
+	current := encryptedPrefix + strconv.Itoa(keys.current) + ":"
+	reencrypted, err := r.reencrypt(keys, func(value string) bool { return !strings.HasPrefix(value, current) })
+	if err != nil {
+		return reencrypted, err
+	}
+	currentHash := hashedPrefix + strconv.Itoa(keys.current) + ":"
+	rehashed, err := r.rehash(keys, func(stored string) bool { return !strings.HasPrefix(stored, currentHash) })
+	reencrypted += rehashed
+	if err != nil {
+		return reencrypted, err
+	}
+
+	// Old keys go only once nothing needs them, so a save that raced the
+	// rotation stays readable; the next rotation retires them
+	remaining := 0
+	for _, c := range encryptedColumns {
+		var n int
+		err := r.queryRow("SELECT COUNT(*) FROM "+c.from()+" WHERE "+c.owner+" = ? AND "+c.lacks(current), userID).Scan(&n)
+		if err != nil {
+			return reencrypted, err
+		}
+		remaining += n
+	}
+	for _, c := range hashedColumns {
+		var n int
+		err := r.queryRow("SELECT COUNT(*) FROM "+c.from()+" WHERE "+c.owner+" = ? AND "+c.lacks(currentHash), userID).Scan(&n)
+		if err != nil {
+			return reencrypted, err
+		}
+		remaining += n
+	}
+	if remaining > 0 {
+		return reencrypted, fmt.Errorf("%d values of user %d changed during rotation; run it again to retire the old keys", remaining, userID)
+	}
+
+	_, err = r.exec("DELETE FROM user_data_keys WHERE user_id = ? AND version < ?", userID, keys.current)
+	return reencrypted, err
+}
+
+func (r *sqlKeyRepository) Status() (*EncryptionStatus, error) {
+	status := &EncryptionStatus{Enabled: r.masterKeys.enabled(), DataKeys: make(map[string]int)}
+	if status.Enabled {
+		status.MasterKeyID = r.masterKeys.current.ID
+	}
+
+	rows, err := r.query("SELECT master_key_id, COUNT(*) FROM user_data_keys GROUP BY master_key_id ORDER BY master_key_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var masterID string
+		var count int
+		if err := rows.Scan(&masterID, &count); err != nil {
+			return nil, err
+		}
+		status.DataKeys[masterID] = count
+		if r.masterKeys == nil || r.masterKeys.byID(masterID) == nil {
+			status.UnknownMasterKeys = append(status.UnknownMasterKeys, masterID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status.Plaintext = make(map[string]int)
+	for _, c := range encryptedColumns {
+		var n int
+		if err := r.queryRow("SELECT COUNT(*) FROM " + c.from() + " WHERE " + c.lacks(encryptedPrefix)).Scan(&n); err != nil {
+			return nil, err
+		}
+		status.Plaintext[c.name()] += n
+	}
+	for _, c := range hashedColumns {
+		var n int
+		if err := r.queryRow("SELECT COUNT(*) FROM " + c.from() + " WHERE " + c.lacks(hashedPrefix)).Scan(&n); err != nil {
+			return nil, err
+		}
+		status.Plaintext[c.name()] += n
+	}
+	return status, nil
+}
+
+// Check the configured master keys against the database and encrypt any
+// content stored before encryption was turned on. Run at startup.
+func initEncryption() {
+	status, err := store.Keys.Status()
+	if err != nil {
+		log.Fatal("Failed to check encryption keys:", err)
+	}
+
+	if !status.Enabled {
+		if len(status.DataKeys) > 0 {
+			log.Fatal(errNoMasterKey)
+		}
+		log.Println("Warning: ENCRYPTION_MASTER_KEY is not set; entry content is stored unencrypted")
+		return
+	}
+	if len(status.UnknownMasterKeys) > 0 {
+		log.Fatalf("Data keys are wrapped by master keys %s, which are neither ENCRYPTION_MASTER_KEY nor in ENCRYPTION_PREVIOUS_MASTER_KEYS",
+			strings.Join(status.UnknownMasterKeys, ", "))
+	}
+
+	if status.plaintextValues() > 0 {
+		encrypted, err := store.Keys.EncryptExisting()
+		if err != nil {
+			log.Fatal("Failed to encrypt existing content:", err)
+		}
+		log.Printf("Encrypted %d stored values", encrypted)
+	}
+	for masterID := range status.DataKeys {
+		if masterID != status.MasterKeyID {
+			log.Printf("Warning: some data keys are still wrapped by a previous master key; run `journal-backend keys rotate-master`")
+			break
+		}
+	}
+}
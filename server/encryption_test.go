@@ -0,0 +1,595 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMasterKey(t *testing.T) *masterKey {
+	t.Helper()
+	encoded, err := generateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseMasterKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Keys of a user with data keys for the given versions, the last current
+func newTestUserKeys(t *testing.T, userID int, versions ...int) *userKeys {
+	t.Helper()
+	keys := &userKeys{userID: userID, aeads: make(map[int]cipher.AEAD)}
+	for _, version := range versions {
+		raw := make([]byte, dataKeyBytes)
+		if _, err := rand.Read(raw); err != nil {
+			t.Fatal(err)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys.aeads[version] = aead
+		keys.current = version
+		keys.hashKey = deriveHashKey(raw)
+	}
+	return keys
+}
+
+// A SQLite store in a temporary file, with the writer for inspecting rows
+// as stored
+func openTestStore(t *testing.T, path string, keys *masterKeys) (*sql.DB, *Store) {
+	t.Helper()
+	conn, s, err := openSQLiteStore(StorageConfig{Driver: "sqlite", DatabaseURL: path, MasterKeys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, s
+}
+
+func TestParseMasterKey(t *testing.T) {
+	valid, err := generateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"surrounding whitespace", "  " + valid + "\n", false},
+		{"empty", "", true},
+		{"not base64", "not a key!", true},
+		{"too short", base64.StdEncoding.EncodeToString(make([]byte, 16)), true},
+		{"too long", base64.StdEncoding.EncodeToString(make([]byte, 48)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseMasterKey(tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMasterKey() err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(key.ID) != 8 {
+				t.Errorf("key ID %q, want 8 hex digits", key.ID)
+			}
+		})
+	}
+}
+
+func TestWrapDataKey(t *testing.T) {
+	master := newTestMasterKey(t)
+	dataKey := make([]byte, dataKeyBytes)
+	if _, err := rand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := master.wrap(1, 2, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		key             *masterKey
+		userID, version int
+		wrapped         string
+		wantErr         bool
+	}{
+		{"same user and version", master, 1, 2, wrapped, false},
+		{"another user", master, 3, 2, wrapped, true},
+		{"another version", master, 1, 1, wrapped, true},
+		{"another master key", newTestMasterKey(t), 1, 2, wrapped, true},
+		{"empty", master, 1, 2, "", true},
+		{"not base64", master, 1, 2, "%%%", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.key.unwrap(tt.userID, tt.version, tt.wrapped)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unwrap() err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != string(dataKey) {
+				t.Errorf("unwrap() returned a different key")
+			}
+		})
+	}
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	keys := newTestUserKeys(t, 1, 1)
+
+	tests := []struct {
+		name  string
+		field string
+		value string
+	}{
+		{"empty", "text", ""},
+		{"ascii", "title", "A quiet day"},
+		{"multibyte", "text", "Très fatigué aujourd'hui 😊 今日は疲れた"},
+		{"looks encrypted", "text", "enc:v1:1:not really"},
+		{"long", fieldChatContent, strings.Repeat("journal ", 10000)},
+		{"derived field", fieldAnalysisSummary, "Overall sentiment: neutral"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := keys.seal(tt.field, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(sealed, encryptedPrefix+"1:") {
+				t.Errorf("sealed %q lacks the %q prefix", sealed, encryptedPrefix+"1:")
+			}
+			if tt.value != "" && strings.Contains(sealed, tt.value) {
+				t.Errorf("sealed value contains the plaintext")
+			}
+			opened, err := keys.open(tt.field, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opened != tt.value {
+				t.Errorf("open(seal(%q)) = %q", tt.value, opened)
+			}
+
+			// Sealing twice gives different ciphertext
+			if again, _ := keys.seal(tt.field, tt.value); again == sealed {
+				t.Errorf("two seals of %q are identical", tt.value)
+			}
+		})
+	}
+}
+
+// Ciphertext is bound to its user and field
+func TestOpenRejectsMovedCiphertext(t *testing.T) {
+	keys := newTestUserKeys(t, 1, 1)
+	sealed, err := keys.seal("title", "Private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUser := &userKeys{userID: 2, current: 1, aeads: keys.aeads}
+
+	tests := []struct {
+		name  string
+		keys  *userKeys
+		field string
+	}{
+		{"another field", keys, "text"},
+		{"another user with the same key", otherUser, "title"},
+		{"another data key", newTestUserKeys(t, 1, 1), "title"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := tt.keys.open(tt.field, sealed); err == nil {
+				t.Errorf("open() = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestOpenParsing(t *testing.T) {
+	keys := newTestUserKeys(t, 1, 1)
+	tooShort := base64.StdEncoding.EncodeToString([]byte("short"))
+
+	tests := []struct {
+		name    string
+		keys    *userKeys
+		stored  string
+		want    string
+		wantErr error // the error expected, if a particular one
+		fail    bool
+	}{
+		{"plaintext passes through", keys, "written before encryption", "written before encryption", nil, false},
+		{"empty passes through", keys, "", "", nil, false},
+		{"other prefix version passes through", keys, "enc:v2:1:abc", "enc:v2:1:abc", nil, false},
+		{"prefix only", keys, "enc:v1:", "", nil, true},
+		{"no separator", keys, "enc:v1:1", "", nil, true},
+		{"version not a number", keys, "enc:v1:x:" + tooShort, "", nil, true},
+		{"unknown version", keys, "enc:v1:9:" + tooShort, "", nil, true},
+		{"not base64", keys, "enc:v1:1:***", "", nil, true},
+		{"shorter than a nonce", keys, "enc:v1:1:" + tooShort, "", nil, true},
+		{"no keys at all", &userKeys{userID: 1, aeads: map[int]cipher.AEAD{}}, "enc:v1:1:" + tooShort, "", errNoMasterKey, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.open("text", tt.stored)
+			if (err != nil) != tt.fail {
+				t.Fatalf("open(%q) = %q, %v, want error %v", tt.stored, got, err, tt.fail)
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("open(%q) err = %v, want %v", tt.stored, err, tt.wantErr)
+			}
+			if !tt.fail && got != tt.want {
+				t.Errorf("open(%q) = %q, want %q", tt.stored, got, tt.want)
+			}
+		})
+	}
+}
+
+// Without a data key values are stored as they are
+func TestSealWithoutKey(t *testing.T) {
+	keys := &userKeys{userID: 1, aeads: map[int]cipher.AEAD{}}
+	for _, value := range []string{"", "plain", "ünïcode"} {
+		if got, err := keys.seal("text", value); err != nil || got != value {
+			t.Errorf("seal(%q) = %q, %v, want it unchanged", value, got, err)
+		}
+		if got, err := keys.sealJSON(fieldDigestThemes, []byte(value)); err != nil || got != value {
+			t.Errorf("sealJSON(%q) = %q, %v, want it unchanged", value, got, err)
+		}
+	}
+}
+
+func TestKeyedHash(t *testing.T) {
+	keys := newTestUserKeys(t, 1, 1)
+	hashed := keys.hash(fieldFeedbackKey, "marcher 🌳")
+	if !strings.HasPrefix(hashed, hashedPrefix+"1:") || strings.Contains(hashed, "marcher") {
+		t.Fatalf("hash() = %q", hashed)
+	}
+	if again := keys.hash(fieldFeedbackKey, "marcher 🌳"); again != hashed {
+		t.Errorf("equal values hashed to %q and %q", hashed, again)
+	}
+	if other := keys.hash(fieldFeedbackKey, "marcher"); other == hashed {
+		t.Errorf("different values hashed alike")
+	}
+	if other := keys.hash(fieldFeedbackSuggestion, "marcher 🌳"); other == hashed {
+		t.Errorf("the same value in another field hashed alike")
+	}
+
+	// Another user's key, or the same user's next one, gives another hash
+	otherUser := newTestUserKeys(t, 2, 1)
+	otherUser.hashKey = keys.hashKey
+	if other := otherUser.hash(fieldFeedbackKey, "marcher 🌳"); other == hashed {
+		t.Errorf("two users' values hashed alike")
+	}
+	rotated := newTestUserKeys(t, 1, 1, 2)
+	if other := rotated.hash(fieldFeedbackKey, "marcher 🌳"); !strings.HasPrefix(other, hashedPrefix+"2:") {
+		t.Errorf("hash after rotation = %q, want key version 2", other)
+	}
+
+	if plain := (&userKeys{userID: 1}).hash(fieldFeedbackKey, "marcher 🌳"); plain != "marcher 🌳" {
+		t.Errorf("hash() without a key = %q, want the value", plain)
+	}
+}
+
+func TestSealJSONRoundTrip(t *testing.T) {
+	keys := newTestUserKeys(t, 1, 1)
+
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"empty array", `[]`},
+		{"empty object", `{}`},
+		{"multibyte themes", `["wörk","家族","😊"]`},
+		{"quoted", `{"suggestion":"Say \"no\" more"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := keys.sealJSON(fieldDigestThemes, []byte(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(sealed, `"`+encryptedPrefix) || !strings.HasSuffix(sealed, `"`) {
+				t.Errorf("sealJSON() = %q, want a JSON string", sealed)
+			}
+			opened, err := keys.openJSON(fieldDigestThemes, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opened != tt.json {
+				t.Errorf("openJSON(sealJSON(%q)) = %q", tt.json, opened)
+			}
+			if _, err := keys.openJSON(fieldAnalysisStructured, sealed); err == nil {
+				t.Errorf("openJSON() with another field succeeded")
+			}
+		})
+	}
+
+	// JSON stored before encryption passes through, a broken string doesn't
+	if got, err := keys.openJSON(fieldDigestThemes, `["plain"]`); err != nil || got != `["plain"]` {
+		t.Errorf("openJSON(plain) = %q, %v", got, err)
+	}
+	if _, err := keys.openJSON(fieldDigestThemes, `"enc:v1:1:abc`); err == nil {
+		t.Errorf("openJSON() of an unterminated string succeeded")
+	}
+}
+
+// Every encrypted column is stored sealed and read back as written
+func TestStoreEncryptsColumns(t *testing.T) {
+	master := newTestMasterKey(t)
+	conn, s := openTestStore(t, filepath.Join(t.TempDir(), "journal.db"), &masterKeys{current: master})
+
+	user, err := s.Users.Create("Zoë", "zoe@example.com", "hash", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &Entry{UserID: user.ID, Title: "Ça va", Text: "Très bien 😊", Date: "2026-10-18", Timezone: "UTC"}
+	if err := s.Entries.Create(entry); err != nil {
+		t.Fatal(err)
+	}
+	entry.Text = "Très bien, vraiment 😊"
+	if err := s.Entries.Update(entry); err != nil {
+		t.Fatal(err)
+	}
+	analysis := &MoodResult{
+		EntryRevision: 1, OverallSentiment: "positive", SentimentScore: 0.8, Emotions: []EmotionResult{},
+		Summary: "Un résumé", Suggestions: "Marcher 🌳", Structured: &StructuredSuggestion{Suggestion: "Marcher"},
+	}
+	if err := s.MoodAnalyses.Save(entry.ID, analysis); err != nil {
+		t.Fatal(err)
+	}
+	digest := &Digest{UserID: user.ID, Period: "week", PeriodStart: "2026-10-12", PeriodEnd: "2026-10-18",
+		SentimentArc: []SentimentTrend{}, Emotions: []EmotionResult{}, Themes: []string{"wörk"}, Narrative: "Une semaine"}
+	if err := s.Digests.Save(digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Digests.UpdateNarrative(digest.ID, "Une autre semaine", "template"); err != nil {
+		t.Fatal(err)
+	}
+	conversation, err := s.Chats.CreateConversation(user.ID, "Comment ça va ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Chats.AddMessage(&ChatMessage{ConversationID: conversation.ID, Role: "user", Content: "Bonjour 👋", Citations: []int{}}); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().UTC().Add(time.Hour)
+	if err := s.ModelCache.Put(user.ID, "m", "generation", "h", []byte(`{"text":"réponse"}`), expires); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ModelCache.Put(0, "m", "generation", "h", []byte("no user"), expires); err != nil {
+		t.Fatal(err)
+	}
+	feedback := &SuggestionFeedback{UserID: user.ID, EntryID: entry.ID, AnalysisID: analysis.ID, Suggestion: analysis.Suggestions,
+		Outcome: outcomeHelped, FollowUp: "J'ai marché une heure", key: suggestionKey(analysis.Suggestions)}
+	if err := s.SuggestionFeedback.Save(feedback); err != nil {
+		t.Fatal(err)
+	}
+	checkIn := &MoodCheckIn{UserID: user.ID, Date: "2026-10-18", Rating: 7, Emotions: []string{}, Note: "Fatigué 😴"}
+	if err := s.CheckIns.Create(checkIn); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := s.Keys.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := status.plaintextValues(); n != 0 {
+		t.Errorf("%d values stored unencrypted: %v", n, status.Plaintext)
+	}
+	for _, c := range encryptedColumns {
+		var stored sql.NullString
+		err := conn.QueryRow("SELECT "+c.value("t.")+" FROM "+c.from()+" WHERE "+c.owner+" = ? LIMIT 1", user.ID).Scan(&stored)
+		if err != nil {
+			t.Errorf("%s: %v", c.name(), err)
+			continue
+		}
+		if !isEncrypted(c.sealed(stored.String)) {
+			t.Errorf("%s stored as %q", c.name(), stored.String)
+		}
+	}
+	var key string
+	if err := conn.QueryRow("SELECT suggestion_key FROM suggestion_feedback WHERE id = ?", feedback.ID).Scan(&key); err != nil ||
+		!strings.HasPrefix(key, hashedPrefix) {
+		t.Errorf("suggestion key stored as %q, %v", key, err)
+	}
+	var unowned string
+	if err := conn.QueryRow("SELECT output FROM model_cache WHERE user_id = 0").Scan(&unowned); err != nil || unowned != "no user" {
+		t.Errorf("output without a user stored as %q, %v", unowned, err)
+	}
+
+	gotEntry, err := s.Entries.GetByID(entry.ID)
+	if err != nil || gotEntry.Title != entry.Title || gotEntry.Text != entry.Text {
+		t.Errorf("entry read back as %+v, %v", gotEntry, err)
+	}
+	gotAnalysis, err := s.MoodAnalyses.GetByEntry(entry.ID)
+	if err != nil || gotAnalysis.Summary != analysis.Summary || gotAnalysis.Suggestions != analysis.Suggestions ||
+		gotAnalysis.Structured == nil || gotAnalysis.Structured.Suggestion != "Marcher" {
+		t.Errorf("analysis read back as %+v, %v", gotAnalysis, err)
+	}
+	gotDigest, err := s.Digests.GetByPeriod(user.ID, "week", "2026-10-12")
+	if err != nil || gotDigest.Narrative != "Une autre semaine" || len(gotDigest.Themes) != 1 || gotDigest.Themes[0] != "wörk" {
+		t.Errorf("digest read back as %+v, %v", gotDigest, err)
+	}
+	gotConversation, err := s.Chats.GetConversation(conversation.ID)
+	if err != nil || gotConversation.Title != "Comment ça va ?" {
+		t.Errorf("conversation read back as %+v, %v", gotConversation, err)
+	}
+	messages, err := s.Chats.ListMessages(conversation.ID)
+	if err != nil || len(messages) != 1 || messages[0].Content != "Bonjour 👋" {
+		t.Errorf("messages read back as %+v, %v", messages, err)
+	}
+	output, err := s.ModelCache.Get(user.ID, "m", "generation", "h", time.Now().UTC())
+	if err != nil || string(output) != `{"text":"réponse"}` {
+		t.Errorf("cached output read back as %q, %v", output, err)
+	}
+	gotFeedback, err := s.SuggestionFeedback.GetByAnalysis(analysis.ID)
+	if err != nil || gotFeedback.Suggestion != feedback.Suggestion || gotFeedback.FollowUp != feedback.FollowUp {
+		t.Errorf("feedback read back as %+v, %v", gotFeedback, err)
+	}
+	stats, err := s.SuggestionFeedback.Stats(user.ID)
+	if err != nil || len(stats) != 1 || stats[0].Suggestion != feedback.Suggestion || stats[0].Helped != 1 {
+		t.Errorf("stats read back as %+v, %v", stats, err)
+	}
+	gotCheckIn, err := s.CheckIns.GetByID(checkIn.ID)
+	if err != nil || gotCheckIn.Note != checkIn.Note {
+		t.Errorf("check-in read back as %+v, %v", gotCheckIn, err)
+	}
+}
+
+// Content stored before a master key was set is encrypted by
+// EncryptExisting, then survives a rotation of the user's key and of the
+// master key
+func TestEncryptExistingAndRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.db")
+	_, plain := openTestStore(t, path, &masterKeys{})
+
+	user, err := plain.Users.Create("Élodie", "elodie@example.com", "hash", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &Entry{UserID: user.ID, Title: "Avant", Text: "Écrit en clair", Date: "2026-10-18", Timezone: "UTC"}
+	if err := plain.Entries.Create(entry); err != nil {
+		t.Fatal(err)
+	}
+	entry.Text = "Écrit en clair, modifié"
+	if err := plain.Entries.Update(entry); err != nil {
+		t.Fatal(err)
+	}
+	digest := &Digest{UserID: user.ID, Period: "week", PeriodStart: "2026-10-12", PeriodEnd: "2026-10-18",
+		SentimentArc: []SentimentTrend{}, Emotions: []EmotionResult{}, Themes: []string{"été"}, Narrative: "Calme"}
+	if err := plain.Digests.Save(digest); err != nil {
+		t.Fatal(err)
+	}
+	// Two ratings of the same suggestion, to be grouped after rotation
+	for revision, suggestion := range []string{"Marcher 🌳", repeatedSuggestionPrefix + "marcher 🌳"} {
+		analysis := &MoodResult{EntryRevision: revision + 1, OverallSentiment: "neutral", Emotions: []EmotionResult{},
+			Summary: "Calme", Suggestions: suggestion}
+		if err := plain.MoodAnalyses.Save(entry.ID, analysis); err != nil {
+			t.Fatal(err)
+		}
+		feedback := &SuggestionFeedback{UserID: user.ID, EntryID: entry.ID, AnalysisID: analysis.ID, Suggestion: suggestion,
+			Outcome: outcomeHelped, FollowUp: "Ça a aidé", key: suggestionKey(suggestion)}
+		if err := plain.SuggestionFeedback.Save(feedback); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkIn := &MoodCheckIn{UserID: user.ID, Date: "2026-10-18", Rating: 6, Emotions: []string{}, Note: "Écrit en clair"}
+	if err := plain.CheckIns.Create(checkIn); err != nil {
+		t.Fatal(err)
+	}
+
+	first := newTestMasterKey(t)
+	conn, s := openTestStore(t, path, &masterKeys{current: first})
+
+	status, err := s.Keys.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"entries.title": 1, "entries.text": 1, "entry_revisions.title": 1, "entry_revisions.text": 1,
+		"mood_analysis.summary": 2, "mood_analysis.suggestions": 2, "digests.themes": 1, "digests.narrative": 1,
+		"suggestion_feedback.suggestion": 2, "suggestion_feedback.follow_up": 2, "suggestion_feedback.suggestion_key": 2,
+		"mood_checkins.note": 1}
+	for name, n := range status.Plaintext {
+		if n != want[name] {
+			t.Errorf("%d plaintext values in %s, want %d", n, name, want[name])
+		}
+	}
+
+	encrypted, err := s.Keys.EncryptExisting()
+	if err != nil || encrypted != 17 {
+		t.Fatalf("EncryptExisting() = %d, %v, want 17", encrypted, err)
+	}
+	if again, err := s.Keys.EncryptExisting(); err != nil || again != 0 {
+		t.Errorf("second EncryptExisting() = %d, %v, want 0", again, err)
+	}
+
+	rotated, err := s.Keys.RotateUserKey(user.ID)
+	if err != nil || rotated != 17 {
+		t.Fatalf("RotateUserKey() = %d, %v, want 17", rotated, err)
+	}
+	var versions, current int
+	if err := conn.QueryRow("SELECT COUNT(*), MAX(version) FROM user_data_keys WHERE user_id = ?", user.ID).Scan(&versions, &current); err != nil {
+		t.Fatal(err)
+	}
+	if versions != 1 || current != 2 {
+		t.Errorf("%d data keys, current version %d, want only version 2", versions, current)
+	}
+	var narrative string
+	if err := conn.QueryRow("SELECT narrative FROM digests WHERE id = ?", digest.ID).Scan(&narrative); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(narrative, encryptedPrefix+"2:") {
+		t.Errorf("narrative stored as %q after rotation, want key version 2", narrative)
+	}
+	var keyVersions int
+	if err := conn.QueryRow("SELECT COUNT(DISTINCT suggestion_key) FROM suggestion_feedback WHERE suggestion_key LIKE ?", hashedPrefix+"2:%").
+		Scan(&keyVersions); err != nil || keyVersions != 1 {
+		t.Errorf("%d distinct suggestion keys under key version 2, %v; want 1", keyVersions, err)
+	}
+
+	// A new master key, with the first still able to unwrap
+	second := newTestMasterKey(t)
+	_, s = openTestStore(t, path, &masterKeys{current: second, previous: []*masterKey{first}})
+	rewrapped, err := s.Keys.RewrapDataKeys()
+	if err != nil || rewrapped != 1 {
+		t.Fatalf("RewrapDataKeys() = %d, %v, want 1", rewrapped, err)
+	}
+
+	// Only the second key is needed from now on
+	_, s = openTestStore(t, path, &masterKeys{current: second})
+	status, err = s.Keys.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DataKeys[second.ID] != 1 || len(status.UnknownMasterKeys) != 0 || status.plaintextValues() != 0 {
+		t.Errorf("status after rotation = %+v", status)
+	}
+	gotEntry, err := s.Entries.GetByID(entry.ID)
+	if err != nil || gotEntry.Text != "Écrit en clair, modifié" {
+		t.Errorf("entry read back as %+v, %v", gotEntry, err)
+	}
+	revisions, err := s.Revisions.ListByEntry(entry.ID)
+	if err != nil || len(revisions) != 1 || revisions[0].Text != "Écrit en clair" {
+		t.Errorf("revisions read back as %+v, %v", revisions, err)
+	}
+	gotDigest, err := s.Digests.GetByPeriod(user.ID, "week", "2026-10-12")
+	if err != nil || gotDigest.Narrative != "Calme" || len(gotDigest.Themes) != 1 || gotDigest.Themes[0] != "été" {
+		t.Errorf("digest read back as %+v, %v", gotDigest, err)
+	}
+	stats, err := s.SuggestionFeedback.Stats(user.ID)
+	if err != nil || len(stats) != 1 || stats[0].Helped != 2 {
+		t.Errorf("stats read back as %+v, %v", stats, err)
+	}
+	gotCheckIn, err := s.CheckIns.GetByID(checkIn.ID)
+	if err != nil || gotCheckIn.Note != "Écrit en clair" {
+		t.Errorf("check-in read back as %+v, %v", gotCheckIn, err)
+	}
+
+	// The first key alone can no longer read anything
+	_, s = openTestStore(t, path, &masterKeys{current: first})
+	status, err = s.Keys.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.UnknownMasterKeys) != 1 || status.UnknownMasterKeys[0] != second.ID {
+		t.Errorf("unknown master keys %v, want [%s]", status.UnknownMasterKeys, second.ID)
+	}
+	if _, err := s.Entries.GetByID(entry.ID); err == nil {
+		t.Errorf("entry read with a master key that doesn't wrap its data key")
+	}
+}
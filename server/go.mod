@@ -10,3 +10,5 @@ require (
 	github.com/rs/cors v1.10.1
 	golang.org/x/crypto v0.14.0
 )
+
+require github.com/lib/pq v1.10.9
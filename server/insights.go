@@ -0,0 +1,267 @@
+// insights.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Mood aggregated over one day, week or month
+type TrendBucket struct {
+	Period        string          `json:"period"` // first day of the bucket, YYYY-MM-DD
+	EntryCount    int             `json:"entry_count"`
+	AverageScore  *float64        `json:"average_score"`  // null for empty buckets
+	MovingAverage *float64        `json:"moving_average"` // over the trailing window
+	Sentiments    map[string]int  `json:"sentiments"`
+	Emotions      []EmotionResult `json:"emotions"` // mean score per entry, highest first
+	// The user's own check-ins, null when there were none
+	SelfReported *SelfReportedMood `json:"self_reported"`
+	// Model average minus self-reported score, when both exist; positive
+	// means the model read the period as happier than the user did
+	Disagreement *float64 `json:"disagreement"`
+
+	scoreSum float64
+}
+
+type MoodTrends struct {
+	Granularity string        `json:"granularity"`
+	From        string        `json:"from"`
+	To          string        `json:"to"`
+	Window      int           `json:"window"` // buckets in the moving average
+	Buckets     []TrendBucket `json:"buckets"`
+}
+
+// Default lookback and moving-average window per granularity
+var trendDefaults = map[string]struct {
+	buckets int
+	window  int
+}{
+	"day":   {30, 7},
+	"week":  {12, 4},
+	"month": {12, 3},
+}
+
+// Upper bound on buckets in one response
+const maxTrendBuckets = 1000
+
+var errTrendRangeTooLarge = fmt.Errorf("range spans more than %d buckets", maxTrendBuckets)
+
+// Average sentiment scores within this distance of zero count as neutral
+const neutralScoreBand = 0.1
+
+// First day of the bucket containing t
+func bucketStart(granularity string, t time.Time) time.Time {
+	switch granularity {
+	case "week":
+		// Weeks start on Monday, matching sqlDialect.dateBucket
+		offset := (int(t.Weekday()) + 6) % 7
+		return t.AddDate(0, 0, -offset)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return t
+	}
+}
+
+// Advance a bucket start by n buckets
+func addBuckets(granularity string, t time.Time, n int) time.Time {
+	switch granularity {
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "month":
+		return t.AddDate(0, n, 0)
+	default:
+		return t.AddDate(0, 0, n)
+	}
+}
+
+// Label an average sentiment score
+func sentimentLabel(score float64) string {
+	switch {
+	case score > neutralScoreBand:
+		return "positive"
+	case score < -neutralScoreBand:
+		return "negative"
+	default:
+		return "neutral"
+	}
+}
+
+// Build the mood time series for a user between two ISO dates (inclusive),
+// filling empty buckets and computing entry-weighted moving averages
+func computeMoodTrends(userID int, granularity, from, to string, window int) (*MoodTrends, error) {
+	fromDay, err := time.Parse(entryDateLayout, from)
+	if err != nil {
+		return nil, err
+	}
+	toDay, err := time.Parse(entryDateLayout, to)
+	if err != nil {
+		return nil, err
+	}
+
+	first := bucketStart(granularity, fromDay)
+	last := bucketStart(granularity, toDay)
+
+	// Guard the gap-filling loop against huge ranges
+	if addBuckets(granularity, first, maxTrendBuckets).Before(last) {
+		return nil, errTrendRangeTooLarge
+	}
+
+	found, err := store.Insights.MoodBuckets(userID, granularity, from, to)
+	if err != nil {
+		return nil, err
+	}
+	byPeriod := make(map[string]TrendBucket, len(found))
+	for _, b := range found {
+		byPeriod[b.Period] = b
+	}
+	checkIns, err := store.CheckIns.Buckets(userID, granularity, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	trends := &MoodTrends{
+		Granularity: granularity,
+		From:        from,
+		To:          to,
+		Window:      window,
+		Buckets:     []TrendBucket{},
+	}
+	for t := first; !t.After(last); t = addBuckets(granularity, t, 1) {
+		period := t.Format(entryDateLayout)
+		b, ok := byPeriod[period]
+		if !ok {
+			b = TrendBucket{
+				Period:     period,
+				Sentiments: map[string]int{"positive": 0, "negative": 0, "neutral": 0},
+			}
+		}
+		if b.EntryCount > 0 {
+			avg := b.scoreSum / float64(b.EntryCount)
+			b.AverageScore = &avg
+		}
+		if self, ok := checkIns[period]; ok {
+			self.AverageRating = self.ratingSum / float64(self.CheckInCount)
+			self.Score = ratingScore(self.AverageRating)
+			b.SelfReported = self
+			if b.AverageScore != nil {
+				diff := *b.AverageScore - self.Score
+				b.Disagreement = &diff
+			}
+		}
+		if b.Emotions == nil {
+			b.Emotions = []EmotionResult{}
+		}
+		sort.Slice(b.Emotions, func(i, j int) bool {
+			return b.Emotions[i].Score > b.Emotions[j].Score
+		})
+		trends.Buckets = append(trends.Buckets, b)
+	}
+
+	// Moving average over the trailing window, weighted by entry count so a
+	// bucket with one entry doesn't swing it as much as a busy one
+	for i := range trends.Buckets {
+		var sum float64
+		var count int
+		for j := max(0, i-window+1); j <= i; j++ {
+			sum += trends.Buckets[j].scoreSum
+			count += trends.Buckets[j].EntryCount
+		}
+		if count > 0 {
+			avg := sum / float64(count)
+			trends.Buckets[i].MovingAverage = &avg
+		}
+	}
+
+	return trends, nil
+}
+
+// Recent weekly sentiment for UserPatterns, skipping weeks without entries
+func recentSentimentTrends(userID int, weeks int) []SentimentTrend {
+	today := time.Now().In(loadLocation(userTimezone(userID)))
+	from := addBuckets("week", bucketStart("week", today), -(weeks - 1))
+
+	trends, err := computeMoodTrends(userID, "week",
+		from.Format(entryDateLayout), today.Format(entryDateLayout), 1)
+	if err != nil {
+		return nil
+	}
+
+	var result []SentimentTrend
+	for _, b := range trends.Buckets {
+		if b.AverageScore == nil {
+			continue
+		}
+		result = append(result, SentimentTrend{
+			Period:    b.Period,
+			Sentiment: sentimentLabel(*b.AverageScore),
+			Score:     *b.AverageScore,
+			Count:     b.EntryCount,
+		})
+	}
+	return result
+}
+
+// Mood time series for charts:
+// ?granularity=day|week|month&from=YYYY-MM-DD&to=YYYY-MM-DD&window=4
+func getTrendsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	query := r.URL.Query()
+
+	granularity := query.Get("granularity")
+	if granularity == "" {
+		granularity = "week"
+	}
+	defaults, ok := trendDefaults[granularity]
+	if !ok {
+		http.Error(w, "Invalid granularity, expected day, week or month", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseDateRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Default to the most recent buckets up to today in the user's timezone
+	if to == "" {
+		to = time.Now().In(loadLocation(userTimezone(userID))).Format(entryDateLayout)
+	}
+	if from == "" {
+		toDay, _ := time.Parse(entryDateLayout, to)
+		start := addBuckets(granularity, bucketStart(granularity, toDay), -(defaults.buckets - 1))
+		from = start.Format(entryDateLayout)
+	}
+	if from > to {
+		http.Error(w, "'from' must not be after 'to'", http.StatusBadRequest)
+		return
+	}
+
+	window := defaults.window
+	if v := query.Get("window"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 52 {
+			http.Error(w, "Invalid window, expected 1-52", http.StatusBadRequest)
+			return
+		}
+		window = n
+	}
+
+	trends, err := computeMoodTrends(userID, granularity, from, to, window)
+	if err == errTrendRangeTooLarge {
+		http.Error(w, "Range is too large for this granularity", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to compute trends", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trends)
+}
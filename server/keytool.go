@@ -0,0 +1,151 @@
+// keytool.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+const keyToolUsage = `usage: journal-backend keys <command>
+
+  generate             print a new random master key
+  status               show the master key, data keys and unencrypted rows
+  encrypt              encrypt content stored unencrypted
+  rotate-master        rewrap every data key with ENCRYPTION_MASTER_KEY
+  rotate-user <id|all> give users new data keys and re-encrypt their content
+
+The database and keys are configured by the same environment variables as
+the server.`
+
+// Run the key management tool with the arguments after "keys". Returns the
+// exit code.
+func runKeyTool(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, keyToolUsage)
+		return 2
+	}
+
+	// Needs no database
+	if args[0] == "generate" {
+		key, err := generateMasterKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to generate key:", err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	}
+
+	conn, keyStore, err := openStore(loadStorageConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open database:", err)
+		return 1
+	}
+	defer conn.Close()
+
+	switch args[0] {
+	case "status":
+		err = printKeyStatus(keyStore)
+	case "encrypt":
+		var n int
+		n, err = keyStore.Keys.EncryptExisting()
+		fmt.Printf("Encrypted %d values\n", n)
+	case "rotate-master":
+		var n int
+		n, err = keyStore.Keys.RewrapDataKeys()
+		fmt.Printf("Rewrapped %d data keys\n", n)
+	case "rotate-user":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, keyToolUsage)
+			return 2
+		}
+		err = rotateUserKeys(keyStore, args[1])
+	default:
+		fmt.Fprintln(os.Stderr, keyToolUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func printKeyStatus(keyStore *Store) error {
+	status, err := keyStore.Keys.Status()
+	if err != nil {
+		return err
+	}
+
+	if status.Enabled {
+		fmt.Println("Master key:", status.MasterKeyID)
+	} else {
+		fmt.Println("Master key: not set; new content is stored unencrypted")
+	}
+
+	masterIDs := make([]string, 0, len(status.DataKeys))
+	for id := range status.DataKeys {
+		masterIDs = append(masterIDs, id)
+	}
+	sort.Strings(masterIDs)
+	for _, id := range masterIDs {
+		var note string
+		switch {
+		case id == status.MasterKeyID:
+			note = " (current)"
+		case slices.Contains(status.UnknownMasterKeys, id):
+			note = " (not configured)"
+		default:
+			note = " (previous; run rotate-master)"
+		}
+		fmt.Printf("Data keys wrapped by %s: %d%s\n", id, status.DataKeys[id], note)
+	}
+
+	fmt.Println("Unencrypted values:", status.plaintextValues())
+	columns := append([]encryptedColumn{}, encryptedColumns...)
+	for _, c := range hashedColumns {
+		columns = append(columns, c.encryptedColumn)
+	}
+	for _, c := range columns {
+		if n := status.Plaintext[c.name()]; n > 0 {
+			fmt.Printf("  %s: %d\n", c.name(), n)
+		}
+	}
+	return nil
+}
+
+// Rotate the data key of one user, or of every user
+func rotateUserKeys(keyStore *Store, which string) error {
+	var userIDs []int
+	if which == "all" {
+		users, err := keyStore.Users.List()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			userIDs = append(userIDs, user.ID)
+		}
+	} else {
+		userID, err := strconv.Atoi(which)
+		if err != nil {
+			return fmt.Errorf("invalid user ID %q", which)
+		}
+		if _, err := keyStore.Users.GetByID(userID); err != nil {
+			return fmt.Errorf("user %d not found", userID)
+		}
+		userIDs = []int{userID}
+	}
+
+	for _, userID := range userIDs {
+		n, err := keyStore.Keys.RotateUserKey(userID)
+		if err != nil {
+			return fmt.Errorf("user %d: %v", userID, err)
+		}
+		fmt.Printf("User %d: re-encrypted %d values\n", userID, n)
+	}
+	return nil
+}
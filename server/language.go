@@ -0,0 +1,253 @@
+// language.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Language codes are ISO 639-1. Text whose language can't be told is "und".
+const undeterminedLanguage = "und"
+
+// Languages told apart by their stopwords
+var stopwordLanguages = []string{"en", "es", "fr", "de", "it", "pt", "nl"}
+
+var languageStopwords = map[string]map[string]bool{
+	"en": englishStopwords,
+	"es": makeWordSet(`a al algo algunas algunos ante antes como con contra cual cuando de del desde donde
+		durante e el ella ellas ellos en entre era es esa esas ese eso esos esta estaba estamos están
+		estar estas este esto estos estoy fue había han hasta hay hoy la las le les lo los me mi mis
+		mucho muchos muy más mí nada ni no nos nosotros o os otra otras otro otros para pero poco
+		porque que quien quienes qué se ser si sin sobre soy su sus sí también te tengo ti tiene
+		todo todos tu tus tú un una uno unos y ya yo él`),
+	"fr": makeWordSet(`ai aie as au aujourd'hui aussi aux avais avait avec avez avoir avons bien c ce cela
+		ces cet cette comme d dans de des donc du elle elles en encore es est et eux fait j je l la
+		le les leur lui m ma mais me moi mes mon même n ne nos notre nous on ont ou où par pas peu
+		plus pour qu que quand qui s sa sans se ses si son sont suis sur t ta te tes toi ton tout
+		très tu un une vos votre vous y à été était être`),
+	"de": makeWordSet(`aber alle als also am an auch auf aus bei bin bis bist da damit dann das dass dein
+		dem den der des dich die dir doch du ein eine einem einen einer er es etwas für hab habe
+		haben hat hatte heute ich ihr im in ist ja jetzt kann kein keine mich mein meine mit muss
+		nach nicht nichts noch nur ob oder ohne schon sehr sein sich sie sind so über um und uns
+		unter viel vom von vor war was weil wenn wer wie wieder wir wird zu zum zur`),
+	"it": makeWordSet(`a ad al alla alle anche avevo c'è che chi ci come con cosa da dal dalla dei del
+		della delle di e era ero fa gli ha hanno ho i il in io l'ho la le lei lo loro lui ma me mi
+		mia mio molto ne nel nella noi non o oggi per perché più poi quando quello questa questo se
+		sei si sono sono stata stato su sua suo ti tra tu tutto un una uno è`),
+	"pt": makeWordSet(`a ao aos as até com como da das de dei depois do dos e ela ele eles em entre era
+		essa esse esta estava estou eu foi hoje isso isto já lhe mais mas me meu minha muito na nas
+		no nos não nós o os ou para pela pelo por porque quando que se sem ser seu sua são também
+		te tem tenho tinha um uma você é`),
+	"nl": makeWordSet(`aan al als bij dan dat de den der deze die dit door een en er ga geen had heb hebben
+		heeft het hij hoe ik in is je kan maar me met mij mijn na naar niet niets nog nu of om ons
+		ook op over te tegen toch tot u uit van vandaag veel voor was wat we wel werd wij zal ze zei
+		zich zij zijn zo zou`),
+}
+
+// Minimum evidence for a stopword guess: stopwords seen, and their share of
+// the words
+const (
+	minLanguageStopwords = 2
+	minLanguageShare     = 0.15
+)
+
+// Scripts that identify a language well enough on their own
+var scriptLanguages = []struct {
+	table    *unicode.RangeTable
+	language string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Thai, "th"},
+}
+
+// Guess the language of text offline. Text mostly in a non-Latin script is
+// identified by the script; Latin text by which language's stopwords it
+// uses most. Short or ambiguous text is "und".
+func detectLanguage(text string) string {
+	var letters, latin int
+	scripts := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.table, r) {
+				scripts[s.language]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return undeterminedLanguage
+	}
+
+	if latin*2 < letters {
+		// Japanese mixes kanji with kana; any real amount of kana decides it
+		if scripts["ja"]*10 >= letters {
+			return "ja"
+		}
+		best, bestCount := undeterminedLanguage, 0
+		for _, s := range scriptLanguages {
+			if scripts[s.language] > bestCount {
+				best, bestCount = s.language, scripts[s.language]
+			}
+		}
+		return best
+	}
+
+	words := wordPattern.FindAllString(strings.ToLower(strings.ReplaceAll(text, "’", "'")), -1)
+	best, bestHits, secondHits := undeterminedLanguage, 0, 0
+	for _, lang := range stopwordLanguages {
+		hits := 0
+		for _, w := range words {
+			if languageStopwords[lang][w] {
+				hits++
+			}
+		}
+		switch {
+		case hits > bestHits:
+			best, bestHits, secondHits = lang, hits, bestHits
+		case hits > secondHits:
+			secondHits = hits
+		}
+	}
+	if bestHits < minLanguageStopwords || float64(bestHits) < minLanguageShare*float64(len(words)) ||
+		bestHits == secondHits {
+		return undeterminedLanguage
+	}
+	return best
+}
+
+// Stopwords for a language. Languages without a list, and undetermined
+// text, use the English list.
+func stopwordsFor(language string) map[string]bool {
+	if words, ok := languageStopwords[language]; ok {
+		return words
+	}
+	return englishStopwords
+}
+
+// Translation models into English, for languages the emotion model can't
+// read. Others go through the many-to-English model.
+var translationModels = map[string]string{
+	"ar": "Helsinki-NLP/opus-mt-ar-en",
+	"de": "Helsinki-NLP/opus-mt-de-en",
+	"es": "Helsinki-NLP/opus-mt-es-en",
+	"fr": "Helsinki-NLP/opus-mt-fr-en",
+	"it": "Helsinki-NLP/opus-mt-it-en",
+	"ja": "Helsinki-NLP/opus-mt-ja-en",
+	"ko": "Helsinki-NLP/opus-mt-ko-en",
+	"nl": "Helsinki-NLP/opus-mt-nl-en",
+	"ru": "Helsinki-NLP/opus-mt-ru-en",
+	"zh": "Helsinki-NLP/opus-mt-zh-en",
+}
+
+const multilingualTranslationModel = "Helsinki-NLP/opus-mt-mul-en"
+
+// How a text in some language gets its emotions: a model that reads the
+// language, or translation into English for the English model
+type emotionRoute struct {
+	Language    string
+	Model       string
+	Translation string // model translating into English first, if any
+}
+
+// Route for a language. EMOTION_MODEL_<LANG> names a model that reads the
+// language directly; otherwise non-English text is translated, by
+// TRANSLATION_MODEL_<LANG> if set. Undetermined text goes to the English
+// model as is.
+func emotionRouteFor(language string) emotionRoute {
+	route := emotionRoute{Language: language, Model: emotionModel}
+	if language == "en" || language == undeterminedLanguage || language == "" {
+		return route
+	}
+
+	suffix := strings.ToUpper(language)
+	if model := strings.TrimSpace(os.Getenv("EMOTION_MODEL_" + suffix)); model != "" {
+		route.Model = model
+		return route
+	}
+	route.Translation = strings.TrimSpace(os.Getenv("TRANSLATION_MODEL_" + suffix))
+	if route.Translation == "" {
+		route.Translation = translationModels[language]
+	}
+	if route.Translation == "" {
+		route.Translation = multilingualTranslationModel
+	}
+	return route
+}
+
+// Model version note for the route, when it differs from the default
+func (r emotionRoute) version() string {
+	switch {
+	case r.Translation != "":
+		return fmt.Sprintf("language=%s;translation=%s", r.Language, r.Translation)
+	case r.Model != emotionModel:
+		return fmt.Sprintf("language=%s;emotion=%s", r.Language, r.Model)
+	}
+	return ""
+}
+
+// Note the route in an analysis's model version
+func withEmotionRoute(version string, route emotionRoute) string {
+	if note := route.version(); note != "" {
+		return version + ";" + note
+	}
+	return version
+}
+
+// Translate text into English with a translation model
+func translateToEnglish(ctx context.Context, model, text string) (string, error) {
+	response, err := callHuggingFaceAPI(ctx, model, "translation", text)
+	if err != nil {
+		return "", err
+	}
+
+	var result []struct {
+		TranslationText string `json:"translation_text"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return "", fmt.Errorf("unexpected translation response: %s", string(response))
+	}
+	if len(result) == 0 || strings.TrimSpace(result[0].TranslationText) == "" {
+		return "", fmt.Errorf("empty translation")
+	}
+	return result[0].TranslationText, nil
+}
+
+// Translate several texts into English in one request
+func translateBatchToEnglish(ctx context.Context, model string, texts []string) ([]string, error) {
+	response, err := callHuggingFaceBatch(ctx, model, "translation", texts)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []struct {
+		TranslationText string `json:"translation_text"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil || len(result) != len(texts) {
+		return nil, fmt.Errorf("unexpected translation response for %d texts: %s", len(texts), string(response))
+	}
+	translated := make([]string, len(texts))
+	for i, r := range result {
+		translated[i] = r.TranslationText
+	}
+	return translated, nil
+}
@@ -0,0 +1,166 @@
+// lexicon.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Sentiment and emotions from word lists, for users whose analysis stays on
+// this server. Much cruder than the models: English only, blind to sarcasm,
+// and negation is handled by flipping the few words after it.
+
+// Recorded as the sentiment and emotion model of a local analysis
+const lexiconModel = "lexicon-v1"
+
+// Sentiment words by weight
+var sentimentLexicon = map[float64]string{
+	2: `amazing awesome beautiful blessed blissful brilliant delighted ecstatic elated excellent
+		excited fantastic glorious grateful incredible joyful love loved lovely marvelous
+		overjoyed perfect proud thrilled wonderful`,
+	1: `accomplished better calm comfortable confident content enjoy enjoyed energized fun glad
+		good great happy helpful hope hopeful inspired laugh laughed nice optimistic peaceful pleasant productive refreshed relaxed relieved rested safe satisfied
+		smile smiled success successful support supported thankful win won`,
+	-1: `afraid alone angry annoyed anxious ashamed awful bad bored confused disappointed
+		down drained embarrassed exhausted fail failed frustrated guilty hate hated hurt
+		irritated jealous lonely lost nervous overwhelmed pain sad scared sick stressed tense
+		tired unhappy upset worried worse worthless`,
+	-2: `agony broken crushed depressed despair devastated disgusted dread furious heartbroken
+		hopeless horrible miserable panic panicked rage terrible terrified unbearable worst`,
+}
+
+// Emotion words, by the emotion model's labels
+var emotionLexicon = map[string]map[string]bool{
+	"anger": makeWordSet(`angry annoyed annoying furious hate hated irritated livid mad outraged
+		rage resent resentful frustrated frustrating`),
+	"disgust": makeWordSet(`disgust disgusted disgusting gross nasty repulsed revolting sickening
+		vile`),
+	"fear": makeWordSet(`afraid anxious anxiety dread dreading fear frightened nervous panic
+		panicked scared terrified tense worried worry worrying`),
+	"joy": makeWordSet(`cheerful delighted ecstatic elated enjoy enjoyed excited fun glad
+		grateful happy joy joyful laugh laughed love loved proud smile smiled thrilled`),
+	"sadness": makeWordSet(`alone cried cry crying depressed despair devastated down grief
+		heartbroken hopeless lonely lost miserable miss missed sad sorrow tears unhappy upset`),
+	"surprise": makeWordSet(`amazed astonished shocked startled stunned surprise surprised
+		surprising unexpected`),
+}
+
+const neutralEmotion = "neutral"
+
+// Words that flip or cancel the words following them
+var negations = makeWordSet(`not no never nothing nobody nowhere neither nor hardly barely
+	without isn't aren't wasn't weren't don't doesn't didn't can't couldn't won't wouldn't
+	shouldn't haven't hasn't hadn't cannot`)
+
+const (
+	// Words after a negation that it applies to
+	negationReach = 3
+	// Squashes the summed word weights into -1..1; larger is more cautious
+	lexiconNormalisation = 15
+	// Words of text that count as one of neutral, against the emotion words
+	// found
+	neutralWordsPerEmotion = 12
+)
+
+var sentimentWeights = func() map[string]float64 {
+	weights := make(map[string]float64)
+	for weight, words := range sentimentLexicon {
+		for _, w := range strings.Fields(words) {
+			weights[w] = weight
+		}
+	}
+	return weights
+}()
+
+// Lexicons are English; undetermined text is read as English too
+func lexiconReads(language string) bool {
+	return language == "en" || language == undeterminedLanguage || language == ""
+}
+
+func lexiconWords(text string) []string {
+	return wordPattern.FindAllString(strings.ToLower(strings.ReplaceAll(text, "’", "'")), -1)
+}
+
+// Sentiment of text from the word list, on the models' -1..1 scale
+func localSentiment(text string) (string, float64, error) {
+	if language := detectLanguage(text); !lexiconReads(language) {
+		return "", 0, fmt.Errorf("no local sentiment lexicon for language %q", language)
+	}
+
+	var sum float64
+	negatedUntil := -1
+	for i, w := range lexiconWords(text) {
+		if negations[w] {
+			negatedUntil = i + negationReach
+			continue
+		}
+		weight, ok := sentimentWeights[w]
+		if !ok {
+			continue
+		}
+		// "not happy" leans negative, but less than "unhappy"
+		if i <= negatedUntil {
+			weight = -weight / 2
+		}
+		sum += weight
+	}
+
+	score := sum / math.Sqrt(sum*sum+lexiconNormalisation)
+	return sentimentLabel(score), score, nil
+}
+
+// Emotions of text from the word lists. Every label is returned, with
+// neutral taking the share of words that carry no emotion, strongest first.
+func localEmotions(language, text string) ([]EmotionResult, error) {
+	if !lexiconReads(language) {
+		return nil, fmt.Errorf("no local emotion lexicon for language %q", language)
+	}
+
+	words := lexiconWords(text)
+	counts := make(map[string]float64)
+	var found float64
+	negatedUntil := -1
+	for i, w := range words {
+		if negations[w] {
+			negatedUntil = i + negationReach
+			continue
+		}
+		// "not scared" isn't fear
+		if i <= negatedUntil {
+			continue
+		}
+		for label, set := range emotionLexicon {
+			if set[w] {
+				counts[label]++
+				found++
+			}
+		}
+	}
+
+	neutral := math.Max(1, float64(len(words))/neutralWordsPerEmotion)
+	total := found + neutral
+	emotions := []EmotionResult{{Label: neutralEmotion, Score: neutral / total}}
+	for label := range emotionLexicon {
+		emotions = append(emotions, EmotionResult{Label: label, Score: counts[label] / total})
+	}
+	sort.Slice(emotions, func(i, j int) bool {
+		if emotions[i].Score != emotions[j].Score {
+			return emotions[i].Score > emotions[j].Score
+		}
+		return emotions[i].Label < emotions[j].Label
+	})
+	return emotions, nil
+}
+
+// Model version of an analysis for the user ctx carries: the lexicon's when
+// their analysis is local, the models' and emotion route otherwise
+func analysisVersion(ctx context.Context, calibration *MoodCalibration, route emotionRoute) string {
+	if privacyFrom(ctx).localOnly() {
+		return calibration.withCalibration(fmt.Sprintf("sentiment=%s;emotion=%s;generation=%s",
+			lexiconModel, lexiconModel, generationModel))
+	}
+	return withEmotionRoute(calibration.modelVersion(), route)
+}
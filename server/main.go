@@ -2,27 +2,29 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/cors"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -30,6 +32,12 @@ import (
 // Database instance
 var db *sql.DB
 
+// Repositories for the configured storage backend
+var store *Store
+
+// Active storage configuration
+var storageConfig StorageConfig
+
 // JWT secret key (in production, use environment variable)
 var jwtSecret = []byte("your-secret-key-change-this-in-production")
 
@@ -45,15 +53,55 @@ func init() {
 
 	// Then initialize the variable
 	huggingFaceAPIKey = os.Getenv("HUGGINGFACE_API_KEY") // Optional: Set for higher rate limits
+	if model := os.Getenv("GENERATION_MODEL"); model != "" {
+		generationModel = model
+	}
 }
 
 const huggingFaceAPIURL = "https://router.huggingface.co/hf-inference/models/"
 
+// Hugging Face models used by the analysis pipeline
+const (
+	sentimentModel = "tabularisai/multilingual-sentiment-analysis"
+	emotionModel   = "j-hartmann/emotion-english-distilroberta-base"
+	embeddingModel = "BAAI/bge-small-en-v1.5"
+)
+
+// Text-generation model, overridable with GENERATION_MODEL. Prompts are
+// laid out in its chat format (see prompts.go).
+var generationModel = "mistralai/Mixtral-8x7B-Instruct-v0.1"
+
+// Cancelled when the server shuts down, so background jobs abandon their
+// model calls
+var appContext = context.Background()
+
+// Longest a background analysis may take, retries included
+const backgroundAnalysisTimeout = 5 * time.Minute
+
+// Context for analysing a user's entry after its request has returned
+func backgroundAnalysisContext(userID int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(withModelUser(appContext, userID), backgroundAnalysisTimeout)
+}
+
+// Analyzer names recorded with each mood analysis. Bump the suffix when the
+// pipeline logic changes so old and new results can be told apart.
+const (
+	basicAnalyzer = "basic-v1"
+	ragAnalyzer   = "rag-v1"
+)
+
+// Model version string recorded with each mood analysis
+func analysisModelVersion() string {
+	return fmt.Sprintf("sentiment=%s;emotion=%s;generation=%s", sentimentModel, emotionModel, generationModel)
+}
+
 // Migration struct
 type Migration struct {
 	Version int
 	Name    string
 	SQL     string
+	// Optional data migration run after SQL, in the same transaction
+	Migrate func(tx *sql.Tx, dialect sqlDialect) error
 }
 
 // User struct
@@ -63,7 +111,10 @@ type User struct {
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
 	Password  string    `json:"password,omitempty"`
+	Timezone  string    `json:"timezone"`
 	CreatedAt time.Time `json:"created_at"`
+	// What the pipeline may do with the user's text (see privacy.go)
+	PrivacySettings
 }
 
 type Entry struct {
@@ -72,18 +123,45 @@ type Entry struct {
 	Title        string      `json:"title"`
 	Text         string      `json:"text"`
 	Date         string      `json:"date"`
+	Timezone     string      `json:"timezone"`
+	Revision     int         `json:"revision"`
 	CreatedAt    time.Time   `json:"created_at"`
+	UpdatedAt    *time.Time  `json:"updated_at,omitempty"`
+	DeletedAt    *time.Time  `json:"deleted_at,omitempty"`
+	NotebookID   *int        `json:"notebook_id,omitempty"`
+	Tags         []string    `json:"tags,omitempty"`
 	MoodAnalysis *MoodResult `json:"mood_analysis,omitempty"`
 }
 
 // Mood analysis structs
 type MoodResult struct {
+	ID               int             `json:"id"`
+	EntryRevision    int             `json:"entry_revision"`
+	Analyzer         string          `json:"analyzer"`
+	ModelVersion     string          `json:"model_version"`
+	Language         string          `json:"language,omitempty"` // detected, ISO 639-1 or "und"
+	IsCurrent        bool            `json:"is_current"`
+	RiskLevel        string          `json:"risk_level"` // "none", "concern" or "critical"
 	OverallSentiment string          `json:"overall_sentiment"`
 	SentimentScore   float64         `json:"sentiment_score"`
 	Emotions         []EmotionResult `json:"emotions"`
 	Summary          string          `json:"summary"`
 	Suggestions      string          `json:"suggestions"`
-	AnalyzedAt       time.Time       `json:"analyzed_at"`
+	// Generation model that wrote the suggestion, or "template". Empty for
+	// analyses saved before this was recorded.
+	SuggestionBy string    `json:"suggestion_by"`
+	AnalyzedAt   time.Time `json:"analyzed_at"`
+	// The suggestion's rationale, category and duration, when the
+	// generative model wrote it
+	Structured *StructuredSuggestion `json:"structured_suggestion,omitempty"`
+	// Per-sentence scores, served by the spans endpoint
+	Sentences []SentenceScore `json:"-"`
+	// The models' output before the user's calibration, if it was applied
+	ModelOutput *ModelMoodOutput `json:"model_output,omitempty"`
+	// The user's correction and suggestion rating, on the current analysis
+	// only
+	Correction *MoodCorrection     `json:"correction,omitempty"`
+	Feedback   *SuggestionFeedback `json:"feedback,omitempty"`
 }
 
 type EmotionResult struct {
@@ -106,6 +184,9 @@ type SimilarEntry struct {
 	Entry      Entry       `json:"entry"`
 	Similarity float64     `json:"similarity"`
 	MoodResult *MoodResult `json:"mood_result,omitempty"`
+	Passage    string      `json:"passage,omitempty"` // the best matching chunk of a long entry
+
+	passageStart, passageEnd int // byte offsets of Passage, set by FindSimilar
 }
 
 // RAG Context for analysis
@@ -118,8 +199,11 @@ type RAGContext struct {
 type UserPatterns struct {
 	CommonEmotions   []EmotionResult  `json:"common_emotions"`
 	SentimentTrends  []SentimentTrend `json:"sentiment_trends"`
-	TriggerKeywords  []string         `json:"trigger_keywords"`
-	CopingStrategies []string         `json:"coping_strategies"`
+	TriggerKeywords  []string         `json:"trigger_keywords"`  // associated with negative entries
+	PositiveKeywords []string         `json:"positive_keywords"` // associated with positive entries
+	CopingStrategies []string         `json:"coping_strategies"` // most effective for the user first
+
+	suggestionStats map[string]SuggestionStats
 }
 
 type SentimentTrend struct {
@@ -150,6 +234,7 @@ type SignupRequest struct {
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Timezone string `json:"timezone"`
 }
 
 type AuthResponse struct {
@@ -225,52 +310,432 @@ var migrations = []Migration{
 	CREATE INDEX IF NOT EXISTS idx_embeddings_user_id ON entry_embeddings(user_id);
 	CREATE INDEX IF NOT EXISTS idx_embeddings_entry_id ON entry_embeddings(entry_id);`,
 	},
+	{
+		Version: 5,
+		Name:    "add_mood_analysis_history",
+		SQL: `
+		ALTER TABLE entries ADD COLUMN revision INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE mood_analysis ADD COLUMN entry_revision INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE mood_analysis ADD COLUMN analyzer TEXT NOT NULL DEFAULT 'legacy';
+		ALTER TABLE mood_analysis ADD COLUMN model_version TEXT NOT NULL DEFAULT '';
+		ALTER TABLE mood_analysis ADD COLUMN is_current BOOLEAN NOT NULL DEFAULT 0;
+		UPDATE mood_analysis SET is_current = 1
+		WHERE id IN (SELECT MAX(id) FROM mood_analysis GROUP BY entry_id);
+		CREATE INDEX IF NOT EXISTS idx_mood_analysis_entry_id ON mood_analysis(entry_id);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_mood_analysis_current ON mood_analysis(entry_id) WHERE is_current;`,
+	},
+	{
+		Version: 6,
+		Name:    "create_entry_revisions_table",
+		SQL: `
+		ALTER TABLE entries ADD COLUMN updated_at DATETIME;
+		CREATE TABLE IF NOT EXISTS entry_revisions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			entry_id INTEGER NOT NULL,
+			revision INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			text TEXT NOT NULL,
+			saved_at DATETIME NOT NULL,
+			archived_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (entry_id) REFERENCES entries (id) ON DELETE CASCADE,
+			UNIQUE (entry_id, revision)
+		);`,
+	},
+	{
+		Version: 7,
+		Name:    "add_entries_deleted_at",
+		SQL: `
+		ALTER TABLE entries ADD COLUMN deleted_at DATETIME;
+		CREATE INDEX IF NOT EXISTS idx_entries_deleted_at ON entries(deleted_at) WHERE deleted_at IS NOT NULL;`,
+	},
+	{
+		Version: 8,
+		Name:    "create_tags_and_notebooks",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS notebooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			UNIQUE (user_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS tags (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			UNIQUE (user_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS entry_tags (
+			entry_id INTEGER NOT NULL,
+			tag_id INTEGER NOT NULL,
+			PRIMARY KEY (entry_id, tag_id),
+			FOREIGN KEY (entry_id) REFERENCES entries (id) ON DELETE CASCADE,
+			FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_entry_tags_tag_id ON entry_tags(tag_id);
+		ALTER TABLE entries ADD COLUMN notebook_id INTEGER REFERENCES notebooks (id) ON DELETE SET NULL;
+		CREATE INDEX IF NOT EXISTS idx_entries_notebook_id ON entries(notebook_id);`,
+	},
+	{
+		Version: 9,
+		Name:    "add_timezones_and_iso_dates",
+		SQL: `
+		ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+		ALTER TABLE entries ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+		CREATE INDEX IF NOT EXISTS idx_entries_user_date ON entries(user_id, date);`,
+		Migrate: migrateEntryDates,
+	},
+	{
+		Version: 10,
+		Name:    "create_digests_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS digests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			period TEXT NOT NULL, -- 'week' or 'month'
+			period_start TEXT NOT NULL,
+			period_end TEXT NOT NULL,
+			entry_count INTEGER NOT NULL,
+			average_score REAL,
+			sentiment_arc TEXT NOT NULL, -- JSON array
+			emotions TEXT NOT NULL, -- JSON array
+			themes TEXT NOT NULL, -- JSON array
+			narrative TEXT NOT NULL,
+			narrative_by TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			UNIQUE (user_id, period, period_start)
+		);`,
+	},
+	{
+		Version: 11,
+		Name:    "create_chat_tables",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS chat_conversations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_chat_conversations_user_id ON chat_conversations(user_id);
+		CREATE TABLE IF NOT EXISTS chat_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			conversation_id INTEGER NOT NULL,
+			role TEXT NOT NULL, -- 'user' or 'assistant'
+			content TEXT NOT NULL,
+			citations TEXT NOT NULL, -- JSON array of entry IDs
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (conversation_id) REFERENCES chat_conversations (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_chat_messages_conversation_id ON chat_messages(conversation_id);`,
+	},
+	{
+		Version: 12,
+		Name:    "add_mood_analysis_risk_level",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN risk_level TEXT NOT NULL DEFAULT 'none';`,
+	},
+	{
+		Version: 13,
+		Name:    "create_mood_checkins_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS mood_checkins (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			entry_id INTEGER UNIQUE, -- NULL for a standalone check-in
+			date TEXT NOT NULL,
+			rating INTEGER NOT NULL,
+			energy INTEGER,
+			sleep_hours REAL,
+			emotions TEXT NOT NULL, -- JSON array of labels
+			note TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			FOREIGN KEY (entry_id) REFERENCES entries (id) ON DELETE SET NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_mood_checkins_user_date ON mood_checkins(user_id, date);`,
+	},
+	{
+		Version: 14,
+		Name:    "create_mood_corrections_table",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN model_output TEXT; -- JSON, set when calibration changed the result
+		CREATE TABLE IF NOT EXISTS mood_corrections (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			entry_id INTEGER NOT NULL,
+			analysis_id INTEGER NOT NULL UNIQUE,
+			model_sentiment TEXT NOT NULL,
+			model_score REAL NOT NULL,
+			model_emotions TEXT NOT NULL, -- JSON array
+			sentiment TEXT, -- NULL if not reviewed
+			emotions TEXT, -- JSON array of labels, NULL if not reviewed
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			FOREIGN KEY (entry_id) REFERENCES entries (id) ON DELETE CASCADE,
+			FOREIGN KEY (analysis_id) REFERENCES mood_analysis (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_mood_corrections_user_id ON mood_corrections(user_id);`,
+	},
+	{
+		Version: 15,
+		Name:    "create_suggestion_feedback_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS suggestion_feedback (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			entry_id INTEGER NOT NULL,
+			analysis_id INTEGER NOT NULL UNIQUE,
+			suggestion TEXT NOT NULL,
+			suggestion_key TEXT NOT NULL, -- normalised, to group ratings of the same suggestion
+			outcome TEXT NOT NULL, -- 'helped', 'did_not_help' or 'tried'
+			follow_up TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			FOREIGN KEY (entry_id) REFERENCES entries (id) ON DELETE CASCADE,
+			FOREIGN KEY (analysis_id) REFERENCES mood_analysis (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_suggestion_feedback_user_key ON suggestion_feedback(user_id, suggestion_key);`,
+	},
+	{
+		Version: 16,
+		Name:    "add_mood_analysis_structured_suggestion",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN structured_suggestion TEXT; -- JSON, set when the model wrote the suggestion`,
+	},
+	{
+		Version: 17,
+		Name:    "create_model_cache_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS model_cache (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			model TEXT NOT NULL,
+			task TEXT NOT NULL, -- 'sentiment', 'emotion', 'embedding', 'risk' or 'generation'
+			input_hash TEXT NOT NULL, -- SHA-256 of the exact request body
+			output TEXT NOT NULL, -- the response body
+			size_bytes INTEGER NOT NULL,
+			hits INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			UNIQUE (model, task, input_hash)
+		);
+		CREATE INDEX IF NOT EXISTS idx_model_cache_last_used ON model_cache(last_used_at);`,
+	},
+	{
+		Version: 18,
+		Name:    "create_entry_chunk_embeddings_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS entry_chunk_embeddings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			entry_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			chunk_index INTEGER NOT NULL,
+			start_offset INTEGER NOT NULL, -- byte offsets into title + " " + text
+			end_offset INTEGER NOT NULL,
+			embedding TEXT NOT NULL, -- JSON string of float64 array
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (entry_id) REFERENCES entries (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			UNIQUE (entry_id, chunk_index)
+		);
+		CREATE INDEX IF NOT EXISTS idx_chunk_embeddings_user_id ON entry_chunk_embeddings(user_id);`,
+	},
+	{
+		Version: 19,
+		Name:    "add_mood_analysis_sentence_scores",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN sentence_scores TEXT; -- JSON array of per-sentence scores`,
+	},
+	{
+		Version: 20,
+		Name:    "add_mood_analysis_language",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN language TEXT NOT NULL DEFAULT ''; -- ISO 639-1, 'und' if undetermined, '' before detection`,
+	},
+	{
+		Version: 21,
+		Name:    "add_users_external_processing",
+		SQL: `
+		ALTER TABLE users ADD COLUMN external_processing BOOLEAN NOT NULL DEFAULT 1;`,
+	},
+	{
+		Version: 22,
+		Name:    "add_users_privacy_settings",
+		SQL: `
+		ALTER TABLE users ADD COLUMN mood_analysis BOOLEAN NOT NULL DEFAULT 1;
+		ALTER TABLE users ADD COLUMN embeddings BOOLEAN NOT NULL DEFAULT 1;
+		ALTER TABLE users ADD COLUMN generative_suggestions BOOLEAN NOT NULL DEFAULT 1;
+		ALTER TABLE users ADD COLUMN local_analysis BOOLEAN NOT NULL DEFAULT 0;`,
+	},
+	{
+		// Existing content is encrypted at startup once a master key is set
+		// (see encryption.go), not here, since it may be set later
+		Version: 23,
+		Name:    "create_user_data_keys_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS user_data_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			wrapped_key TEXT NOT NULL, -- base64 nonce and ciphertext, under the master key
+			master_key_id TEXT NOT NULL, -- which master key wrapped it
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			UNIQUE (user_id, version)
+		);`,
+	},
+	{
+		// Outputs are kept per user so opting out can delete them. The
+		// cache is rebuilt as models are called again.
+		Version: 24,
+		Name:    "add_model_cache_user_id",
+		SQL: `
+		DROP TABLE IF EXISTS model_cache;
+		CREATE TABLE model_cache (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL, -- whose text the request carried, 0 if none
+			model TEXT NOT NULL,
+			task TEXT NOT NULL, -- 'sentiment', 'emotion', 'translation', 'embedding', 'risk' or 'generation'
+			input_hash TEXT NOT NULL, -- SHA-256 of the exact request body
+			output TEXT NOT NULL, -- the response body
+			size_bytes INTEGER NOT NULL,
+			hits INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			UNIQUE (user_id, model, task, input_hash)
+		);
+		CREATE INDEX IF NOT EXISTS idx_model_cache_last_used ON model_cache(last_used_at);`,
+	},
+	{
+		Version: 25,
+		Name:    "add_mood_analysis_suggestion_by",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN suggestion_by TEXT NOT NULL DEFAULT ''; -- generation model, 'template', or '' if not recorded`,
+	},
 }
 
-// Hugging Face API functions
-func callHuggingFaceAPI(modelName, text string) ([]byte, error) {
-	url := huggingFaceAPIURL + modelName
+// Hugging Face API functions. Text is redacted first (see redact.go),
+// outputs are cached per model and task (modelcache.go) and calls go through
+// the shared client (modelclient.go).
+func callHuggingFaceAPI(ctx context.Context, modelName, task, text string) ([]byte, error) {
+	redacted, err := prepareExternalText(ctx, text)
+	if err != nil {
+		return nil, err
+	}
 
 	payload := map[string]interface{}{
-		"inputs": text,
+		"inputs": redacted.Text,
 	}
+	return postModelInputs(ctx, modelName, task, payload)
+}
 
+// Run a model on several texts in one request. Pipelines take a list of
+// inputs and answer with a result for each, in order.
+func callHuggingFaceBatch(ctx context.Context, modelName, task string, texts []string) ([]byte, error) {
+	inputs := make([]string, len(texts))
+	for i, text := range texts {
+		redacted, err := prepareExternalText(ctx, text)
+		if err != nil {
+			return nil, err
+		}
+		inputs[i] = redacted.Text
+	}
+
+	payload := map[string]interface{}{
+		"inputs": inputs,
+	}
+	return postModelInputs(ctx, modelName, task, payload)
+}
+
+// Send a request body of redacted inputs, through the cache
+func postModelInputs(ctx context.Context, modelName, task string, payload map[string]interface{}) ([]byte, error) {
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
+	return cachedModelCall(ctx, modelName, task, jsonPayload, func() ([]byte, error) {
+		body, err := hfClient().post(ctx, modelName, jsonPayload, modelRequestTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(body) {
+			return nil, fmt.Errorf("API returned invalid JSON")
+		}
+		return body, nil
+	})
+}
+
+// Run the text-generation model on a rendered prompt and return only the
+// continuation, with redacted values restored. The same prompt and
+// parameters get the cached continuation.
+func generateText(ctx context.Context, prompt *RenderedPrompt) (string, error) {
+	redacted, err := prepareExternalText(ctx, prompt.Text)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if huggingFaceAPIKey != "" {
-		req.Header.Set("Authorization", "Bearer "+huggingFaceAPIKey)
+	payload := map[string]interface{}{
+		"inputs":     redacted.Text,
+		"parameters": prompt.Params.payload(),
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := cachedModelCall(ctx, generationModel, "generation", jsonPayload, func() ([]byte, error) {
+		body, err := hfClient().post(ctx, generationModel, jsonPayload, generationTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		// Don't cache an empty generation
+		if _, err := parseGeneratedText(body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	text, err := parseGeneratedText(body)
+	if err != nil {
+		return "", err
+	}
+	return redacted.restore(text), nil
+}
+
+// The continuation from a text-generation response
+func parseGeneratedText(body []byte) (string, error) {
+	var result []struct {
+		GeneratedText string `json:"generated_text"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	if len(result) == 0 || strings.TrimSpace(result[0].GeneratedText) == "" {
+		return "", fmt.Errorf("empty generation")
 	}
 
-	return body, nil
+	return strings.TrimSpace(result[0].GeneratedText), nil
 }
 
-func analyzeSentiment(text string) (string, float64, error) {
-	response, err := callHuggingFaceAPI("tabularisai/multilingual-sentiment-analysis", text)
+// Sentiment of text that fits the model's input; see analyzeSentiment
+func classifySentiment(ctx context.Context, text string) (string, float64, error) {
+	response, err := callHuggingFaceAPI(ctx, sentimentModel, "sentiment", text)
 	if err != nil {
 		return "", 0, err
 	}
@@ -279,91 +744,25 @@ func analyzeSentiment(text string) (string, float64, error) {
 	log.Printf("Raw sentiment API response: %s", string(response))
 
 	// Try to unmarshal as nested array first (Hugging Face returns [[{...}]])
-	var nestedResponse [][]struct {
-		Label string  `json:"label"`
-		Score float64 `json:"score"`
-	}
-
+	var nestedResponse [][]EmotionResult
 	if err := json.Unmarshal(response, &nestedResponse); err == nil && len(nestedResponse) > 0 {
 		// Use the first inner array
-		sentimentResponse := nestedResponse[0]
-		if len(sentimentResponse) == 0 {
-			return "neutral", 0, nil
-		}
-
-		// Find the sentiment with highest score
-		var bestSentiment string
-		var bestScore float64
-		for _, result := range sentimentResponse {
-			if result.Score > bestScore {
-				bestScore = result.Score
-				bestSentiment = result.Label
-			}
-		}
-
-		// Convert to readable format and score
-		switch strings.ToLower(bestSentiment) {
-		case "negative", "very negative":
-			return "negative", -bestScore, nil
-		case "neutral":
-			return "neutral", 0, nil
-		case "positive", "very positive":
-			return "positive", bestScore, nil
-		default:
-			return bestSentiment, bestScore, nil
-		}
+		sentiment, score := sentimentOf(nestedResponse[0])
+		return sentiment, score, nil
 	}
 
 	// Fallback: Try to unmarshal as single array
-	var sentimentResponse []struct {
-		Label string  `json:"label"`
-		Score float64 `json:"score"`
-	}
-
+	var sentimentResponse []EmotionResult
 	if err := json.Unmarshal(response, &sentimentResponse); err == nil {
-		if len(sentimentResponse) == 0 {
-			return "neutral", 0, nil
-		}
-
-		// Find the sentiment with highest score
-		var bestSentiment string
-		var bestScore float64
-		for _, result := range sentimentResponse {
-			if result.Score > bestScore {
-				bestScore = result.Score
-				bestSentiment = result.Label
-			}
-		}
-
-		// Convert to readable format and score
-		switch strings.ToLower(bestSentiment) {
-		case "negative", "very negative":
-			return "negative", -bestScore, nil
-		case "neutral":
-			return "neutral", 0, nil
-		case "positive", "very positive":
-			return "positive", bestScore, nil
-		default:
-			return bestSentiment, bestScore, nil
-		}
+		sentiment, score := sentimentOf(sentimentResponse)
+		return sentiment, score, nil
 	}
 
 	// If both formats fail, try single object format
-	var singleResponse struct {
-		Label string  `json:"label"`
-		Score float64 `json:"score"`
-	}
+	var singleResponse EmotionResult
 	if err := json.Unmarshal(response, &singleResponse); err == nil {
-		switch strings.ToLower(singleResponse.Label) {
-		case "negative", "very negative":
-			return "negative", -singleResponse.Score, nil
-		case "neutral":
-			return "neutral", 0, nil
-		case "positive", "very positive":
-			return "positive", singleResponse.Score, nil
-		default:
-			return singleResponse.Label, singleResponse.Score, nil
-		}
+		sentiment, score := sentimentOf([]EmotionResult{singleResponse})
+		return sentiment, score, nil
 	}
 
 	log.Printf("Failed to parse sentiment response in any expected format")
@@ -371,9 +770,45 @@ func analyzeSentiment(text string) (string, float64, error) {
 	return "neutral", 0, fmt.Errorf("failed to parse sentiment response")
 }
 
-func analyzeEmotions(text string) ([]EmotionResult, error) {
-	// Use j-hartmann/emotion-english-distilroberta-base model
-	response, err := callHuggingFaceAPI("j-hartmann/emotion-english-distilroberta-base", text)
+// Sentiment and signed score from the sentiment model's label scores: the
+// label with the highest score, negative scores for negative labels
+func sentimentOf(results []EmotionResult) (string, float64) {
+	if len(results) == 0 {
+		return "neutral", 0
+	}
+
+	best := results[0]
+	for _, result := range results[1:] {
+		if result.Score > best.Score {
+			best = result
+		}
+	}
+
+	// Convert to readable format and score
+	switch strings.ToLower(best.Label) {
+	case "negative", "very negative":
+		return "negative", -best.Score
+	case "neutral":
+		return "neutral", 0
+	case "positive", "very positive":
+		return "positive", best.Score
+	default:
+		return best.Label, best.Score
+	}
+}
+
+// Emotions of text that fits the model's input, translating it first if
+// the route says to; see analyzeEmotions
+func classifyEmotions(ctx context.Context, route emotionRoute, text string) ([]EmotionResult, error) {
+	if route.Translation != "" {
+		translated, err := translateToEnglish(ctx, route.Translation, text)
+		if err != nil {
+			return nil, fmt.Errorf("translation for emotion analysis failed: %v", err)
+		}
+		text = translated
+	}
+
+	response, err := callHuggingFaceAPI(ctx, route.Model, "emotion", text)
 	if err != nil {
 		return nil, err
 	}
@@ -434,39 +869,64 @@ func analyzeEmotions(text string) ([]EmotionResult, error) {
 	return nil, fmt.Errorf("failed to parse emotion response")
 }
 
-func performMoodAnalysis(text string) (*MoodResult, error) {
+func performMoodAnalysis(ctx context.Context, userID int, text string) (*MoodResult, error) {
+	// Screen for crisis language before anything else
+	risk := assessRisk(ctx, text)
+
 	// Analyze sentiment
-	sentiment, score, err := analyzeSentiment(text)
+	sentiment, score, err := analyzeSentiment(ctx, text)
 	if err != nil {
 		log.Printf("Sentiment analysis failed: %v", err)
 		sentiment = "neutral"
 		score = 0
 	}
 
-	// Analyze emotions
-	emotions, err := analyzeEmotions(text)
+	// Analyze emotions with a model that reads the entry's language
+	language := detectLanguage(text)
+	route := emotionRouteFor(language)
+	emotions, err := analyzeEmotions(ctx, route, text)
 	if err != nil {
 		log.Printf("Emotion analysis failed: %v", err)
 		emotions = []EmotionResult{}
 	}
 
+	// Re-weight the models' output with the user's corrections
+	calibration := loadMoodCalibration(userID)
+	sentiment, score, emotions, modelOutput := calibration.apply(sentiment, score, emotions)
+
 	// Generate summary
 	summary := generateMoodSummary(sentiment, emotions)
 
-	// Generate AI suggestions
-	suggestions, err := generateAISuggestions(text)
-	if err != nil {
+	// Flagged entries get support resources and never go to the
+	// generative model
+	var suggestions, promptID string
+	suggestionBy := templateSuggestion
+	var structured *StructuredSuggestion
+	if risk.Flagged() {
+		suggestions = safetySuggestion(risk.Level)
+	} else if structured, err = generateAISuggestions(ctx, userID, text); err == nil {
+		suggestions = structured.Suggestion
+		promptID = structured.promptID
+		suggestionBy = withPromptVersion(generationModel, promptID)
+	} else {
 		log.Printf("AI suggestion generation failed: %v", err)
-		suggestions = "Try reflecting more on your feelings or write another journal entry."
+		suggestions = generateFallbackSuggestion(risk, text)
 	}
 
 	return &MoodResult{
+		Analyzer:         basicAnalyzer,
+		ModelVersion:     withPromptVersion(analysisVersion(ctx, calibration, route), promptID),
+		Language:         language,
+		RiskLevel:        risk.Level,
 		OverallSentiment: sentiment,
 		SentimentScore:   score,
 		Emotions:         emotions,
 		Summary:          summary,
 		Suggestions:      suggestions,
+		SuggestionBy:     suggestionBy,
+		Structured:       structured,
 		AnalyzedAt:       time.Now(),
+		ModelOutput:      modelOutput,
 	}, nil
 }
 
@@ -493,126 +953,48 @@ func generateMoodSummary(sentiment string, emotions []EmotionResult) string {
 	return summary.String()
 }
 
-// mistralai/Mixtral-8x7B-Instruct-v0.1
-func generateAISuggestions(text string) (string, error) {
-	// Use a more reliable model for text generation
-	model := "mistralai/Mixtral-8x7B-Instruct-v0.1" // Alternative: "gpt2" or "facebook/blenderbot-400M-distill"
-
-	// Create a more focused prompt
-	prompt := fmt.Sprintf("Based on this journal entry, suggest one helpful wellness activity:\n\nJournal: \"%s\"\n\nSuggestion:", text)
-
-	payload := map[string]interface{}{
-		"inputs": prompt,
-		"parameters": map[string]interface{}{
-			"max_length":   150,
-			"temperature":  0.7,
-			"do_sample":    true,
-			"pad_token_id": 50256,
-		},
+// Ask the generative model for one wellness suggestion, using the user's
+// variant of the suggestion prompt
+func generateAISuggestions(ctx context.Context, userID int, text string) (*StructuredSuggestion, error) {
+	if !privacyFrom(ctx).GenerativeSuggestions {
+		return nil, errGenerativeSuggestionsDisabled
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	prompt, err := renderPrompt("suggestion", userID, struct{ Text string }{text})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", huggingFaceAPIURL+model, bytes.NewBuffer(jsonPayload))
+	generated, err := generateText(ctx, prompt)
 	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	if huggingFaceAPIKey != "" {
-		req.Header.Set("Authorization", "Bearer "+huggingFaceAPIKey)
+		return nil, err
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	suggestion, err := parseOrRepairSuggestion(ctx, userID, generated)
 	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("AI suggestion API error: %s", string(body))
-		return generateFallbackSuggestion(text), nil // Return fallback instead of error
-	}
-
-	var result []map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("Failed to decode AI response: %v", err)
-		return generateFallbackSuggestion(text), nil
-	}
-
-	if len(result) > 0 {
-		if generated, ok := result[0]["generated_text"].(string); ok {
-			// Clean up the response
-			cleaned := cleanAISuggestion(generated, prompt)
-			if cleaned != "" {
-				return cleaned, nil
-			}
-		}
+		return nil, err
 	}
-
-	return generateFallbackSuggestion(text), nil
+	suggestion.promptID = prompt.TemplateID
+	return suggestion, nil
 }
 
-// Clean up AI-generated suggestions
-func cleanAISuggestion(generated, originalPrompt string) string {
-	// Remove the original prompt from the response
-	suggestion := strings.Replace(generated, originalPrompt, "", 1)
-
-	// Clean up common issues
-	suggestion = strings.TrimSpace(suggestion)
-
-	// Remove any remaining prompt artifacts
-	lines := strings.Split(suggestion, "\n")
-	var cleanLines []string
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		// Skip lines that look like prompts or metadata
-		if strings.Contains(strings.ToLower(line), "journal entry") ||
-			strings.Contains(strings.ToLower(line), "suggestion:") ||
-			strings.Contains(strings.ToLower(line), "based on") ||
-			len(line) < 10 { // Skip very short lines
-			continue
-		}
-
-		// Clean up formatting
-		line = strings.Trim(line, "\"'*-")
-		if line != "" {
-			cleanLines = append(cleanLines, line)
-		}
+// Model version string noting the prompt template behind the suggestion,
+// so A/B variants can be compared
+func withPromptVersion(version, promptID string) string {
+	if promptID == "" {
+		return version
 	}
+	return version + ";prompt=" + promptID
+}
 
-	if len(cleanLines) > 0 {
-		// Take the first meaningful line and ensure it's well-formatted
-		suggestion = cleanLines[0]
-
-		// Ensure it ends with proper punctuation
-		if !strings.HasSuffix(suggestion, ".") && !strings.HasSuffix(suggestion, "!") && !strings.HasSuffix(suggestion, "?") {
-			suggestion += "."
-		}
-
-		// Capitalize first letter
-		if len(suggestion) > 0 {
-			suggestion = strings.ToUpper(string(suggestion[0])) + suggestion[1:]
-		}
-
-		return suggestion
+// Generate fallback suggestions based on sentiment. risk is the entry's
+// screening, already done by the caller.
+func generateFallbackSuggestion(risk RiskAssessment, text string) string {
+	// Crisis language gets support resources, not a wellness tip
+	if risk.Flagged() {
+		return safetySuggestion(risk.Level)
 	}
 
-	return ""
-}
-
-// Generate fallback suggestions based on sentiment
-func generateFallbackSuggestion(text string) string {
 	// Simple keyword-based suggestions as fallback
 	lowerText := strings.ToLower(text)
 
@@ -655,58 +1037,35 @@ func generateFallbackSuggestion(text string) string {
 	return suggestions[len(text)%len(suggestions)]
 }
 
-func saveMoodAnalysis(entryID int, moodResult *MoodResult) error {
-	emotionsJSON, err := json.Marshal(moodResult.Emotions)
-	if err != nil {
-		return err
+// Save an analysis of one of the user's entries, unless they have turned
+// mood analysis off since it started
+func saveMoodAnalysis(userID, entryID int, moodResult *MoodResult) error {
+	if !loadPrivacySettings(userID).MoodAnalysis {
+		return errMoodAnalysisDisabled
 	}
-
-	_, err = db.Exec(`
-	INSERT INTO mood_analysis (entry_id, overall_sentiment, sentiment_score, emotions, summary, suggestions)
-	VALUES (?, ?, ?, ?, ?, ?)`,
-		entryID, moodResult.OverallSentiment, moodResult.SentimentScore,
-		string(emotionsJSON), moodResult.Summary, moodResult.Suggestions)
-
-	return err
+	return store.MoodAnalyses.Save(entryID, moodResult)
 }
 
 func getMoodAnalysis(entryID int) (*MoodResult, error) {
-	var moodResult MoodResult
-	var emotionsJSON string
-
-	err := db.QueryRow(`
-		SELECT overall_sentiment, sentiment_score, emotions, summary, suggestions, analyzed_at
-		FROM mood_analysis WHERE entry_id = ?`, entryID).Scan(
-		&moodResult.OverallSentiment, &moodResult.SentimentScore,
-		&emotionsJSON, &moodResult.Summary, &moodResult.Suggestions, &moodResult.AnalyzedAt)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if err := json.Unmarshal([]byte(emotionsJSON), &moodResult.Emotions); err != nil {
-		return nil, err
-	}
-
-	return &moodResult, nil
+	return store.MoodAnalyses.GetByEntry(entryID)
 }
 
 // Create migrations table
-func createMigrationsTable() error {
+func createMigrationsTable(conn *sql.DB) error {
 	createMigrationsSQL := `
 	CREATE TABLE IF NOT EXISTS migrations (
 		version INTEGER PRIMARY KEY,
 		name TEXT NOT NULL,
-		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);`
-	_, err := db.Exec(createMigrationsSQL)
+	_, err := conn.Exec(createMigrationsSQL)
 	return err
 }
 
 // Get current migration version
-func getCurrentMigrationVersion() (int, error) {
+func getCurrentMigrationVersion(conn *sql.DB) (int, error) {
 	var version int
-	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM migrations").Scan(&version)
+	err := conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM migrations").Scan(&version)
 	if err != nil {
 		return 0, err
 	}
@@ -714,14 +1073,14 @@ func getCurrentMigrationVersion() (int, error) {
 }
 
 // Run migrations
-func runMigrations() error {
+func runMigrations(conn *sql.DB, dialect sqlDialect, migrations []Migration) error {
 	// Create migrations table first
-	if err := createMigrationsTable(); err != nil {
+	if err := createMigrationsTable(conn); err != nil {
 		return fmt.Errorf("failed to create migrations table: %v", err)
 	}
 
 	// Get current version
-	currentVersion, err := getCurrentMigrationVersion()
+	currentVersion, err := getCurrentMigrationVersion(conn)
 	if err != nil {
 		return fmt.Errorf("failed to get current migration version: %v", err)
 	}
@@ -731,16 +1090,34 @@ func runMigrations() error {
 		if migration.Version > currentVersion {
 			fmt.Printf("Running migration %d: %s\n", migration.Version, migration.Name)
 
-			// Execute migration
-			if _, err := db.Exec(migration.SQL); err != nil {
+			// Execute and record the migration atomically so a failure
+			// never leaves a half-applied schema behind
+			tx, err := conn.Begin()
+			if err != nil {
+				return fmt.Errorf("failed to begin migration %d: %v", migration.Version, err)
+			}
+
+			if _, err := tx.Exec(migration.SQL); err != nil {
+				tx.Rollback()
 				return fmt.Errorf("failed to run migration %d (%s): %v", migration.Version, migration.Name, err)
 			}
 
-			// Record migration
-			if _, err := db.Exec("INSERT INTO migrations (version, name) VALUES (?, ?)", migration.Version, migration.Name); err != nil {
+			if migration.Migrate != nil {
+				if err := migration.Migrate(tx, dialect); err != nil {
+					tx.Rollback()
+					return fmt.Errorf("failed to migrate data for migration %d (%s): %v", migration.Version, migration.Name, err)
+				}
+			}
+
+			if _, err := tx.Exec(dialect.rebind("INSERT INTO migrations (version, name) VALUES (?, ?)"), migration.Version, migration.Name); err != nil {
+				tx.Rollback()
 				return fmt.Errorf("failed to record migration %d: %v", migration.Version, err)
 			}
 
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("failed to commit migration %d: %v", migration.Version, err)
+			}
+
 			fmt.Printf("Migration %d completed successfully\n", migration.Version)
 		}
 	}
@@ -760,22 +1137,9 @@ func createBackup() error {
 	timestamp := time.Now().Format("20060102_150405")
 	backupPath := filepath.Join(backupDir, fmt.Sprintf("journal_backup_%s.db", timestamp))
 
-	// Open source database file
-	sourceFile, err := os.Open("./journal.db")
-	if err != nil {
-		return fmt.Errorf("failed to open source database: %v", err)
-	}
-	defer sourceFile.Close()
-
-	// Create backup file
-	backupFile, err := os.Create(backupPath)
-	if err != nil {
-		return fmt.Errorf("failed to create backup file: %v", err)
-	}
-	defer backupFile.Close()
-
-	// Copy database file
-	if _, err := io.Copy(backupFile, sourceFile); err != nil {
+	// Snapshot the database through SQLite. Copying the file directly would
+	// miss pages still in the WAL and can tear under concurrent writes.
+	if _, err := db.Exec("VACUUM INTO ?", backupPath); err != nil {
 		return fmt.Errorf("failed to copy database: %v", err)
 	}
 
@@ -854,26 +1218,30 @@ func scheduleBackups() {
 
 // Initialize database
 func initDB() {
+	storageConfig = loadStorageConfig()
+
+	// Open database and run migrations
 	var err error
-	db, err = sql.Open("sqlite3", "./journal.db")
+	db, store, err = openStore(storageConfig)
 	if err != nil {
-		log.Fatal("Failed to open database:", err)
+		log.Fatal("Failed to initialize database:", err)
 	}
 
-	// Run migrations
-	if err := runMigrations(); err != nil {
-		log.Fatal("Failed to run migrations:", err)
-	}
+	// Before the first backup, so it holds no content left unencrypted
+	initEncryption()
 
-	// Create initial backup
-	if err := createBackup(); err != nil {
-		log.Printf("Warning: Failed to create initial backup: %v", err)
-	}
+	// File backups only apply to SQLite; Postgres is backed up by its host
+	if store.Driver == sqliteDialect.name {
+		// Create initial backup
+		if err := createBackup(); err != nil {
+			log.Printf("Warning: Failed to create initial backup: %v", err)
+		}
 
-	// Schedule automatic backups
-	scheduleBackups()
+		// Schedule automatic backups
+		scheduleBackups()
+	}
 
-	fmt.Println("Database initialized successfully")
+	fmt.Printf("Database initialized successfully (%s)\n", store.Driver)
 }
 
 // Hash password
@@ -944,9 +1312,18 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	timezone := defaultTimezone
+	if req.Timezone != "" {
+		tz, err := normalizeTimezone(req.Timezone)
+		if err != nil {
+			http.Error(w, "Invalid timezone", http.StatusBadRequest)
+			return
+		}
+		timezone = tz
+	}
+
 	// Check if user already exists
-	var existingID int
-	err := db.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&existingID)
+	_, _, err := store.Users.GetByEmail(req.Email)
 	if err == nil {
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
@@ -960,26 +1337,14 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Insert user
-	result, err := db.Exec("INSERT INTO users (name, email, password) VALUES (?, ?, ?)",
-		req.Name, req.Email, hashedPassword)
+	user, err := store.Users.Create(req.Name, req.Email, hashedPassword, timezone)
 	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
 
-	userID, _ := result.LastInsertId()
-
-	// Get the created user with created_at timestamp
-	var user User
-	err = db.QueryRow("SELECT id, name, email, created_at FROM users WHERE id = ?", userID).
-		Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt)
-	if err != nil {
-		http.Error(w, "Failed to retrieve created user", http.StatusInternalServerError)
-		return
-	}
-
 	// Generate token
-	token, err := generateToken(int(userID), req.Email)
+	token, err := generateToken(user.ID, req.Email)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
@@ -987,7 +1352,7 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 
 	response := AuthResponse{
 		Token: token,
-		User:  user,
+		User:  *user,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1002,10 +1367,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user from database - now including created_at
-	var user User
-	var hashedPassword string
-	err := db.QueryRow("SELECT id, name, email, password, created_at FROM users WHERE email = ?", req.Email).
-		Scan(&user.ID, &user.Name, &user.Email, &hashedPassword, &user.CreatedAt)
+	user, hashedPassword, err := store.Users.GetByEmail(req.Email)
 	if err != nil {
 		http.Error(w, "No such user found, Please sign up!", http.StatusUnauthorized)
 		return
@@ -1026,7 +1388,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	response := AuthResponse{
 		Token: token,
-		User:  user,
+		User:  *user,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1037,31 +1399,30 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 func getEntriesHandler(w http.ResponseWriter, r *http.Request) {
 	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
 
-	// Updated query to include created_at
-	rows, err := db.Query("SELECT id, title, text, date, created_at FROM entries WHERE user_id = ? ORDER BY created_at DESC", userID)
+	filter, err := parseEntryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := store.Entries.ListByUser(userID, filter)
 	if err != nil {
 		http.Error(w, "Failed to fetch entries", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var entries []Entry
-	for rows.Next() {
-		var entry Entry
-		// Updated scan to include created_at
-		err := rows.Scan(&entry.ID, &entry.Title, &entry.Text, &entry.Date, &entry.CreatedAt)
-		if err != nil {
-			http.Error(w, "Failed to scan entry", http.StatusInternalServerError)
-			return
-		}
-		entry.UserID = userID
+	entryTags, err := store.Tags.ListForUserEntries(userID)
+	if err != nil {
+		log.Printf("Failed to load tags for user %d: %v", userID, err)
+	}
+
+	for i := range entries {
+		entries[i].Tags = entryTags[entries[i].ID]
 
 		// Try to get mood analysis for this entry
-		if moodAnalysis, err := getMoodAnalysis(entry.ID); err == nil {
-			entry.MoodAnalysis = moodAnalysis
+		if moodAnalysis, err := getMoodAnalysis(entries[i].ID); err == nil {
+			entries[i].MoodAnalysis = moodAnalysis
 		}
-
-		entries = append(entries, entry)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1083,35 +1444,41 @@ func createEntryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set date if not provided
-	if entry.Date == "" {
-		entry.Date = time.Now().Format("1/2/2006") // MM/DD/YYYY format to match frontend
+	// Date defaults to today in the user's timezone
+	if err := resolveEntryDate(userID, &entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Insert entry
-	result, err := db.Exec("INSERT INTO entries (user_id, title, text, date) VALUES (?, ?, ?, ?)",
-		userID, entry.Title, entry.Text, entry.Date)
-	if err != nil {
-		http.Error(w, "Failed to create entry", http.StatusInternalServerError)
+	if !ownsNotebook(userID, entry.NotebookID) {
+		http.Error(w, "Notebook not found", http.StatusBadRequest)
 		return
 	}
 
-	entryID, _ := result.LastInsertId()
-
-	// Get the created entry with created_at timestamp
-	err = db.QueryRow("SELECT id, title, text, date, created_at FROM entries WHERE id = ?", entryID).
-		Scan(&entry.ID, &entry.Title, &entry.Text, &entry.Date, &entry.CreatedAt)
-	if err != nil {
-		http.Error(w, "Failed to retrieve created entry", http.StatusInternalServerError)
+	// Insert entry, with its tags if any
+	entry.UserID = userID
+	if entry.Tags != nil {
+		entry.Tags = normalizeTagNames(entry.Tags)
+	}
+	if err := store.Entries.Create(&entry); err != nil {
+		http.Error(w, "Failed to create entry", http.StatusInternalServerError)
 		return
 	}
-	entry.UserID = userID
+	entryID := entry.ID
 
-	// Perform mood analysis in background
+	// Perform mood analysis in background, if the user wants it
 	go func() {
-		combinedText := entry.Title + " " + entry.Text
-		if moodResult, err := performMoodAnalysis(combinedText); err == nil {
-			if err := saveMoodAnalysis(int(entryID), moodResult); err != nil {
+		ctx, cancel := backgroundAnalysisContext(userID)
+		defer cancel()
+		if !privacyFrom(ctx).MoodAnalysis {
+			return
+		}
+
+		combinedText := entryAnalysisText(entry)
+		if moodResult, err := performMoodAnalysis(ctx, userID, combinedText); err == nil {
+			moodResult.EntryRevision = entry.Revision
+			moodResult.Sentences = scoreSentences(ctx, userID, entry.Text, moodResult.Language)
+			if err := saveMoodAnalysis(userID, entryID, moodResult); err != nil {
 				log.Printf("Failed to save mood analysis for entry %d: %v", entryID, err)
 			} else {
 				log.Printf("Mood analysis completed for entry %d", entryID)
@@ -1139,9 +1506,11 @@ func preprocessText(text string) string {
 	var cleanWords []string
 
 	for _, word := range words {
-		// Remove punctuation
-		word = strings.Trim(word, ".,!?;:\"'()[]{}...")
-		if len(word) > 2 { // Keep words longer than 2 characters
+		// Remove punctuation, in any script (¿, «, 。 and so on)
+		word = strings.TrimFunc(word, func(r rune) bool {
+			return unicode.IsPunct(r) || unicode.IsSymbol(r)
+		})
+		if utf8.RuneCountInString(word) > 2 { // Keep words longer than 2 characters
 			cleanWords = append(cleanWords, word)
 		}
 	}
@@ -1195,10 +1564,12 @@ func generateSimpleEmbedding(text string) []float64 {
 }
 
 // Generate embedding using Hugging Face sentence-transformers
-func generateEmbedding(text string) ([]float64, error) {
-	model := "BAAI/bge-small-en-v1.5"
+func generateEmbedding(ctx context.Context, text string) ([]float64, error) {
+	if privacyFrom(ctx).localOnly() {
+		return generateSimpleEmbedding(text), nil
+	}
 
-	response, err := callHuggingFaceAPI(model, text)
+	response, err := callHuggingFaceAPI(ctx, embeddingModel, "embedding", text)
 	if err != nil {
 		// Fallback to simple embedding
 		log.Printf("Hugging Face embedding failed, using fallback: %v", err)
@@ -1244,89 +1615,28 @@ func cosineSimilarity(a, b []float64) float64 {
 
 // Save entry embedding to database
 func saveEntryEmbedding(entryID, userID int, text string, embedding []float64) error {
-	textHash := generateTextHash(text)
-	embeddingJSON, err := json.Marshal(embedding)
-	if err != nil {
-		return err
-	}
-
-	// Check if embedding already exists
-	var existingID int
-	err = db.QueryRow("SELECT id FROM entry_embeddings WHERE entry_id = ?", entryID).Scan(&existingID)
-
-	if err == sql.ErrNoRows {
-		// Insert new embedding
-		_, err = db.Exec(`
-			INSERT INTO entry_embeddings (entry_id, user_id, embedding, text_hash)
-			VALUES (?, ?, ?, ?)`,
-			entryID, userID, string(embeddingJSON), textHash)
-	} else if err == nil {
-		// Update existing embedding
-		_, err = db.Exec(`
-			UPDATE entry_embeddings SET embedding = ?, text_hash = ?
-			WHERE id = ?`,
-			string(embeddingJSON), textHash, existingID)
-	}
-
-	return err
+	return store.Embeddings.Save(entryID, userID, embedding, generateTextHash(text))
 }
 
 // Find similar entries using vector similarity
 func findSimilarEntries(userID int, queryEmbedding []float64, limit int) ([]SimilarEntry, error) {
-	rows, err := db.Query(`
-		SELECT ee.entry_id, ee.embedding, e.title, e.text, e.date, e.created_at
-		FROM entry_embeddings ee
-		JOIN entries e ON ee.entry_id = e.id
-		WHERE ee.user_id = ?
-		ORDER BY e.created_at DESC`,
-		userID)
+	candidates, err := store.Embeddings.FindSimilar(userID, queryEmbedding, limit)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var candidates []SimilarEntry
-
-	for rows.Next() {
-		var entryID int
-		var embeddingJSON string
-		var entry Entry
-
-		err := rows.Scan(&entryID, &embeddingJSON, &entry.Title, &entry.Text, &entry.Date, &entry.CreatedAt)
-		if err != nil {
-			continue
-		}
-
-		// Parse embedding
-		var embedding []float64
-		if err := json.Unmarshal([]byte(embeddingJSON), &embedding); err != nil {
-			continue
-		}
-
-		// Calculate similarity
-		similarity := cosineSimilarity(queryEmbedding, embedding)
-
-		entry.ID = entryID
-		entry.UserID = userID
 
+	for i := range candidates {
 		// Get mood analysis if available
-		moodAnalysis, _ := getMoodAnalysis(entryID)
-
-		candidates = append(candidates, SimilarEntry{
-			Entry:      entry,
-			Similarity: similarity,
-			MoodResult: moodAnalysis,
-		})
-	}
-
-	// Sort by similarity (descending)
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].Similarity > candidates[j].Similarity
-	})
-
-	// Return top results
-	if len(candidates) > limit {
-		candidates = candidates[:limit]
+		candidates[i].MoodResult, _ = getMoodAnalysis(candidates[i].Entry.ID)
+
+		// Cut out the chunk that matched. Offsets saved before an edit that
+		// hasn't been re-embedded yet may not fit, so check them.
+		c := &candidates[i]
+		text := entryAnalysisText(c.Entry)
+		if c.passageEnd > c.passageStart && c.passageEnd <= len(text) &&
+			utf8.ValidString(text[c.passageStart:c.passageEnd]) {
+			c.Passage = text[c.passageStart:c.passageEnd]
+		}
 	}
 
 	return candidates, nil
@@ -1335,17 +1645,10 @@ func findSimilarEntries(userID int, queryEmbedding []float64, limit int) ([]Simi
 // Analyze user patterns from historical data
 func analyzeUserPatterns(userID int) (*UserPatterns, error) {
 	// Get user's mood analysis history
-	rows, err := db.Query(`
-		SELECT ma.overall_sentiment, ma.sentiment_score, ma.emotions, ma.analyzed_at
-		FROM mood_analysis ma
-		JOIN entries e ON ma.entry_id = e.id
-		WHERE e.user_id = ?
-		ORDER BY ma.analyzed_at DESC
-		LIMIT 50`, userID)
+	history, err := store.MoodAnalyses.ListRecentByUser(userID, 50)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
 	var patterns UserPatterns
 	emotionFreq := make(map[string]int)
@@ -1353,28 +1656,15 @@ func analyzeUserPatterns(userID int) (*UserPatterns, error) {
 	var totalScore float64
 	var count int
 
-	for rows.Next() {
-		var sentiment string
-		var score float64
-		var emotionsJSON string
-		var analyzedAt time.Time
-
-		if err := rows.Scan(&sentiment, &score, &emotionsJSON, &analyzedAt); err != nil {
-			continue
-		}
-
+	for _, analysis := range history {
 		// Count sentiments
-		sentimentCounts[sentiment]++
-		totalScore += score
+		sentimentCounts[analysis.OverallSentiment]++
+		totalScore += analysis.SentimentScore
 		count++
 
-		// Parse emotions
-		var emotions []EmotionResult
-		if err := json.Unmarshal([]byte(emotionsJSON), &emotions); err == nil {
-			for _, emotion := range emotions {
-				if emotion.Score > 0.3 { // Only count significant emotions
-					emotionFreq[emotion.Label]++
-				}
+		for _, emotion := range analysis.Emotions {
+			if emotion.Score > 0.3 { // Only count significant emotions
+				emotionFreq[emotion.Label]++
 			}
 		}
 	}
@@ -1402,26 +1692,62 @@ func analyzeUserPatterns(userID int) (*UserPatterns, error) {
 		})
 	}
 
-	// Build coping strategies based on patterns
-	patterns.CopingStrategies = generateCopingStrategies(patterns.CommonEmotions)
+	patterns.SentimentTrends = recentSentimentTrends(userID, 8)
+
+	if triggers, err := detectTriggerKeywords(userID, 5); err == nil {
+		patterns.TriggerKeywords = triggerTerms(triggers.Negative)
+		patterns.PositiveKeywords = triggerTerms(triggers.Positive)
+	} else {
+		log.Printf("Failed to detect trigger keywords for user %d: %v", userID, err)
+	}
+
+	// Build coping strategies based on patterns, ranked by how well they
+	// have worked for the user
+	patterns.suggestionStats = loadSuggestionStats(userID)
+	patterns.CopingStrategies = generateCopingStrategies(patterns.CommonEmotions, patterns.suggestionStats)
 
 	return &patterns, nil
 }
 
-// Generate personalized coping strategies
-func generateCopingStrategies(commonEmotions []EmotionResult) []string {
+// Candidate coping strategies for each emotion
+var copingStrategiesByEmotion = map[string][]string{
+	"fear": {
+		"Practice deep breathing exercises when feeling anxious",
+		"Write down what you're worried about and one small step you can take on it",
+	},
+	"sadness": {
+		"Engage in activities that bring you joy, like listening to music",
+		"Reach out to a friend or someone you trust and share how you feel",
+	},
+	"anger": {
+		"Try physical exercise or journaling to release tension",
+		"Step away for a few minutes and come back when you feel calmer",
+	},
+	"joy": {
+		"Continue doing activities that bring you happiness",
+		"Note what made today good so you can come back to it",
+	},
+}
+
+// Generate personalized coping strategies for the user's common emotions,
+// ranked by how well each has worked for them
+func generateCopingStrategies(commonEmotions []EmotionResult, stats map[string]SuggestionStats) []string {
 	strategies := []string{}
+	seen := make(map[string]bool)
 
 	for _, emotion := range commonEmotions {
-		switch strings.ToLower(emotion.Label) {
-		case "anxiety", "fear":
-			strategies = append(strategies, "Practice deep breathing exercises when feeling anxious")
-		case "sadness":
-			strategies = append(strategies, "Engage in activities that bring you joy, like listening to music")
-		case "anger":
-			strategies = append(strategies, "Try physical exercise or journaling to release tension")
-		case "joy", "happiness":
-			strategies = append(strategies, "Continue doing activities that bring you happiness")
+		label := strings.ToLower(emotion.Label)
+		switch label {
+		case "anxiety":
+			label = "fear"
+		case "happiness":
+			label = "joy"
+		}
+		for _, strategy := range copingStrategiesByEmotion[label] {
+			if !seen[strategy] {
+				seen[strategy] = true
+				strategies = append(strategies, strategy)
+			}
 		}
 	}
 
@@ -1429,17 +1755,26 @@ func generateCopingStrategies(commonEmotions []EmotionResult) []string {
 		strategies = append(strategies, "Practice mindfulness and self-reflection through journaling")
 	}
 
-	return strategies
+	return rankSuggestions(strategies, stats)
 }
 
 // Enhanced mood analysis with RAG context
-func performRAGMoodAnalysis(userID int, text string) (*MoodResult, error) {
+func performRAGMoodAnalysis(ctx context.Context, userID int, text string, tags []string) (*MoodResult, error) {
+	// Similar entries come from embeddings; without them this is the basic
+	// analysis
+	if !privacyFrom(ctx).Embeddings {
+		return performMoodAnalysis(ctx, userID, text)
+	}
+
+	// Screen for crisis language before anything else
+	risk := assessRisk(ctx, text)
+
 	// Generate embedding for current text
-	embedding, err := generateEmbedding(text)
+	embedding, _, err := embedChunks(ctx, text)
 	if err != nil {
 		log.Printf("Failed to generate embedding: %v", err)
 		// Fallback to original analysis
-		return performMoodAnalysis(text)
+		return performMoodAnalysis(ctx, userID, text)
 	}
 
 	// Find similar entries
@@ -1447,7 +1782,7 @@ func performRAGMoodAnalysis(userID int, text string) (*MoodResult, error) {
 	if err != nil {
 		log.Printf("Failed to find similar entries: %v", err)
 		// Fallback to original analysis
-		return performMoodAnalysis(text)
+		return performMoodAnalysis(ctx, userID, text)
 	}
 
 	// Analyze user patterns
@@ -1458,37 +1793,61 @@ func performRAGMoodAnalysis(userID int, text string) (*MoodResult, error) {
 	}
 
 	// Perform basic sentiment and emotion analysis
-	sentiment, score, err := analyzeSentiment(text)
+	sentiment, score, err := analyzeSentiment(ctx, text)
 	if err != nil {
 		log.Printf("Sentiment analysis failed: %v", err)
 		sentiment = "neutral"
 		score = 0
 	}
 
-	emotions, err := analyzeEmotions(text)
+	language := detectLanguage(text)
+	route := emotionRouteFor(language)
+	emotions, err := analyzeEmotions(ctx, route, text)
 	if err != nil {
 		log.Printf("Emotion analysis failed: %v", err)
 		emotions = []EmotionResult{}
 	}
 
-	// Generate enhanced summary with RAG context
-	summary := generateRAGMoodSummary(sentiment, emotions, similarEntries, patterns)
+	// Re-weight the models' output with the user's corrections
+	calibration := loadMoodCalibration(userID)
+	sentiment, score, emotions, modelOutput := calibration.apply(sentiment, score, emotions)
 
-	// Generate personalized suggestions
-	suggestions := generateRAGSuggestions(text, similarEntries, patterns)
+	// Generate enhanced summary with RAG context
+	summary := generateRAGMoodSummary(text, tags, sentiment, emotions, similarEntries, patterns)
+
+	// Generate personalized suggestions, or support resources for a flagged
+	// entry, which never goes to the generative model
+	var suggestions, promptID string
+	suggestionBy := templateSuggestion
+	var structured *StructuredSuggestion
+	if risk.Flagged() {
+		suggestions = safetySuggestion(risk.Level)
+	} else {
+		suggestions, suggestionBy, structured = generateRAGSuggestions(ctx, userID, text, risk, similarEntries, patterns)
+		if structured != nil {
+			promptID = structured.promptID
+		}
+	}
 
 	return &MoodResult{
+		Analyzer:         ragAnalyzer,
+		ModelVersion:     withPromptVersion(analysisVersion(ctx, calibration, route), promptID),
+		Language:         language,
+		RiskLevel:        risk.Level,
 		OverallSentiment: sentiment,
 		SentimentScore:   score,
 		Emotions:         emotions,
 		Summary:          summary,
 		Suggestions:      suggestions,
+		SuggestionBy:     suggestionBy,
+		Structured:       structured,
 		AnalyzedAt:       time.Now(),
+		ModelOutput:      modelOutput,
 	}, nil
 }
 
 // Generate enhanced mood summary with RAG context
-func generateRAGMoodSummary(sentiment string, emotions []EmotionResult, similarEntries []SimilarEntry, patterns *UserPatterns) string {
+func generateRAGMoodSummary(text string, tags []string, sentiment string, emotions []EmotionResult, similarEntries []SimilarEntry, patterns *UserPatterns) string {
 	var summary strings.Builder
 
 	summary.WriteString(fmt.Sprintf("Overall sentiment: %s. ", strings.Title(sentiment)))
@@ -1520,6 +1879,16 @@ func generateRAGMoodSummary(sentiment string, emotions []EmotionResult, similarE
 		}
 	}
 
+	// Point out words and tags that have tended to come with a mood shift
+	if triggers := matchTriggerKeywords(patterns.TriggerKeywords, text, tags); len(triggers) > 0 {
+		summary.WriteString(fmt.Sprintf("In past entries, %s has often come with lower mood for you. ",
+			strings.Join(triggers, ", ")))
+	}
+	if lifts := matchTriggerKeywords(patterns.PositiveKeywords, text, tags); len(lifts) > 0 {
+		summary.WriteString(fmt.Sprintf("In past entries, %s has often come with better mood for you. ",
+			strings.Join(lifts, ", ")))
+	}
+
 	// Add context from similar entries
 	if len(similarEntries) > 0 && similarEntries[0].Similarity > 0.7 {
 		summary.WriteString("This entry is similar to previous experiences you've written about. ")
@@ -1528,33 +1897,52 @@ func generateRAGMoodSummary(sentiment string, emotions []EmotionResult, similarE
 	return summary.String()
 }
 
-// Generate personalized suggestions using RAG
-func generateRAGSuggestions(text string, similarEntries []SimilarEntry, patterns *UserPatterns) string {
+// Generate personalized suggestions using RAG, with who wrote them (see
+// MoodResult.SuggestionBy). The structured form is returned when the
+// generative model wrote the suggestion.
+func generateRAGSuggestions(ctx context.Context, userID int, text string, risk RiskAssessment, similarEntries []SimilarEntry, patterns *UserPatterns) (string, string, *StructuredSuggestion) {
 	// 1. Try generating a fresh AI suggestion
-	if suggestion, err := generateAISuggestions(text); err == nil && suggestion != "" {
+	if structured, err := generateAISuggestions(ctx, userID, text); err == nil {
 		log.Printf("Generated fresh RAG suggestion")
-		return suggestion
+		return structured.Suggestion, withPromptVersion(generationModel, structured.promptID), structured
 	} else {
 		log.Printf("Failed to generate AI suggestion: %v", err)
 	}
 
-	// 2. Fallback: Check for any useful past suggestion in similar entries
+	// 2. Fallback: repeat the best past suggestion for a similar entry,
+	// but only one the user rated as having helped. A repeat keeps its
+	// author, and model-written ones are only repeated while the user
+	// allows generative suggestions.
+	var best *MoodResult
+	bestEffectiveness := unratedEffectiveness
 	for _, similar := range similarEntries {
-		if similar.Similarity > 0.6 && similar.MoodResult != nil && similar.MoodResult.Suggestions != "" {
-			return fmt.Sprintf("Previously, you found this helpful: %s", similar.MoodResult.Suggestions)
+		if similar.Similarity <= 0.6 || similar.MoodResult == nil || similar.MoodResult.Suggestions == "" {
+			continue
+		}
+		past := similar.MoodResult
+		if !privacyFrom(ctx).GenerativeSuggestions && suggestionGenerated(past.SuggestionBy, past.Suggestions, past.Structured != nil) {
+			continue
+		}
+		s, ok := patterns.suggestionStats[suggestionKey(past.Suggestions)]
+		if ok && s.Helped > 0 && s.Effectiveness > bestEffectiveness {
+			best = past
+			bestEffectiveness = s.Effectiveness
 		}
 	}
+	if best != nil {
+		return repeatedSuggestionPrefix + strings.TrimPrefix(best.Suggestions, repeatedSuggestionPrefix), best.SuggestionBy, nil
+	}
 
 	// 3. Fallback: Use first available coping strategy
 	if len(patterns.CopingStrategies) > 0 {
-		return patterns.CopingStrategies[0]
+		return patterns.CopingStrategies[0], templateSuggestion, nil
 	}
 
 	// 4. Final fallback
-	return generateContextAwareSuggestion(text, similarEntries)
+	return generateContextAwareSuggestion(risk, text, similarEntries), templateSuggestion, nil
 }
 
-func generateContextAwareSuggestion(text string, similarEntries []SimilarEntry) string {
+func generateContextAwareSuggestion(risk RiskAssessment, text string, similarEntries []SimilarEntry) string {
 	lowerText := strings.ToLower(text)
 
 	// Check for recurring themes in similar entries
@@ -1575,17 +1963,21 @@ func generateContextAwareSuggestion(text string, similarEntries []SimilarEntry)
 	}
 
 	// Default fallback
-	return generateFallbackSuggestion(text)
+	return generateFallbackSuggestion(risk, text)
 }
 
 func extractCommonThemes(entries []SimilarEntry) []string {
-	// Simple theme extraction based on common words
+	// Simple theme extraction based on common words, skipping each entry's
+	// language's stopwords
 	wordCount := make(map[string]int)
 
 	for _, entry := range entries {
-		words := strings.Fields(strings.ToLower(entry.Entry.Text))
-		for _, word := range words {
-			if len(word) > 4 && !isCommonWord(word) { // Skip short and common words
+		language := ""
+		if entry.MoodResult != nil {
+			language = entry.MoodResult.Language
+		}
+		for word := range contentTermsIn(entry.Entry.Text, language) {
+			if len([]rune(word)) > 4 { // Skip short words
 				wordCount[word]++
 			}
 		}
@@ -1599,16 +1991,15 @@ func extractCommonThemes(entries []SimilarEntry) []string {
 		}
 	}
 
-	return themes
-}
+	// Most frequent first, so callers can take the top few
+	sort.Slice(themes, func(i, j int) bool {
+		if wordCount[themes[i]] != wordCount[themes[j]] {
+			return wordCount[themes[i]] > wordCount[themes[j]]
+		}
+		return themes[i] < themes[j]
+	})
 
-func isCommonWord(word string) bool {
-	commonWords := map[string]bool{
-		"that": true, "this": true, "with": true, "have": true, "will": true,
-		"been": true, "were": true, "said": true, "each": true, "which": true,
-		"their": true, "time": true, "would": true, "there": true, "could": true,
-	}
-	return commonWords[word]
+	return themes
 }
 
 func updateEntryHandler(w http.ResponseWriter, r *http.Request) {
@@ -1627,54 +2018,95 @@ func updateEntryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if entry belongs to user
-	var ownerID int
-	err = db.QueryRow("SELECT user_id FROM entries WHERE id = ?", entryID).Scan(&ownerID)
+	existing, err := store.Entries.GetByID(entryID)
 	if err != nil {
 		http.Error(w, "Entry not found", http.StatusNotFound)
 		return
 	}
-	if ownerID != userID {
+	if existing.UserID != userID {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
-	// Update entry
-	_, err = db.Exec("UPDATE entries SET title = ?, text = ? WHERE id = ?",
-		entry.Title, entry.Text, entryID)
-	if err != nil {
-		http.Error(w, "Failed to update entry", http.StatusInternalServerError)
+	// notebook_id: omitted leaves it unchanged, 0 unfiles the entry
+	if entry.NotebookID != nil && *entry.NotebookID != 0 && !ownsNotebook(userID, entry.NotebookID) {
+		http.Error(w, "Notebook not found", http.StatusBadRequest)
 		return
 	}
 
-	// Get the updated entry with created_at timestamp
-	err = db.QueryRow("SELECT id, title, text, date, created_at FROM entries WHERE id = ?", entryID).
-		Scan(&entry.ID, &entry.Title, &entry.Text, &entry.Date, &entry.CreatedAt)
-	if err != nil {
-		http.Error(w, "Failed to retrieve updated entry", http.StatusInternalServerError)
-		return
+	// date: omitted leaves it unchanged; read in the entry's own timezone
+	if entry.Date != "" {
+		date, err := parseEntryDate(entry.Date, loadLocation(existing.Timezone))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		existing.Date = date
 	}
-	entry.UserID = userID
 
-	// Re-analyze mood in background
-	go func() {
-		combinedText := entry.Title + " " + entry.Text
-		if moodResult, err := performMoodAnalysis(combinedText); err == nil {
-			// Delete old analysis and save new one
-			db.Exec("DELETE FROM mood_analysis WHERE entry_id = ?", entryID)
-			if err := saveMoodAnalysis(entryID, moodResult); err != nil {
-				log.Printf("Failed to save updated mood analysis for entry %d: %v", entryID, err)
-			} else {
-				log.Printf("Mood analysis updated for entry %d", entryID)
-			}
-		} else {
-			log.Printf("Failed to perform mood analysis for updated entry %d: %v", entryID, err)
+	existing.Title = entry.Title
+	existing.Text = entry.Text
+	if entry.NotebookID != nil {
+		existing.NotebookID = entry.NotebookID
+		if *entry.NotebookID == 0 {
+			existing.NotebookID = nil
 		}
-	}()
+	}
+	// tags: omitted leaves them unchanged, [] clears them
+	if entry.Tags != nil {
+		existing.Tags = normalizeTagNames(entry.Tags)
+	}
+
+	// Content, notebook and tags are saved together or not at all
+	revision := existing.Revision
+	if err := store.Entries.Update(existing); err != nil {
+		http.Error(w, "Failed to update entry", http.StatusInternalServerError)
+		return
+	}
+	existing.Tags, _ = store.Tags.ListForEntry(entryID)
+
+	entry = *existing
+
+	// Re-analyze mood in background, unless only the date, notebook or tags
+	// changed
+	if entry.Revision != revision {
+		go reanalyzeEntry(entry)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(entry)
 }
 
+// Re-run mood analysis for an edited entry. The previous analysis is kept
+// as history and the new one becomes current. Only what the user's privacy
+// settings allow is run.
+func reanalyzeEntry(entry Entry) {
+	ctx, cancel := backgroundAnalysisContext(entry.UserID)
+	defer cancel()
+
+	// Keep the embeddings in step with the text, for retrieval
+	if _, err := embedEntry(ctx, entry); err != nil && err != errEmbeddingsDisabled {
+		log.Printf("Failed to update embedding for entry %d: %v", entry.ID, err)
+	}
+
+	if !privacyFrom(ctx).MoodAnalysis {
+		return
+	}
+
+	combinedText := entryAnalysisText(entry)
+	if moodResult, err := performMoodAnalysis(ctx, entry.UserID, combinedText); err == nil {
+		moodResult.EntryRevision = entry.Revision
+		moodResult.Sentences = scoreSentences(ctx, entry.UserID, entry.Text, moodResult.Language)
+		if err := saveMoodAnalysis(entry.UserID, entry.ID, moodResult); err != nil {
+			log.Printf("Failed to save updated mood analysis for entry %d: %v", entry.ID, err)
+		} else {
+			log.Printf("Mood analysis updated for entry %d", entry.ID)
+		}
+	} else {
+		log.Printf("Failed to perform mood analysis for updated entry %d: %v", entry.ID, err)
+	}
+}
+
 func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
 	vars := mux.Vars(r)
@@ -1685,20 +2117,18 @@ func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if entry belongs to user
-	var ownerID int
-	err = db.QueryRow("SELECT user_id FROM entries WHERE id = ?", entryID).Scan(&ownerID)
+	existing, err := store.Entries.GetByID(entryID)
 	if err != nil {
 		http.Error(w, "Entry not found", http.StatusNotFound)
 		return
 	}
-	if ownerID != userID {
+	if existing.UserID != userID {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
-	// Delete entry (mood analysis will be deleted due to CASCADE)
-	_, err = db.Exec("DELETE FROM entries WHERE id = ?", entryID)
-	if err != nil {
+	// Move entry to the trash; it is purged with its analyses later
+	if err := store.Entries.Delete(entryID); err != nil {
 		http.Error(w, "Failed to delete entry", http.StatusInternalServerError)
 		return
 	}
@@ -1717,13 +2147,12 @@ func getMoodAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if entry belongs to user
-	var ownerID int
-	err = db.QueryRow("SELECT user_id FROM entries WHERE id = ?", entryID).Scan(&ownerID)
+	existing, err := store.Entries.GetByID(entryID)
 	if err != nil {
 		http.Error(w, "Entry not found", http.StatusNotFound)
 		return
 	}
-	if ownerID != userID {
+	if existing.UserID != userID {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
@@ -1734,18 +2163,56 @@ func getMoodAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Mood analysis not found", http.StatusNotFound)
 		return
 	}
+	if correction, err := store.Corrections.GetByAnalysis(moodAnalysis.ID); err == nil {
+		moodAnalysis.Correction = correction
+	}
+	if feedback, err := store.SuggestionFeedback.GetByAnalysis(moodAnalysis.ID); err == nil {
+		moodAnalysis.Feedback = feedback
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(moodAnalysis)
 }
 
+// Get every mood analysis recorded for an entry, newest first
+func getMoodHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	vars := mux.Vars(r)
+	entryID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check if entry belongs to user
+	existing, err := store.Entries.GetByID(entryID)
+	if err != nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if existing.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	history, err := store.MoodAnalyses.ListByEntry(entryID)
+	if err != nil {
+		http.Error(w, "Failed to fetch mood history", http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []MoodResult{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
 // Get current user's profile
 func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
 
-	var user User
-	err := db.QueryRow("SELECT id, name, email, created_at FROM users WHERE id = ?", userID).
-		Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt)
+	user, err := store.Users.GetByID(userID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -1758,14 +2225,16 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user)
 }
 
-// Update username and/or password
+// Update username, timezone, external processing and/or password
 func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
 
 	type UpdateRequest struct {
-		Name            string `json:"name"`
-		CurrentPassword string `json:"currentPassword"`
-		NewPassword     string `json:"newPassword"`
+		Name               string `json:"name"`
+		CurrentPassword    string `json:"currentPassword"`
+		NewPassword        string `json:"newPassword"`
+		Timezone           string `json:"timezone"`
+		ExternalProcessing *bool  `json:"externalProcessing"`
 	}
 
 	var req UpdateRequest
@@ -1778,14 +2247,44 @@ func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Update name
 	if strings.TrimSpace(req.Name) != "" {
-		_, err := db.Exec("UPDATE users SET name = ? WHERE id = ?", req.Name, userID)
-		if err != nil {
+		if err := store.Users.UpdateName(userID, req.Name); err != nil {
 			http.Error(w, "Failed to update name", http.StatusInternalServerError)
 			return
 		}
 		updated = true
 	}
 
+	// Update timezone; existing entries keep the timezone they were written in
+	if req.Timezone != "" {
+		timezone, err := normalizeTimezone(req.Timezone)
+		if err != nil {
+			http.Error(w, "Invalid timezone", http.StatusBadRequest)
+			return
+		}
+		if err := store.Users.UpdateTimezone(userID, timezone); err != nil {
+			http.Error(w, "Failed to update timezone", http.StatusInternalServerError)
+			return
+		}
+		updated = true
+	}
+
+	// Allow or stop sending the user's text to external model providers;
+	// the other privacy settings are under /api/user/privacy
+	if req.ExternalProcessing != nil {
+		user, err := store.Users.GetByID(userID)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		settings := user.PrivacySettings
+		settings.ExternalProcessing = *req.ExternalProcessing
+		if err := store.Users.UpdatePrivacy(userID, settings); err != nil {
+			http.Error(w, "Failed to update external processing", http.StatusInternalServerError)
+			return
+		}
+		updated = true
+	}
+
 	// Update password
 	if strings.TrimSpace(req.NewPassword) != "" {
 		if strings.TrimSpace(req.CurrentPassword) == "" {
@@ -1794,8 +2293,7 @@ func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Fetch hashed password from DB
-		var storedHashed string
-		err := db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&storedHashed)
+		storedHashed, err := store.Users.GetPasswordHash(userID)
 		if err != nil {
 			http.Error(w, "Failed to verify current password", http.StatusInternalServerError)
 			return
@@ -1814,8 +2312,7 @@ func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, err = db.Exec("UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID)
-		if err != nil {
+		if err := store.Users.UpdatePassword(userID, hashedPassword); err != nil {
 			http.Error(w, "Failed to update password", http.StatusInternalServerError)
 			return
 		}
@@ -1846,44 +2343,50 @@ func createEntryHandlerWithRAG(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set date if not provided
-	if entry.Date == "" {
-		entry.Date = time.Now().Format("1/2/2006")
+	// Date defaults to today in the user's timezone
+	if err := resolveEntryDate(userID, &entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Insert entry
-	result, err := db.Exec("INSERT INTO entries (user_id, title, text, date) VALUES (?, ?, ?, ?)",
-		userID, entry.Title, entry.Text, entry.Date)
-	if err != nil {
-		http.Error(w, "Failed to create entry", http.StatusInternalServerError)
+	if !ownsNotebook(userID, entry.NotebookID) {
+		http.Error(w, "Notebook not found", http.StatusBadRequest)
 		return
 	}
 
-	entryID, _ := result.LastInsertId()
-
-	// Get the created entry with created_at timestamp
-	err = db.QueryRow("SELECT id, title, text, date, created_at FROM entries WHERE id = ?", entryID).
-		Scan(&entry.ID, &entry.Title, &entry.Text, &entry.Date, &entry.CreatedAt)
-	if err != nil {
-		http.Error(w, "Failed to retrieve created entry", http.StatusInternalServerError)
+	// Insert entry, with its tags if any
+	entry.UserID = userID
+	if entry.Tags != nil {
+		entry.Tags = normalizeTagNames(entry.Tags)
+	}
+	if err := store.Entries.Create(&entry); err != nil {
+		http.Error(w, "Failed to create entry", http.StatusInternalServerError)
 		return
 	}
-	entry.UserID = userID
+	entryID := entry.ID
 
-	// Perform RAG-enhanced mood analysis in background
+	// Perform RAG-enhanced mood analysis in background, as far as the
+	// user's privacy settings allow
 	go func() {
-		combinedText := entry.Title + " " + entry.Text
+		ctx, cancel := backgroundAnalysisContext(userID)
+		defer cancel()
 
-		// Generate and save embedding
-		if embedding, err := generateEmbedding(combinedText); err == nil {
-			if err := saveEntryEmbedding(int(entryID), userID, combinedText, embedding); err != nil {
-				log.Printf("Failed to save embedding for entry %d: %v", entryID, err)
-			}
+		combinedText := entryAnalysisText(entry)
+
+		// Generate and save embeddings, whole and per chunk
+		if _, err := embedEntry(ctx, entry); err != nil && err != errEmbeddingsDisabled {
+			log.Printf("Failed to save embedding for entry %d: %v", entryID, err)
+		}
+
+		if !privacyFrom(ctx).MoodAnalysis {
+			return
 		}
 
 		// Perform RAG-enhanced mood analysis
-		if moodResult, err := performRAGMoodAnalysis(userID, combinedText); err == nil {
-			if err := saveMoodAnalysis(int(entryID), moodResult); err != nil {
+		if moodResult, err := performRAGMoodAnalysis(ctx, userID, combinedText, entry.Tags); err == nil {
+			moodResult.EntryRevision = entry.Revision
+			moodResult.Sentences = scoreSentences(ctx, userID, entry.Text, moodResult.Language)
+			if err := saveMoodAnalysis(userID, entryID, moodResult); err != nil {
 				log.Printf("Failed to save mood analysis for entry %d: %v", entryID, err)
 			} else {
 				log.Printf("RAG mood analysis completed for entry %d", entryID)
@@ -1898,11 +2401,61 @@ func createEntryHandlerWithRAG(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(entry)
 }
 
+// Listener for operational endpoints when OPS_ADDR is unset. Loopback only,
+// since they have no authentication.
+const defaultOpsAddr = "127.0.0.1:9090"
+
+// Serve the operational endpoints on OPS_ADDR until ctx ends. OPS_ADDR=off
+// turns them off.
+func startOpsServer(ctx context.Context) {
+	addr := os.Getenv("OPS_ADDR")
+	if addr == "" {
+		addr = defaultOpsAddr
+	}
+	if addr == "off" {
+		return
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/models/metrics", getModelMetricsHandler).Methods("GET")
+
+	server := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		fmt.Println("Ops server starting on", addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("Ops server stopped: %v", err)
+		}
+	}()
+}
+
 func main() {
+	// Key management runs instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeyTool(os.Args[2:]))
+	}
+
+	// Stop background jobs and drain requests on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	appContext = ctx
+
 	// Initialize database
 	initDB()
 	defer db.Close()
 
+	// Permanently remove entries that have been in the trash too long
+	scheduleTrashPurge()
+
+	// Write weekly and monthly digests as each user's periods end
+	scheduleDigests()
+
+	// Keep the model output cache within its TTL and size limits
+	scheduleModelCachePrune()
+
 	// Check if Hugging Face API key is provided
 	r := mux.NewRouter()
 
@@ -1914,13 +2467,70 @@ func main() {
 	r.HandleFunc("/api/entries", authenticateToken(getEntriesHandler)).Methods("GET")
 	// r.HandleFunc("/api/entries", authenticateToken(createEntryHandler)).Methods("POST")
 	r.HandleFunc("/api/entries", authenticateToken(createEntryHandlerWithRAG)).Methods("POST")
+	r.HandleFunc("/api/entries/trash", authenticateToken(listTrashHandler)).Methods("GET")
 	r.HandleFunc("/api/entries/{id}", authenticateToken(updateEntryHandler)).Methods("PUT")
 	r.HandleFunc("/api/entries/{id}", authenticateToken(deleteEntryHandler)).Methods("DELETE")
+	r.HandleFunc("/api/entries/{id}/restore", authenticateToken(restoreEntryHandler)).Methods("POST")
 	r.HandleFunc("/api/entries/{id}/mood", authenticateToken(getMoodAnalysisHandler)).Methods("GET")
+	r.HandleFunc("/api/entries/{id}/mood/history", authenticateToken(getMoodHistoryHandler)).Methods("GET")
+	r.HandleFunc("/api/entries/{id}/mood/spans", authenticateToken(getMoodSpansHandler)).Methods("GET")
+	r.HandleFunc("/api/entries/{id}/mood/correction", authenticateToken(correctMoodAnalysisHandler)).Methods("PUT")
+	r.HandleFunc("/api/entries/{id}/mood/feedback", authenticateToken(rateSuggestionHandler)).Methods("PUT")
+	r.HandleFunc("/api/entries/{id}/revisions", authenticateToken(listRevisionsHandler)).Methods("GET")
+	r.HandleFunc("/api/entries/{id}/revisions/diff", authenticateToken(diffRevisionsHandler)).Methods("GET")
+	r.HandleFunc("/api/entries/{id}/revisions/{revision}/restore", authenticateToken(restoreRevisionHandler)).Methods("POST")
+
+	// Organization routes
+	r.HandleFunc("/api/notebooks", authenticateToken(listNotebooksHandler)).Methods("GET")
+	r.HandleFunc("/api/notebooks", authenticateToken(createNotebookHandler)).Methods("POST")
+	r.HandleFunc("/api/notebooks/{id}", authenticateToken(renameNotebookHandler)).Methods("PUT")
+	r.HandleFunc("/api/notebooks/{id}", authenticateToken(deleteNotebookHandler)).Methods("DELETE")
+	r.HandleFunc("/api/tags", authenticateToken(listTagsHandler)).Methods("GET")
+	r.HandleFunc("/api/tags", authenticateToken(createTagHandler)).Methods("POST")
+	r.HandleFunc("/api/tags/autocomplete", authenticateToken(autocompleteTagsHandler)).Methods("GET")
+	r.HandleFunc("/api/tags/{id}", authenticateToken(renameTagHandler)).Methods("PUT")
+	r.HandleFunc("/api/tags/{id}", authenticateToken(deleteTagHandler)).Methods("DELETE")
+	r.HandleFunc("/api/tags/{id}/merge", authenticateToken(mergeTagHandler)).Methods("POST")
+
+	// Insight routes
+	r.HandleFunc("/api/insights/trends", authenticateToken(getTrendsHandler)).Methods("GET")
+	r.HandleFunc("/api/insights/triggers", authenticateToken(getTriggersHandler)).Methods("GET")
+	r.HandleFunc("/api/digests", authenticateToken(listDigestsHandler)).Methods("GET")
+
+	// Calibration routes
+	r.HandleFunc("/api/corrections", authenticateToken(listCorrectionsHandler)).Methods("GET")
+	r.HandleFunc("/api/corrections/export", authenticateToken(exportCorrectionsHandler)).Methods("GET")
+	r.HandleFunc("/api/corrections/{id}", authenticateToken(deleteCorrectionHandler)).Methods("DELETE")
+	r.HandleFunc("/api/calibration", authenticateToken(getCalibrationHandler)).Methods("GET")
+
+	// Suggestion feedback routes
+	r.HandleFunc("/api/suggestions/feedback", authenticateToken(listSuggestionFeedbackHandler)).Methods("GET")
+	r.HandleFunc("/api/suggestions/feedback/{id}", authenticateToken(deleteSuggestionFeedbackHandler)).Methods("DELETE")
+	r.HandleFunc("/api/suggestions/effectiveness", authenticateToken(getSuggestionEffectivenessHandler)).Methods("GET")
+
+	// Check-in routes
+	r.HandleFunc("/api/checkins", authenticateToken(listCheckInsHandler)).Methods("GET")
+	r.HandleFunc("/api/checkins", authenticateToken(createCheckInHandler)).Methods("POST")
+	r.HandleFunc("/api/checkins/{id}", authenticateToken(updateCheckInHandler)).Methods("PUT")
+	r.HandleFunc("/api/checkins/{id}", authenticateToken(deleteCheckInHandler)).Methods("DELETE")
+
+	// Safety routes
+	r.HandleFunc("/api/safety/resources", authenticateToken(getSafetyResourcesHandler)).Methods("GET")
+
+	// Prompt routes
+	r.HandleFunc("/api/prompts", authenticateToken(listPromptsHandler)).Methods("GET")
+
+	// Chat routes
+	r.HandleFunc("/api/chat", authenticateToken(chatHandler)).Methods("POST")
+	r.HandleFunc("/api/chat/conversations", authenticateToken(listConversationsHandler)).Methods("GET")
+	r.HandleFunc("/api/chat/conversations/{id}", authenticateToken(getConversationHandler)).Methods("GET")
+	r.HandleFunc("/api/chat/conversations/{id}", authenticateToken(deleteConversationHandler)).Methods("DELETE")
 
 	// User profile routes
 	r.HandleFunc("/api/user/profile", authenticateToken(getUserProfileHandler)).Methods("GET")
 	r.HandleFunc("/api/user/profile", authenticateToken(updateUserProfileHandler)).Methods("PUT")
+	r.HandleFunc("/api/user/privacy", authenticateToken(getPrivacySettingsHandler)).Methods("GET")
+	r.HandleFunc("/api/user/privacy", authenticateToken(updatePrivacySettingsHandler)).Methods("PUT")
 	// Setup CORS
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:5173"}, // Add your frontend URLs
@@ -1932,6 +2542,23 @@ func main() {
 
 	handler := c.Handler(r)
 
+	server := &http.Server{Addr: ":8080", Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+	}()
+
+	// Provider metrics cover every user's traffic, so they are served
+	// apart from the API
+	startOpsServer(ctx)
+
 	fmt.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
 }
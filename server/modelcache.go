@@ -0,0 +1,146 @@
+// modelcache.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Model outputs are cached by (user, model, task, hash of the request), so
+// an unchanged entry or a retried analysis never calls the API again. They
+// are kept per user so they can be deleted with the user's other data.
+const (
+	defaultModelCacheTTL        = 30 * 24 * time.Hour
+	defaultModelCacheMaxEntries = 50000
+	defaultModelCacheMaxMB      = 200
+)
+
+// How often expired and excess outputs are pruned
+const modelCachePruneInterval = time.Hour
+
+type ModelCacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+}
+
+type modelCacheConfig struct {
+	TTL        time.Duration // 0 disables the cache
+	MaxEntries int
+	MaxBytes   int64
+}
+
+var (
+	modelCacheOnce   sync.Once
+	modelCacheLimits modelCacheConfig
+)
+
+// Limits from MODEL_CACHE_TTL, MODEL_CACHE_MAX_ENTRIES and
+// MODEL_CACHE_MAX_MB, falling back to the defaults
+func modelCacheSettings() modelCacheConfig {
+	modelCacheOnce.Do(func() {
+		cfg := modelCacheConfig{
+			TTL:        defaultModelCacheTTL,
+			MaxEntries: defaultModelCacheMaxEntries,
+			MaxBytes:   defaultModelCacheMaxMB << 20,
+		}
+
+		if v := os.Getenv("MODEL_CACHE_TTL"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+				cfg.TTL = d
+			} else {
+				log.Printf("Invalid MODEL_CACHE_TTL %q, using %s", v, defaultModelCacheTTL)
+			}
+		}
+		if v := os.Getenv("MODEL_CACHE_MAX_ENTRIES"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				cfg.MaxEntries = n
+			} else {
+				log.Printf("Invalid MODEL_CACHE_MAX_ENTRIES %q, using %d", v, defaultModelCacheMaxEntries)
+			}
+		}
+		if v := os.Getenv("MODEL_CACHE_MAX_MB"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				cfg.MaxBytes = int64(n) << 20
+			} else {
+				log.Printf("Invalid MODEL_CACHE_MAX_MB %q, using %d", v, defaultModelCacheMaxMB)
+			}
+		}
+
+		modelCacheLimits = cfg
+	})
+	return modelCacheLimits
+}
+
+// Hash of the exact request body. Unlike generateTextHash it doesn't
+// normalise the text first: case and punctuation can change a model's
+// output, and generation parameters are part of the request.
+func modelRequestHash(payload []byte) string {
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// Return the cached output for this request, or make the call and cache
+// what it returns. Only successful calls are cached; call should return an
+// error for any output that shouldn't be reused.
+func cachedModelCall(ctx context.Context, model, task string, payload []byte, call func() ([]byte, error)) ([]byte, error) {
+	cfg := modelCacheSettings()
+	if cfg.TTL <= 0 || store == nil {
+		return call()
+	}
+
+	userID := modelUserID(ctx)
+	hash := modelRequestHash(payload)
+	now := time.Now().UTC()
+	output, err := store.ModelCache.Get(userID, model, task, hash, now)
+	if err == nil {
+		return output, nil
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("Model cache lookup failed: %v", err)
+	}
+
+	output, err = call()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.ModelCache.Put(userID, model, task, hash, output, now.Add(cfg.TTL)); err != nil {
+		log.Printf("Failed to cache %s output: %v", task, err)
+	}
+	return output, nil
+}
+
+// Drop expired outputs and evict the least recently used beyond the limits
+func pruneModelCache() {
+	cfg := modelCacheSettings()
+	pruned, err := store.ModelCache.Prune(time.Now().UTC(), cfg.MaxEntries, cfg.MaxBytes)
+	if err != nil {
+		log.Printf("Model cache prune failed: %v", err)
+		return
+	}
+	if pruned > 0 {
+		if stats, err := store.ModelCache.Stats(); err == nil {
+			log.Printf("Pruned %d model outputs from cache (%d left, %d bytes, %d hits)",
+				pruned, stats.Entries, stats.Bytes, stats.Hits)
+		}
+	}
+}
+
+// Schedule the cache prune, running once at startup
+func scheduleModelCachePrune() {
+	pruneModelCache()
+
+	ticker := time.NewTicker(modelCachePruneInterval)
+	go func() {
+		for range ticker.C {
+			pruneModelCache()
+		}
+	}()
+}
@@ -0,0 +1,455 @@
+// modelclient.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retry and concurrency defaults for model provider calls
+const (
+	defaultModelMaxAttempts    = 3
+	defaultModelMaxConcurrency = 4 // in-flight requests per model
+	retryBaseDelay             = 500 * time.Millisecond
+	retryMaxDelay              = 30 * time.Second
+)
+
+// A model's breaker opens after this many failed calls in a row and lets a
+// single trial call through once the cooldown has passed
+const (
+	breakerFailureThreshold = 5
+	breakerCooldown         = 30 * time.Second
+)
+
+// Per-attempt timeouts
+const (
+	modelRequestTimeout     = 30 * time.Second
+	generationTimeout       = 60 * time.Second
+	streamGenerationTimeout = 2 * time.Minute
+)
+
+// Returned without calling the provider while a model's breaker is open
+var errCircuitOpen = errors.New("model temporarily unavailable")
+
+// A non-200 response from the provider
+type modelAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *modelAPIError) Error() string {
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Rate limits, overload and "model loading" are worth retrying
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// Call counts and latency for one model
+type ModelMetrics struct {
+	Model            string     `json:"model"`
+	Requests         int64      `json:"requests"` // calls, each possibly several attempts
+	Successes        int64      `json:"successes"`
+	Failures         int64      `json:"failures"`
+	Rejected         int64      `json:"rejected"` // refused by the open breaker
+	Retries          int64      `json:"retries"`
+	InFlight         int        `json:"in_flight"`
+	ErrorRate        float64    `json:"error_rate"`         // failures / finished calls
+	AverageLatencyMs float64    `json:"average_latency_ms"` // per attempt
+	MaxLatencyMs     float64    `json:"max_latency_ms"`
+	BreakerState     string     `json:"breaker_state"`
+	LastError        string     `json:"last_error,omitempty"`
+	LastErrorAt      *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Shared state for one model: concurrency slots, breaker and metrics
+type modelState struct {
+	slots chan struct{}
+
+	mu sync.Mutex
+	// breaker
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probing             bool // a half-open trial call is in flight
+	// metrics
+	metrics        ModelMetrics
+	attempts       int64
+	totalLatencyMs float64
+}
+
+// Whether a call may go ahead, moving an open breaker to half-open once
+// its cooldown is over
+func (s *modelState) allow(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case breakerOpen:
+		if now.Sub(s.openedAt) < breakerCooldown {
+			s.metrics.Rejected++
+			return false
+		}
+		s.state = breakerHalfOpen
+		s.probing = true
+		return true
+	case breakerHalfOpen:
+		if s.probing {
+			s.metrics.Rejected++
+			return false
+		}
+		s.probing = true
+		return true
+	}
+	return true
+}
+
+func (s *modelState) recordAttempt(latency time.Duration) {
+	ms := float64(latency) / float64(time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	s.totalLatencyMs += ms
+	if ms > s.metrics.MaxLatencyMs {
+		s.metrics.MaxLatencyMs = ms
+	}
+}
+
+func (s *modelState) recordSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.Successes++
+	s.state = breakerClosed
+	s.consecutiveFailures = 0
+	s.probing = false
+}
+
+// Record a failed call. Only provider faults count towards the breaker;
+// a rejected request (4xx) says nothing about the model's health.
+func (s *modelState) recordFailure(err error, providerFault bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.Failures++
+	s.metrics.LastError = err.Error()
+	s.metrics.LastErrorAt = &now
+
+	if !providerFault {
+		if s.state == breakerHalfOpen {
+			s.probing = false
+		}
+		return
+	}
+	s.consecutiveFailures++
+	if s.state == breakerHalfOpen || s.consecutiveFailures >= breakerFailureThreshold {
+		if s.state != breakerOpen {
+			log.Printf("Opening circuit breaker for %s after %d failures: %v", s.metrics.Model, s.consecutiveFailures, err)
+		}
+		s.state = breakerOpen
+		s.openedAt = now
+		s.probing = false
+	}
+}
+
+// A call abandoned by its caller neither closes nor opens the breaker, but
+// frees the half-open trial for the next call
+func (s *modelState) recordCancelled() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == breakerHalfOpen {
+		s.probing = false
+	}
+}
+
+func (s *modelState) snapshot() ModelMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.metrics
+	m.BreakerState = s.state
+	m.InFlight = len(s.slots)
+	if finished := m.Successes + m.Failures; finished > 0 {
+		m.ErrorRate = float64(m.Failures) / float64(finished)
+	}
+	if s.attempts > 0 {
+		m.AverageLatencyMs = s.totalLatencyMs / float64(s.attempts)
+	}
+	return m
+}
+
+// HTTP client shared by every model provider call
+type modelClient struct {
+	http           *http.Client
+	baseURL        string
+	maxAttempts    int
+	maxConcurrency int
+
+	mu     sync.Mutex
+	models map[string]*modelState
+}
+
+var (
+	modelClientOnce sync.Once
+	sharedClient    *modelClient
+)
+
+// The shared client, configured from MODEL_MAX_ATTEMPTS and
+// MODEL_MAX_CONCURRENCY
+func hfClient() *modelClient {
+	modelClientOnce.Do(func() {
+		c := &modelClient{
+			// Timeouts are per attempt, through the request context, so
+			// streamed responses aren't cut off
+			http:           &http.Client{},
+			baseURL:        huggingFaceAPIURL,
+			maxAttempts:    defaultModelMaxAttempts,
+			maxConcurrency: defaultModelMaxConcurrency,
+			models:         make(map[string]*modelState),
+		}
+		if v := os.Getenv("MODEL_MAX_ATTEMPTS"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				c.maxAttempts = n
+			} else {
+				log.Printf("Invalid MODEL_MAX_ATTEMPTS %q, using %d", v, defaultModelMaxAttempts)
+			}
+		}
+		if v := os.Getenv("MODEL_MAX_CONCURRENCY"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				c.maxConcurrency = n
+			} else {
+				log.Printf("Invalid MODEL_MAX_CONCURRENCY %q, using %d", v, defaultModelMaxConcurrency)
+			}
+		}
+		sharedClient = c
+	})
+	return sharedClient
+}
+
+func (c *modelClient) model(name string) *modelState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.models[name]
+	if !ok {
+		s = &modelState{
+			slots:   make(chan struct{}, c.maxConcurrency),
+			state:   breakerClosed,
+			metrics: ModelMetrics{Model: name},
+		}
+		c.models[name] = s
+	}
+	return s
+}
+
+// Metrics for every model called so far, by name
+func (c *modelClient) metrics() []ModelMetrics {
+	c.mu.Lock()
+	states := make([]*modelState, 0, len(c.models))
+	for _, s := range c.models {
+		states = append(states, s)
+	}
+	c.mu.Unlock()
+
+	metrics := make([]ModelMetrics, 0, len(states))
+	for _, s := range states {
+		metrics = append(metrics, s.snapshot())
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Model < metrics[j].Model })
+	return metrics
+}
+
+// POST a JSON payload to a model and return the response body
+func (c *modelClient) post(ctx context.Context, model string, payload []byte, timeout time.Duration) ([]byte, error) {
+	resp, err := c.do(ctx, model, payload, timeout, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// POST a streaming request. The caller must close the response body, which
+// also frees the concurrency slot.
+func (c *modelClient) stream(ctx context.Context, model string, payload []byte, timeout time.Duration) (*http.Response, error) {
+	return c.do(ctx, model, payload, timeout, true)
+}
+
+// Body that releases the request's slot and context when closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Send the request, retrying provider faults with backoff until it
+// succeeds, the attempts run out or ctx is done. A successful response is
+// returned unread.
+func (c *modelClient) do(ctx context.Context, model string, payload []byte, timeout time.Duration, stream bool) (*http.Response, error) {
+	s := c.model(model)
+	s.mu.Lock()
+	s.metrics.Requests++
+	s.mu.Unlock()
+
+	if !s.allow(time.Now()) {
+		return nil, fmt.Errorf("%s: %w", model, errCircuitOpen)
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		s.recordCancelled()
+		return nil, ctx.Err()
+	}
+	releaseSlot := func() { <-s.slots }
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		req, err := http.NewRequestWithContext(attemptCtx, "POST", c.baseURL+model, bytes.NewReader(payload))
+		if err != nil {
+			cancel()
+			releaseSlot()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if stream {
+			req.Header.Set("Accept", "text/event-stream")
+		}
+		if huggingFaceAPIKey != "" {
+			req.Header.Set("Authorization", "Bearer "+huggingFaceAPIKey)
+		}
+
+		start := time.Now()
+		resp, err := c.http.Do(req)
+
+		if err == nil && resp.StatusCode == http.StatusOK {
+			s.recordAttempt(time.Since(start))
+			s.recordSuccess()
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() {
+				cancel()
+				releaseSlot()
+			}}
+			return resp, nil
+		}
+
+		var delay time.Duration
+		providerFault := true
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				// The caller gave up; not the provider's fault
+				s.recordCancelled()
+				releaseSlot()
+				return nil, ctx.Err()
+			}
+			delay = backoffDelay(attempt)
+		} else {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			cancel()
+			s.recordAttempt(time.Since(start))
+
+			err = &modelAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+			providerFault = retryableStatus(resp.StatusCode)
+			delay = retryDelay(resp.Header, body, attempt)
+		}
+
+		if !providerFault || attempt >= c.maxAttempts {
+			s.recordFailure(err, providerFault, time.Now())
+			releaseSlot()
+			return nil, err
+		}
+
+		s.mu.Lock()
+		s.metrics.Retries++
+		s.mu.Unlock()
+		log.Printf("%s attempt %d failed, retrying in %s: %v", model, attempt, delay.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.recordCancelled()
+			releaseSlot()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// How long to wait before retrying a failed response: the provider's
+// Retry-After header, or the estimated_time of a model that is still
+// loading, otherwise exponential backoff
+func retryDelay(header http.Header, body []byte, attempt int) time.Duration {
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return capRetryDelay(time.Duration(secs) * time.Second)
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			return capRetryDelay(time.Until(at))
+		}
+	}
+
+	var loading struct {
+		EstimatedTime float64 `json:"estimated_time"` // seconds
+	}
+	if json.Unmarshal(body, &loading) == nil && loading.EstimatedTime > 0 {
+		return capRetryDelay(time.Duration(loading.EstimatedTime * float64(time.Second)))
+	}
+
+	return backoffDelay(attempt)
+}
+
+// Exponential backoff with jitter: half the step plus a random part of
+// the other half
+func backoffDelay(attempt int) time.Duration {
+	step := retryBaseDelay << (attempt - 1)
+	if step > retryMaxDelay || step <= 0 {
+		step = retryMaxDelay
+	}
+	return step/2 + time.Duration(rand.Int63n(int64(step/2)+1))
+}
+
+func capRetryDelay(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	if d > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return d
+}
+
+// Latency, error rates and breaker state for each model called since
+// startup
+func getModelMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hfClient().metrics())
+}
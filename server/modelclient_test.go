@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		body       string
+		attempt    int
+		min, max   time.Duration
+	}{
+		{"retry-after seconds", "3", "", 1, 3 * time.Second, 3 * time.Second},
+		{"retry-after zero", "0", "", 1, 0, 0},
+		{"retry-after capped", "3600", "", 1, retryMaxDelay, retryMaxDelay},
+		{"retry-after date in the past", "Mon, 02 Jan 2006 15:04:05 GMT", "", 1, 0, 0},
+		{"retry-after wins over loading", "2", `{"estimated_time": 20}`, 1, 2 * time.Second, 2 * time.Second},
+		{"model loading", "", `{"error": "Model is loading", "estimated_time": 12.5}`, 1, 12500 * time.Millisecond, 12500 * time.Millisecond},
+		{"loading capped", "", `{"estimated_time": 500}`, 1, retryMaxDelay, retryMaxDelay},
+		{"invalid retry-after falls back", "soon", "", 1, retryBaseDelay / 2, retryBaseDelay},
+		{"first backoff", "", "", 1, retryBaseDelay / 2, retryBaseDelay},
+		{"third backoff", "", "not json", 3, 2 * retryBaseDelay, 4 * retryBaseDelay},
+		{"backoff capped", "", "", 40, retryMaxDelay / 2, retryMaxDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+			got := retryDelay(header, []byte(tt.body), tt.attempt)
+			if got < tt.min || got > tt.max {
+				t.Errorf("retryDelay() = %s, want between %s and %s", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	fault := errors.New("503")
+	s := &modelState{state: breakerClosed, slots: make(chan struct{}, 1), metrics: ModelMetrics{Model: "test"}}
+
+	// Client errors never open it
+	for i := 0; i < 2*breakerFailureThreshold; i++ {
+		s.recordFailure(fault, false, now)
+	}
+	if s.state != breakerClosed || !s.allow(now) {
+		t.Fatalf("breaker %s after client errors, want closed", s.state)
+	}
+
+	// Provider faults open it at the threshold, and a success in between
+	// starts the count again
+	for i := 0; i < breakerFailureThreshold-1; i++ {
+		s.recordFailure(fault, true, now)
+	}
+	s.recordSuccess()
+	for i := 0; i < breakerFailureThreshold-1; i++ {
+		s.recordFailure(fault, true, now)
+	}
+	if s.state != breakerClosed {
+		t.Fatalf("breaker %s before the threshold, want closed", s.state)
+	}
+	s.recordFailure(fault, true, now)
+	if s.state != breakerOpen {
+		t.Fatalf("breaker %s at the threshold, want open", s.state)
+	}
+
+	tests := []struct {
+		name      string
+		at        time.Duration // after opening
+		wantAllow bool
+		wantState string
+	}{
+		{"rejected while cooling down", breakerCooldown / 2, false, breakerOpen},
+		{"one trial after the cooldown", breakerCooldown, true, breakerHalfOpen},
+		{"no second trial while one is in flight", breakerCooldown, false, breakerHalfOpen},
+	}
+	for _, tt := range tests {
+		if got := s.allow(now.Add(tt.at)); got != tt.wantAllow || s.state != tt.wantState {
+			t.Errorf("%s: allow() = %v in state %s, want %v in %s", tt.name, got, s.state, tt.wantAllow, tt.wantState)
+		}
+	}
+	if m := s.snapshot(); m.Rejected != 2 || m.BreakerState != breakerHalfOpen {
+		t.Errorf("snapshot has %d rejected in state %s", m.Rejected, m.BreakerState)
+	}
+
+	// A cancelled trial frees the way for another; a failed one reopens
+	s.recordCancelled()
+	if !s.allow(now.Add(breakerCooldown)) {
+		t.Fatalf("no trial after a cancelled one")
+	}
+	later := now.Add(breakerCooldown)
+	s.recordFailure(fault, true, later)
+	if s.state != breakerOpen || s.allow(later.Add(breakerCooldown/2)) {
+		t.Fatalf("breaker %s after a failed trial, want open", s.state)
+	}
+
+	// A successful trial closes it
+	if !s.allow(later.Add(breakerCooldown)) {
+		t.Fatalf("no trial after the second cooldown")
+	}
+	s.recordSuccess()
+	if s.state != breakerClosed || !s.allow(later.Add(breakerCooldown)) {
+		t.Errorf("breaker %s after a successful trial, want closed", s.state)
+	}
+}
+
+// A client for a test server, without waiting between attempts
+func newTestModelClient(t *testing.T, handler http.HandlerFunc) *modelClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &modelClient{
+		http:           server.Client(),
+		baseURL:        server.URL + "/",
+		maxAttempts:    3,
+		maxConcurrency: 1,
+		models:         make(map[string]*modelState),
+	}
+}
+
+func TestModelClientRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int // returned in turn, the last one repeated
+		wantErr      bool
+		wantCalls    int32
+		wantFailures int64
+	}{
+		{"success", []int{http.StatusOK}, false, 1, 0},
+		{"retried until success", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, false, 3, 0},
+		{"attempts run out", []int{http.StatusBadGateway}, true, 3, 1},
+		{"client error not retried", []int{http.StatusBadRequest}, true, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := newTestModelClient(t, func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&calls, 1))
+				status := tt.statuses[len(tt.statuses)-1]
+				if n <= len(tt.statuses) {
+					status = tt.statuses[n-1]
+				}
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(status)
+				w.Write([]byte(`[{"label": "joy", "score": 0.9}]`))
+			})
+
+			body, err := c.post(context.Background(), "test-model", []byte(`{}`), time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("post() err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(body) == 0 {
+				t.Errorf("post() returned an empty body")
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+			m := c.model("test-model").snapshot()
+			if m.Requests != 1 || m.Failures != tt.wantFailures || m.Retries != int64(tt.wantCalls-1) || m.InFlight != 0 {
+				t.Errorf("metrics %+v", m)
+			}
+		})
+	}
+}
+
+func TestModelClientOpenBreaker(t *testing.T) {
+	var calls int32
+	c := newTestModelClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	c.maxAttempts = 1
+
+	for i := 0; i < breakerFailureThreshold; i++ {
+		c.post(context.Background(), "test-model", nil, time.Second)
+	}
+	if _, err := c.post(context.Background(), "test-model", nil, time.Second); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("post() err = %v, want %v", err, errCircuitOpen)
+	}
+	if calls != breakerFailureThreshold {
+		t.Errorf("%d calls reached the provider, want %d", calls, breakerFailureThreshold)
+	}
+}
@@ -0,0 +1,358 @@
+// organize.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A user-defined collection of entries; each entry is in at most one
+type Notebook struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	EntryCount int       `json:"entry_count"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// A user-defined label; entries can carry any number of them
+type Tag struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	EntryCount int       `json:"entry_count"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type nameRequest struct {
+	Name string `json:"name"`
+}
+
+type mergeTagRequest struct {
+	Into int `json:"into"`
+}
+
+// Normalize a tag name: trimmed, lowercase, no leading '#', single spaces
+func normalizeTagName(name string) string {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "#")
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Normalize and de-duplicate tag names, dropping empty ones
+func normalizeTagNames(names []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, name := range names {
+		name = normalizeTagName(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result
+}
+
+// Check that notebookID, if set, names one of the user's notebooks
+func ownsNotebook(userID int, notebookID *int) bool {
+	if notebookID == nil {
+		return true
+	}
+	notebook, err := store.Notebooks.GetByID(*notebookID)
+	return err == nil && notebook.UserID == userID
+}
+
+// Parse ?tag=a&tag=b&notebook=3&from=2024-01-01&to=2024-01-31 on the
+// entries list
+func parseEntryFilter(r *http.Request) (EntryFilter, error) {
+	var filter EntryFilter
+	query := r.URL.Query()
+
+	if tags := query["tag"]; len(tags) > 0 {
+		filter.Tags = normalizeTagNames(tags)
+	}
+
+	if v := query.Get("notebook"); v != "" {
+		notebookID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid notebook ID")
+		}
+		filter.NotebookID = &notebookID
+	}
+
+	from, to, err := parseDateRange(query)
+	if err != nil {
+		return filter, err
+	}
+	filter.From, filter.To = from, to
+
+	return filter, nil
+}
+
+// Decode a {"name": ...} body, writing an error response on failure
+func decodeName(w http.ResponseWriter, r *http.Request, normalize func(string) string) (string, bool) {
+	var req nameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+
+	name := normalize(req.Name)
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// Load the notebook named by the {id} route variable if the user owns it
+func loadOwnedNotebook(w http.ResponseWriter, r *http.Request) (*Notebook, bool) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	notebookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid notebook ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	notebook, err := store.Notebooks.GetByID(notebookID)
+	if err != nil {
+		http.Error(w, "Notebook not found", http.StatusNotFound)
+		return nil, false
+	}
+	if notebook.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return nil, false
+	}
+	return notebook, true
+}
+
+// Load the tag named by the {id} route variable if the user owns it
+func loadOwnedTag(w http.ResponseWriter, r *http.Request) (*Tag, bool) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	tagID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	tag, err := store.Tags.GetByID(tagID)
+	if err != nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return nil, false
+	}
+	if tag.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return nil, false
+	}
+	return tag, true
+}
+
+// Notebook handlers
+func listNotebooksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	notebooks, err := store.Notebooks.ListByUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch notebooks", http.StatusInternalServerError)
+		return
+	}
+	if notebooks == nil {
+		notebooks = []Notebook{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notebooks)
+}
+
+func createNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	name, ok := decodeName(w, r, strings.TrimSpace)
+	if !ok {
+		return
+	}
+
+	notebook, err := store.Notebooks.Create(userID, name)
+	if err != nil {
+		http.Error(w, "Notebook already exists", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(notebook)
+}
+
+func renameNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	notebook, ok := loadOwnedNotebook(w, r)
+	if !ok {
+		return
+	}
+
+	name, ok := decodeName(w, r, strings.TrimSpace)
+	if !ok {
+		return
+	}
+
+	if err := store.Notebooks.Rename(notebook.ID, name); err != nil {
+		http.Error(w, "Notebook already exists", http.StatusConflict)
+		return
+	}
+	notebook.Name = name
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notebook)
+}
+
+func deleteNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	notebook, ok := loadOwnedNotebook(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.Notebooks.Delete(notebook.ID); err != nil {
+		http.Error(w, "Failed to delete notebook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Tag handlers
+func listTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	tags, err := store.Tags.ListByUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+	if tags == nil {
+		tags = []Tag{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+func createTagHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	name, ok := decodeName(w, r, normalizeTagName)
+	if !ok {
+		return
+	}
+
+	tag, err := store.Tags.Create(userID, name)
+	if err != nil {
+		http.Error(w, "Tag already exists", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// Suggest tags as the user types: ?q=wo&limit=10
+func autocompleteTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 50 {
+			limit = n
+		}
+	}
+
+	tags, err := store.Tags.Search(userID, normalizeTagName(r.URL.Query().Get("q")), limit)
+	if err != nil {
+		http.Error(w, "Failed to search tags", http.StatusInternalServerError)
+		return
+	}
+	if tags == nil {
+		tags = []Tag{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// Rename a tag. Renaming onto another existing tag is rejected; use merge.
+func renameTagHandler(w http.ResponseWriter, r *http.Request) {
+	tag, ok := loadOwnedTag(w, r)
+	if !ok {
+		return
+	}
+
+	name, ok := decodeName(w, r, normalizeTagName)
+	if !ok {
+		return
+	}
+
+	if existing, err := store.Tags.GetByName(tag.UserID, name); err == nil && existing.ID != tag.ID {
+		http.Error(w, "A tag with that name already exists; merge them instead", http.StatusConflict)
+		return
+	}
+
+	if err := store.Tags.Rename(tag.ID, name); err != nil {
+		http.Error(w, "Failed to rename tag", http.StatusInternalServerError)
+		return
+	}
+	tag.Name = name
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag)
+}
+
+func deleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	tag, ok := loadOwnedTag(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.Tags.Delete(tag.ID); err != nil {
+		http.Error(w, "Failed to delete tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Merge the tag into another: {"into": 7}. Entries carrying the merged tag
+// get the target tag instead, and the merged tag is deleted.
+func mergeTagHandler(w http.ResponseWriter, r *http.Request) {
+	source, ok := loadOwnedTag(w, r)
+	if !ok {
+		return
+	}
+
+	var req mergeTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	target, err := store.Tags.GetByID(req.Into)
+	if err != nil || target.UserID != source.UserID {
+		http.Error(w, "Target tag not found", http.StatusNotFound)
+		return
+	}
+	if target.ID == source.ID {
+		http.Error(w, "Cannot merge a tag into itself", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.Tags.Merge(source.ID, target.ID); err != nil {
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,221 @@
+// privacy.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// What the pipeline may do with a user's text. A new account has
+// everything on except local analysis.
+type PrivacySettings struct {
+	// Sentiment, emotions, crisis screening and a suggestion for each entry
+	MoodAnalysis bool `json:"mood_analysis"`
+	// Entry embeddings, for similar entries and chat retrieval
+	Embeddings bool `json:"embeddings"`
+	// Suggestions and digest narratives written by the generative model.
+	// Without it they come from keywords and templates.
+	GenerativeSuggestions bool `json:"generative_suggestions"`
+	// Whether the user's text may be sent, redacted, to external model
+	// providers
+	ExternalProcessing bool `json:"external_processing"`
+	// Sentiment, emotions and embeddings computed on this server only, even
+	// where external processing is allowed
+	LocalAnalysis bool `json:"local_analysis"`
+}
+
+// Settings when no user is attached to a model call
+var defaultPrivacySettings = PrivacySettings{
+	MoodAnalysis:          true,
+	Embeddings:            true,
+	GenerativeSuggestions: true,
+	ExternalProcessing:    true,
+}
+
+var (
+	errMoodAnalysisDisabled          = errors.New("mood analysis is turned off for this user")
+	errEmbeddingsDisabled            = errors.New("embeddings are turned off for this user")
+	errGenerativeSuggestionsDisabled = errors.New("generative suggestions are turned off for this user")
+)
+
+// Whether analysis runs on this server only. Without external processing
+// there is no other choice.
+func (p PrivacySettings) localOnly() bool {
+	return p.LocalAnalysis || !p.ExternalProcessing
+}
+
+// Settings of the user whose text ctx carries (see withModelUser)
+func privacyFrom(ctx context.Context) PrivacySettings {
+	if u, ok := ctx.Value(modelUserKey{}).(*modelUser); ok {
+		return u.Privacy
+	}
+	return defaultPrivacySettings
+}
+
+// ID of the user whose text ctx carries, 0 if none
+func modelUserID(ctx context.Context) int {
+	if u, ok := ctx.Value(modelUserKey{}).(*modelUser); ok {
+		return u.ID
+	}
+	return 0
+}
+
+// The user's current settings. If they can't be loaded everything is off,
+// so nothing is done or kept that the user may have refused.
+func loadPrivacySettings(userID int) PrivacySettings {
+	user, err := store.Users.GetByID(userID)
+	if err != nil {
+		log.Printf("Failed to load privacy settings for user %d: %v", userID, err)
+		return PrivacySettings{}
+	}
+	return user.PrivacySettings
+}
+
+// What was deleted after an opt-out
+type PrivacyDeletion struct {
+	Analyses      int `json:"analyses"`       // with their corrections, ratings and sentence scores
+	Embeddings    int `json:"embeddings"`     // entries whose embeddings went
+	Suggestions   int `json:"suggestions"`    // generated suggestions cleared
+	Digests       int `json:"digests"`        // deleted, or rewritten from the template
+	CachedOutputs int `json:"cached_outputs"` // model outputs of the features turned off
+	Conversations int `json:"conversations"`  // chats, with their model-written answers
+}
+
+// Delete the data derived by the features the settings turn off. Safe to
+// repeat: a feature already off has nothing left to delete.
+func deleteOptedOutData(userID int, settings PrivacySettings) (*PrivacyDeletion, error) {
+	deleted := &PrivacyDeletion{}
+	var err error
+	// Cached outputs of each feature turned off
+	var cacheTasks []string
+
+	if !settings.MoodAnalysis {
+		if deleted.Analyses, err = store.MoodAnalyses.DeleteByUser(userID); err != nil {
+			return nil, err
+		}
+		// Digests are built from the analyses
+		if deleted.Digests, err = store.Digests.DeleteByUser(userID); err != nil {
+			return nil, err
+		}
+		cacheTasks = append(cacheTasks, "sentiment", "emotion", "translation", "risk")
+	}
+
+	if !settings.Embeddings {
+		if deleted.Embeddings, err = store.Embeddings.DeleteByUser(userID); err != nil {
+			return nil, err
+		}
+		cacheTasks = append(cacheTasks, "embedding")
+	}
+
+	if !settings.GenerativeSuggestions {
+		if deleted.Suggestions, err = store.MoodAnalyses.ClearGeneratedSuggestions(userID); err != nil {
+			return nil, err
+		}
+
+		// Digests keep their stats; a model-written narrative is replaced
+		// with the template one
+		digests, err := store.Digests.ListByUser(userID, "", math.MaxInt32)
+		if err != nil {
+			return nil, err
+		}
+		for _, digest := range digests {
+			if digest.NarrativeBy == "template" {
+				continue
+			}
+			if err := store.Digests.UpdateNarrative(digest.ID, templateNarrative(&digest), "template"); err != nil {
+				return nil, err
+			}
+			deleted.Digests++
+		}
+
+		// Chat answers are model-written and quote entries
+		if deleted.Conversations, err = store.Chats.DeleteByUser(userID); err != nil {
+			return nil, err
+		}
+		cacheTasks = append(cacheTasks, "generation")
+	}
+
+	if deleted.CachedOutputs, err = store.ModelCache.DeleteByUser(userID, cacheTasks...); err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// Get the user's privacy settings
+func getPrivacySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	user, err := store.Users.GetByID(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.PrivacySettings)
+}
+
+// Change any of the user's privacy settings; omitted ones are unchanged.
+// Turning off mood analysis, embeddings or generative suggestions deletes
+// what they produced.
+func updatePrivacySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		MoodAnalysis          *bool `json:"mood_analysis"`
+		Embeddings            *bool `json:"embeddings"`
+		GenerativeSuggestions *bool `json:"generative_suggestions"`
+		ExternalProcessing    *bool `json:"external_processing"`
+		LocalAnalysis         *bool `json:"local_analysis"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.Users.GetByID(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	settings := user.PrivacySettings
+	for _, field := range []struct {
+		value *bool
+		dest  *bool
+	}{
+		{req.MoodAnalysis, &settings.MoodAnalysis},
+		{req.Embeddings, &settings.Embeddings},
+		{req.GenerativeSuggestions, &settings.GenerativeSuggestions},
+		{req.ExternalProcessing, &settings.ExternalProcessing},
+		{req.LocalAnalysis, &settings.LocalAnalysis},
+	} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+
+	if err := store.Users.UpdatePrivacy(userID, settings); err != nil {
+		http.Error(w, "Failed to update privacy settings", http.StatusInternalServerError)
+		return
+	}
+
+	deleted, err := deleteOptedOutData(userID, settings)
+	if err != nil {
+		log.Printf("Failed to delete opted-out data for user %d: %v", userID, err)
+		http.Error(w, "Settings saved, but deleting data failed; save again to retry", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		PrivacySettings
+		Deleted *PrivacyDeletion `json:"deleted"`
+	}{settings, deleted})
+}
@@ -0,0 +1,389 @@
+// prompts.go
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Built-in prompt templates, one file per task and version:
+// prompts/<task>.v<version>.tmpl. Each defines three blocks: "params" (JSON
+// generation parameters), "system" and "user".
+//
+//go:embed prompts/*.tmpl
+var builtinPrompts embed.FS
+
+// Generation parameters sent with a prompt
+type GenerationParams struct {
+	MaxNewTokens      int      `json:"max_new_tokens"`
+	Temperature       float64  `json:"temperature"`
+	TopP              float64  `json:"top_p,omitempty"`
+	RepetitionPenalty float64  `json:"repetition_penalty,omitempty"`
+	Stop              []string `json:"stop,omitempty"`
+}
+
+// Parameters for the Hugging Face text-generation API
+func (p GenerationParams) payload() map[string]interface{} {
+	params := map[string]interface{}{
+		"max_new_tokens":   p.MaxNewTokens,
+		"temperature":      p.Temperature,
+		"do_sample":        p.Temperature > 0,
+		"return_full_text": false,
+	}
+	if p.TopP > 0 {
+		params["top_p"] = p.TopP
+	}
+	if p.RepetitionPenalty > 0 {
+		params["repetition_penalty"] = p.RepetitionPenalty
+	}
+	if len(p.Stop) > 0 {
+		params["stop"] = p.Stop
+	}
+	return params
+}
+
+type PromptTemplate struct {
+	ID      string           `json:"id"` // "<task>@v<version>"
+	Task    string           `json:"task"`
+	Version int              `json:"version"`
+	Source  string           `json:"source"` // "builtin" or the file it was loaded from
+	Params  GenerationParams `json:"params"`
+
+	tmpl *template.Template
+}
+
+// A prompt ready to send: formatted for the generation model
+type RenderedPrompt struct {
+	TemplateID string
+	Text       string
+	Params     GenerationParams
+}
+
+var promptFileName = regexp.MustCompile(`^([a-z_]+)\.v(\d+)\.tmpl$`)
+
+// Chat-control tokens of the supported formats. They are stripped from
+// user text so it can't close its delimiter or open a new turn.
+var controlTokenPattern = regexp.MustCompile(`(?i)\[/?INST\]|</?s>|<\|[a-z_]+\|>|<<\/?SYS>>`)
+
+// Wrap user-supplied text in <name> tags, removing anything inside it that
+// could end the block early or impersonate a chat turn. Removal repeats
+// until nothing changes, since taking out one token can join the text
+// around it into another.
+func untrustedBlock(name, text string) string {
+	tag := regexp.MustCompile(`(?i)<\s*/?\s*` + regexp.QuoteMeta(name) + `\b[^>]*>`)
+	for {
+		cleaned := controlTokenPattern.ReplaceAllString(tag.ReplaceAllString(text, ""), "")
+		if cleaned == text {
+			break
+		}
+		text = cleaned
+	}
+	return "<" + name + ">\n" + strings.TrimSpace(text) + "\n</" + name + ">"
+}
+
+var promptFuncs = template.FuncMap{"untrusted": untrustedBlock}
+
+// Blocks any template can include with {{template "name"}}. Output schemas
+// live here so the prompt and the validator can't drift apart.
+var promptPartials = map[string]string{
+	"suggestion_schema": suggestionSchemaPrompt(),
+}
+
+// Parse one template file's contents
+func parsePromptTemplate(task string, version int, source string, data []byte) (*PromptTemplate, error) {
+	tmpl := template.New(task).Funcs(promptFuncs)
+	for name, text := range promptPartials {
+		if _, err := tmpl.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("partial %s: %v", name, err)
+		}
+	}
+	if _, err := tmpl.Parse(string(data)); err != nil {
+		return nil, err
+	}
+	for _, block := range []string{"params", "system", "user"} {
+		if tmpl.Lookup(block) == nil {
+			return nil, fmt.Errorf("missing {{define %q}} block", block)
+		}
+	}
+
+	var params bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&params, "params", nil); err != nil {
+		return nil, err
+	}
+	p := &PromptTemplate{
+		ID:      fmt.Sprintf("%s@v%d", task, version),
+		Task:    task,
+		Version: version,
+		Source:  source,
+		tmpl:    tmpl,
+	}
+	if err := json.Unmarshal(params.Bytes(), &p.Params); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+	if p.Params.MaxNewTokens <= 0 {
+		return nil, fmt.Errorf("params need a positive max_new_tokens")
+	}
+	return p, nil
+}
+
+var (
+	promptsOnce sync.Once
+	prompts     map[string]*PromptTemplate // by ID
+)
+
+// Built-in templates plus any in PROMPTS_DIR, which replace built-ins with
+// the same task and version. Loaded once.
+func loadPromptTemplates() map[string]*PromptTemplate {
+	promptsOnce.Do(func() {
+		prompts = make(map[string]*PromptTemplate)
+
+		load := func(fsys fs.FS, source string) {
+			names, err := fs.Glob(fsys, "*.tmpl")
+			if err != nil {
+				log.Printf("Failed to list prompt templates in %s: %v", source, err)
+				return
+			}
+			for _, name := range names {
+				m := promptFileName.FindStringSubmatch(name)
+				if m == nil {
+					log.Printf("Skipping prompt template %s: expected <task>.v<version>.tmpl", name)
+					continue
+				}
+				version, _ := strconv.Atoi(m[2])
+				data, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					log.Printf("Failed to read prompt template %s: %v", name, err)
+					continue
+				}
+				origin := "builtin"
+				if source != "builtin" {
+					origin = filepath.Join(source, name)
+				}
+				p, err := parsePromptTemplate(m[1], version, origin, data)
+				if err != nil {
+					log.Printf("Invalid prompt template %s: %v", name, err)
+					continue
+				}
+				prompts[p.ID] = p
+			}
+		}
+
+		builtin, _ := fs.Sub(builtinPrompts, "prompts")
+		load(builtin, "builtin")
+		if dir := os.Getenv("PROMPTS_DIR"); dir != "" {
+			load(os.DirFS(dir), dir)
+		}
+	})
+	return prompts
+}
+
+// A template and its share of users in an A/B split
+type promptVariant struct {
+	ID     string `json:"id"`
+	Weight int    `json:"weight"`
+}
+
+// Variants configured for a task with PROMPT_<TASK>, e.g.
+// PROMPT_SUGGESTION="suggestion@v3=80,suggestion@v4=20". Without it, the
+// highest version of the task is used for everyone.
+func promptVariants(task string) []promptVariant {
+	all := loadPromptTemplates()
+
+	var variants []promptVariant
+	config := os.Getenv("PROMPT_" + strings.ToUpper(task))
+	for _, part := range strings.Split(config, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, weight := part, 1
+		if i := strings.LastIndex(part, "="); i >= 0 {
+			id = strings.TrimSpace(part[:i])
+			n, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+			if err != nil || n < 0 {
+				log.Printf("Ignoring prompt variant %q: invalid weight", part)
+				continue
+			}
+			weight = n
+		}
+		p, ok := all[id]
+		if !ok || p.Task != task {
+			log.Printf("Ignoring prompt variant %q: no such %s template", id, task)
+			continue
+		}
+		if weight > 0 {
+			variants = append(variants, promptVariant{ID: id, Weight: weight})
+		}
+	}
+	if len(variants) > 0 {
+		return variants
+	}
+
+	var latest *PromptTemplate
+	for _, p := range all {
+		if p.Task == task && (latest == nil || p.Version > latest.Version) {
+			latest = p
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return []promptVariant{{ID: latest.ID, Weight: 1}}
+}
+
+// Pick the user's variant. The same user always lands in the same bucket
+// for a task, so an A/B split compares users rather than single analyses.
+func selectPromptTemplate(task string, userID int) (*PromptTemplate, error) {
+	variants := promptVariants(task)
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("no prompt template for task %q", task)
+	}
+
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d", task, userID)
+	bucket := int(h.Sum32() % uint32(total))
+
+	for _, v := range variants {
+		if bucket < v.Weight {
+			return loadPromptTemplates()[v.ID], nil
+		}
+		bucket -= v.Weight
+	}
+	return loadPromptTemplates()[variants[len(variants)-1].ID], nil
+}
+
+// How a model expects system and user turns to be laid out
+type chatFormat struct {
+	Name   string
+	render func(system, user string) string
+}
+
+var chatFormats = map[string]chatFormat{
+	"mistral": {"mistral", func(system, user string) string {
+		// Mistral instruct models have no system role; it leads the first turn
+		return "[INST] " + system + "\n\n" + user + " [/INST]"
+	}},
+	"llama3": {"llama3", func(system, user string) string {
+		return "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\n" + system + "<|eot_id|>" +
+			"<|start_header_id|>user<|end_header_id|>\n\n" + user + "<|eot_id|>" +
+			"<|start_header_id|>assistant<|end_header_id|>\n\n"
+	}},
+	"chatml": {"chatml", func(system, user string) string {
+		return "<|im_start|>system\n" + system + "<|im_end|>\n<|im_start|>user\n" + user + "<|im_end|>\n<|im_start|>assistant\n"
+	}},
+	"zephyr": {"zephyr", func(system, user string) string {
+		return "<|system|>\n" + system + "</s>\n<|user|>\n" + user + "</s>\n<|assistant|>\n"
+	}},
+	"plain": {"plain", func(system, user string) string {
+		return system + "\n\n" + user + "\n\nResponse:"
+	}},
+}
+
+// Chat format for the generation model: GENERATION_CHAT_FORMAT if set,
+// otherwise guessed from the model name
+func chatFormatForModel(model string) chatFormat {
+	if name := strings.ToLower(os.Getenv("GENERATION_CHAT_FORMAT")); name != "" {
+		if format, ok := chatFormats[name]; ok {
+			return format
+		}
+		log.Printf("Unknown GENERATION_CHAT_FORMAT %q, guessing from the model name", name)
+	}
+
+	lower := strings.ToLower(model)
+	switch {
+	case strings.Contains(lower, "mistral"), strings.Contains(lower, "mixtral"):
+		return chatFormats["mistral"]
+	case strings.Contains(lower, "llama-3"), strings.Contains(lower, "llama3"):
+		return chatFormats["llama3"]
+	case strings.Contains(lower, "zephyr"):
+		return chatFormats["zephyr"]
+	case strings.Contains(lower, "qwen"), strings.Contains(lower, "hermes"):
+		return chatFormats["chatml"]
+	default:
+		return chatFormats["plain"]
+	}
+}
+
+// Render the user's variant of a task's template for the generation model
+func renderPrompt(task string, userID int, data interface{}) (*RenderedPrompt, error) {
+	p, err := selectPromptTemplate(task, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var system, user bytes.Buffer
+	if err := p.tmpl.ExecuteTemplate(&system, "system", data); err != nil {
+		return nil, fmt.Errorf("prompt %s: %v", p.ID, err)
+	}
+	if err := p.tmpl.ExecuteTemplate(&user, "user", data); err != nil {
+		return nil, fmt.Errorf("prompt %s: %v", p.ID, err)
+	}
+
+	format := chatFormatForModel(generationModel)
+	return &RenderedPrompt{
+		TemplateID: p.ID,
+		Text:       format.render(strings.TrimSpace(system.String()), strings.TrimSpace(user.String())),
+		Params:     p.Params,
+	}, nil
+}
+
+// Loaded templates with each task's variants and the user's assignment
+func listPromptsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	type taskInfo struct {
+		Task     string          `json:"task"`
+		Variants []promptVariant `json:"variants"`
+		Assigned string          `json:"assigned"` // this user's variant
+	}
+	response := struct {
+		ChatFormat string           `json:"chat_format"`
+		Templates  []PromptTemplate `json:"templates"`
+		Tasks      []taskInfo       `json:"tasks"`
+	}{
+		ChatFormat: chatFormatForModel(generationModel).Name,
+		Templates:  []PromptTemplate{},
+		Tasks:      []taskInfo{},
+	}
+
+	tasks := make(map[string]bool)
+	for _, p := range loadPromptTemplates() {
+		response.Templates = append(response.Templates, *p)
+		tasks[p.Task] = true
+	}
+	sort.Slice(response.Templates, func(i, j int) bool {
+		return response.Templates[i].ID < response.Templates[j].ID
+	})
+
+	for task := range tasks {
+		info := taskInfo{Task: task, Variants: promptVariants(task)}
+		if p, err := selectPromptTemplate(task, userID); err == nil {
+			info.Assigned = p.ID
+		}
+		response.Tasks = append(response.Tasks, info)
+	}
+	sort.Slice(response.Tasks, func(i, j int) bool {
+		return response.Tasks[i].Task < response.Tasks[j].Task
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,367 @@
+// redact.go
+package main
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Journal text is redacted before it leaves for a model provider: names,
+// contact details, addresses and account numbers are replaced with
+// placeholders like [PERSON_1]. Generated text has them put back before
+// anyone reads it.
+
+//go:embed data/given_names.txt
+var givenNamesData string
+
+// Returned instead of calling a provider for a user who has turned
+// external processing off
+var errExternalProcessingDisabled = errors.New("external processing is disabled for this user")
+
+// Kinds of PII, in the order their detectors run. Where matches overlap,
+// the earlier kind wins.
+const (
+	piiURL     = "URL"
+	piiEmail   = "EMAIL"
+	piiAccount = "ACCOUNT" // IBANs and card numbers
+	piiID      = "ID"      // social security style numbers
+	piiIP      = "IP"
+	piiPhone   = "PHONE"
+	piiAddress = "ADDRESS"
+	piiPerson  = "PERSON"
+)
+
+type piiDetector struct {
+	kind    string
+	pattern *regexp.Regexp
+	valid   func(match string) bool // optional check on each match
+}
+
+var piiDetectors = []piiDetector{
+	{piiURL, regexp.MustCompile(`\b(?:https?://|www\.)[^\s<>"]+[^\s<>".,;:!?)\]]`), nil},
+	{piiEmail, regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`), nil},
+	{piiAccount, regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`), nil},
+	{piiAccount, regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), luhnValid},
+	{piiID, regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), nil},
+	{piiIP, regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), nil},
+	{piiPhone, regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{1,4}\)[ .-]?)?\d{2,6}(?:[ .-]\d{2,6}){1,4}\b|\+\d{7,15}\b|\b\d{10,11}\b`), phoneLike},
+	{piiAddress, regexp.MustCompile(`\b\d{1,5}[A-Za-z]?,? (?:[A-Z][\p{L}'-]+ ){1,3}(?:Street|St|Avenue|Ave|Road|Rd|Boulevard|Blvd|Lane|Ln|Drive|Dr|Court|Ct|Place|Pl|Square|Sq|Way|Terrace|Close|Crescent|Gardens|Parkway|Highway)\b\.?`), nil},
+	{piiAddress, regexp.MustCompile(`\b[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}\b`), nil}, // UK postcode
+	{piiAddress, regexp.MustCompile(`\b[A-Z]{2} \d{5}(?:-\d{4})?\b`), nil},        // US state and ZIP
+	{piiPerson, regexp.MustCompile(`\b(?:Mr|Mrs|Ms|Mx|Miss|Dr|Prof)\.? [A-Z][\p{L}'-]+(?: [A-Z][\p{L}'-]+)?`), nil},
+}
+
+// Dates look like phone numbers to the pattern; these aren't redacted
+var datePattern = regexp.MustCompile(`^\d{1,4}[-/.]\d{1,2}[-/.]\d{1,4}$`)
+
+// A phone number has 7 to 15 digits and isn't a date
+func phoneLike(match string) bool {
+	digits := 0
+	for _, r := range match {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= 7 && digits <= 15 && !datePattern.MatchString(match)
+}
+
+// Card numbers pass the Luhn check
+func luhnValid(match string) bool {
+	var sum, n int
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+var (
+	givenNamesOnce sync.Once
+	givenNames     map[string]bool
+)
+
+// Names matched by the dictionary: the embedded list plus one name per line
+// of PII_NAMES_FILE
+func knownGivenNames() map[string]bool {
+	givenNamesOnce.Do(func() {
+		givenNames = make(map[string]bool)
+		addNames := func(text string) {
+			scanner := bufio.NewScanner(strings.NewReader(text))
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				for _, name := range strings.Fields(line) {
+					givenNames[name] = true
+				}
+			}
+		}
+		addNames(givenNamesData)
+
+		if path := os.Getenv("PII_NAMES_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("Failed to read PII_NAMES_FILE %q: %v", path, err)
+			} else {
+				addNames(string(data))
+			}
+		}
+	})
+	return givenNames
+}
+
+// Whether redaction runs; PII_REDACTION=false turns it off
+func redactionEnabled() bool {
+	return os.Getenv("PII_REDACTION") != "false"
+}
+
+// Capitalised words, with any run of them that follows. Not anchored with
+// \b, which only knows ASCII letters and would miss "Élodie"; findNames
+// skips matches inside a word instead.
+var capitalisedRun = regexp.MustCompile(`\p{Lu}[\p{L}'-]*(?: \p{Lu}[\p{L}'-]*)*`)
+
+// Spans of names from the dictionary or the user's own names. A run of
+// capitalised words starting with a known name is one name ("Sam Jones").
+func findNames(text string, extra map[string]bool) [][2]int {
+	names := knownGivenNames()
+	var spans [][2]int
+	for _, m := range capitalisedRun.FindAllStringIndex(text, -1) {
+		// A capital inside a word ("iPhone") doesn't start a name
+		if r, _ := utf8.DecodeLastRuneInString(text[:m[0]]); unicode.IsLetter(r) || unicode.IsDigit(r) {
+			continue
+		}
+		words := strings.Split(text[m[0]:m[1]], " ")
+		start := m[0]
+		for i, w := range words {
+			bare := strings.TrimSuffix(strings.TrimSuffix(w, "'s"), "’s")
+			if names[bare] || extra[bare] {
+				end := start + len(bare)
+				// Take the surname too, if one follows
+				if i+1 < len(words) && bare == w {
+					end = start + len(w) + 1 + len(strings.TrimSuffix(words[i+1], "'s"))
+				}
+				spans = append(spans, [2]int{start, end})
+				break
+			}
+			start += len(w) + 1
+		}
+	}
+	return spans
+}
+
+// A redacted text and how to put its placeholders back
+type redaction struct {
+	Text     string
+	original map[string]string // placeholder to the text it replaced
+}
+
+type piiSpan struct {
+	start, end int
+	kind       string
+}
+
+// Replace PII in text with placeholders. The same value gets the same
+// placeholder throughout the text, numbered in order of appearance, so
+// equal texts redact equally. names are the user's own, always redacted.
+func redactPII(text string, names []string) *redaction {
+	r := &redaction{Text: text, original: map[string]string{}}
+	if !redactionEnabled() || text == "" {
+		return r
+	}
+
+	var spans []piiSpan
+	for _, d := range piiDetectors {
+		for _, m := range d.pattern.FindAllStringIndex(text, -1) {
+			if d.valid == nil || d.valid(text[m[0]:m[1]]) {
+				spans = append(spans, piiSpan{m[0], m[1], d.kind})
+			}
+		}
+	}
+	extra := make(map[string]bool)
+	for _, name := range names {
+		for _, part := range strings.Fields(name) {
+			if len([]rune(part)) > 1 && unicode.IsUpper([]rune(part)[0]) {
+				extra[part] = true
+			}
+		}
+	}
+	for _, m := range findNames(text, extra) {
+		spans = append(spans, piiSpan{m[0], m[1], piiPerson})
+	}
+	if len(spans) == 0 {
+		return r
+	}
+
+	// Keep the first detector's span where spans overlap, then the longer
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	var kept []piiSpan
+	for _, s := range spans {
+		if n := len(kept); n > 0 && s.start < kept[n-1].end {
+			if piiPriority(s.kind) < piiPriority(kept[n-1].kind) ||
+				(s.kind == kept[n-1].kind && s.end > kept[n-1].end) {
+				kept[n-1] = s
+			}
+			continue
+		}
+		kept = append(kept, s)
+	}
+
+	placeholders := make(map[string]string) // kind and normalised value to placeholder
+	counts := make(map[string]int)
+	var out strings.Builder
+	pos := 0
+	for _, s := range kept {
+		value := text[s.start:s.end]
+		key := s.kind + "\x00" + normalisePII(s.kind, value)
+		placeholder, ok := placeholders[key]
+		if !ok {
+			// Skip numbers the text already uses, so they restore unambiguously
+			for {
+				counts[s.kind]++
+				placeholder = fmt.Sprintf("[%s_%d]", s.kind, counts[s.kind])
+				if !strings.Contains(text, placeholder) {
+					break
+				}
+			}
+			placeholders[key] = placeholder
+			r.original[placeholder] = value
+		}
+		out.WriteString(text[pos:s.start])
+		out.WriteString(placeholder)
+		pos = s.end
+	}
+	out.WriteString(text[pos:])
+	r.Text = out.String()
+	return r
+}
+
+func piiPriority(kind string) int {
+	for i, d := range piiDetectors {
+		if d.kind == kind {
+			return i
+		}
+	}
+	return len(piiDetectors)
+}
+
+// Compare values ignoring case, spacing and phone punctuation
+func normalisePII(kind, value string) string {
+	if kind == piiPhone || kind == piiAccount || kind == piiID {
+		var digits strings.Builder
+		for _, r := range value {
+			if unicode.IsDigit(r) || unicode.IsLetter(r) {
+				digits.WriteRune(r)
+			}
+		}
+		return strings.ToUpper(digits.String())
+	}
+	return strings.ToLower(strings.Join(strings.Fields(value), " "))
+}
+
+// Longest placeholder the restorer waits for, e.g. [ADDRESS_12345]
+const maxPlaceholderLen = 24
+
+// Put the original values back in generated text
+func (r *redaction) restore(text string) string {
+	if len(r.original) == 0 || !strings.Contains(text, "[") {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(r.original))
+	for placeholder, value := range r.original {
+		pairs = append(pairs, placeholder, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// Restores placeholders in streamed text, holding back a possible
+// placeholder until it is complete
+type streamRestorer struct {
+	redaction *redaction
+	pending   string
+}
+
+// The text that can be passed on after this token
+func (s *streamRestorer) write(token string) string {
+	s.pending += token
+	if len(s.redaction.original) == 0 {
+		out := s.pending
+		s.pending = ""
+		return out
+	}
+
+	// Hold back from the last "[" that isn't closed yet, if it could still
+	// become a placeholder
+	hold := len(s.pending)
+	if i := strings.LastIndex(s.pending, "["); i >= 0 && !strings.Contains(s.pending[i:], "]") &&
+		len(s.pending)-i < maxPlaceholderLen {
+		hold = i
+	}
+	out := s.redaction.restore(s.pending[:hold])
+	s.pending = s.pending[hold:]
+	return out
+}
+
+// Whatever is still held back, at the end of the stream
+func (s *streamRestorer) flush() string {
+	out := s.redaction.restore(s.pending)
+	s.pending = ""
+	return out
+}
+
+// The user whose text a model call carries, and what may be sent for them
+type modelUser struct {
+	ID      int
+	Privacy PrivacySettings
+	Names   []string // their own names, always redacted
+}
+
+type modelUserKey struct{}
+
+// Attach the user to ctx for the model calls made with it. If the user
+// can't be loaded, nothing is sent or kept for them.
+func withModelUser(ctx context.Context, userID int) context.Context {
+	u := &modelUser{ID: userID}
+	if user, err := store.Users.GetByID(userID); err != nil {
+		log.Printf("Failed to load user %d for model calls, keeping their text local: %v", userID, err)
+	} else {
+		u.Privacy = user.PrivacySettings
+		u.Names = []string{user.Name}
+	}
+	return context.WithValue(ctx, modelUserKey{}, u)
+}
+
+// Check that ctx's text may go to an external provider and redact it
+func prepareExternalText(ctx context.Context, text string) (*redaction, error) {
+	var names []string
+	if u, ok := ctx.Value(modelUserKey{}).(*modelUser); ok {
+		if !u.Privacy.ExternalProcessing {
+			return nil, errExternalProcessingDisabled
+		}
+		names = u.Names
+	}
+	return redactPII(text, names), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactPII(t *testing.T) {
+	t.Setenv("PII_REDACTION", "")
+
+	tests := []struct {
+		name    string
+		text    string
+		names   []string
+		want    string
+		wantPII map[string]string
+	}{
+		{"empty", "", nil, "", map[string]string{}},
+		{"nothing to redact", "A quiet day at home.", nil, "A quiet day at home.", map[string]string{}},
+		{"email", "Write to sam@example.com", nil, "Write to [EMAIL_1]",
+			map[string]string{"[EMAIL_1]": "sam@example.com"}},
+		{"phone", "Call +44 20 7946 0958 tomorrow", nil, "Call [PHONE_1] tomorrow",
+			map[string]string{"[PHONE_1]": "+44 20 7946 0958"}},
+		{"dates are not phones", "Booked for 2024-05-01", nil, "Booked for 2024-05-01", map[string]string{}},
+		{"card passing luhn", "Card 4111 1111 1111 1111 expired", nil, "Card [ACCOUNT_1] expired",
+			map[string]string{"[ACCOUNT_1]": "4111 1111 1111 1111"}},
+		{"number failing luhn", "Order 4111 1111 1111 1112 shipped", nil, "Order 4111 1111 1111 1112 shipped", map[string]string{}},
+		{"name and full name", "Sam and Sam Jones", nil, "[PERSON_1] and [PERSON_2]",
+			map[string]string{"[PERSON_1]": "Sam", "[PERSON_2]": "Sam Jones"}},
+		{"same value, same placeholder", "Sam called. Then sam@example.com and Sam again.", nil,
+			"[PERSON_1] called. Then [EMAIL_1] and [PERSON_1] again.",
+			map[string]string{"[PERSON_1]": "Sam", "[EMAIL_1]": "sam@example.com"}},
+		{"possessive", "Maria's birthday", nil, "[PERSON_1]'s birthday", map[string]string{"[PERSON_1]": "Maria"}},
+		{"user's own multibyte name", "Élodie est partie avec Zoë", []string{"Élodie Durand", "Zoë"},
+			"[PERSON_1] est partie avec [PERSON_2]", map[string]string{"[PERSON_1]": "Élodie", "[PERSON_2]": "Zoë"}},
+		{"multibyte full name", "Je vois Élodie Durand demain", []string{"Élodie Durand"},
+			"Je vois [PERSON_1] demain", map[string]string{"[PERSON_1]": "Élodie Durand"}},
+		{"capital inside a word", "My iSam app", []string{"Sam"}, "My iSam app", map[string]string{}},
+		{"title and multibyte surname", "Dr. Müller called", nil, "[PERSON_1] called",
+			map[string]string{"[PERSON_1]": "Dr. Müller"}},
+		{"placeholder already in the text", "[PERSON_1] is what I call Sam", nil, "[PERSON_1] is what I call [PERSON_2]",
+			map[string]string{"[PERSON_2]": "Sam"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := redactPII(tt.text, tt.names)
+			if r.Text != tt.want {
+				t.Errorf("redactPII(%q) = %q, want %q", tt.text, r.Text, tt.want)
+			}
+			if !reflect.DeepEqual(r.original, tt.wantPII) {
+				t.Errorf("placeholders = %v, want %v", r.original, tt.wantPII)
+			}
+			if restored := r.restore(r.Text); restored != tt.text {
+				t.Errorf("restore(%q) = %q, want %q", r.Text, restored, tt.text)
+			}
+		})
+	}
+}
+
+func TestRedactPIIDisabled(t *testing.T) {
+	t.Setenv("PII_REDACTION", "false")
+
+	text := "Sam's number is +44 20 7946 0958"
+	if r := redactPII(text, []string{"Sam"}); r.Text != text || len(r.original) != 0 {
+		t.Errorf("redactPII with redaction off = %q, %v", r.Text, r.original)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	r := &redaction{original: map[string]string{"[PERSON_1]": "Élodie", "[PERSON_12]": "Sam", "[EMAIL_1]": "a@b.co"}}
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"empty", "", ""},
+		{"no placeholders", "Take a walk.", "Take a walk."},
+		{"placeholder", "Call [PERSON_1] tonight", "Call Élodie tonight"},
+		{"longer number not confused with a prefix", "[PERSON_12] and [PERSON_1]", "Sam and Élodie"},
+		{"unknown placeholder left", "Ask [PERSON_3]", "Ask [PERSON_3]"},
+		{"repeated", "[EMAIL_1], [EMAIL_1]", "a@b.co, a@b.co"},
+		{"brackets that aren't placeholders", "[note] 😊", "[note] 😊"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.restore(tt.text); got != tt.want {
+				t.Errorf("restore(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamRestorer(t *testing.T) {
+	r := &redaction{original: map[string]string{"[PERSON_1]": "Élodie", "[EMAIL_1]": "a@b.co"}}
+	longBracket := "[" + strings.Repeat("x", maxPlaceholderLen) + " more"
+
+	tests := []struct {
+		name   string
+		tokens []string
+		// What each write passes on; the flush gives the rest
+		wantWrites []string
+		want       string
+	}{
+		{"no tokens", nil, nil, ""},
+		{"empty tokens", []string{"", ""}, []string{"", ""}, ""},
+		{"whole placeholder in one token", []string{"Hi [PERSON_1]!"}, []string{"Hi Élodie!"}, "Hi Élodie!"},
+		{"placeholder split across tokens", []string{"Hi [PER", "SON", "_1], bye"},
+			[]string{"Hi ", "", "Élodie, bye"}, "Hi Élodie, bye"},
+		{"split at the bracket", []string{"Mail [", "EMAIL_1]"}, []string{"Mail ", "a@b.co"}, "Mail a@b.co"},
+		{"two placeholders split", []string{"[PERSON_1] at [EM", "AIL_1] 😊"},
+			[]string{"Élodie at ", "a@b.co 😊"}, "Élodie at a@b.co 😊"},
+		{"bracket closed without a placeholder", []string{"see [no", "te] ok"}, []string{"see ", "[note] ok"}, "see [note] ok"},
+		{"unclosed bracket held until flush", []string{"list: [PERS"}, []string{"list: "}, "list: [PERS"},
+		{"unclosed bracket too long to be a placeholder", []string{longBracket}, []string{longBracket}, longBracket},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &streamRestorer{redaction: r}
+			var out strings.Builder
+			var writes []string
+			for _, token := range tt.tokens {
+				w := s.write(token)
+				writes = append(writes, w)
+				out.WriteString(w)
+			}
+			out.WriteString(s.flush())
+
+			if !reflect.DeepEqual(writes, tt.wantWrites) {
+				t.Errorf("writes = %q, want %q", writes, tt.wantWrites)
+			}
+			if out.String() != tt.want {
+				t.Errorf("streamed %q, want %q", out.String(), tt.want)
+			}
+			if got := r.restore(strings.Join(tt.tokens, "")); got != tt.want {
+				t.Errorf("restoring the whole text gives %q, streaming %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Without placeholders to restore, tokens pass straight through
+func TestStreamRestorerNothingRedacted(t *testing.T) {
+	s := &streamRestorer{redaction: &redaction{original: map[string]string{}}}
+	for _, token := range []string{"[PER", "SON_1]", " é"} {
+		if got := s.write(token); got != token {
+			t.Errorf("write(%q) = %q, want it unchanged", token, got)
+		}
+	}
+	if got := s.flush(); got != "" {
+		t.Errorf("flush() = %q, want nothing", got)
+	}
+}
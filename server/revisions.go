@@ -0,0 +1,327 @@
+// revisions.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A saved version of an entry's title and text
+type EntryRevision struct {
+	EntryID   int       `json:"entry_id"`
+	Revision  int       `json:"revision"`
+	Title     string    `json:"title"`
+	Text      string    `json:"text"`
+	SavedAt   time.Time `json:"saved_at"`
+	IsCurrent bool      `json:"is_current"`
+}
+
+// One step of a word-level diff
+type DiffOp struct {
+	Op   string `json:"op"` // "equal", "insert" or "delete"
+	Text string `json:"text"`
+}
+
+type RevisionDiff struct {
+	EntryID int      `json:"entry_id"`
+	From    int      `json:"from"`
+	To      int      `json:"to"`
+	Title   []DiffOp `json:"title"`
+	Text    []DiffOp `json:"text"`
+}
+
+// Load the entry named by the {id} route variable, writing an error response
+// and returning false if it is missing or belongs to another user
+func loadOwnedEntry(w http.ResponseWriter, r *http.Request) (*Entry, bool) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	entryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	entry, err := store.Entries.GetByID(entryID)
+	if err != nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return nil, false
+	}
+	if entry.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// The entry's live content as a revision
+func currentRevision(entry *Entry) *EntryRevision {
+	savedAt := entry.CreatedAt
+	if entry.UpdatedAt != nil {
+		savedAt = *entry.UpdatedAt
+	}
+
+	return &EntryRevision{
+		EntryID:   entry.ID,
+		Revision:  entry.Revision,
+		Title:     entry.Title,
+		Text:      entry.Text,
+		SavedAt:   savedAt,
+		IsCurrent: true,
+	}
+}
+
+// Look up a revision of the entry, including the current one
+func getRevision(entry *Entry, revision int) (*EntryRevision, error) {
+	if revision == entry.Revision {
+		return currentRevision(entry), nil
+	}
+	return store.Revisions.Get(entry.ID, revision)
+}
+
+// List every version of an entry, current first
+func listRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := loadOwnedEntry(w, r)
+	if !ok {
+		return
+	}
+
+	archived, err := store.Revisions.ListByEntry(entry.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
+	}
+
+	revisions := append([]EntryRevision{*currentRevision(entry)}, archived...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// Word-level diff between two revisions: ?from=1&to=3. "to" defaults to the
+// current revision and "from" to the one before it.
+func diffRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := loadOwnedEntry(w, r)
+	if !ok {
+		return
+	}
+
+	to := entry.Revision
+	if v := r.URL.Query().Get("to"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid 'to' revision", http.StatusBadRequest)
+			return
+		}
+		to = n
+	}
+
+	from := to - 1
+	if v := r.URL.Query().Get("from"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid 'from' revision", http.StatusBadRequest)
+			return
+		}
+		from = n
+	}
+
+	fromRev, err := getRevision(entry, from)
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	toRev, err := getRevision(entry, to)
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	diff := RevisionDiff{
+		EntryID: entry.ID,
+		From:    from,
+		To:      to,
+		Title:   diffWords(fromRev.Title, toRev.Title),
+		Text:    diffWords(fromRev.Text, toRev.Text),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// Restore an old revision as the entry's current content. The content being
+// replaced is archived like any other edit, so a restore can be undone.
+func restoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := loadOwnedEntry(w, r)
+	if !ok {
+		return
+	}
+
+	revision, err := strconv.Atoi(mux.Vars(r)["revision"])
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+	if revision == entry.Revision {
+		http.Error(w, "Revision is already current", http.StatusBadRequest)
+		return
+	}
+
+	old, err := store.Revisions.Get(entry.ID, revision)
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	entry.Title = old.Title
+	entry.Text = old.Text
+	current := entry.Revision
+	if err := store.Entries.Update(entry); err != nil {
+		http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	// Re-analyze mood in background, unless the old content matched the
+	// current one
+	if entry.Revision != current {
+		go reanalyzeEntry(*entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// Words and the whitespace between them, so a diff reassembles exactly
+var diffTokenPattern = regexp.MustCompile(`\s+|\S+`)
+
+// Above this many edits the diff falls back to replacing the whole text.
+// Backtracking keeps the diagonals of every round, about maxDiffEdits²
+// ints, so this caps a diff at a few MB however unrelated the revisions.
+const maxDiffEdits = 500
+
+// Compute a word-level diff from a to b using Myers' algorithm
+func diffWords(a, b string) []DiffOp {
+	aTokens := diffTokenPattern.FindAllString(a, -1)
+	bTokens := diffTokenPattern.FindAllString(b, -1)
+
+	var ops []DiffOp
+	push := func(op, text string) {
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, DiffOp{Op: op, Text: text})
+	}
+
+	edits, ok := myersDiff(aTokens, bTokens)
+	if !ok {
+		if a != "" {
+			push("delete", a)
+		}
+		if b != "" {
+			push("insert", b)
+		}
+		return ops
+	}
+
+	for _, e := range edits {
+		push(e.op, e.text)
+	}
+	if ops == nil {
+		ops = []DiffOp{}
+	}
+	return ops
+}
+
+type diffEdit struct {
+	op   string
+	text string
+}
+
+// Shortest edit script between two token slices. Returns false if it would
+// take more than maxDiffEdits edits.
+func myersDiff(a, b []string) ([]diffEdit, bool) {
+	n, m := len(a), len(b)
+	maxD := n + m
+	if maxD > maxDiffEdits {
+		maxD = maxDiffEdits
+	}
+
+	// v[k] is the furthest x reached on diagonal k; offset shifts k >= -d-1
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+
+	// trace[d] holds v for diagonals -d-1..d+1 before round d, for backtracking
+	var trace [][]int
+	found := false
+
+	for d := 0; d <= maxD && !found; d++ {
+		snapshot := make([]int, 2*d+3)
+		copy(snapshot, v[offset-d-1:offset+d+2])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		return nil, false
+	}
+
+	// Walk back from (n, m) collecting edits in reverse
+	var edits []diffEdit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snap := trace[d]
+		at := func(k int) int { return snap[k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			edits = append(edits, diffEdit{"equal", a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, diffEdit{"insert", b[y-1]})
+			} else {
+				edits = append(edits, diffEdit{"delete", a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits, true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Rebuild both sides of a diff: equal and deleted text make the old side,
+// equal and inserted text the new one
+func applyDiff(ops []DiffOp) (string, string) {
+	var from, to strings.Builder
+	for _, op := range ops {
+		switch op.Op {
+		case "equal":
+			from.WriteString(op.Text)
+			to.WriteString(op.Text)
+		case "delete":
+			from.WriteString(op.Text)
+		case "insert":
+			to.WriteString(op.Text)
+		}
+	}
+	return from.String(), to.String()
+}
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []DiffOp
+	}{
+		{"both empty", "", "", []DiffOp{}},
+		{"from empty", "", "new text", []DiffOp{{"insert", "new text"}}},
+		{"to empty", "old text", "", []DiffOp{{"delete", "old text"}}},
+		{"unchanged", "same words", "same words", []DiffOp{{"equal", "same words"}}},
+		{"word replaced", "the cat sat", "the dog sat",
+			[]DiffOp{{"equal", "the "}, {"delete", "cat"}, {"insert", "dog"}, {"equal", " sat"}}},
+		{"word appended", "I walked", "I walked home",
+			[]DiffOp{{"equal", "I walked"}, {"insert", " home"}}},
+		{"whitespace changed", "a b", "a\n\nb",
+			[]DiffOp{{"equal", "a"}, {"delete", " "}, {"insert", "\n\n"}, {"equal", "b"}}},
+		{"multibyte words", "Ça va très bien 😊", "Ça va très mal 😊",
+			[]DiffOp{{"equal", "Ça va très "}, {"delete", "bien"}, {"insert", "mal"}, {"equal", " 😊"}}},
+		{"multibyte punctuation kept in word", "今日は 晴れ。", "今日は 雨。",
+			[]DiffOp{{"equal", "今日は "}, {"delete", "晴れ。"}, {"insert", "雨。"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffWords(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffWords(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if from, to := applyDiff(got); from != tt.a || to != tt.b {
+				t.Errorf("diff rebuilds %q -> %q, want %q -> %q", from, to, tt.a, tt.b)
+			}
+		})
+	}
+}
+
+func TestDiffWordsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{"reordered", "one two three four", "four three two one"},
+		{"interleaved edits", "a b c d e f g", "a x c d y f z g"},
+		{"mixed scripts", "Привет мир, hello world", "Привет, hello новый world"},
+		{"emoji only", "😊 😢 😡", "😢 😊"},
+		{"leading and trailing space", "  padded  ", "padded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := diffWords(tt.a, tt.b)
+			if from, to := applyDiff(ops); from != tt.a || to != tt.b {
+				t.Errorf("diff rebuilds %q -> %q, want %q -> %q", from, to, tt.a, tt.b)
+			}
+			for i := 1; i < len(ops); i++ {
+				if ops[i].Op == ops[i-1].Op {
+					t.Errorf("adjacent %s ops not merged: %v", ops[i].Op, ops)
+				}
+			}
+		})
+	}
+}
+
+// Past maxDiffEdits the diff falls back to replacing the whole text
+func TestDiffWordsTooManyEdits(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < maxDiffEdits; i++ {
+		a.WriteString("x ")
+		b.WriteString("y ")
+	}
+
+	got := diffWords(a.String(), b.String())
+	want := []DiffOp{{"delete", a.String()}, {"insert", b.String()}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d ops, want a single delete and insert", len(got))
+	}
+}
+
+// A small edit to a long entry stays within the cap and diffs normally
+func TestDiffWordsLongText(t *testing.T) {
+	before := strings.Repeat("walked along the river ", 1000)
+	after := before + "and sat down"
+
+	got := diffWords(before+"home", after)
+	want := []DiffOp{{"equal", before}, {"delete", "home"}, {"insert", "and sat down"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d ops, want equal, delete and insert", len(got))
+	}
+}
+
+// Only a changed title or text makes a new revision, with or without
+// encryption
+func TestEntryUpdateRevisions(t *testing.T) {
+	for name, keys := range map[string]*masterKeys{"plaintext": {}, "encrypted": {current: newTestMasterKey(t)}} {
+		t.Run(name, func(t *testing.T) {
+			_, s := openTestStore(t, filepath.Join(t.TempDir(), "journal.db"), keys)
+			user, err := s.Users.Create("Zoë", "zoe@example.com", "hash", "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := &Entry{UserID: user.ID, Title: "Día", Text: "Très bien 😊", Date: "2026-10-18", Timezone: "UTC"}
+			if err := s.Entries.Create(entry); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name         string
+				edit         func(e *Entry)
+				wantRevision int
+			}{
+				{"nothing", func(e *Entry) {}, 1},
+				{"tags and date", func(e *Entry) { e.Tags = []string{"été"}; e.Date = "2026-10-17" }, 1},
+				{"text", func(e *Entry) { e.Text = "Très bien, vraiment 😊" }, 2},
+				{"title", func(e *Entry) { e.Title = "Dia" }, 3},
+				{"tags again", func(e *Entry) { e.Tags = []string{} }, 3},
+				{"text back to an old one", func(e *Entry) { e.Text = "Très bien 😊" }, 4},
+			}
+			for _, tt := range tests {
+				tt.edit(entry)
+				if err := s.Entries.Update(entry); err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				revisions, err := s.Revisions.ListByEntry(entry.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if entry.Revision != tt.wantRevision || len(revisions) != tt.wantRevision-1 {
+					t.Errorf("after editing the %s: revision %d with %d archived, want %d with %d",
+						tt.name, entry.Revision, len(revisions), tt.wantRevision, tt.wantRevision-1)
+				}
+			}
+
+			got, err := s.Entries.GetByID(entry.ID)
+			if err != nil || got.Revision != 4 || got.Date != "2026-10-17" || got.Title != "Dia" {
+				t.Errorf("entry read back as %+v, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+// risk.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Risk levels stored with each mood analysis
+const (
+	riskNone     = "none"
+	riskConcern  = "concern"  // distress or hopelessness without explicit intent
+	riskCritical = "critical" // self-harm or suicidal language
+)
+
+// Order of severity, for taking the higher of two levels
+var riskRank = map[string]int{riskNone: 0, riskConcern: 1, riskCritical: 2}
+
+type RiskAssessment struct {
+	Level   string   `json:"level"`
+	Reasons []string `json:"reasons"` // rule categories or "model"
+}
+
+// Whether the text must be kept away from generative models
+func (a RiskAssessment) Flagged() bool {
+	return a.Level != riskNone
+}
+
+type riskRule struct {
+	level    string
+	category string
+	pattern  *regexp.Regexp
+}
+
+// Phrase rules. They err towards flagging: a false positive only means the
+// entry gets support resources instead of a generated suggestion.
+var riskRules = []riskRule{
+	{riskCritical, "suicidal_ideation", regexp.MustCompile(`\bsuicid(e|al)\b`)},
+	{riskCritical, "suicidal_ideation", regexp.MustCompile(`\b(kill|killing|end|ending|take|taking) (myself|my own life|my life)\b`)},
+	{riskCritical, "suicidal_ideation", regexp.MustCompile(`\b(want|wanted|wanting|going) to die\b`)},
+	{riskCritical, "suicidal_ideation", regexp.MustCompile(`\bwish(ed)? i (was|were|had been) (dead|never born)\b`)},
+	{riskCritical, "suicidal_ideation", regexp.MustCompile(`\b(better off dead|better off without me)\b`)},
+	{riskCritical, "suicidal_ideation", regexp.MustCompile(`\b(no|any) reason to (live|keep living|go on)\b`)},
+	{riskCritical, "suicidal_ideation", regexp.MustCompile(`\b(don't|do not|didn't|not) want to (be alive|live|wake up)\b`)},
+	{riskCritical, "self_harm", regexp.MustCompile(`\bself[- ]?harm(ing)?\b`)},
+	{riskCritical, "self_harm", regexp.MustCompile(`\b(hurt|hurting|harm|harming|cut|cutting|burn|burning|starve|starving) myself\b`)},
+	{riskCritical, "self_harm", regexp.MustCompile(`\boverdos(e|ed|ing)\b`)},
+	{riskConcern, "hopelessness", regexp.MustCompile(`\b(hopeless|worthless)\b`)},
+	{riskConcern, "hopelessness", regexp.MustCompile(`\bcan't (go on|take (it|this) any ?more|do this any ?more)\b`)},
+	{riskConcern, "hopelessness", regexp.MustCompile(`\b(no way out|give up on (everything|life)|disappear forever)\b`)},
+	{riskConcern, "hopelessness", regexp.MustCompile(`\b(nobody|no one) would (care|notice|miss me)\b`)},
+}
+
+// Optional text-classification model (RISK_MODEL) used alongside the rules.
+// It can raise the level the rules found but never lower it.
+func riskModel() string {
+	return strings.TrimSpace(os.Getenv("RISK_MODEL"))
+}
+
+// Model labels treated as risk, matched by substring
+var riskModelLabels = []string{"suicid", "self-harm", "self_harm", "selfharm", "crisis", "risk"}
+
+// Assess a text for crisis language
+func assessRisk(ctx context.Context, text string) RiskAssessment {
+	normalized := strings.ToLower(strings.ReplaceAll(text, "’", "'"))
+
+	assessment := RiskAssessment{Level: riskNone, Reasons: []string{}}
+	seen := make(map[string]bool)
+	for _, rule := range riskRules {
+		if !rule.pattern.MatchString(normalized) {
+			continue
+		}
+		if riskRank[rule.level] > riskRank[assessment.Level] {
+			assessment.Level = rule.level
+		}
+		if !seen[rule.category] {
+			seen[rule.category] = true
+			assessment.Reasons = append(assessment.Reasons, rule.category)
+		}
+	}
+
+	if model := riskModel(); model != "" && assessment.Level != riskCritical && !privacyFrom(ctx).localOnly() {
+		if level, err := classifyRiskWithModel(ctx, model, text); err != nil {
+			log.Printf("Risk model failed, using rules only: %v", err)
+		} else if riskRank[level] > riskRank[assessment.Level] {
+			assessment.Level = level
+			assessment.Reasons = append(assessment.Reasons, "model")
+		}
+	}
+
+	return assessment
+}
+
+// Ask the configured classifier for a risk level. Long text is classified
+// chunk by chunk and takes the highest level found, stopping at critical.
+func classifyRiskWithModel(ctx context.Context, model, text string) (string, error) {
+	chunks := chunkText(text)
+	if len(chunks) <= 1 {
+		return classifyRiskChunk(ctx, model, text)
+	}
+
+	level := riskNone
+	for _, chunk := range chunks {
+		chunkLevel, err := classifyRiskChunk(ctx, model, chunk.Text)
+		if err != nil {
+			return "", err
+		}
+		if riskRank[chunkLevel] > riskRank[level] {
+			level = chunkLevel
+		}
+		if level == riskCritical {
+			break
+		}
+	}
+	return level, nil
+}
+
+// Risk level of text that fits the classifier's input
+func classifyRiskChunk(ctx context.Context, model, text string) (string, error) {
+	response, err := callHuggingFaceAPI(ctx, model, "risk", text)
+	if err != nil {
+		return "", err
+	}
+
+	var nested [][]EmotionResult
+	var flat []EmotionResult
+	if err := json.Unmarshal(response, &nested); err == nil && len(nested) > 0 {
+		flat = nested[0]
+	} else if err := json.Unmarshal(response, &flat); err != nil {
+		return "", fmt.Errorf("unexpected risk model response: %s", string(response))
+	}
+
+	level := riskNone
+	for _, result := range flat {
+		label := strings.ToLower(result.Label)
+		for _, riskLabel := range riskModelLabels {
+			if !strings.Contains(label, riskLabel) {
+				continue
+			}
+			switch {
+			case result.Score >= 0.8:
+				return riskCritical, nil
+			case result.Score >= 0.5:
+				level = riskConcern
+			}
+		}
+	}
+	return level, nil
+}
+
+// Risk level to store; analyses made without screening count as none
+func (m *MoodResult) riskLevel() string {
+	if m.RiskLevel == "" {
+		return riskNone
+	}
+	return m.RiskLevel
+}
+
+// Whether an entry must be kept out of generative prompts, either because
+// its stored analysis flagged it or because its text does now
+func isFlaggedEntry(ctx context.Context, entry Entry) bool {
+	if analysis, err := getMoodAnalysis(entry.ID); err == nil && analysis.RiskLevel != "" && analysis.RiskLevel != riskNone {
+		return true
+	}
+	return assessRisk(ctx, entry.Title+" "+entry.Text).Flagged()
+}
+
+// A crisis line or support service
+type HelplineResource struct {
+	Name  string `json:"name"`
+	Phone string `json:"phone,omitempty"`
+	Text  string `json:"text,omitempty"` // how to reach it by text message
+	URL   string `json:"url,omitempty"`
+}
+
+type HelplineRegion struct {
+	Region    string             `json:"region"`
+	Emergency string             `json:"emergency"` // emergency services number
+	Resources []HelplineResource `json:"resources"`
+}
+
+// Built-in helplines by region code. HELPLINES_FILE can add regions or
+// replace these with a JSON object of the same shape.
+var defaultHelplines = map[string]HelplineRegion{
+	"US": {Emergency: "911", Resources: []HelplineResource{
+		{Name: "988 Suicide & Crisis Lifeline", Phone: "988", Text: "Text 988", URL: "https://988lifeline.org"},
+		{Name: "Crisis Text Line", Text: "Text HOME to 741741", URL: "https://www.crisistextline.org"},
+	}},
+	"CA": {Emergency: "911", Resources: []HelplineResource{
+		{Name: "9-8-8 Suicide Crisis Helpline", Phone: "988", Text: "Text 988", URL: "https://988.ca"},
+	}},
+	"UK": {Emergency: "999", Resources: []HelplineResource{
+		{Name: "Samaritans", Phone: "116 123", URL: "https://www.samaritans.org"},
+		{Name: "Shout", Text: "Text SHOUT to 85258", URL: "https://giveusashout.org"},
+	}},
+	"IE": {Emergency: "112", Resources: []HelplineResource{
+		{Name: "Samaritans", Phone: "116 123", URL: "https://www.samaritans.org/ireland"},
+		{Name: "Text About It", Text: "Text HELLO to 50808", URL: "https://text50808.ie"},
+	}},
+	"AU": {Emergency: "000", Resources: []HelplineResource{
+		{Name: "Lifeline", Phone: "13 11 14", Text: "Text 0477 13 11 14", URL: "https://www.lifeline.org.au"},
+	}},
+	"NZ": {Emergency: "111", Resources: []HelplineResource{
+		{Name: "Need to talk? 1737", Phone: "1737", Text: "Text 1737", URL: "https://1737.org.nz"},
+		{Name: "Lifeline Aotearoa", Phone: "0800 543 354", URL: "https://www.lifeline.org.nz"},
+	}},
+	"IN": {Emergency: "112", Resources: []HelplineResource{
+		{Name: "Tele-MANAS", Phone: "14416", URL: "https://telemanas.mohfw.gov.in"},
+	}},
+	"DE": {Emergency: "112", Resources: []HelplineResource{
+		{Name: "TelefonSeelsorge", Phone: "0800 111 0 111", URL: "https://www.telefonseelsorge.de"},
+	}},
+	"INTL": {Emergency: "your local emergency number", Resources: []HelplineResource{
+		{Name: "Find A Helpline", URL: "https://findahelpline.com"},
+	}},
+}
+
+// Region used when HELPLINE_REGION is unset or unknown
+const defaultHelplineRegion = "INTL"
+
+var (
+	helplinesOnce sync.Once
+	helplines     map[string]HelplineRegion
+)
+
+// Built-in helplines merged with HELPLINES_FILE, loaded once
+func loadHelplines() map[string]HelplineRegion {
+	helplinesOnce.Do(func() {
+		helplines = make(map[string]HelplineRegion)
+		for code, region := range defaultHelplines {
+			helplines[code] = region
+		}
+
+		path := os.Getenv("HELPLINES_FILE")
+		if path == "" {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read HELPLINES_FILE %s: %v", path, err)
+			return
+		}
+		var custom map[string]HelplineRegion
+		if err := json.Unmarshal(data, &custom); err != nil {
+			log.Printf("Failed to parse HELPLINES_FILE %s: %v", path, err)
+			return
+		}
+		for code, region := range custom {
+			helplines[strings.ToUpper(code)] = region
+		}
+	})
+	return helplines
+}
+
+// Helplines for the configured region (HELPLINE_REGION)
+func helplinesForRegion() HelplineRegion {
+	all := loadHelplines()
+
+	code := strings.ToUpper(strings.TrimSpace(os.Getenv("HELPLINE_REGION")))
+	region, ok := all[code]
+	if !ok {
+		code = defaultHelplineRegion
+		region = all[code]
+	}
+	region.Region = code
+	return region
+}
+
+// Support message used in place of a generated suggestion for a flagged
+// entry
+func safetySuggestion(level string) string {
+	region := helplinesForRegion()
+
+	var b strings.Builder
+	if level == riskCritical {
+		b.WriteString("It sounds like you may be going through something really painful, and you don't have to face it alone. ")
+		b.WriteString(fmt.Sprintf("If you are in immediate danger, please call %s now. ", region.Emergency))
+	} else {
+		b.WriteString("It sounds like things feel very heavy right now. Talking to someone can help, even when it feels like it won't. ")
+	}
+
+	var ways []string
+	for _, r := range region.Resources {
+		var contact []string
+		if r.Phone != "" {
+			contact = append(contact, "call "+r.Phone)
+		}
+		if r.Text != "" {
+			contact = append(contact, strings.ToLower(r.Text[:1])+r.Text[1:])
+		}
+		if r.URL != "" {
+			contact = append(contact, r.URL)
+		}
+		ways = append(ways, fmt.Sprintf("%s (%s)", r.Name, strings.Join(contact, ", ")))
+	}
+	if len(ways) > 0 {
+		b.WriteString("You can reach " + strings.Join(ways, "; ") + ". ")
+	}
+	b.WriteString("Reaching out to someone you trust can help too.")
+
+	return b.String()
+}
+
+// Helplines for the configured region, for the UI to show alongside a
+// flagged analysis
+func getSafetyResourcesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(helplinesForRegion())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAssessRisk(t *testing.T) {
+	t.Setenv("RISK_MODEL", "")
+
+	tests := []struct {
+		name        string
+		text        string
+		wantLevel   string
+		wantReasons []string
+	}{
+		{"empty", "", riskNone, []string{}},
+		{"ordinary entry", "Went for a run and felt great afterwards.", riskNone, []string{}},
+		{"suicidal ideation", "Some days I think about suicide.", riskCritical, []string{"suicidal_ideation"}},
+		{"case and curly apostrophe", "I DON’T WANT TO WAKE UP tomorrow", riskCritical, []string{"suicidal_ideation"}},
+		{"ending my life", "I keep thinking about ending my life", riskCritical, []string{"suicidal_ideation"}},
+		{"self harm", "I started cutting myself again", riskCritical, []string{"self_harm"}},
+		{"hyphenated self-harm", "Thinking about self-harm", riskCritical, []string{"self_harm"}},
+		{"hopelessness only", "Everything feels hopeless and I can't take it anymore", riskConcern, []string{"hopelessness"}},
+		{"critical outranks concern", "I feel worthless. I want to die.", riskCritical, []string{"suicidal_ideation", "hopelessness"}},
+		{"category reported once", "I want to die. Better off dead.", riskCritical, []string{"suicidal_ideation"}},
+		{"words inside other words", "The dieting plan ended; my cutlery is new", riskNone, []string{}},
+		{"killing time is not a risk", "Killing time before the train", riskNone, []string{}},
+		{"multibyte around the phrase", "Ça va mal… I want to die 😢", riskCritical, []string{"suicidal_ideation"}},
+		{"non-English text is not matched", "Je veux mourir", riskNone, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := assessRisk(context.Background(), tt.text)
+			if got.Level != tt.wantLevel || !reflect.DeepEqual(got.Reasons, tt.wantReasons) {
+				t.Errorf("assessRisk(%q) = %s %v, want %s %v", tt.text, got.Level, got.Reasons, tt.wantLevel, tt.wantReasons)
+			}
+			if got.Flagged() != (tt.wantLevel != riskNone) {
+				t.Errorf("Flagged() = %v for level %s", got.Flagged(), got.Level)
+			}
+		})
+	}
+}
+
+// Every rule matches its own example and only raises to its own level
+func TestRiskRules(t *testing.T) {
+	examples := []string{
+		"suicidal", "kill myself", "going to die", "wish i had been never born", "better off without me",
+		"no reason to keep living", "do not want to be alive", "self harming", "starving myself", "overdosed",
+		"worthless", "can't do this any more", "give up on everything", "no one would miss me",
+	}
+	if len(examples) != len(riskRules) {
+		t.Fatalf("%d examples for %d rules", len(examples), len(riskRules))
+	}
+	for i, rule := range riskRules {
+		if !rule.pattern.MatchString(examples[i]) {
+			t.Errorf("rule %d (%s) doesn't match %q", i, rule.category, examples[i])
+		}
+		if _, ok := riskRank[rule.level]; !ok || rule.level == riskNone {
+			t.Errorf("rule %d has level %q", i, rule.level)
+		}
+	}
+}
+
+func TestSafetySuggestion(t *testing.T) {
+	t.Setenv("HELPLINE_REGION", "uk")
+
+	critical := safetySuggestion(riskCritical)
+	for _, want := range []string{"999", "Samaritans (call 116 123", "text SHOUT to 85258"} {
+		if !strings.Contains(critical, want) {
+			t.Errorf("critical suggestion lacks %q: %s", want, critical)
+		}
+	}
+	if concern := safetySuggestion(riskConcern); strings.Contains(concern, "immediate danger") {
+		t.Errorf("concern suggestion mentions immediate danger: %s", concern)
+	}
+
+	t.Setenv("HELPLINE_REGION", "nowhere")
+	if region := helplinesForRegion(); region.Region != defaultHelplineRegion {
+		t.Errorf("unknown region gives %q, want %q", region.Region, defaultHelplineRegion)
+	}
+}
+
+func TestScreenChatHistory(t *testing.T) {
+	t.Setenv("RISK_MODEL", "")
+	user := func(content string) ChatMessage { return ChatMessage{Role: "user", Content: content} }
+	assistant := func(content string) ChatMessage { return ChatMessage{Role: "assistant", Content: content} }
+
+	tests := []struct {
+		name     string
+		messages []ChatMessage
+		want     []string
+	}{
+		{"empty", nil, []string{}},
+		{"nothing flagged", []ChatMessage{user("How was May?"), assistant("Mostly calm 😊")},
+			[]string{"How was May?", "Mostly calm 😊"}},
+		{"flagged question and its answer dropped",
+			[]ChatMessage{user("When did I sleep well?"), assistant("In June."), user("I want to die"), assistant(safetySuggestion(riskCritical)), user("Et après ?")},
+			[]string{"When did I sleep well?", "In June.", "Et après ?"}},
+		{"flagged question without an answer yet", []ChatMessage{user("Ça va"), user("I feel hopeless")}, []string{"Ça va"}},
+		{"answer after an unflagged question kept", []ChatMessage{user("I feel hopeless"), user("Anyway, work?"), assistant("Busy.")},
+			[]string{"Anyway, work?", "Busy."}},
+		{"flagged answer dropped", []ChatMessage{user("What did I write?"), assistant("You wrote you wanted to die.")},
+			[]string{"What did I write?"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, m := range screenChatHistory(context.Background(), tt.messages) {
+				got = append(got, m.Content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("screenChatHistory() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+// sentences.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Sentiment and emotions of one sentence of an entry's text, stored with
+// the analysis. Offsets count Unicode code points into the entry text (not
+// the title); the sentence itself isn't stored.
+type SentenceScore struct {
+	Start     int             `json:"start"`
+	End       int             `json:"end"`
+	Sentiment string          `json:"sentiment"`
+	Score     float64         `json:"score"`
+	Emotions  []EmotionResult `json:"emotions"` // strongest first
+}
+
+const (
+	// Longer entries have their first sentences scored only
+	maxScoredSentences = 80
+	// Emotions kept per sentence
+	sentenceEmotions = 3
+	// Sentences marked as driving the entry's sentiment or top emotion
+	maxDrivingSentences = 3
+	// A sentence must feel the entry's top emotion at least this strongly to
+	// be marked as driving it
+	minDrivingEmotionScore = 0.3
+)
+
+// Sentences don't run across line breaks, even without punctuation
+var lineBreak = regexp.MustCompile(`\n+`)
+
+// Sentences of text as byte offsets, within lines
+func textSentences(text string) [][2]int {
+	var sentences [][2]int
+	for _, line := range splitSpans(text, 0, len(text), lineBreak) {
+		sentences = append(sentences, splitSentences(text, line[0], line[1])...)
+	}
+	return sentences
+}
+
+// A byte span of text as code point offsets
+func runeOffsets(text string, span [2]int) (int, int) {
+	start := utf8.RuneCountInString(text[:span[0]])
+	return start, start + utf8.RuneCountInString(text[span[0]:span[1]])
+}
+
+// Score each sentence of an entry's text, in the language detected for the
+// entry, with the user's calibration. The sentences go to each model in one
+// batched request. A sentence whose sentiment can't be classified is left
+// out.
+func scoreSentences(ctx context.Context, userID int, text, language string) []SentenceScore {
+	spans := textSentences(text)
+	if len(spans) > maxScoredSentences {
+		spans = spans[:maxScoredSentences]
+	}
+	if len(spans) == 0 {
+		return []SentenceScore{}
+	}
+	sentences := make([]string, len(spans))
+	for i, span := range spans {
+		sentences[i] = text[span[0]:span[1]]
+	}
+
+	sentiments, err := sentenceSentiments(ctx, sentences)
+	if err != nil {
+		log.Printf("Could not score any of %d sentences: %v", len(sentences), err)
+		return []SentenceScore{}
+	}
+	emotions, err := sentenceEmotionScores(ctx, emotionRouteFor(language), sentences)
+	if err != nil {
+		log.Printf("Emotions of %d sentences failed: %v", len(sentences), err)
+		emotions = make([][]EmotionResult, len(sentences))
+	}
+	calibration := loadMoodCalibration(userID)
+
+	scores := []SentenceScore{}
+	for i, span := range spans {
+		if sentiments[i].Label == "" {
+			continue
+		}
+		found := emotions[i]
+		if found == nil {
+			found = []EmotionResult{}
+		}
+		sentiment, score, found, _ := calibration.apply(sentiments[i].Label, sentiments[i].Score, found)
+		if len(found) > sentenceEmotions {
+			found = found[:sentenceEmotions]
+		}
+
+		start, end := runeOffsets(text, span)
+		scores = append(scores, SentenceScore{
+			Start:     start,
+			End:       end,
+			Sentiment: sentiment,
+			Score:     score,
+			Emotions:  found,
+		})
+	}
+	return scores
+}
+
+// Sentiment label and signed score of each sentence; an empty label for
+// one that couldn't be classified. Sentences that fit the model's input go
+// in one request, a longer one is classified chunk by chunk on its own.
+func sentenceSentiments(ctx context.Context, sentences []string) ([]EmotionResult, error) {
+	results := make([]EmotionResult, len(sentences))
+	if privacyFrom(ctx).localOnly() {
+		for i, sentence := range sentences {
+			if sentiment, score, err := localSentiment(sentence); err == nil {
+				results[i] = EmotionResult{Label: sentiment, Score: score}
+			}
+		}
+		return results, nil
+	}
+
+	batch, long := splitByModelInput(sentences)
+	if len(batch) > 0 {
+		labelScores, err := classifyBatch(ctx, sentimentModel, "sentiment", textsAt(sentences, batch))
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range batch {
+			sentiment, score := sentimentOf(labelScores[j])
+			results[i] = EmotionResult{Label: sentiment, Score: score}
+		}
+	}
+	for _, i := range long {
+		if sentiment, score, err := analyzeSentiment(ctx, sentences[i]); err == nil {
+			results[i] = EmotionResult{Label: sentiment, Score: score}
+		}
+	}
+	return results, nil
+}
+
+// Emotions of each sentence, strongest first, batched like
+// sentenceSentiments and translated first if the route says to
+func sentenceEmotionScores(ctx context.Context, route emotionRoute, sentences []string) ([][]EmotionResult, error) {
+	results := make([][]EmotionResult, len(sentences))
+	if privacyFrom(ctx).localOnly() {
+		for i, sentence := range sentences {
+			results[i], _ = localEmotions(route.Language, sentence)
+		}
+		return results, nil
+	}
+
+	batch, long := splitByModelInput(sentences)
+	if len(batch) > 0 {
+		texts := textsAt(sentences, batch)
+		if route.Translation != "" {
+			translated, err := translateBatchToEnglish(ctx, route.Translation, texts)
+			if err != nil {
+				return nil, fmt.Errorf("translation for emotion analysis failed: %v", err)
+			}
+			texts = translated
+		}
+		labelScores, err := classifyBatch(ctx, route.Model, "emotion", texts)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range batch {
+			results[i] = labelScores[j]
+		}
+	}
+	for _, i := range long {
+		results[i], _ = analyzeEmotions(ctx, route, sentences[i])
+	}
+	return results, nil
+}
+
+// Indexes of the texts that fit the models' input, and of the rest
+func splitByModelInput(texts []string) (fit, long []int) {
+	for i, text := range texts {
+		if estimateTokens(text) <= chunkTokenBudget {
+			fit = append(fit, i)
+		} else {
+			long = append(long, i)
+		}
+	}
+	return fit, long
+}
+
+// The texts at the given indexes
+func textsAt(texts []string, indexes []int) []string {
+	picked := make([]string, len(indexes))
+	for j, i := range indexes {
+		picked[j] = texts[i]
+	}
+	return picked
+}
+
+// Label scores for each text from one batched classification request
+func classifyBatch(ctx context.Context, model, task string, texts []string) ([][]EmotionResult, error) {
+	response, err := callHuggingFaceBatch(ctx, model, task, texts)
+	if err != nil {
+		return nil, err
+	}
+	return parseBatchClassification(response, len(texts))
+}
+
+// A batched classification response holds a list of label scores per
+// input, or only the top label of each
+func parseBatchClassification(response []byte, inputs int) ([][]EmotionResult, error) {
+	var nested [][]EmotionResult
+	if err := json.Unmarshal(response, &nested); err == nil && len(nested) == inputs {
+		return nested, nil
+	}
+
+	var flat []EmotionResult
+	if err := json.Unmarshal(response, &flat); err == nil {
+		if len(flat) == inputs {
+			perInput := make([][]EmotionResult, inputs)
+			for i, result := range flat {
+				perInput[i] = []EmotionResult{result}
+			}
+			return perInput, nil
+		}
+		// Every label of a single input, unnested
+		if inputs == 1 && len(flat) > 0 {
+			return [][]EmotionResult{flat}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected response for %d inputs: %s", inputs, string(response))
+}
+
+// A scored sentence with its text and its part in the entry's mood
+type SentenceSpan struct {
+	SentenceScore
+	Text string `json:"text"`
+	// The sentence's share of the entry's sentiment: its score weighted by
+	// its length
+	Contribution float64 `json:"contribution"`
+	// Among the sentences pulling most towards the entry's sentiment, or
+	// feeling its top emotion most
+	DrivesSentiment bool `json:"drives_sentiment"`
+	DrivesEmotion   bool `json:"drives_emotion"`
+}
+
+type EntrySpans struct {
+	EntryID          int            `json:"entry_id"`
+	Title            string         `json:"title"`
+	Text             string         `json:"text"`
+	AnalysisID       int            `json:"analysis_id"`
+	EntryRevision    int            `json:"entry_revision"` // the revision the analysis read
+	Stale            bool           `json:"stale"`          // the entry changed since; spans may not line up
+	OverallSentiment string         `json:"overall_sentiment"`
+	SentimentScore   float64        `json:"sentiment_score"`
+	TopEmotion       string         `json:"top_emotion,omitempty"`
+	Spans            []SentenceSpan `json:"spans"`
+}
+
+// Annotate an entry's text with its analysis's sentence scores
+func buildEntrySpans(entry *Entry, analysis *MoodResult) *EntrySpans {
+	result := &EntrySpans{
+		EntryID:          entry.ID,
+		Title:            entry.Title,
+		Text:             entry.Text,
+		AnalysisID:       analysis.ID,
+		EntryRevision:    analysis.EntryRevision,
+		Stale:            analysis.EntryRevision != entry.Revision,
+		OverallSentiment: analysis.OverallSentiment,
+		SentimentScore:   analysis.SentimentScore,
+		Spans:            []SentenceSpan{},
+	}
+	var topScore float64
+	for _, e := range analysis.Emotions {
+		if e.Score > topScore {
+			result.TopEmotion, topScore = e.Label, e.Score
+		}
+	}
+
+	runes := []rune(entry.Text)
+	var totalLength int
+	for _, s := range analysis.Sentences {
+		totalLength += s.End - s.Start
+	}
+
+	for _, s := range analysis.Sentences {
+		span := SentenceSpan{SentenceScore: s}
+		if s.Start >= 0 && s.Start <= s.End && s.End <= len(runes) {
+			span.Text = string(runes[s.Start:s.End])
+		}
+		if totalLength > 0 {
+			span.Contribution = s.Score * float64(s.End-s.Start) / float64(totalLength)
+		}
+		result.Spans = append(result.Spans, span)
+	}
+
+	markDrivingSentences(result)
+	return result
+}
+
+// Mark the sentences that drove the entry's mood: those contributing most
+// in the direction of its sentiment, and those feeling its top emotion most.
+// A neutral entry has no sentiment drivers.
+func markDrivingSentences(result *EntrySpans) {
+	direction := 0.0
+	switch sentimentLabel(result.SentimentScore) {
+	case "positive":
+		direction = 1
+	case "negative":
+		direction = -1
+	}
+
+	var bySentiment, byEmotion []int
+	emotionScores := make(map[int]float64)
+	for i, span := range result.Spans {
+		if direction != 0 && span.Contribution*direction > 0 && span.Sentiment == result.OverallSentiment {
+			bySentiment = append(bySentiment, i)
+		}
+		if result.TopEmotion == "" {
+			continue
+		}
+		for _, e := range span.Emotions {
+			if e.Label == result.TopEmotion && e.Score >= minDrivingEmotionScore {
+				byEmotion = append(byEmotion, i)
+				emotionScores[i] = e.Score
+			}
+		}
+	}
+
+	sort.SliceStable(bySentiment, func(a, b int) bool {
+		return math.Abs(result.Spans[bySentiment[a]].Contribution) > math.Abs(result.Spans[bySentiment[b]].Contribution)
+	})
+	sort.SliceStable(byEmotion, func(a, b int) bool {
+		return emotionScores[byEmotion[a]] > emotionScores[byEmotion[b]]
+	})
+	for n, i := range bySentiment {
+		if n == maxDrivingSentences {
+			break
+		}
+		result.Spans[i].DrivesSentiment = true
+	}
+	for n, i := range byEmotion {
+		if n == maxDrivingSentences {
+			break
+		}
+		result.Spans[i].DrivesEmotion = true
+	}
+}
+
+// Get the entry's text annotated with per-sentence sentiment and emotions
+func getMoodSpansHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	vars := mux.Vars(r)
+	entryID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check if entry belongs to user
+	entry, err := store.Entries.GetByID(entryID)
+	if err != nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if entry.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	analysis, err := getMoodAnalysis(entryID)
+	if err != nil {
+		http.Error(w, "Mood analysis not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildEntrySpans(entry, analysis))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTextSentences(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"blank lines", "\n\n  \n", nil},
+		{"one sentence", "Slept well.", []string{"Slept well."}},
+		{"line breaks end sentences", "Groceries\nLaundry\n\nCall mum", []string{"Groceries", "Laundry", "Call mum"}},
+		{"punctuation and lines", "Long day. Tired!\nBut happy", []string{"Long day.", "Tired!", "But happy"}},
+		{"multibyte", "Día largo. Estoy cansada…\n¿Mañana? 😊", []string{"Día largo.", "Estoy cansada…", "¿Mañana?", "😊"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, span := range textSentences(tt.text) {
+				got = append(got, tt.text[span[0]:span[1]])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("textSentences(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// Offsets stored with the scores count code points, so slicing the text's
+// runes gives back each sentence
+func TestRuneOffsetsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want [][2]int
+	}{
+		{"empty", "", nil},
+		{"ascii", "One. Two.", [][2]int{{0, 4}, {5, 9}}},
+		{"two-byte letters", "Ça va. Très bien.", [][2]int{{0, 6}, {7, 17}}},
+		{"emoji", "😊 Good. 😢 Bad.", [][2]int{{0, 7}, {8, 14}}},
+		{"cjk", "今日は晴れ。\n明日は雨。", [][2]int{{0, 6}, {7, 12}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runes := []rune(tt.text)
+			var got [][2]int
+			for _, span := range textSentences(tt.text) {
+				start, end := runeOffsets(tt.text, span)
+				got = append(got, [2]int{start, end})
+				if sentence := string(runes[start:end]); sentence != tt.text[span[0]:span[1]] {
+					t.Errorf("runes [%d, %d) = %q, want %q", start, end, sentence, tt.text[span[0]:span[1]])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("offsets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildEntrySpans(t *testing.T) {
+	entry := &Entry{ID: 7, Title: "Día", Text: "Ça va mal. Très bien! 😊", Revision: 2}
+	analysis := &MoodResult{
+		ID:               3,
+		EntryRevision:    2,
+		OverallSentiment: "positive",
+		SentimentScore:   0.6,
+		Emotions:         []EmotionResult{{Label: "sadness", Score: 0.2}, {Label: "joy", Score: 0.7}},
+		Sentences: []SentenceScore{
+			{Start: 0, End: 10, Sentiment: "negative", Score: -0.8, Emotions: []EmotionResult{{Label: "sadness", Score: 0.9}}},
+			{Start: 11, End: 21, Sentiment: "positive", Score: 0.9, Emotions: []EmotionResult{{Label: "joy", Score: 0.8}}},
+			{Start: 22, End: 23, Sentiment: "positive", Score: 0.5, Emotions: []EmotionResult{{Label: "joy", Score: 0.2}}},
+			// Out of range, as after an edit the analysis didn't see
+			{Start: 30, End: 40, Sentiment: "positive", Score: 0.4},
+		},
+	}
+
+	tests := []struct {
+		text         string
+		contribution float64
+		drivesSent   bool
+		drivesEmo    bool
+	}{
+		{"Ça va mal.", -0.8 * 10 / 31, false, false},
+		{"Très bien!", 0.9 * 10 / 31, true, true},
+		{"😊", 0.5 * 1 / 31, true, false},
+		{"", 0.4 * 10 / 31, true, false},
+	}
+
+	result := buildEntrySpans(entry, analysis)
+	if result.Stale || result.TopEmotion != "joy" || len(result.Spans) != len(tests) {
+		t.Fatalf("got stale %v, top emotion %q and %d spans", result.Stale, result.TopEmotion, len(result.Spans))
+	}
+	for i, tt := range tests {
+		span := result.Spans[i]
+		if span.Text != tt.text {
+			t.Errorf("span %d text = %q, want %q", i, span.Text, tt.text)
+		}
+		if d := span.Contribution - tt.contribution; d > 1e-9 || d < -1e-9 {
+			t.Errorf("span %d contribution = %v, want %v", i, span.Contribution, tt.contribution)
+		}
+		if span.DrivesSentiment != tt.drivesSent || span.DrivesEmotion != tt.drivesEmo {
+			t.Errorf("span %d drives sentiment %v, emotion %v, want %v, %v",
+				i, span.DrivesSentiment, span.DrivesEmotion, tt.drivesSent, tt.drivesEmo)
+		}
+	}
+
+	entry.Revision = 3
+	if !buildEntrySpans(entry, analysis).Stale {
+		t.Errorf("analysis of revision 2 not stale for revision 3")
+	}
+}
+
+func TestBuildEntrySpansEmpty(t *testing.T) {
+	result := buildEntrySpans(&Entry{}, &MoodResult{OverallSentiment: "neutral"})
+	if result.Spans == nil || len(result.Spans) != 0 || result.TopEmotion != "" {
+		t.Errorf("got %+v, want no spans and no top emotion", result)
+	}
+}
+
+func TestParseBatchClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		inputs   int
+		want     [][]EmotionResult
+		wantErr  bool
+	}{
+		{"list per input", `[[{"label":"joy","score":0.9}],[{"label":"fear","score":0.6},{"label":"joy","score":0.1}]]`, 2,
+			[][]EmotionResult{{{"joy", 0.9}}, {{"fear", 0.6}, {"joy", 0.1}}}, false},
+		{"top label per input", `[{"label":"positive","score":0.8},{"label":"negative","score":0.7}]`, 2,
+			[][]EmotionResult{{{"positive", 0.8}}, {{"negative", 0.7}}}, false},
+		{"every label of one input unnested", `[{"label":"positive","score":0.8},{"label":"negative","score":0.2}]`, 1,
+			[][]EmotionResult{{{"positive", 0.8}, {"negative", 0.2}}}, false},
+		{"multibyte labels", `[[{"label":"colère","score":0.5}]]`, 1, [][]EmotionResult{{{"colère", 0.5}}}, false},
+		{"fewer results than inputs", `[[{"label":"joy","score":0.9}]]`, 2, nil, true},
+		{"empty for one input", `[]`, 1, nil, true},
+		{"error object", `{"error":"Model is loading"}`, 2, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBatchClassification([]byte(tt.response), tt.inputs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Every sentence goes to each model in a single request
+func TestScoreSentencesBatched(t *testing.T) {
+	t.Setenv("MODEL_CACHE_TTL", "0")
+	_, s := openTestStore(t, filepath.Join(t.TempDir(), "journal.db"), &masterKeys{})
+	previousStore := store
+	store = s
+	t.Cleanup(func() { store = previousStore })
+
+	requests := make(map[string]int)
+	var mu sync.Mutex
+	client := newTestModelClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Inputs []string }
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		requests[strings.TrimPrefix(r.URL.Path, "/")]++
+		mu.Unlock()
+
+		var results []interface{}
+		for _, input := range body.Inputs {
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/"+sentimentModel) && strings.Contains(input, "mal"):
+				results = append(results, []EmotionResult{{"negative", 0.9}, {"positive", 0.1}})
+			case strings.HasPrefix(r.URL.Path, "/"+sentimentModel):
+				results = append(results, []EmotionResult{{"positive", 0.8}, {"negative", 0.2}})
+			case strings.Contains(r.URL.Path, "opus-mt"):
+				results = append(results, map[string]string{"translation_text": "translated " + input})
+			default:
+				results = append(results, []EmotionResult{{"joy", 0.7}, {"fear", 0.2}, {"anger", 0.05}, {"sadness", 0.05}})
+			}
+		}
+		json.NewEncoder(w).Encode(results)
+	})
+	hfClient()
+	previousClient := sharedClient
+	sharedClient = client
+	t.Cleanup(func() { sharedClient = previousClient })
+
+	text := "Ça va mal. Très bien!\nDemain 😊"
+	tests := []struct {
+		name         string
+		language     string
+		privacy      PrivacySettings
+		wantRequests int
+	}{
+		{"english route", "en", defaultPrivacySettings, 2},
+		{"translated first", "fr", defaultPrivacySettings, 3},
+		{"local only", "en", PrivacySettings{MoodAnalysis: true}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for model := range requests {
+				delete(requests, model)
+			}
+			ctx := context.WithValue(context.Background(), modelUserKey{}, &modelUser{ID: 1, Privacy: tt.privacy})
+			scores := scoreSentences(ctx, 1, text, tt.language)
+
+			total := 0
+			for model, n := range requests {
+				if n != 1 {
+					t.Errorf("%d requests to %s, want 1", n, model)
+				}
+				total += n
+			}
+			if total != tt.wantRequests {
+				t.Errorf("%d requests to %v, want %d", total, requests, tt.wantRequests)
+			}
+			if tt.wantRequests == 0 {
+				return
+			}
+
+			want := []SentenceScore{
+				{Start: 0, End: 10, Sentiment: "negative", Score: -0.9},
+				{Start: 11, End: 21, Sentiment: "positive", Score: 0.8},
+				{Start: 22, End: 30, Sentiment: "positive", Score: 0.8},
+			}
+			if len(scores) != len(want) {
+				t.Fatalf("got %d scores, want %d", len(scores), len(want))
+			}
+			for i, w := range want {
+				got := scores[i]
+				if got.Start != w.Start || got.End != w.End || got.Sentiment != w.Sentiment || got.Score != w.Score {
+					t.Errorf("sentence %d scored %+v, want %+v", i, got, w)
+				}
+				if len(got.Emotions) != sentenceEmotions || got.Emotions[0].Label != "joy" {
+					t.Errorf("sentence %d emotions %v, want the top %d with joy first", i, got.Emotions, sentenceEmotions)
+				}
+			}
+		})
+	}
+}
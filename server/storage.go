@@ -0,0 +1,2728 @@
+// storage.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Repository interfaces. Handlers talk to these instead of issuing SQL
+// directly so the backend can be swapped by configuration.
+type UserRepository interface {
+	Create(name, email, passwordHash, timezone string) (*User, error)
+	GetByID(id int) (*User, error)
+	// GetByEmail returns the user together with their password hash
+	GetByEmail(email string) (*User, string, error)
+	GetPasswordHash(id int) (string, error)
+	UpdateName(id int, name string) error
+	UpdatePassword(id int, passwordHash string) error
+	UpdateTimezone(id int, timezone string) error
+	UpdatePrivacy(id int, settings PrivacySettings) error
+	// List returns every user, without password hashes
+	List() ([]User, error)
+}
+
+type EntryRepository interface {
+	// Create inserts the entry with its tags, if entry.Tags is set, creating
+	// any that don't exist
+	Create(entry *Entry) error
+	// GetByID and ListByUser skip entries in the trash
+	GetByID(id int) (*Entry, error)
+	ListByUser(userID int, filter EntryFilter) ([]Entry, error)
+	// Update saves date and notebook and, if entry.Tags is set, replaces the
+	// tags. A changed title or text first archives the current version to
+	// entry_revisions and bumps entry.Revision; otherwise the revision stays
+	// as it is. All in one transaction.
+	Update(entry *Entry) error
+	// Delete moves the entry to the trash
+	Delete(id int) error
+	// Restore takes one of the user's entries out of the trash. Returns
+	// sql.ErrNoRows if there is no such trashed entry.
+	Restore(id, userID int) error
+	ListDeleted(userID int) ([]Entry, error)
+	// PurgeDeleted permanently removes entries trashed before cutoff along
+	// with their analyses, embeddings and revisions
+	PurgeDeleted(cutoff time.Time) (int, error)
+}
+
+// Optional filters for listing entries
+type EntryFilter struct {
+	Tags       []string // entries must carry all of these tags
+	NotebookID *int
+	From, To   string // inclusive range of entry dates (YYYY-MM-DD)
+}
+
+type NotebookRepository interface {
+	Create(userID int, name string) (*Notebook, error)
+	GetByID(id int) (*Notebook, error)
+	// ListByUser returns notebooks with their entry counts
+	ListByUser(userID int) ([]Notebook, error)
+	Rename(id int, name string) error
+	// Delete removes the notebook; its entries become unfiled
+	Delete(id int) error
+}
+
+type TagRepository interface {
+	Create(userID int, name string) (*Tag, error)
+	GetByID(id int) (*Tag, error)
+	GetByName(userID int, name string) (*Tag, error)
+	// ListByUser returns tags with their entry counts
+	ListByUser(userID int) ([]Tag, error)
+	// Search returns tags starting with prefix, most used first
+	Search(userID int, prefix string, limit int) ([]Tag, error)
+	Rename(id int, name string) error
+	Delete(id int) error
+	// Merge moves every entry from the source tag to the target and
+	// deletes the source, in one transaction
+	Merge(sourceID, targetID int) error
+	ListForEntry(entryID int) ([]string, error)
+	// ListForUserEntries maps each of the user's entry IDs to its tags
+	ListForUserEntries(userID int) (map[int][]string, error)
+}
+
+type EntryRevisionRepository interface {
+	// ListByEntry returns archived (non-current) versions, newest first
+	ListByEntry(entryID int) ([]EntryRevision, error)
+	Get(entryID, revision int) (*EntryRevision, error)
+}
+
+type MoodAnalysisRepository interface {
+	// Save appends an analysis to the entry's history and makes it current,
+	// unless an analysis of a newer entry revision is already current
+	Save(entryID int, moodResult *MoodResult) error
+	// GetByEntry returns the entry's current analysis
+	GetByEntry(entryID int) (*MoodResult, error)
+	// ListByEntry returns every analysis of the entry, newest first
+	ListByEntry(entryID int) ([]MoodResult, error)
+	DeleteByEntry(entryID int) error
+	// DeleteByUser removes every analysis of the user's entries, trashed
+	// ones included, with their corrections and suggestion ratings
+	DeleteByUser(userID int) (int, error)
+	// ClearGeneratedSuggestions blanks the suggestions the generative model
+	// wrote in the user's analyses, repeats of them included, and deletes
+	// their ratings
+	ClearGeneratedSuggestions(userID int) (int, error)
+	// ListRecentByUser returns current analyses across the user's entries
+	ListRecentByUser(userID, limit int) ([]MoodResult, error)
+}
+
+type InsightRepository interface {
+	// MoodBuckets aggregates the current analyses of the user's entries dated
+	// from..to (inclusive, either may be empty) into "day", "week" or "month"
+	// buckets keyed by their first day. Empty buckets are not returned.
+	MoodBuckets(userID int, granularity, from, to string) ([]TrendBucket, error)
+	// AnalysedEntries returns the text and current sentiment of each of the
+	// user's entries that has been analysed
+	AnalysedEntries(userID int) ([]AnalysedEntry, error)
+}
+
+type DigestRepository interface {
+	// Save stores a new digest; one per user, period and start date
+	Save(digest *Digest) error
+	// GetByPeriod returns sql.ErrNoRows if the digest hasn't been written
+	GetByPeriod(userID int, period, periodStart string) (*Digest, error)
+	// ListByUser returns digests newest first, optionally for one period
+	ListByUser(userID int, period string, limit int) ([]Digest, error)
+	UpdateNarrative(id int, narrative, narrativeBy string) error
+	DeleteByUser(userID int) (int, error)
+}
+
+type ChatRepository interface {
+	CreateConversation(userID int, title string) (*ChatConversation, error)
+	GetConversation(id int) (*ChatConversation, error)
+	// ListConversations returns the user's conversations, most recently
+	// active first
+	ListConversations(userID int) ([]ChatConversation, error)
+	// DeleteConversation removes the conversation and its messages
+	DeleteConversation(id int) error
+	// DeleteByUser removes all the user's conversations. Returns how many
+	// went.
+	DeleteByUser(userID int) (int, error)
+	// AddMessage appends a message and bumps the conversation's updated_at
+	AddMessage(message *ChatMessage) error
+	// ListMessages returns the conversation's messages, oldest first
+	ListMessages(conversationID int) ([]ChatMessage, error)
+}
+
+type CorrectionRepository interface {
+	// Save records a correction, replacing any earlier one of the same
+	// analysis
+	Save(correction *MoodCorrection) error
+	GetByID(id int) (*MoodCorrection, error)
+	GetByAnalysis(analysisID int) (*MoodCorrection, error)
+	// ListByUser returns the user's corrections, newest first
+	ListByUser(userID int) ([]MoodCorrection, error)
+	Delete(id int) error
+	// Dataset returns each correction with the text of the entry revision
+	// that was analysed, oldest first
+	Dataset(userID int) ([]LabelledExample, error)
+}
+
+type SuggestionFeedbackRepository interface {
+	// Save records a rating, replacing any earlier one of the same analysis
+	Save(feedback *SuggestionFeedback) error
+	GetByID(id int) (*SuggestionFeedback, error)
+	GetByAnalysis(analysisID int) (*SuggestionFeedback, error)
+	// ListByUser returns the user's ratings, most recently changed first
+	ListByUser(userID int) ([]SuggestionFeedback, error)
+	Delete(id int) error
+	// Stats counts the user's outcomes for each distinct suggestion
+	Stats(userID int) ([]SuggestionStats, error)
+}
+
+type CheckInRepository interface {
+	Create(checkIn *MoodCheckIn) error
+	GetByID(id int) (*MoodCheckIn, error)
+	// GetByEntry returns sql.ErrNoRows if the entry has no check-in
+	GetByEntry(entryID int) (*MoodCheckIn, error)
+	// ListByUser returns check-ins dated from..to (inclusive, either may be
+	// empty), newest first. Check-ins on trashed entries are skipped.
+	ListByUser(userID int, from, to string) ([]MoodCheckIn, error)
+	Update(checkIn *MoodCheckIn) error
+	Delete(id int) error
+	// Buckets aggregates check-ins like InsightRepository.MoodBuckets,
+	// keyed by the first day of each bucket
+	Buckets(userID int, granularity, from, to string) (map[string]*SelfReportedMood, error)
+}
+
+type EmbeddingRepository interface {
+	Save(entryID, userID int, embedding []float64, textHash string) error
+	// SaveChunks replaces the entry's chunk embeddings; none clears them
+	SaveChunks(entryID, userID int, chunks []ChunkEmbedding) error
+	// FindSimilar returns the user's entries ranked by similarity to the
+	// query embedding. An entry scores its best match over the whole text
+	// and its chunks, and the offsets of a matching chunk are kept.
+	// MoodResult and Passage are left empty on the results.
+	FindSimilar(userID int, queryEmbedding []float64, limit int) ([]SimilarEntry, error)
+	// DeleteByUser removes the whole-text and chunk embeddings of all the
+	// user's entries. Returns how many entries had one.
+	DeleteByUser(userID int) (int, error)
+}
+
+type ModelCacheRepository interface {
+	// Get returns a cached output and records the hit, or sql.ErrNoRows if
+	// there is none or it expired before now. userID is 0 for requests
+	// carrying no user's text.
+	Get(userID int, model, task, inputHash string, now time.Time) ([]byte, error)
+	// Put stores an output, replacing any earlier one for the same key
+	Put(userID int, model, task, inputHash string, output []byte, expiresAt time.Time) error
+	// DeleteByUser deletes the user's outputs of the given tasks. Returns
+	// how many went.
+	DeleteByUser(userID int, tasks ...string) (int, error)
+	// Prune deletes expired outputs, then the least recently used ones until
+	// at most maxEntries totalling maxBytes remain. Returns how many went.
+	Prune(now time.Time, maxEntries int, maxBytes int64) (int, error)
+	Stats() (*ModelCacheStats, error)
+}
+
+type KeyRepository interface {
+	// EncryptExisting encrypts the values of encryptedColumns stored in
+	// plaintext and hashes those of hashedColumns. Returns how many it
+	// encrypted or hashed.
+	EncryptExisting() (int, error)
+	// RewrapDataKeys wraps every data key not wrapped by the current master
+	// key with it. Returns how many it rewrapped.
+	RewrapDataKeys() (int, error)
+	// RotateUserKey gives the user a new data key, re-encrypts and rehashes
+	// their content with it and deletes the keys no longer used. Returns how
+	// many values it re-encrypted or rehashed.
+	RotateUserKey(userID int) (int, error)
+	Status() (*EncryptionStatus, error)
+}
+
+// Store bundles the repositories for one backend
+type Store struct {
+	Driver             string
+	Users              UserRepository
+	Entries            EntryRepository
+	Revisions          EntryRevisionRepository
+	Notebooks          NotebookRepository
+	Tags               TagRepository
+	MoodAnalyses       MoodAnalysisRepository
+	Insights           InsightRepository
+	Digests            DigestRepository
+	Chats              ChatRepository
+	CheckIns           CheckInRepository
+	Corrections        CorrectionRepository
+	SuggestionFeedback SuggestionFeedbackRepository
+	Embeddings         EmbeddingRepository
+	ModelCache         ModelCacheRepository
+	Keys               KeyRepository
+}
+
+// Storage configuration
+type StorageConfig struct {
+	Driver      string      // "sqlite" or "postgres"
+	DatabaseURL string      // file path for sqlite, connection string for postgres
+	PgVector    bool        // use pgvector for embedding search (postgres only)
+	MasterKeys  *masterKeys // encrypt entry content at rest; set by openStore
+}
+
+// Load storage configuration from environment
+func loadStorageConfig() StorageConfig {
+	cfg := StorageConfig{
+		Driver:      strings.ToLower(strings.TrimSpace(os.Getenv("DB_DRIVER"))),
+		DatabaseURL: os.Getenv("DATABASE_URL"),
+	}
+
+	if cfg.Driver == "" {
+		cfg.Driver = "sqlite"
+	}
+	if cfg.Driver == "sqlite" && cfg.DatabaseURL == "" {
+		cfg.DatabaseURL = "./journal.db"
+	}
+	cfg.PgVector, _ = strconv.ParseBool(os.Getenv("PGVECTOR_ENABLED"))
+
+	return cfg
+}
+
+// SQL dialect differences between backends
+type sqlDialect struct {
+	name string
+	// numbered placeholders ($1, $2, ...) instead of ?
+	numberedParams bool
+}
+
+var (
+	sqliteDialect   = sqlDialect{name: "sqlite"}
+	postgresDialect = sqlDialect{name: "postgres", numberedParams: true}
+)
+
+// Rewrite ? placeholders for the dialect
+func (d sqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var out strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		out.WriteRune(ch)
+	}
+	return out.String()
+}
+
+// Expression for the first day (YYYY-MM-DD) of the day, week or month
+// containing an ISO date column. Weeks start on Monday.
+func (d sqlDialect) dateBucket(granularity, column string) string {
+	switch granularity {
+	case "week":
+		if d.name == "postgres" {
+			return "to_char(date_trunc('week', " + column + "::date), 'YYYY-MM-DD')"
+		}
+		return "date(" + column + ", '-6 days', 'weekday 1')"
+	case "month":
+		return "SUBSTR(" + column + ", 1, 7) || '-01'"
+	default:
+		return column
+	}
+}
+
+// Suffix for a SELECT that locks the rows it reads until the transaction
+// ends. SQLite has no row locks and needs none behind its single writer.
+func (d sqlDialect) forUpdate() string {
+	if d.name == "postgres" {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// FROM-clause item expanding a JSON array of emotions as je, with
+// expressions for each element's label and score
+func (d sqlDialect) emotionElements(column string) (from, label, score string) {
+	if d.name == "postgres" {
+		return "jsonb_array_elements(" + column + ") je", "je->>'label'", "(je->>'score')::float8"
+	}
+	return "json_each(" + column + ") je", "json_extract(je.value, '$.label')", "json_extract(je.value, '$.score')"
+}
+
+// FROM-clause item expanding a JSON array of strings as je, with an
+// expression for each element
+func (d sqlDialect) stringElements(column string) (from, value string) {
+	if d.name == "postgres" {
+		return "jsonb_array_elements_text(" + column + ") je", "je"
+	}
+	return "json_each(" + column + ") je", "je.value"
+}
+
+// Shared database/sql implementation used by both backends.
+// Writes go through db; reads use reader, which for SQLite is a separate
+// read-only pool so queries don't queue behind the single writer.
+type sqlStore struct {
+	db         *sql.DB
+	reader     *sql.DB
+	dialect    sqlDialect
+	masterKeys *masterKeys // without a current key, content is stored unencrypted
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.reader.Query(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.reader.QueryRow(s.dialect.rebind(query), args...)
+}
+
+// QueryRow on the writer, for INSERT ... RETURNING
+func (s *sqlStore) writeRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.dialect.rebind(query), args...)
+}
+
+// Transaction wrapper with the same placeholder rewriting as sqlStore
+type sqlTx struct {
+	tx      *sql.Tx
+	dialect sqlDialect
+}
+
+func (t *sqlTx) exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.Exec(t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.Query(t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) queryRow(query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRow(t.dialect.rebind(query), args...)
+}
+
+// Run fn in a transaction on the writer, rolling back if it returns an error
+func (s *sqlStore) withTx(fn func(tx *sqlTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&sqlTx{tx: tx, dialect: s.dialect}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Build a store backed by the shared SQL repositories
+func newSQLStore(writer, reader *sql.DB, dialect sqlDialect, keys *masterKeys) *Store {
+	s := &sqlStore{db: writer, reader: reader, dialect: dialect, masterKeys: keys}
+	return &Store{
+		Driver:             dialect.name,
+		Users:              &sqlUserRepository{s},
+		Entries:            &sqlEntryRepository{s},
+		Revisions:          &sqlEntryRevisionRepository{s},
+		Notebooks:          &sqlNotebookRepository{s},
+		Tags:               &sqlTagRepository{s},
+		MoodAnalyses:       &sqlMoodAnalysisRepository{s},
+		Insights:           &sqlInsightRepository{s},
+		Digests:            &sqlDigestRepository{s},
+		Chats:              &sqlChatRepository{s},
+		CheckIns:           &sqlCheckInRepository{s},
+		Corrections:        &sqlCorrectionRepository{s},
+		SuggestionFeedback: &sqlSuggestionFeedbackRepository{s},
+		Embeddings:         &sqlEmbeddingRepository{s},
+		ModelCache:         &sqlModelCacheRepository{s},
+		Keys:               &sqlKeyRepository{s},
+	}
+}
+
+// Row scanner satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Users
+type sqlUserRepository struct{ *sqlStore }
+
+// Columns read by scanUser, in order
+const userColumns = `id, name, email, timezone, created_at,
+	mood_analysis, embeddings, generative_suggestions, external_processing, local_analysis`
+
+func scanUser(row rowScanner, extra ...interface{}) (*User, error) {
+	var user User
+	dest := []interface{}{&user.ID, &user.Name, &user.Email, &user.Timezone, &user.CreatedAt,
+		&user.MoodAnalysis, &user.Embeddings, &user.GenerativeSuggestions,
+		&user.ExternalProcessing, &user.LocalAnalysis}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *sqlUserRepository) Create(name, email, passwordHash, timezone string) (*User, error) {
+	return scanUser(r.writeRow(`
+		INSERT INTO users (name, email, password, timezone) VALUES (?, ?, ?, ?)
+		RETURNING `+userColumns,
+		name, email, passwordHash, timezone))
+}
+
+func (r *sqlUserRepository) GetByID(id int) (*User, error) {
+	return scanUser(r.queryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (r *sqlUserRepository) GetByEmail(email string) (*User, string, error) {
+	var passwordHash string
+	user, err := scanUser(r.queryRow("SELECT "+userColumns+", password FROM users WHERE email = ?", email), &passwordHash)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, passwordHash, nil
+}
+
+func (r *sqlUserRepository) GetPasswordHash(id int) (string, error) {
+	var passwordHash string
+	err := r.queryRow("SELECT password FROM users WHERE id = ?", id).Scan(&passwordHash)
+	return passwordHash, err
+}
+
+func (r *sqlUserRepository) UpdateName(id int, name string) error {
+	_, err := r.exec("UPDATE users SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+func (r *sqlUserRepository) UpdatePassword(id int, passwordHash string) error {
+	_, err := r.exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, id)
+	return err
+}
+
+func (r *sqlUserRepository) UpdateTimezone(id int, timezone string) error {
+	_, err := r.exec("UPDATE users SET timezone = ? WHERE id = ?", timezone, id)
+	return err
+}
+
+func (r *sqlUserRepository) UpdatePrivacy(id int, settings PrivacySettings) error {
+	_, err := r.exec(`
+		UPDATE users SET mood_analysis = ?, embeddings = ?, generative_suggestions = ?,
+			external_processing = ?, local_analysis = ?
+		WHERE id = ?`,
+		settings.MoodAnalysis, settings.Embeddings, settings.GenerativeSuggestions,
+		settings.ExternalProcessing, settings.LocalAnalysis, id)
+	return err
+}
+
+func (r *sqlUserRepository) List() ([]User, error) {
+	rows, err := r.query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+// Entries
+type sqlEntryRepository struct{ *sqlStore }
+
+// Columns read by scanEntry, in order
+const entryColumns = "id, user_id, title, text, date, timezone, revision, created_at, updated_at, deleted_at, notebook_id"
+
+func scanEntry(row rowScanner) (*Entry, error) {
+	var entry Entry
+	var updatedAt, deletedAt sql.NullTime
+	var notebookID sql.NullInt64
+	err := row.Scan(&entry.ID, &entry.UserID, &entry.Title, &entry.Text, &entry.Date,
+		&entry.Timezone, &entry.Revision, &entry.CreatedAt, &updatedAt, &deletedAt, &notebookID)
+	if err != nil {
+		return nil, err
+	}
+	if notebookID.Valid {
+		id := int(notebookID.Int64)
+		entry.NotebookID = &id
+	}
+	if updatedAt.Valid {
+		entry.UpdatedAt = &updatedAt.Time
+	}
+	if deletedAt.Valid {
+		entry.DeletedAt = &deletedAt.Time
+	}
+	return &entry, nil
+}
+
+// Scan the user's entries, decrypting their content with keys
+func scanEntries(rows *sql.Rows, keys *userKeys) ([]Entry, error) {
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.openContent(&entry.Title, &entry.Text); err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, rows.Err()
+}
+
+func (r *sqlEntryRepository) Create(entry *Entry) error {
+	keys, err := r.writingKeys(entry.UserID)
+	if err != nil {
+		return err
+	}
+	title, text, err := keys.sealContent(entry.Title, entry.Text)
+	if err != nil {
+		return err
+	}
+
+	return r.withTx(func(tx *sqlTx) error {
+		err := tx.queryRow(`
+			INSERT INTO entries (user_id, title, text, date, timezone, notebook_id) VALUES (?, ?, ?, ?, ?, ?)
+			RETURNING id, revision, created_at`,
+			entry.UserID, title, text, entry.Date, entry.Timezone, entry.NotebookID).Scan(&entry.ID, &entry.Revision, &entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		if entry.Tags != nil {
+			return replaceEntryTags(tx, entry.UserID, entry.ID, entry.Tags)
+		}
+		return nil
+	})
+}
+
+func (r *sqlEntryRepository) GetByID(id int) (*Entry, error) {
+	entry, err := scanEntry(r.queryRow("SELECT "+entryColumns+" FROM entries WHERE id = ? AND deleted_at IS NULL", id))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.readingKeys(entry.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := keys.openContent(&entry.Title, &entry.Text); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (r *sqlEntryRepository) ListByUser(userID int, filter EntryFilter) ([]Entry, error) {
+	// Keys are loaded before the rows are open, so the two reads don't
+	// hold two connections at once
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + entryColumns + " FROM entries WHERE user_id = ? AND deleted_at IS NULL"
+	args := []interface{}{userID}
+
+	if filter.NotebookID != nil {
+		query += " AND notebook_id = ?"
+		args = append(args, *filter.NotebookID)
+	}
+
+	// ISO dates compare correctly as strings
+	if filter.From != "" {
+		query += " AND date >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.To != "" {
+		query += " AND date <= ?"
+		args = append(args, filter.To)
+	}
+
+	if len(filter.Tags) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(filter.Tags)), ", ")
+		query += `
+			AND id IN (
+				SELECT et.entry_id FROM entry_tags et
+				JOIN tags t ON t.id = et.tag_id
+				WHERE t.user_id = ? AND t.name IN (` + placeholders + `)
+				GROUP BY et.entry_id
+				HAVING COUNT(DISTINCT t.id) = ?
+			)`
+		args = append(args, userID)
+		for _, tag := range filter.Tags {
+			args = append(args, tag)
+		}
+		args = append(args, len(filter.Tags))
+	}
+
+	query += " ORDER BY date DESC, created_at DESC"
+
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanEntries(rows, keys)
+}
+
+func (r *sqlEntryRepository) Update(entry *Entry) error {
+	now := time.Now().UTC()
+
+	keys, err := r.writingKeys(entry.UserID)
+	if err != nil {
+		return err
+	}
+	title, text, err := keys.sealContent(entry.Title, entry.Text)
+	if err != nil {
+		return err
+	}
+
+	return r.withTx(func(tx *sqlTx) error {
+		// Compare with the stored content, which ciphertext alone can't tell
+		var storedTitle, storedText string
+		err := tx.queryRow("SELECT title, text, revision FROM entries WHERE id = ?"+r.dialect.forUpdate(), entry.ID).
+			Scan(&storedTitle, &storedText, &entry.Revision)
+		if err != nil {
+			return err
+		}
+		if err := keys.openContent(&storedTitle, &storedText); err != nil {
+			return err
+		}
+
+		if storedTitle == entry.Title && storedText == entry.Text {
+			_, err = tx.exec("UPDATE entries SET date = ?, notebook_id = ?, updated_at = ? WHERE id = ?",
+				entry.Date, entry.NotebookID, now, entry.ID)
+		} else {
+			err = archiveAndUpdateContent(tx, entry, title, text, now)
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Tags != nil {
+			if err := replaceEntryTags(tx, entry.UserID, entry.ID, entry.Tags); err != nil {
+				return err
+			}
+		}
+
+		entry.UpdatedAt = &now
+		return nil
+	})
+}
+
+// Archive the version being replaced, still encrypted as it was, and save
+// the new sealed title and text as the next revision
+func archiveAndUpdateContent(tx *sqlTx, entry *Entry, title, text string, now time.Time) error {
+	_, err := tx.exec(`
+		INSERT INTO entry_revisions (entry_id, revision, title, text, saved_at)
+		SELECT id, revision, title, text, COALESCE(updated_at, created_at)
+		FROM entries WHERE id = ?`, entry.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.queryRow(`
+		UPDATE entries SET title = ?, text = ?, date = ?, notebook_id = ?, revision = revision + 1, updated_at = ?
+		WHERE id = ?
+		RETURNING revision`,
+		title, text, entry.Date, entry.NotebookID, now, entry.ID).Scan(&entry.Revision)
+}
+
+// Replace the entry's tags, creating any the user doesn't have yet
+func replaceEntryTags(tx *sqlTx, userID, entryID int, names []string) error {
+	if _, err := tx.exec("DELETE FROM entry_tags WHERE entry_id = ?", entryID); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var tagID int
+		err := tx.queryRow("SELECT id FROM tags WHERE user_id = ? AND name = ?", userID, name).Scan(&tagID)
+		if err == sql.ErrNoRows {
+			err = tx.queryRow("INSERT INTO tags (user_id, name) VALUES (?, ?) RETURNING id", userID, name).Scan(&tagID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.exec("INSERT INTO entry_tags (entry_id, tag_id) VALUES (?, ?)", entryID, tagID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlEntryRepository) Delete(id int) error {
+	_, err := r.exec("UPDATE entries SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now().UTC(), id)
+	return err
+}
+
+func (r *sqlEntryRepository) Restore(id, userID int) error {
+	result, err := r.exec("UPDATE entries SET deleted_at = NULL WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *sqlEntryRepository) ListDeleted(userID int) ([]Entry, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.query("SELECT "+entryColumns+" FROM entries WHERE user_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanEntries(rows, keys)
+}
+
+func (r *sqlEntryRepository) PurgeDeleted(cutoff time.Time) (int, error) {
+	var purged int64
+
+	err := r.withTx(func(tx *sqlTx) error {
+		// Delete dependent rows explicitly rather than relying on CASCADE,
+		// which older SQLite databases may not have enforced. Check-ins are
+		// the user's own record, so they are kept as standalone ones.
+		dependents := []string{
+			"DELETE FROM mood_corrections WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			"DELETE FROM suggestion_feedback WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			"DELETE FROM mood_analysis WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			"DELETE FROM entry_embeddings WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			"DELETE FROM entry_chunk_embeddings WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			"DELETE FROM entry_revisions WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			"DELETE FROM entry_tags WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			"UPDATE mood_checkins SET entry_id = NULL WHERE entry_id IN (SELECT id FROM entries WHERE deleted_at < ?)",
+			// Cached outputs aren't linked to entries, so the owner's whole
+			// cache goes; it only costs repeated model calls
+			"DELETE FROM model_cache WHERE user_id IN (SELECT user_id FROM entries WHERE deleted_at < ?)",
+		}
+		for _, stmt := range dependents {
+			if _, err := tx.exec(stmt, cutoff); err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.exec("DELETE FROM entries WHERE deleted_at < ?", cutoff)
+		if err != nil {
+			return err
+		}
+		purged, _ = result.RowsAffected()
+		return nil
+	})
+
+	return int(purged), err
+}
+
+// Entry revisions
+type sqlEntryRevisionRepository struct{ *sqlStore }
+
+// ID of the entry's owner, whose keys encrypt the entry's archived versions
+// and what is derived from it
+func (s *sqlStore) entryOwner(entryID int) (int, error) {
+	var userID int
+	err := s.queryRow("SELECT user_id FROM entries WHERE id = ?", entryID).Scan(&userID)
+	return userID, err
+}
+
+// Keys of the entry's owner, for reading
+func (s *sqlStore) entryKeys(entryID int) (*userKeys, error) {
+	userID, err := s.entryOwner(entryID)
+	if err != nil {
+		return nil, err
+	}
+	return s.readingKeys(userID)
+}
+
+func (r *sqlEntryRevisionRepository) ListByEntry(entryID int) ([]EntryRevision, error) {
+	keys, err := r.entryKeys(entryID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.query(`
+		SELECT entry_id, revision, title, text, saved_at
+		FROM entry_revisions WHERE entry_id = ?
+		ORDER BY revision DESC`, entryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []EntryRevision
+	for rows.Next() {
+		var rev EntryRevision
+		if err := rows.Scan(&rev.EntryID, &rev.Revision, &rev.Title, &rev.Text, &rev.SavedAt); err != nil {
+			return nil, err
+		}
+		if err := keys.openContent(&rev.Title, &rev.Text); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (r *sqlEntryRevisionRepository) Get(entryID, revision int) (*EntryRevision, error) {
+	keys, err := r.entryKeys(entryID)
+	if err != nil {
+		return nil, err
+	}
+
+	var rev EntryRevision
+	err = r.queryRow(`
+		SELECT entry_id, revision, title, text, saved_at
+		FROM entry_revisions WHERE entry_id = ? AND revision = ?`, entryID, revision).
+		Scan(&rev.EntryID, &rev.Revision, &rev.Title, &rev.Text, &rev.SavedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := keys.openContent(&rev.Title, &rev.Text); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// Notebooks
+type sqlNotebookRepository struct{ *sqlStore }
+
+func (r *sqlNotebookRepository) Create(userID int, name string) (*Notebook, error) {
+	notebook := Notebook{UserID: userID, Name: name}
+	err := r.writeRow(`
+		INSERT INTO notebooks (user_id, name) VALUES (?, ?)
+		RETURNING id, created_at`, userID, name).Scan(&notebook.ID, &notebook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &notebook, nil
+}
+
+func (r *sqlNotebookRepository) GetByID(id int) (*Notebook, error) {
+	var notebook Notebook
+	err := r.queryRow("SELECT id, user_id, name, created_at FROM notebooks WHERE id = ?", id).
+		Scan(&notebook.ID, &notebook.UserID, &notebook.Name, &notebook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &notebook, nil
+}
+
+func (r *sqlNotebookRepository) ListByUser(userID int) ([]Notebook, error) {
+	rows, err := r.query(`
+		SELECT n.id, n.user_id, n.name, n.created_at, COUNT(e.id)
+		FROM notebooks n
+		LEFT JOIN entries e ON e.notebook_id = n.id AND e.deleted_at IS NULL
+		WHERE n.user_id = ?
+		GROUP BY n.id, n.user_id, n.name, n.created_at
+		ORDER BY n.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notebooks []Notebook
+	for rows.Next() {
+		var notebook Notebook
+		if err := rows.Scan(&notebook.ID, &notebook.UserID, &notebook.Name, &notebook.CreatedAt, &notebook.EntryCount); err != nil {
+			return nil, err
+		}
+		notebooks = append(notebooks, notebook)
+	}
+	return notebooks, rows.Err()
+}
+
+func (r *sqlNotebookRepository) Rename(id int, name string) error {
+	_, err := r.exec("UPDATE notebooks SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+func (r *sqlNotebookRepository) Delete(id int) error {
+	return r.withTx(func(tx *sqlTx) error {
+		if _, err := tx.exec("UPDATE entries SET notebook_id = NULL WHERE notebook_id = ?", id); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM notebooks WHERE id = ?", id)
+		return err
+	})
+}
+
+// Tags
+type sqlTagRepository struct{ *sqlStore }
+
+// Tag columns plus the number of live entries carrying the tag
+const tagCountQuery = `
+	SELECT t.id, t.user_id, t.name, t.created_at, COUNT(e.id)
+	FROM tags t
+	LEFT JOIN entry_tags et ON et.tag_id = t.id
+	LEFT JOIN entries e ON e.id = et.entry_id AND e.deleted_at IS NULL`
+
+func scanTags(rows *sql.Rows) ([]Tag, error) {
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.UserID, &tag.Name, &tag.CreatedAt, &tag.EntryCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (r *sqlTagRepository) Create(userID int, name string) (*Tag, error) {
+	tag := Tag{UserID: userID, Name: name}
+	err := r.writeRow(`
+		INSERT INTO tags (user_id, name) VALUES (?, ?)
+		RETURNING id, created_at`, userID, name).Scan(&tag.ID, &tag.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+func (r *sqlTagRepository) GetByID(id int) (*Tag, error) {
+	var tag Tag
+	err := r.queryRow("SELECT id, user_id, name, created_at FROM tags WHERE id = ?", id).
+		Scan(&tag.ID, &tag.UserID, &tag.Name, &tag.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+func (r *sqlTagRepository) GetByName(userID int, name string) (*Tag, error) {
+	var tag Tag
+	err := r.queryRow("SELECT id, user_id, name, created_at FROM tags WHERE user_id = ? AND name = ?", userID, name).
+		Scan(&tag.ID, &tag.UserID, &tag.Name, &tag.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+func (r *sqlTagRepository) ListByUser(userID int) ([]Tag, error) {
+	rows, err := r.query(tagCountQuery+`
+		WHERE t.user_id = ?
+		GROUP BY t.id, t.user_id, t.name, t.created_at
+		ORDER BY t.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanTags(rows)
+}
+
+func (r *sqlTagRepository) Search(userID int, prefix string, limit int) ([]Tag, error) {
+	// Escape LIKE wildcards in the user's input
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+
+	rows, err := r.query(tagCountQuery+`
+		WHERE t.user_id = ? AND t.name LIKE ? ESCAPE '\'
+		GROUP BY t.id, t.user_id, t.name, t.created_at
+		ORDER BY COUNT(e.id) DESC, t.name
+		LIMIT ?`, userID, escaped+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanTags(rows)
+}
+
+func (r *sqlTagRepository) Rename(id int, name string) error {
+	_, err := r.exec("UPDATE tags SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+func (r *sqlTagRepository) Delete(id int) error {
+	return r.withTx(func(tx *sqlTx) error {
+		if _, err := tx.exec("DELETE FROM entry_tags WHERE tag_id = ?", id); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM tags WHERE id = ?", id)
+		return err
+	})
+}
+
+func (r *sqlTagRepository) Merge(sourceID, targetID int) error {
+	return r.withTx(func(tx *sqlTx) error {
+		// Tag the source's entries with the target, skipping entries that
+		// already carry both
+		_, err := tx.exec(`
+			INSERT INTO entry_tags (entry_id, tag_id)
+			SELECT entry_id, ? FROM entry_tags
+			WHERE tag_id = ? AND entry_id NOT IN (SELECT entry_id FROM entry_tags WHERE tag_id = ?)`,
+			targetID, sourceID, targetID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.exec("DELETE FROM entry_tags WHERE tag_id = ?", sourceID); err != nil {
+			return err
+		}
+		_, err = tx.exec("DELETE FROM tags WHERE id = ?", sourceID)
+		return err
+	})
+}
+
+func (r *sqlTagRepository) ListForEntry(entryID int) ([]string, error) {
+	rows, err := r.query(`
+		SELECT t.name FROM entry_tags et
+		JOIN tags t ON t.id = et.tag_id
+		WHERE et.entry_id = ?
+		ORDER BY t.name`, entryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (r *sqlTagRepository) ListForUserEntries(userID int) (map[int][]string, error) {
+	rows, err := r.query(`
+		SELECT et.entry_id, t.name FROM entry_tags et
+		JOIN tags t ON t.id = et.tag_id
+		WHERE t.user_id = ?
+		ORDER BY t.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[int][]string)
+	for rows.Next() {
+		var entryID int
+		var name string
+		if err := rows.Scan(&entryID, &name); err != nil {
+			return nil, err
+		}
+		tags[entryID] = append(tags[entryID], name)
+	}
+	return tags, rows.Err()
+}
+
+// Mood analyses
+type sqlMoodAnalysisRepository struct{ *sqlStore }
+
+// Columns read by scanMoodResult, in order
+const moodAnalysisColumns = `ma.id, ma.entry_revision, ma.analyzer, ma.model_version, ma.language, ma.is_current, ma.risk_level,
+	ma.overall_sentiment, ma.sentiment_score, ma.emotions, ma.summary, ma.suggestions, ma.suggestion_by, ma.analyzed_at,
+	ma.model_output, ma.structured_suggestion, ma.sentence_scores`
+
+// Scan a mood analysis, decrypting its text with keys of the entry's owner
+func scanMoodResult(row rowScanner, keys *userKeys) (*MoodResult, error) {
+	var moodResult MoodResult
+	var emotionsJSON string
+	var modelOutputJSON, structuredJSON, sentencesJSON sql.NullString
+
+	err := row.Scan(&moodResult.ID, &moodResult.EntryRevision, &moodResult.Analyzer,
+		&moodResult.ModelVersion, &moodResult.Language, &moodResult.IsCurrent, &moodResult.RiskLevel,
+		&moodResult.OverallSentiment, &moodResult.SentimentScore,
+		&emotionsJSON, &moodResult.Summary, &moodResult.Suggestions, &moodResult.SuggestionBy, &moodResult.AnalyzedAt,
+		&modelOutputJSON, &structuredJSON, &sentencesJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	if moodResult.Summary, err = keys.open(fieldAnalysisSummary, moodResult.Summary); err != nil {
+		return nil, err
+	}
+	if moodResult.Suggestions, err = keys.open(fieldAnalysisSuggestions, moodResult.Suggestions); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(emotionsJSON), &moodResult.Emotions); err != nil {
+		return nil, err
+	}
+	if modelOutputJSON.Valid {
+		if err := json.Unmarshal([]byte(modelOutputJSON.String), &moodResult.ModelOutput); err != nil {
+			return nil, err
+		}
+	}
+	if structuredJSON.Valid {
+		structured, err := keys.openJSON(fieldAnalysisStructured, structuredJSON.String)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(structured), &moodResult.Structured); err != nil {
+			return nil, err
+		}
+	}
+	if sentencesJSON.Valid {
+		if err := json.Unmarshal([]byte(sentencesJSON.String), &moodResult.Sentences); err != nil {
+			return nil, err
+		}
+	}
+
+	return &moodResult, nil
+}
+
+func (r *sqlMoodAnalysisRepository) Save(entryID int, moodResult *MoodResult) error {
+	userID, err := r.entryOwner(entryID)
+	if err != nil {
+		return err
+	}
+	keys, err := r.writingKeys(userID)
+	if err != nil {
+		return err
+	}
+	summary, err := keys.seal(fieldAnalysisSummary, moodResult.Summary)
+	if err != nil {
+		return err
+	}
+	suggestions, err := keys.seal(fieldAnalysisSuggestions, moodResult.Suggestions)
+	if err != nil {
+		return err
+	}
+
+	emotionsJSON, err := json.Marshal(moodResult.Emotions)
+	if err != nil {
+		return err
+	}
+	var modelOutput interface{}
+	if moodResult.ModelOutput != nil {
+		data, err := json.Marshal(moodResult.ModelOutput)
+		if err != nil {
+			return err
+		}
+		modelOutput = string(data)
+	}
+	var structured interface{}
+	if moodResult.Structured != nil {
+		data, err := json.Marshal(moodResult.Structured)
+		if err != nil {
+			return err
+		}
+		if structured, err = keys.sealJSON(fieldAnalysisStructured, data); err != nil {
+			return err
+		}
+	}
+	var sentences interface{}
+	if moodResult.Sentences != nil {
+		data, err := json.Marshal(moodResult.Sentences)
+		if err != nil {
+			return err
+		}
+		sentences = string(data)
+	}
+
+	return r.withTx(func(tx *sqlTx) error {
+		// Lock the entry so concurrent saves take turns; otherwise both could
+		// clear is_current and the second insert would break the unique index
+		var lockedID int
+		err := tx.queryRow("SELECT id FROM entries WHERE id = ?"+r.dialect.forUpdate(), entryID).Scan(&lockedID)
+		if err != nil {
+			return err
+		}
+
+		// A slow analysis of an older revision must not displace a newer one
+		var currentRevision int
+		err = tx.queryRow("SELECT entry_revision FROM mood_analysis WHERE entry_id = ? AND is_current", entryID).
+			Scan(&currentRevision)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		moodResult.IsCurrent = err == sql.ErrNoRows || moodResult.EntryRevision >= currentRevision
+
+		if moodResult.IsCurrent {
+			if _, err := tx.exec("UPDATE mood_analysis SET is_current = ? WHERE entry_id = ? AND is_current", false, entryID); err != nil {
+				return err
+			}
+		}
+
+		return tx.queryRow(`
+		INSERT INTO mood_analysis (entry_id, entry_revision, analyzer, model_version, language, is_current, risk_level,
+			overall_sentiment, sentiment_score, emotions, summary, suggestions, suggestion_by, model_output,
+			structured_suggestion, sentence_scores)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, analyzed_at`,
+			entryID, moodResult.EntryRevision, moodResult.Analyzer, moodResult.ModelVersion, moodResult.Language, moodResult.IsCurrent, moodResult.riskLevel(),
+			moodResult.OverallSentiment, moodResult.SentimentScore,
+			string(emotionsJSON), summary, suggestions, moodResult.SuggestionBy, modelOutput,
+			structured, sentences).
+			Scan(&moodResult.ID, &moodResult.AnalyzedAt)
+	})
+}
+
+func (r *sqlMoodAnalysisRepository) GetByEntry(entryID int) (*MoodResult, error) {
+	keys, err := r.entryKeys(entryID)
+	if err != nil {
+		return nil, err
+	}
+	return scanMoodResult(r.queryRow(`
+		SELECT `+moodAnalysisColumns+`
+		FROM mood_analysis ma WHERE ma.entry_id = ? AND ma.is_current`, entryID), keys)
+}
+
+func (r *sqlMoodAnalysisRepository) ListByEntry(entryID int) ([]MoodResult, error) {
+	keys, err := r.entryKeys(entryID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.query(`
+		SELECT `+moodAnalysisColumns+`
+		FROM mood_analysis ma WHERE ma.entry_id = ?
+		ORDER BY ma.analyzed_at DESC, ma.id DESC`, entryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []MoodResult
+	for rows.Next() {
+		moodResult, err := scanMoodResult(rows, keys)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, *moodResult)
+	}
+	return history, rows.Err()
+}
+
+func (r *sqlMoodAnalysisRepository) DeleteByEntry(entryID int) error {
+	return r.withTx(func(tx *sqlTx) error {
+		if _, err := tx.exec("DELETE FROM mood_corrections WHERE entry_id = ?", entryID); err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM suggestion_feedback WHERE entry_id = ?", entryID); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM mood_analysis WHERE entry_id = ?", entryID)
+		return err
+	})
+}
+
+func (r *sqlMoodAnalysisRepository) DeleteByUser(userID int) (int, error) {
+	var deleted int64
+	err := r.withTx(func(tx *sqlTx) error {
+		if _, err := tx.exec("DELETE FROM mood_corrections WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM suggestion_feedback WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		result, err := tx.exec("DELETE FROM mood_analysis WHERE entry_id IN (SELECT id FROM entries WHERE user_id = ?)", userID)
+		if err != nil {
+			return err
+		}
+		deleted, _ = result.RowsAffected()
+		return nil
+	})
+	return int(deleted), err
+}
+
+func (r *sqlMoodAnalysisRepository) ClearGeneratedSuggestions(userID int) (int, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Suggestions without a recorded author are told apart by their text,
+	// which may be encrypted, so they're picked here rather than in SQL
+	rows, err := r.query(`
+		SELECT ma.id, ma.suggestion_by, ma.suggestions, ma.structured_suggestion IS NOT NULL
+		FROM mood_analysis ma
+		JOIN entries e ON ma.entry_id = e.id
+		WHERE e.user_id = ? AND ma.suggestions <> ''`, userID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var generated []int
+	for rows.Next() {
+		var id int
+		var by, suggestion string
+		var structured bool
+		if err := rows.Scan(&id, &by, &suggestion, &structured); err != nil {
+			return 0, err
+		}
+		if suggestion, err = keys.open(fieldAnalysisSuggestions, suggestion); err != nil {
+			return 0, err
+		}
+		if suggestionGenerated(by, suggestion, structured) {
+			generated = append(generated, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	err = r.withTx(func(tx *sqlTx) error {
+		for _, id := range generated {
+			if _, err := tx.exec("DELETE FROM suggestion_feedback WHERE user_id = ? AND analysis_id = ?", userID, id); err != nil {
+				return err
+			}
+			_, err := tx.exec(`
+				UPDATE mood_analysis SET suggestions = '', suggestion_by = '', structured_suggestion = NULL
+				WHERE id = ?`, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(generated), nil
+}
+
+func (r *sqlMoodAnalysisRepository) ListRecentByUser(userID, limit int) ([]MoodResult, error) {
+	rows, err := r.query(`
+		SELECT ma.overall_sentiment, ma.sentiment_score, ma.emotions, ma.analyzed_at
+		FROM mood_analysis ma
+		JOIN entries e ON ma.entry_id = e.id
+		WHERE e.user_id = ? AND ma.is_current AND e.deleted_at IS NULL
+		ORDER BY ma.analyzed_at DESC
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []MoodResult
+	for rows.Next() {
+		var moodResult MoodResult
+		var emotionsJSON string
+
+		if err := rows.Scan(&moodResult.OverallSentiment, &moodResult.SentimentScore, &emotionsJSON, &moodResult.AnalyzedAt); err != nil {
+			continue
+		}
+
+		// Unparseable emotions are treated as none detected
+		json.Unmarshal([]byte(emotionsJSON), &moodResult.Emotions)
+		results = append(results, moodResult)
+	}
+	return results, rows.Err()
+}
+
+// Insights
+type sqlInsightRepository struct{ *sqlStore }
+
+func (r *sqlInsightRepository) MoodBuckets(userID int, granularity, from, to string) ([]TrendBucket, error) {
+	bucket := r.dialect.dateBucket(granularity, "e.date")
+
+	where := "e.user_id = ? AND ma.is_current AND e.deleted_at IS NULL"
+	args := []interface{}{userID}
+	if from != "" {
+		where += " AND e.date >= ?"
+		args = append(args, from)
+	}
+	if to != "" {
+		where += " AND e.date <= ?"
+		args = append(args, to)
+	}
+
+	rows, err := r.query(`
+		SELECT `+bucket+` AS period, COUNT(*), SUM(ma.sentiment_score),
+			SUM(CASE WHEN ma.overall_sentiment = 'positive' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN ma.overall_sentiment = 'negative' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN ma.overall_sentiment = 'neutral' THEN 1 ELSE 0 END)
+		FROM mood_analysis ma
+		JOIN entries e ON ma.entry_id = e.id
+		WHERE `+where+`
+		GROUP BY period
+		ORDER BY period`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []TrendBucket
+	index := make(map[string]int)
+	for rows.Next() {
+		var b TrendBucket
+		var positive, negative, neutral int
+		if err := rows.Scan(&b.Period, &b.EntryCount, &b.scoreSum, &positive, &negative, &neutral); err != nil {
+			return nil, err
+		}
+		b.Sentiments = map[string]int{"positive": positive, "negative": negative, "neutral": neutral}
+		index[b.Period] = len(buckets)
+		buckets = append(buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Emotion distribution: mean score of each label per analysed entry,
+	// counting entries where the label wasn't detected as zero
+	elements, label, score := r.dialect.emotionElements("ma.emotions")
+	emotionRows, err := r.query(`
+		SELECT `+bucket+` AS period, `+label+` AS label, SUM(`+score+`)
+		FROM mood_analysis ma
+		JOIN entries e ON ma.entry_id = e.id, `+elements+`
+		WHERE `+where+`
+		GROUP BY period, label`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer emotionRows.Close()
+
+	for emotionRows.Next() {
+		var period string
+		var label sql.NullString
+		var sum sql.NullFloat64
+		if err := emotionRows.Scan(&period, &label, &sum); err != nil {
+			return nil, err
+		}
+		i, ok := index[period]
+		if !ok || !label.Valid {
+			continue
+		}
+		buckets[i].Emotions = append(buckets[i].Emotions, EmotionResult{
+			Label: label.String,
+			Score: sum.Float64 / float64(buckets[i].EntryCount),
+		})
+	}
+	return buckets, emotionRows.Err()
+}
+
+func (r *sqlInsightRepository) AnalysedEntries(userID int) ([]AnalysedEntry, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.query(`
+		SELECT e.id, e.title, e.text, ma.overall_sentiment, ma.language
+		FROM mood_analysis ma
+		JOIN entries e ON ma.entry_id = e.id
+		WHERE e.user_id = ? AND ma.is_current AND e.deleted_at IS NULL`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AnalysedEntry
+	for rows.Next() {
+		var entry AnalysedEntry
+		var title, text string
+		if err := rows.Scan(&entry.EntryID, &title, &text, &entry.Sentiment, &entry.Language); err != nil {
+			return nil, err
+		}
+		if err := keys.openContent(&title, &text); err != nil {
+			return nil, err
+		}
+		entry.Text = title + " " + text
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Digests
+type sqlDigestRepository struct{ *sqlStore }
+
+// Columns read by scanDigest, in order
+const digestColumns = `id, user_id, period, period_start, period_end, entry_count, average_score,
+	sentiment_arc, emotions, themes, narrative, narrative_by, created_at`
+
+// Scan a digest, decrypting its text with its user's keys
+func scanDigest(row rowScanner, keys *userKeys) (*Digest, error) {
+	var digest Digest
+	var averageScore sql.NullFloat64
+	var arcJSON, emotionsJSON, themesJSON string
+
+	err := row.Scan(&digest.ID, &digest.UserID, &digest.Period, &digest.PeriodStart, &digest.PeriodEnd,
+		&digest.EntryCount, &averageScore, &arcJSON, &emotionsJSON, &themesJSON,
+		&digest.Narrative, &digest.NarrativeBy, &digest.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if digest.Narrative, err = keys.open(fieldDigestNarrative, digest.Narrative); err != nil {
+		return nil, err
+	}
+	if themesJSON, err = keys.openJSON(fieldDigestThemes, themesJSON); err != nil {
+		return nil, err
+	}
+	if averageScore.Valid {
+		digest.AverageScore = &averageScore.Float64
+	}
+
+	for _, field := range []struct {
+		data string
+		dest interface{}
+	}{
+		{arcJSON, &digest.SentimentArc},
+		{emotionsJSON, &digest.Emotions},
+		{themesJSON, &digest.Themes},
+	} {
+		if err := json.Unmarshal([]byte(field.data), field.dest); err != nil {
+			return nil, err
+		}
+	}
+	return &digest, nil
+}
+
+func (r *sqlDigestRepository) Save(digest *Digest) error {
+	arcJSON, err := json.Marshal(digest.SentimentArc)
+	if err != nil {
+		return err
+	}
+	emotionsJSON, err := json.Marshal(digest.Emotions)
+	if err != nil {
+		return err
+	}
+	themesJSON, err := json.Marshal(digest.Themes)
+	if err != nil {
+		return err
+	}
+
+	keys, err := r.writingKeys(digest.UserID)
+	if err != nil {
+		return err
+	}
+	themes, err := keys.sealJSON(fieldDigestThemes, themesJSON)
+	if err != nil {
+		return err
+	}
+	narrative, err := keys.seal(fieldDigestNarrative, digest.Narrative)
+	if err != nil {
+		return err
+	}
+
+	return r.writeRow(`
+		INSERT INTO digests (user_id, period, period_start, period_end, entry_count, average_score,
+			sentiment_arc, emotions, themes, narrative, narrative_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at`,
+		digest.UserID, digest.Period, digest.PeriodStart, digest.PeriodEnd, digest.EntryCount,
+		digest.AverageScore, string(arcJSON), string(emotionsJSON), themes,
+		narrative, digest.NarrativeBy).Scan(&digest.ID, &digest.CreatedAt)
+}
+
+func (r *sqlDigestRepository) GetByPeriod(userID int, period, periodStart string) (*Digest, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanDigest(r.queryRow(`
+		SELECT `+digestColumns+` FROM digests
+		WHERE user_id = ? AND period = ? AND period_start = ?`, userID, period, periodStart), keys)
+}
+
+func (r *sqlDigestRepository) ListByUser(userID int, period string, limit int) ([]Digest, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + digestColumns + " FROM digests WHERE user_id = ?"
+	args := []interface{}{userID}
+	if period != "" {
+		query += " AND period = ?"
+		args = append(args, period)
+	}
+	query += " ORDER BY period_start DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []Digest
+	for rows.Next() {
+		digest, err := scanDigest(rows, keys)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, *digest)
+	}
+	return digests, rows.Err()
+}
+
+func (r *sqlDigestRepository) UpdateNarrative(id int, narrative, narrativeBy string) error {
+	var userID int
+	if err := r.queryRow("SELECT user_id FROM digests WHERE id = ?", id).Scan(&userID); err != nil {
+		return err
+	}
+	keys, err := r.writingKeys(userID)
+	if err != nil {
+		return err
+	}
+	if narrative, err = keys.seal(fieldDigestNarrative, narrative); err != nil {
+		return err
+	}
+	_, err = r.exec("UPDATE digests SET narrative = ?, narrative_by = ? WHERE id = ?", narrative, narrativeBy, id)
+	return err
+}
+
+func (r *sqlDigestRepository) DeleteByUser(userID int) (int, error) {
+	result, err := r.exec("DELETE FROM digests WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := result.RowsAffected()
+	return int(deleted), nil
+}
+
+// Chat conversations
+type sqlChatRepository struct{ *sqlStore }
+
+// ID of the conversation's owner, whose keys encrypt its messages
+func (r *sqlChatRepository) conversationOwner(conversationID int) (int, error) {
+	var userID int
+	err := r.queryRow("SELECT user_id FROM chat_conversations WHERE id = ?", conversationID).Scan(&userID)
+	return userID, err
+}
+
+func (r *sqlChatRepository) CreateConversation(userID int, title string) (*ChatConversation, error) {
+	keys, err := r.writingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	sealedTitle, err := keys.seal(fieldChatTitle, title)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	conversation := ChatConversation{UserID: userID, Title: title, CreatedAt: now, UpdatedAt: now}
+	err = r.writeRow(`
+		INSERT INTO chat_conversations (user_id, title, created_at, updated_at) VALUES (?, ?, ?, ?)
+		RETURNING id`, userID, sealedTitle, now, now).Scan(&conversation.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (r *sqlChatRepository) GetConversation(id int) (*ChatConversation, error) {
+	var c ChatConversation
+	err := r.queryRow("SELECT id, user_id, title, created_at, updated_at FROM chat_conversations WHERE id = ?", id).
+		Scan(&c.ID, &c.UserID, &c.Title, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.readingKeys(c.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if c.Title, err = keys.open(fieldChatTitle, c.Title); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *sqlChatRepository) ListConversations(userID int) ([]ChatConversation, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.query(`
+		SELECT id, user_id, title, created_at, updated_at FROM chat_conversations
+		WHERE user_id = ? ORDER BY updated_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []ChatConversation
+	for rows.Next() {
+		var c ChatConversation
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Title, &c.CreatedAt, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if c.Title, err = keys.open(fieldChatTitle, c.Title); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+func (r *sqlChatRepository) DeleteConversation(id int) error {
+	return r.withTx(func(tx *sqlTx) error {
+		if _, err := tx.exec("DELETE FROM chat_messages WHERE conversation_id = ?", id); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM chat_conversations WHERE id = ?", id)
+		return err
+	})
+}
+
+func (r *sqlChatRepository) DeleteByUser(userID int) (int, error) {
+	var deleted int64
+	err := r.withTx(func(tx *sqlTx) error {
+		_, err := tx.exec(`
+			DELETE FROM chat_messages WHERE conversation_id IN (
+				SELECT id FROM chat_conversations WHERE user_id = ?
+			)`, userID)
+		if err != nil {
+			return err
+		}
+		result, err := tx.exec("DELETE FROM chat_conversations WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+		deleted, _ = result.RowsAffected()
+		return nil
+	})
+	return int(deleted), err
+}
+
+func (r *sqlChatRepository) AddMessage(message *ChatMessage) error {
+	citationsJSON, err := json.Marshal(message.Citations)
+	if err != nil {
+		return err
+	}
+	userID, err := r.conversationOwner(message.ConversationID)
+	if err != nil {
+		return err
+	}
+	keys, err := r.writingKeys(userID)
+	if err != nil {
+		return err
+	}
+	content, err := keys.seal(fieldChatContent, message.Content)
+	if err != nil {
+		return err
+	}
+	message.CreatedAt = time.Now().UTC()
+
+	return r.withTx(func(tx *sqlTx) error {
+		err := tx.queryRow(`
+			INSERT INTO chat_messages (conversation_id, role, content, citations, created_at)
+			VALUES (?, ?, ?, ?, ?)
+			RETURNING id`,
+			message.ConversationID, message.Role, content, string(citationsJSON), message.CreatedAt).
+			Scan(&message.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.exec("UPDATE chat_conversations SET updated_at = ? WHERE id = ?", message.CreatedAt, message.ConversationID)
+		return err
+	})
+}
+
+func (r *sqlChatRepository) ListMessages(conversationID int) ([]ChatMessage, error) {
+	userID, err := r.conversationOwner(conversationID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.query(`
+		SELECT id, conversation_id, role, content, citations, created_at FROM chat_messages
+		WHERE conversation_id = ? ORDER BY id`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		var m ChatMessage
+		var citationsJSON string
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Role, &m.Content, &citationsJSON, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if m.Content, err = keys.open(fieldChatContent, m.Content); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(citationsJSON), &m.Citations); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// Mood corrections
+type sqlCorrectionRepository struct{ *sqlStore }
+
+// Columns read by scanCorrection, in order
+const correctionColumns = `mc.id, mc.user_id, mc.entry_id, mc.analysis_id, mc.model_sentiment, mc.model_score,
+	mc.model_emotions, mc.sentiment, mc.emotions, mc.created_at, mc.updated_at`
+
+func scanCorrection(row rowScanner, extra ...interface{}) (*MoodCorrection, error) {
+	var c MoodCorrection
+	var modelEmotionsJSON string
+	var sentiment, emotionsJSON sql.NullString
+
+	dest := []interface{}{&c.ID, &c.UserID, &c.EntryID, &c.AnalysisID, &c.ModelSentiment, &c.ModelScore,
+		&modelEmotionsJSON, &sentiment, &emotionsJSON, &c.CreatedAt, &c.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(modelEmotionsJSON), &c.ModelEmotions); err != nil {
+		return nil, err
+	}
+	if sentiment.Valid {
+		c.Sentiment = &sentiment.String
+	}
+	if emotionsJSON.Valid {
+		if err := json.Unmarshal([]byte(emotionsJSON.String), &c.Emotions); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+func (r *sqlCorrectionRepository) Save(correction *MoodCorrection) error {
+	modelEmotionsJSON, err := json.Marshal(correction.ModelEmotions)
+	if err != nil {
+		return err
+	}
+	var emotions interface{}
+	if correction.Emotions != nil {
+		data, err := json.Marshal(correction.Emotions)
+		if err != nil {
+			return err
+		}
+		emotions = string(data)
+	}
+	now := time.Now().UTC()
+
+	return r.withTx(func(tx *sqlTx) error {
+		err := tx.queryRow("SELECT id, created_at FROM mood_corrections WHERE analysis_id = ?", correction.AnalysisID).
+			Scan(&correction.ID, &correction.CreatedAt)
+		if err == sql.ErrNoRows {
+			correction.CreatedAt, correction.UpdatedAt = now, now
+			return tx.queryRow(`
+				INSERT INTO mood_corrections (user_id, entry_id, analysis_id, model_sentiment, model_score,
+					model_emotions, sentiment, emotions, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				RETURNING id`,
+				correction.UserID, correction.EntryID, correction.AnalysisID, correction.ModelSentiment,
+				correction.ModelScore, string(modelEmotionsJSON), correction.Sentiment, emotions, now, now).
+				Scan(&correction.ID)
+		}
+		if err != nil {
+			return err
+		}
+
+		correction.UpdatedAt = now
+		_, err = tx.exec(`
+			UPDATE mood_corrections SET sentiment = ?, emotions = ?, updated_at = ? WHERE id = ?`,
+			correction.Sentiment, emotions, now, correction.ID)
+		return err
+	})
+}
+
+func (r *sqlCorrectionRepository) GetByID(id int) (*MoodCorrection, error) {
+	return scanCorrection(r.queryRow("SELECT "+correctionColumns+" FROM mood_corrections mc WHERE mc.id = ?", id))
+}
+
+func (r *sqlCorrectionRepository) GetByAnalysis(analysisID int) (*MoodCorrection, error) {
+	return scanCorrection(r.queryRow("SELECT "+correctionColumns+" FROM mood_corrections mc WHERE mc.analysis_id = ?", analysisID))
+}
+
+func (r *sqlCorrectionRepository) ListByUser(userID int) ([]MoodCorrection, error) {
+	rows, err := r.query(`
+		SELECT `+correctionColumns+` FROM mood_corrections mc
+		WHERE mc.user_id = ? ORDER BY mc.updated_at DESC, mc.id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var corrections []MoodCorrection
+	for rows.Next() {
+		correction, err := scanCorrection(rows)
+		if err != nil {
+			return nil, err
+		}
+		corrections = append(corrections, *correction)
+	}
+	return corrections, rows.Err()
+}
+
+func (r *sqlCorrectionRepository) Delete(id int) error {
+	_, err := r.exec("DELETE FROM mood_corrections WHERE id = ?", id)
+	return err
+}
+
+func (r *sqlCorrectionRepository) Dataset(userID int) ([]LabelledExample, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The analysed revision is archived in entry_revisions once the entry
+	// has been edited since
+	rows, err := r.query(`
+		SELECT `+correctionColumns+`,
+			COALESCE(er.title, e.title), COALESCE(er.text, e.text)
+		FROM mood_corrections mc
+		JOIN mood_analysis ma ON mc.analysis_id = ma.id
+		JOIN entries e ON mc.entry_id = e.id
+		LEFT JOIN entry_revisions er ON er.entry_id = e.id AND er.revision = ma.entry_revision
+		WHERE mc.user_id = ?
+		ORDER BY mc.created_at, mc.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var examples []LabelledExample
+	for rows.Next() {
+		var title, text string
+		c, err := scanCorrection(rows, &title, &text)
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.openContent(&title, &text); err != nil {
+			return nil, err
+		}
+		examples = append(examples, LabelledExample{
+			EntryID:        c.EntryID,
+			Text:           title + " " + text,
+			ModelSentiment: c.ModelSentiment,
+			ModelScore:     c.ModelScore,
+			ModelEmotions:  c.ModelEmotions,
+			Sentiment:      c.Sentiment,
+			Emotions:       c.Emotions,
+			CorrectedAt:    c.UpdatedAt,
+		})
+	}
+	return examples, rows.Err()
+}
+
+// Suggestion feedback
+type sqlSuggestionFeedbackRepository struct{ *sqlStore }
+
+// Columns read by scanSuggestionFeedback, in order
+const suggestionFeedbackColumns = `id, user_id, entry_id, analysis_id, suggestion, outcome, follow_up,
+	created_at, updated_at`
+
+func scanSuggestionFeedback(row rowScanner) (*SuggestionFeedback, error) {
+	var f SuggestionFeedback
+	err := row.Scan(&f.ID, &f.UserID, &f.EntryID, &f.AnalysisID, &f.Suggestion, &f.Outcome, &f.FollowUp,
+		&f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Decrypt a rating's suggestion and follow-up in place
+func openSuggestionFeedback(f *SuggestionFeedback, keys *userKeys) error {
+	var err error
+	if f.Suggestion, err = keys.open(fieldFeedbackSuggestion, f.Suggestion); err != nil {
+		return err
+	}
+	if f.FollowUp, err = keys.open(fieldFeedbackFollowUp, f.FollowUp); err != nil {
+		return err
+	}
+	f.key = suggestionKey(f.Suggestion)
+	return nil
+}
+
+// Read one rating, decrypted with its user's keys
+func (r *sqlSuggestionFeedbackRepository) get(where string, arg interface{}) (*SuggestionFeedback, error) {
+	f, err := scanSuggestionFeedback(r.queryRow("SELECT "+suggestionFeedbackColumns+" FROM suggestion_feedback WHERE "+where, arg))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.readingKeys(f.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := openSuggestionFeedback(f, keys); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *sqlSuggestionFeedbackRepository) Save(feedback *SuggestionFeedback) error {
+	keys, err := r.writingKeys(feedback.UserID)
+	if err != nil {
+		return err
+	}
+	suggestion, err := keys.seal(fieldFeedbackSuggestion, feedback.Suggestion)
+	if err != nil {
+		return err
+	}
+	followUp, err := keys.seal(fieldFeedbackFollowUp, feedback.FollowUp)
+	if err != nil {
+		return err
+	}
+	key := keys.hash(fieldFeedbackKey, feedback.key)
+	now := time.Now().UTC()
+
+	return r.withTx(func(tx *sqlTx) error {
+		err := tx.queryRow("SELECT id, created_at FROM suggestion_feedback WHERE analysis_id = ?", feedback.AnalysisID).
+			Scan(&feedback.ID, &feedback.CreatedAt)
+		if err == sql.ErrNoRows {
+			feedback.CreatedAt, feedback.UpdatedAt = now, now
+			return tx.queryRow(`
+				INSERT INTO suggestion_feedback (user_id, entry_id, analysis_id, suggestion, suggestion_key,
+					outcome, follow_up, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+				RETURNING id`,
+				feedback.UserID, feedback.EntryID, feedback.AnalysisID, suggestion, key,
+				feedback.Outcome, followUp, now, now).Scan(&feedback.ID)
+		}
+		if err != nil {
+			return err
+		}
+
+		feedback.UpdatedAt = now
+		_, err = tx.exec(`
+			UPDATE suggestion_feedback SET outcome = ?, follow_up = ?, updated_at = ? WHERE id = ?`,
+			feedback.Outcome, followUp, now, feedback.ID)
+		return err
+	})
+}
+
+func (r *sqlSuggestionFeedbackRepository) GetByID(id int) (*SuggestionFeedback, error) {
+	return r.get("id = ?", id)
+}
+
+func (r *sqlSuggestionFeedbackRepository) GetByAnalysis(analysisID int) (*SuggestionFeedback, error) {
+	return r.get("analysis_id = ?", analysisID)
+}
+
+func (r *sqlSuggestionFeedbackRepository) ListByUser(userID int) ([]SuggestionFeedback, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.query(`
+		SELECT `+suggestionFeedbackColumns+` FROM suggestion_feedback
+		WHERE user_id = ? ORDER BY updated_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feedback []SuggestionFeedback
+	for rows.Next() {
+		f, err := scanSuggestionFeedback(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := openSuggestionFeedback(f, keys); err != nil {
+			return nil, err
+		}
+		feedback = append(feedback, *f)
+	}
+	return feedback, rows.Err()
+}
+
+func (r *sqlSuggestionFeedbackRepository) Delete(id int) error {
+	_, err := r.exec("DELETE FROM suggestion_feedback WHERE id = ?", id)
+	return err
+}
+
+func (r *sqlSuggestionFeedbackRepository) Stats(userID int) ([]SuggestionStats, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.query(`
+		SELECT MIN(suggestion),
+			SUM(CASE WHEN outcome = 'helped' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN outcome = 'did_not_help' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN outcome = 'tried' THEN 1 ELSE 0 END)
+		FROM suggestion_feedback
+		WHERE user_id = ?
+		GROUP BY suggestion_key`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Groups hashed under different key versions, while a rotation runs,
+	// are merged once decrypted
+	var stats []SuggestionStats
+	byKey := make(map[string]int)
+	for rows.Next() {
+		var s SuggestionStats
+		if err := rows.Scan(&s.Suggestion, &s.Helped, &s.DidNotHelp, &s.Tried); err != nil {
+			return nil, err
+		}
+		if s.Suggestion, err = keys.open(fieldFeedbackSuggestion, s.Suggestion); err != nil {
+			return nil, err
+		}
+		s.Suggestion = strings.TrimPrefix(s.Suggestion, repeatedSuggestionPrefix)
+		s.key = suggestionKey(s.Suggestion)
+		if i, ok := byKey[s.key]; ok {
+			stats[i].Helped += s.Helped
+			stats[i].DidNotHelp += s.DidNotHelp
+			stats[i].Tried += s.Tried
+			continue
+		}
+		byKey[s.key] = len(stats)
+		stats = append(stats, s)
+	}
+	for i := range stats {
+		stats[i].Effectiveness = effectiveness(stats[i].Helped, stats[i].DidNotHelp)
+	}
+	return stats, rows.Err()
+}
+
+// Mood check-ins
+type sqlCheckInRepository struct{ *sqlStore }
+
+// Columns read by scanCheckIn, in order. A check-in on an entry takes the
+// entry's current date.
+const checkInColumns = `c.id, c.user_id, c.entry_id, COALESCE(e.date, c.date), c.rating, c.energy,
+	c.sleep_hours, c.emotions, c.note, c.created_at, c.updated_at`
+
+const checkInFrom = "mood_checkins c LEFT JOIN entries e ON c.entry_id = e.id"
+
+func scanCheckIn(row rowScanner) (*MoodCheckIn, error) {
+	var c MoodCheckIn
+	var entryID, energy sql.NullInt64
+	var sleepHours sql.NullFloat64
+	var emotionsJSON string
+
+	err := row.Scan(&c.ID, &c.UserID, &entryID, &c.Date, &c.Rating, &energy,
+		&sleepHours, &emotionsJSON, &c.Note, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if entryID.Valid {
+		id := int(entryID.Int64)
+		c.EntryID = &id
+	}
+	if energy.Valid {
+		e := int(energy.Int64)
+		c.Energy = &e
+	}
+	if sleepHours.Valid {
+		c.SleepHours = &sleepHours.Float64
+	}
+	if err := json.Unmarshal([]byte(emotionsJSON), &c.Emotions); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Read one check-in, its note decrypted with its user's keys
+func (r *sqlCheckInRepository) get(where string, arg interface{}) (*MoodCheckIn, error) {
+	checkIn, err := scanCheckIn(r.queryRow("SELECT "+checkInColumns+" FROM "+checkInFrom+" WHERE "+where, arg))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.readingKeys(checkIn.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if checkIn.Note, err = keys.open(fieldCheckInNote, checkIn.Note); err != nil {
+		return nil, err
+	}
+	return checkIn, nil
+}
+
+func (r *sqlCheckInRepository) Create(checkIn *MoodCheckIn) error {
+	emotionsJSON, err := json.Marshal(checkIn.Emotions)
+	if err != nil {
+		return err
+	}
+	keys, err := r.writingKeys(checkIn.UserID)
+	if err != nil {
+		return err
+	}
+	note, err := keys.seal(fieldCheckInNote, checkIn.Note)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	checkIn.CreatedAt, checkIn.UpdatedAt = now, now
+
+	return r.writeRow(`
+		INSERT INTO mood_checkins (user_id, entry_id, date, rating, energy, sleep_hours, emotions, note, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		checkIn.UserID, checkIn.EntryID, checkIn.Date, checkIn.Rating, checkIn.Energy, checkIn.SleepHours,
+		string(emotionsJSON), note, now, now).Scan(&checkIn.ID)
+}
+
+func (r *sqlCheckInRepository) GetByID(id int) (*MoodCheckIn, error) {
+	return r.get("c.id = ?", id)
+}
+
+func (r *sqlCheckInRepository) GetByEntry(entryID int) (*MoodCheckIn, error) {
+	return r.get("c.entry_id = ?", entryID)
+}
+
+// WHERE clause shared by listing and bucketing: the user's check-ins that
+// aren't on trashed entries, dated from..to
+func checkInWhere(userID int, from, to string) (string, []interface{}) {
+	where := "c.user_id = ? AND e.deleted_at IS NULL"
+	args := []interface{}{userID}
+	if from != "" {
+		where += " AND COALESCE(e.date, c.date) >= ?"
+		args = append(args, from)
+	}
+	if to != "" {
+		where += " AND COALESCE(e.date, c.date) <= ?"
+		args = append(args, to)
+	}
+	return where, args
+}
+
+func (r *sqlCheckInRepository) ListByUser(userID int, from, to string) ([]MoodCheckIn, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	where, args := checkInWhere(userID, from, to)
+	rows, err := r.query(`
+		SELECT `+checkInColumns+` FROM `+checkInFrom+`
+		WHERE `+where+`
+		ORDER BY COALESCE(e.date, c.date) DESC, c.created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkIns []MoodCheckIn
+	for rows.Next() {
+		checkIn, err := scanCheckIn(rows)
+		if err != nil {
+			return nil, err
+		}
+		if checkIn.Note, err = keys.open(fieldCheckInNote, checkIn.Note); err != nil {
+			return nil, err
+		}
+		checkIns = append(checkIns, *checkIn)
+	}
+	return checkIns, rows.Err()
+}
+
+func (r *sqlCheckInRepository) Update(checkIn *MoodCheckIn) error {
+	emotionsJSON, err := json.Marshal(checkIn.Emotions)
+	if err != nil {
+		return err
+	}
+	keys, err := r.writingKeys(checkIn.UserID)
+	if err != nil {
+		return err
+	}
+	note, err := keys.seal(fieldCheckInNote, checkIn.Note)
+	if err != nil {
+		return err
+	}
+	checkIn.UpdatedAt = time.Now().UTC()
+
+	_, err = r.exec(`
+		UPDATE mood_checkins SET entry_id = ?, date = ?, rating = ?, energy = ?, sleep_hours = ?,
+			emotions = ?, note = ?, updated_at = ?
+		WHERE id = ?`,
+		checkIn.EntryID, checkIn.Date, checkIn.Rating, checkIn.Energy, checkIn.SleepHours,
+		string(emotionsJSON), note, checkIn.UpdatedAt, checkIn.ID)
+	return err
+}
+
+func (r *sqlCheckInRepository) Delete(id int) error {
+	_, err := r.exec("DELETE FROM mood_checkins WHERE id = ?", id)
+	return err
+}
+
+func (r *sqlCheckInRepository) Buckets(userID int, granularity, from, to string) (map[string]*SelfReportedMood, error) {
+	bucket := r.dialect.dateBucket(granularity, "COALESCE(e.date, c.date)")
+	where, args := checkInWhere(userID, from, to)
+
+	rows, err := r.query(`
+		SELECT `+bucket+` AS period, COUNT(*), SUM(c.rating), AVG(c.energy), AVG(c.sleep_hours)
+		FROM `+checkInFrom+`
+		WHERE `+where+`
+		GROUP BY period`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make(map[string]*SelfReportedMood)
+	for rows.Next() {
+		var period string
+		var b SelfReportedMood
+		var energy, sleepHours sql.NullFloat64
+		if err := rows.Scan(&period, &b.CheckInCount, &b.ratingSum, &energy, &sleepHours); err != nil {
+			return nil, err
+		}
+		if energy.Valid {
+			b.AverageEnergy = &energy.Float64
+		}
+		if sleepHours.Valid {
+			b.AverageSleepHours = &sleepHours.Float64
+		}
+		b.Emotions = make(map[string]int)
+		buckets[period] = &b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	elements, value := r.dialect.stringElements("c.emotions")
+	emotionRows, err := r.query(`
+		SELECT `+bucket+` AS period, `+value+` AS emotion, COUNT(*)
+		FROM `+checkInFrom+`, `+elements+`
+		WHERE `+where+`
+		GROUP BY period, emotion`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer emotionRows.Close()
+
+	for emotionRows.Next() {
+		var period, emotion string
+		var count int
+		if err := emotionRows.Scan(&period, &emotion, &count); err != nil {
+			return nil, err
+		}
+		if b, ok := buckets[period]; ok {
+			b.Emotions[emotion] = count
+		}
+	}
+	return buckets, emotionRows.Err()
+}
+
+// Embeddings
+type sqlEmbeddingRepository struct{ *sqlStore }
+
+func (r *sqlEmbeddingRepository) Save(entryID, userID int, embedding []float64, textHash string) error {
+	return r.withTx(func(tx *sqlTx) error {
+		return r.upsert(tx, entryID, userID, embedding, textHash)
+	})
+}
+
+// Insert or update the entry's embedding inside tx
+func (r *sqlEmbeddingRepository) upsert(tx *sqlTx, entryID, userID int, embedding []float64, textHash string) error {
+	embeddingJSON, err := json.Marshal(embedding)
+	if err != nil {
+		return err
+	}
+
+	// Check if embedding already exists
+	var existingID int
+	err = tx.queryRow("SELECT id FROM entry_embeddings WHERE entry_id = ?", entryID).Scan(&existingID)
+
+	if err == sql.ErrNoRows {
+		// Insert new embedding
+		_, err = tx.exec(`
+			INSERT INTO entry_embeddings (entry_id, user_id, embedding, text_hash)
+			VALUES (?, ?, ?, ?)`,
+			entryID, userID, string(embeddingJSON), textHash)
+	} else if err == nil {
+		// Update existing embedding
+		_, err = tx.exec(`
+			UPDATE entry_embeddings SET embedding = ?, text_hash = ?
+			WHERE id = ?`,
+			string(embeddingJSON), textHash, existingID)
+	}
+
+	return err
+}
+
+func (r *sqlEmbeddingRepository) SaveChunks(entryID, userID int, chunks []ChunkEmbedding) error {
+	return r.withTx(func(tx *sqlTx) error {
+		return r.replaceChunks(tx, entryID, userID, chunks)
+	})
+}
+
+// Replace the entry's chunk embeddings inside tx
+func (r *sqlEmbeddingRepository) replaceChunks(tx *sqlTx, entryID, userID int, chunks []ChunkEmbedding) error {
+	if _, err := tx.exec("DELETE FROM entry_chunk_embeddings WHERE entry_id = ?", entryID); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		embeddingJSON, err := json.Marshal(chunk.Embedding)
+		if err != nil {
+			return err
+		}
+		_, err = tx.exec(`
+			INSERT INTO entry_chunk_embeddings (entry_id, user_id, chunk_index, start_offset, end_offset, embedding)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			entryID, userID, chunk.Index, chunk.Start, chunk.End, string(embeddingJSON))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Raise an entry's similarity to that of its best matching chunk, keeping
+// the chunk's offsets
+func (s *SimilarEntry) matchChunk(similarity float64, start, end int) {
+	if similarity > s.Similarity {
+		s.Similarity = similarity
+		s.passageStart, s.passageEnd = start, end
+	}
+}
+
+func (r *sqlEmbeddingRepository) DeleteByUser(userID int) (int, error) {
+	var deleted int64
+	err := r.withTx(func(tx *sqlTx) error {
+		if _, err := tx.exec("DELETE FROM entry_chunk_embeddings WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		result, err := tx.exec("DELETE FROM entry_embeddings WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+		deleted, _ = result.RowsAffected()
+		return nil
+	})
+	return int(deleted), err
+}
+
+// Brute-force cosine similarity over all of the user's embeddings
+func (r *sqlEmbeddingRepository) FindSimilar(userID int, queryEmbedding []float64, limit int) ([]SimilarEntry, error) {
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.query(`
+		SELECT ee.entry_id, ee.embedding, e.title, e.text, e.date, e.timezone, e.created_at
+		FROM entry_embeddings ee
+		JOIN entries e ON ee.entry_id = e.id
+		WHERE ee.user_id = ? AND e.deleted_at IS NULL
+		ORDER BY e.created_at DESC`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []SimilarEntry
+
+	for rows.Next() {
+		var embeddingJSON string
+		var entry Entry
+
+		err := rows.Scan(&entry.ID, &embeddingJSON, &entry.Title, &entry.Text, &entry.Date, &entry.Timezone, &entry.CreatedAt)
+		if err != nil {
+			continue
+		}
+
+		// Parse embedding
+		var embedding []float64
+		if err := json.Unmarshal([]byte(embeddingJSON), &embedding); err != nil {
+			continue
+		}
+
+		entry.UserID = userID
+		candidates = append(candidates, SimilarEntry{
+			Entry:      entry,
+			Similarity: cosineSimilarity(queryEmbedding, embedding),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Long entries also score by their chunks
+	byEntry := make(map[int]*SimilarEntry, len(candidates))
+	for i := range candidates {
+		byEntry[candidates[i].Entry.ID] = &candidates[i]
+	}
+	chunkRows, err := r.query(`
+		SELECT entry_id, start_offset, end_offset, embedding
+		FROM entry_chunk_embeddings
+		WHERE user_id = ?`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer chunkRows.Close()
+
+	for chunkRows.Next() {
+		var entryID, start, end int
+		var embeddingJSON string
+		if err := chunkRows.Scan(&entryID, &start, &end, &embeddingJSON); err != nil {
+			continue
+		}
+		candidate, ok := byEntry[entryID]
+		if !ok {
+			continue
+		}
+
+		var embedding []float64
+		if err := json.Unmarshal([]byte(embeddingJSON), &embedding); err != nil {
+			continue
+		}
+		candidate.matchChunk(cosineSimilarity(queryEmbedding, embedding), start, end)
+	}
+
+	// Sort by similarity (descending)
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Similarity > candidates[j].Similarity
+	})
+
+	// Return top results
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	// Only the results are decrypted
+	if err := openSimilar(keys, candidates); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+func openSimilar(keys *userKeys, results []SimilarEntry) error {
+	for i := range results {
+		if err := keys.openContent(&results[i].Entry.Title, &results[i].Entry.Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Model output cache
+type sqlModelCacheRepository struct{ *sqlStore }
+
+func (r *sqlModelCacheRepository) Get(userID int, model, task, inputHash string, now time.Time) ([]byte, error) {
+	var output string
+	err := r.writeRow(`
+		UPDATE model_cache SET hits = hits + 1, last_used_at = ?
+		WHERE user_id = ? AND model = ? AND task = ? AND input_hash = ? AND expires_at > ?
+		RETURNING output`,
+		now, userID, model, task, inputHash, now).Scan(&output)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	if output, err = keys.open(fieldModelOutput, output); err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
+
+func (r *sqlModelCacheRepository) Put(userID int, model, task, inputHash string, output []byte, expiresAt time.Time) error {
+	// Outputs of requests without a user carry no one's text and are stored
+	// as is
+	stored := string(output)
+	if userID != 0 {
+		keys, err := r.writingKeys(userID)
+		if err != nil {
+			return err
+		}
+		if stored, err = keys.seal(fieldModelOutput, stored); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	_, err := r.exec(`
+		INSERT INTO model_cache (user_id, model, task, input_hash, output, size_bytes, hits, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?)
+		ON CONFLICT (user_id, model, task, input_hash) DO UPDATE SET
+			output = excluded.output, size_bytes = excluded.size_bytes, hits = 0,
+			created_at = excluded.created_at, last_used_at = excluded.last_used_at, expires_at = excluded.expires_at`,
+		userID, model, task, inputHash, stored, len(stored), now, now, expiresAt)
+	return err
+}
+
+func (r *sqlModelCacheRepository) DeleteByUser(userID int, tasks ...string) (int, error) {
+	if len(tasks) == 0 {
+		return 0, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(tasks)), ", ")
+	args := []interface{}{userID}
+	for _, task := range tasks {
+		args = append(args, task)
+	}
+
+	result, err := r.exec("DELETE FROM model_cache WHERE user_id = ? AND task IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := result.RowsAffected()
+	return int(deleted), nil
+}
+
+func (r *sqlModelCacheRepository) Prune(now time.Time, maxEntries int, maxBytes int64) (int, error) {
+	var pruned int64
+
+	err := r.withTx(func(tx *sqlTx) error {
+		result, err := tx.exec("DELETE FROM model_cache WHERE expires_at <= ?", now)
+		if err != nil {
+			return err
+		}
+		pruned, _ = result.RowsAffected()
+
+		// Keep the most recently used outputs that fit both limits
+		result, err = tx.exec(`
+			DELETE FROM model_cache WHERE id IN (
+				SELECT id FROM (
+					SELECT id,
+						ROW_NUMBER() OVER (ORDER BY last_used_at DESC, id DESC) AS position,
+						SUM(size_bytes) OVER (ORDER BY last_used_at DESC, id DESC) AS running_bytes
+					FROM model_cache
+				) ranked
+				WHERE position > ? OR running_bytes > ?
+			)`,
+			maxEntries, maxBytes)
+		if err != nil {
+			return err
+		}
+		evicted, _ := result.RowsAffected()
+		pruned += evicted
+		return nil
+	})
+
+	return int(pruned), err
+}
+
+func (r *sqlModelCacheRepository) Stats() (*ModelCacheStats, error) {
+	var stats ModelCacheStats
+	err := r.queryRow(`
+		SELECT COUNT(*), COALESCE(SUM(size_bytes), 0), COALESCE(SUM(hits), 0) FROM model_cache`).
+		Scan(&stats.Entries, &stats.Bytes, &stats.Hits)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Open the configured backend, run its migrations and return the store
+func openStore(cfg StorageConfig) (*sql.DB, *Store, error) {
+	keys, err := loadMasterKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.MasterKeys = keys
+
+	switch cfg.Driver {
+	case "sqlite", "sqlite3":
+		return openSQLiteStore(cfg)
+	case "postgres", "postgresql":
+		return openPostgresStore(cfg)
+	default:
+		return nil, nil, fmt.Errorf("unsupported DB_DRIVER %q", cfg.Driver)
+	}
+}
@@ -0,0 +1,576 @@
+// storage_postgres.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// PostgreSQL schema, kept in step with the SQLite migrations in main.go
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS users (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			email TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+	},
+	{
+		Version: 2,
+		Name:    "create_entries_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS entries (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id),
+			title TEXT NOT NULL,
+			text TEXT NOT NULL,
+			date TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+	},
+	{
+		Version: 3,
+		Name:    "create_mood_analysis_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS mood_analysis (
+			id SERIAL PRIMARY KEY,
+			entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+			overall_sentiment TEXT NOT NULL,
+			sentiment_score DOUBLE PRECISION NOT NULL,
+			emotions JSONB NOT NULL,
+			summary TEXT,
+			suggestions TEXT,
+			analyzed_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+	},
+	{
+		Version: 4,
+		Name:    "create_embeddings_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS entry_embeddings (
+			id SERIAL PRIMARY KEY,
+			entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			embedding TEXT NOT NULL, -- JSON string of float64 array
+			text_hash TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_embeddings_user_id ON entry_embeddings(user_id);
+		CREATE INDEX IF NOT EXISTS idx_embeddings_entry_id ON entry_embeddings(entry_id);`,
+	},
+	{
+		Version: 5,
+		Name:    "add_mood_analysis_history",
+		SQL: `
+		ALTER TABLE entries ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS entry_revision INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS analyzer TEXT NOT NULL DEFAULT 'legacy';
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS model_version TEXT NOT NULL DEFAULT '';
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS is_current BOOLEAN NOT NULL DEFAULT FALSE;
+		UPDATE mood_analysis SET is_current = TRUE
+		WHERE id IN (SELECT MAX(id) FROM mood_analysis GROUP BY entry_id);
+		CREATE INDEX IF NOT EXISTS idx_mood_analysis_entry_id ON mood_analysis(entry_id);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_mood_analysis_current ON mood_analysis(entry_id) WHERE is_current;`,
+	},
+	{
+		Version: 6,
+		Name:    "create_entry_revisions_table",
+		SQL: `
+		ALTER TABLE entries ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+		CREATE TABLE IF NOT EXISTS entry_revisions (
+			id SERIAL PRIMARY KEY,
+			entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+			revision INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			text TEXT NOT NULL,
+			saved_at TIMESTAMPTZ NOT NULL,
+			archived_at TIMESTAMPTZ DEFAULT NOW(),
+			UNIQUE (entry_id, revision)
+		);`,
+	},
+	{
+		Version: 7,
+		Name:    "add_entries_deleted_at",
+		SQL: `
+		ALTER TABLE entries ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS idx_entries_deleted_at ON entries(deleted_at) WHERE deleted_at IS NOT NULL;`,
+	},
+	{
+		Version: 8,
+		Name:    "create_tags_and_notebooks",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS notebooks (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			UNIQUE (user_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS tags (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			UNIQUE (user_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS entry_tags (
+			entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+			tag_id INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+			PRIMARY KEY (entry_id, tag_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_entry_tags_tag_id ON entry_tags(tag_id);
+		ALTER TABLE entries ADD COLUMN IF NOT EXISTS notebook_id INTEGER REFERENCES notebooks (id) ON DELETE SET NULL;
+		CREATE INDEX IF NOT EXISTS idx_entries_notebook_id ON entries(notebook_id);`,
+	},
+	{
+		Version: 9,
+		Name:    "add_timezones_and_iso_dates",
+		SQL: `
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
+		ALTER TABLE entries ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
+		CREATE INDEX IF NOT EXISTS idx_entries_user_date ON entries(user_id, date);`,
+		Migrate: migrateEntryDates,
+	},
+	{
+		Version: 10,
+		Name:    "create_digests_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS digests (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			period TEXT NOT NULL,
+			period_start TEXT NOT NULL,
+			period_end TEXT NOT NULL,
+			entry_count INTEGER NOT NULL,
+			average_score DOUBLE PRECISION,
+			sentiment_arc JSONB NOT NULL,
+			emotions JSONB NOT NULL,
+			themes JSONB NOT NULL,
+			narrative TEXT NOT NULL,
+			narrative_by TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			UNIQUE (user_id, period, period_start)
+		);`,
+	},
+	{
+		Version: 11,
+		Name:    "create_chat_tables",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS chat_conversations (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			title TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_chat_conversations_user_id ON chat_conversations(user_id);
+		CREATE TABLE IF NOT EXISTS chat_messages (
+			id SERIAL PRIMARY KEY,
+			conversation_id INTEGER NOT NULL REFERENCES chat_conversations (id) ON DELETE CASCADE,
+			role TEXT NOT NULL,
+			content TEXT NOT NULL,
+			citations JSONB NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_chat_messages_conversation_id ON chat_messages(conversation_id);`,
+	},
+	{
+		Version: 12,
+		Name:    "add_mood_analysis_risk_level",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS risk_level TEXT NOT NULL DEFAULT 'none';`,
+	},
+	{
+		Version: 13,
+		Name:    "create_mood_checkins_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS mood_checkins (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			entry_id INTEGER UNIQUE REFERENCES entries (id) ON DELETE SET NULL,
+			date TEXT NOT NULL,
+			rating INTEGER NOT NULL,
+			energy INTEGER,
+			sleep_hours DOUBLE PRECISION,
+			emotions JSONB NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_mood_checkins_user_date ON mood_checkins(user_id, date);`,
+	},
+	{
+		Version: 14,
+		Name:    "create_mood_corrections_table",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS model_output JSONB;
+		CREATE TABLE IF NOT EXISTS mood_corrections (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+			analysis_id INTEGER NOT NULL UNIQUE REFERENCES mood_analysis (id) ON DELETE CASCADE,
+			model_sentiment TEXT NOT NULL,
+			model_score DOUBLE PRECISION NOT NULL,
+			model_emotions JSONB NOT NULL,
+			sentiment TEXT,
+			emotions JSONB,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_mood_corrections_user_id ON mood_corrections(user_id);`,
+	},
+	{
+		Version: 15,
+		Name:    "create_suggestion_feedback_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS suggestion_feedback (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+			analysis_id INTEGER NOT NULL UNIQUE REFERENCES mood_analysis (id) ON DELETE CASCADE,
+			suggestion TEXT NOT NULL,
+			suggestion_key TEXT NOT NULL,
+			outcome TEXT NOT NULL,
+			follow_up TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_suggestion_feedback_user_key ON suggestion_feedback(user_id, suggestion_key);`,
+	},
+	{
+		Version: 16,
+		Name:    "add_mood_analysis_structured_suggestion",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS structured_suggestion JSONB;`,
+	},
+	{
+		Version: 17,
+		Name:    "create_model_cache_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS model_cache (
+			id SERIAL PRIMARY KEY,
+			model TEXT NOT NULL,
+			task TEXT NOT NULL,
+			input_hash TEXT NOT NULL,
+			output TEXT NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			hits INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL,
+			last_used_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			UNIQUE (model, task, input_hash)
+		);
+		CREATE INDEX IF NOT EXISTS idx_model_cache_last_used ON model_cache(last_used_at);`,
+	},
+	{
+		Version: 18,
+		Name:    "create_entry_chunk_embeddings_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS entry_chunk_embeddings (
+			id SERIAL PRIMARY KEY,
+			entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			chunk_index INTEGER NOT NULL,
+			start_offset INTEGER NOT NULL,
+			end_offset INTEGER NOT NULL,
+			embedding TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			UNIQUE (entry_id, chunk_index)
+		);
+		CREATE INDEX IF NOT EXISTS idx_chunk_embeddings_user_id ON entry_chunk_embeddings(user_id);`,
+	},
+	{
+		Version: 19,
+		Name:    "add_mood_analysis_sentence_scores",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS sentence_scores JSONB;`,
+	},
+	{
+		Version: 20,
+		Name:    "add_mood_analysis_language",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS language TEXT NOT NULL DEFAULT '';`,
+	},
+	{
+		Version: 21,
+		Name:    "add_users_external_processing",
+		SQL: `
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS external_processing BOOLEAN NOT NULL DEFAULT TRUE;`,
+	},
+	{
+		Version: 22,
+		Name:    "add_users_privacy_settings",
+		SQL: `
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS mood_analysis BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS embeddings BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS generative_suggestions BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS local_analysis BOOLEAN NOT NULL DEFAULT FALSE;`,
+	},
+	{
+		Version: 23,
+		Name:    "create_user_data_keys_table",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS user_data_keys (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			version INTEGER NOT NULL,
+			wrapped_key TEXT NOT NULL,
+			master_key_id TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			UNIQUE (user_id, version)
+		);`,
+	},
+	{
+		Version: 24,
+		Name:    "add_model_cache_user_id",
+		SQL: `
+		DROP TABLE IF EXISTS model_cache;
+		CREATE TABLE model_cache (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			model TEXT NOT NULL,
+			task TEXT NOT NULL,
+			input_hash TEXT NOT NULL,
+			output TEXT NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			hits INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL,
+			last_used_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			UNIQUE (user_id, model, task, input_hash)
+		);
+		CREATE INDEX IF NOT EXISTS idx_model_cache_last_used ON model_cache(last_used_at);`,
+	},
+	{
+		Version: 25,
+		Name:    "add_mood_analysis_suggestion_by",
+		SQL: `
+		ALTER TABLE mood_analysis ADD COLUMN IF NOT EXISTS suggestion_by TEXT NOT NULL DEFAULT '';`,
+	},
+}
+
+// Embedding dimension used by BAAI/bge-small-en-v1.5 and the fallback embedding
+const embeddingDimensions = 384
+
+// Open the PostgreSQL backend
+func openPostgresStore(cfg StorageConfig) (*sql.DB, *Store, error) {
+	if cfg.DatabaseURL == "" {
+		return nil, nil, fmt.Errorf("DATABASE_URL is required when DB_DRIVER=postgres")
+	}
+
+	conn, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+
+	if err := runMigrations(conn, postgresDialect, postgresMigrations); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// Postgres handles concurrent writers itself, so one pool serves both roles
+	store := newSQLStore(conn, conn, postgresDialect, cfg.MasterKeys)
+
+	if cfg.PgVector {
+		if err := enablePgVector(conn); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		store.Embeddings = &pgvectorEmbeddingRepository{
+			sqlEmbeddingRepository: *store.Embeddings.(*sqlEmbeddingRepository),
+		}
+	}
+
+	return conn, store, nil
+}
+
+// Install the pgvector extension and add the vector column alongside the
+// JSON embedding. Safe to run on every start.
+func enablePgVector(conn *sql.DB) error {
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS vector",
+		fmt.Sprintf("ALTER TABLE entry_embeddings ADD COLUMN IF NOT EXISTS embedding_vec vector(%d)", embeddingDimensions),
+		"CREATE INDEX IF NOT EXISTS idx_embeddings_vec ON entry_embeddings USING hnsw (embedding_vec vector_cosine_ops)",
+		fmt.Sprintf("ALTER TABLE entry_chunk_embeddings ADD COLUMN IF NOT EXISTS embedding_vec vector(%d)", embeddingDimensions),
+		"CREATE INDEX IF NOT EXISTS idx_chunk_embeddings_vec ON entry_chunk_embeddings USING hnsw (embedding_vec vector_cosine_ops)",
+	}
+
+	for _, stmt := range statements {
+		if _, err := conn.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to enable pgvector: %v", err)
+		}
+	}
+	return nil
+}
+
+// Embedding repository that searches with pgvector's cosine distance
+// operator instead of scoring every row in Go
+type pgvectorEmbeddingRepository struct {
+	sqlEmbeddingRepository
+}
+
+// Format an embedding as a pgvector literal, e.g. [0.1,0.2]
+func vectorLiteral(embedding []float64) string {
+	parts := make([]string, len(embedding))
+	for i, v := range embedding {
+		parts[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+func (r *pgvectorEmbeddingRepository) Save(entryID, userID int, embedding []float64, textHash string) error {
+	return r.withTx(func(tx *sqlTx) error {
+		if err := r.upsert(tx, entryID, userID, embedding, textHash); err != nil {
+			return err
+		}
+
+		// Embeddings of another dimension stay JSON-only and are skipped by search
+		if len(embedding) != embeddingDimensions {
+			_, err := tx.exec("UPDATE entry_embeddings SET embedding_vec = NULL WHERE entry_id = ?", entryID)
+			return err
+		}
+
+		_, err := tx.exec("UPDATE entry_embeddings SET embedding_vec = ?::vector WHERE entry_id = ?",
+			vectorLiteral(embedding), entryID)
+		return err
+	})
+}
+
+func (r *pgvectorEmbeddingRepository) SaveChunks(entryID, userID int, chunks []ChunkEmbedding) error {
+	return r.withTx(func(tx *sqlTx) error {
+		if err := r.replaceChunks(tx, entryID, userID, chunks); err != nil {
+			return err
+		}
+
+		for _, chunk := range chunks {
+			if len(chunk.Embedding) != embeddingDimensions {
+				continue
+			}
+			_, err := tx.exec("UPDATE entry_chunk_embeddings SET embedding_vec = ?::vector WHERE entry_id = ? AND chunk_index = ?",
+				vectorLiteral(chunk.Embedding), entryID, chunk.Index)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// How many nearest chunks are fetched per result wanted, since several may
+// belong to the same entry
+const chunkCandidatesPerResult = 4
+
+func (r *pgvectorEmbeddingRepository) FindSimilar(userID int, queryEmbedding []float64, limit int) ([]SimilarEntry, error) {
+	if len(queryEmbedding) != embeddingDimensions {
+		return r.sqlEmbeddingRepository.FindSimilar(userID, queryEmbedding, limit)
+	}
+
+	keys, err := r.readingKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := r.nearestEntries(userID, queryEmbedding, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge in the entries of the nearest chunks, each scoring its best
+	byEntry := make(map[int]int, len(results))
+	for i := range results {
+		byEntry[results[i].Entry.ID] = i
+	}
+	rows, err := r.query(`
+		SELECT e.id, e.title, e.text, e.date, e.timezone, e.created_at,
+			ce.start_offset, ce.end_offset,
+			1 - (ce.embedding_vec <=> ?::vector) AS similarity
+		FROM entry_chunk_embeddings ce
+		JOIN entries e ON ce.entry_id = e.id
+		WHERE ce.user_id = ? AND ce.embedding_vec IS NOT NULL AND e.deleted_at IS NULL
+		ORDER BY ce.embedding_vec <=> ?::vector
+		LIMIT ?`,
+		vectorLiteral(queryEmbedding), userID, vectorLiteral(queryEmbedding), limit*chunkCandidatesPerResult)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry Entry
+		var start, end int
+		var similarity float64
+		err := rows.Scan(&entry.ID, &entry.Title, &entry.Text, &entry.Date, &entry.Timezone, &entry.CreatedAt,
+			&start, &end, &similarity)
+		if err != nil {
+			continue
+		}
+
+		i, ok := byEntry[entry.ID]
+		if !ok {
+			entry.UserID = userID
+			results = append(results, SimilarEntry{Entry: entry, Similarity: -1})
+			i = len(results) - 1
+			byEntry[entry.ID] = i
+		}
+		results[i].matchChunk(similarity, start, end)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Similarity > results[j].Similarity
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	if err := openSimilar(keys, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// The entries whose whole-text embeddings are nearest the query
+func (r *pgvectorEmbeddingRepository) nearestEntries(userID int, queryEmbedding []float64, limit int) ([]SimilarEntry, error) {
+	rows, err := r.query(`
+		SELECT e.id, e.title, e.text, e.date, e.timezone, e.created_at,
+			1 - (ee.embedding_vec <=> ?::vector) AS similarity
+		FROM entry_embeddings ee
+		JOIN entries e ON ee.entry_id = e.id
+		WHERE ee.user_id = ? AND ee.embedding_vec IS NOT NULL AND e.deleted_at IS NULL
+		ORDER BY ee.embedding_vec <=> ?::vector
+		LIMIT ?`,
+		vectorLiteral(queryEmbedding), userID, vectorLiteral(queryEmbedding), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SimilarEntry
+	for rows.Next() {
+		var similar SimilarEntry
+		err := rows.Scan(&similar.Entry.ID, &similar.Entry.Title, &similar.Entry.Text,
+			&similar.Entry.Date, &similar.Entry.Timezone, &similar.Entry.CreatedAt, &similar.Similarity)
+		if err != nil {
+			continue
+		}
+		similar.Entry.UserID = userID
+		results = append(results, similar)
+	}
+
+	return results, rows.Err()
+}
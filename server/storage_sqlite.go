@@ -0,0 +1,67 @@
+// storage_sqlite.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"runtime"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Busy timeout for SQLite lock contention, in milliseconds
+const sqliteBusyTimeoutMS = 5000
+
+// Build a go-sqlite3 DSN for the database file with our connection pragmas.
+// WAL lets readers run alongside the writer, busy_timeout makes lock
+// contention wait instead of failing with "database is locked", and
+// _txlock=immediate takes the write lock at BEGIN so transactions never
+// fail halfway through on a lock upgrade.
+func sqliteDSN(path string, readOnly bool) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", fmt.Sprint(sqliteBusyTimeoutMS))
+	params.Set("_foreign_keys", "on")
+	params.Set("_synchronous", "NORMAL")
+	if readOnly {
+		params.Set("_query_only", "true")
+	} else {
+		params.Set("_txlock", "immediate")
+	}
+
+	// Strip any parameters the caller already put on the path
+	path = strings.TrimPrefix(path, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+
+	return "file:" + path + "?" + params.Encode()
+}
+
+// Open the SQLite backend with a single writer connection and a separate
+// read pool
+func openSQLiteStore(cfg StorageConfig) (*sql.DB, *Store, error) {
+	writer, err := sql.Open("sqlite3", sqliteDSN(cfg.DatabaseURL, false))
+	if err != nil {
+		return nil, nil, err
+	}
+	// SQLite allows one writer at a time; serialize writes in the pool
+	// rather than letting connections fight over the lock
+	writer.SetMaxOpenConns(1)
+
+	if err := runMigrations(writer, sqliteDialect, migrations); err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+
+	reader, err := sql.Open("sqlite3", sqliteDSN(cfg.DatabaseURL, true))
+	if err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+	reader.SetMaxOpenConns(max(4, runtime.NumCPU()))
+
+	return writer, newSQLStore(writer, reader, sqliteDialect, cfg.MasterKeys), nil
+}
@@ -0,0 +1,137 @@
+// structured.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A suggestion as the generation model returns it: the activity plus what
+// the UI needs to present it
+type StructuredSuggestion struct {
+	Suggestion       string `json:"suggestion"`
+	Rationale        string `json:"rationale"`
+	Category         string `json:"category"`
+	EstimatedMinutes int    `json:"estimated_minutes"`
+
+	promptID string // template that produced it
+}
+
+// Categories a structured suggestion can fall in
+var suggestionCategories = []string{
+	"mindfulness", "movement", "rest", "social", "reflection",
+	"creativity", "nature", "organisation", "self_care",
+}
+
+// Limits enforced on structured suggestions
+const (
+	minSuggestionChars   = 10
+	maxSuggestionChars   = 300
+	maxRationaleChars    = 400
+	maxSuggestionMinutes = 120
+)
+
+// How many times an invalid reply is sent back to be repaired
+const suggestionRepairAttempts = 1
+
+// The schema as the model is told it, included in prompts as the
+// "suggestion_schema" block
+func suggestionSchemaPrompt() string {
+	return fmt.Sprintf(`Reply with a single JSON object and nothing else, with exactly these fields:
+{"suggestion": string, %d to %d characters, the activity itself, addressed to the writer as "you",
+ "rationale": string, at most %d characters, why it fits what they wrote,
+ "category": one of %s,
+ "estimated_minutes": integer from 1 to %d, how long it takes}`,
+		minSuggestionChars, maxSuggestionChars, maxRationaleChars,
+		`"`+strings.Join(suggestionCategories, `", "`)+`"`, maxSuggestionMinutes)
+}
+
+// Parse and validate a model reply against the suggestion schema. The
+// error says what was wrong, in words the repair prompt can pass back.
+func parseStructuredSuggestion(output string) (*StructuredSuggestion, error) {
+	start := strings.Index(output, "{")
+	if start < 0 {
+		return nil, fmt.Errorf("the reply contains no JSON object")
+	}
+
+	// Decode the first object only; models often add a closing remark
+	var raw struct {
+		Suggestion       *string `json:"suggestion"`
+		Rationale        *string `json:"rationale"`
+		Category         *string `json:"category"`
+		EstimatedMinutes *int    `json:"estimated_minutes"`
+	}
+	if err := json.NewDecoder(strings.NewReader(output[start:])).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("the JSON object is invalid: %v", err)
+	}
+
+	switch {
+	case raw.Suggestion == nil:
+		return nil, fmt.Errorf(`the "suggestion" field is missing`)
+	case raw.Rationale == nil:
+		return nil, fmt.Errorf(`the "rationale" field is missing`)
+	case raw.Category == nil:
+		return nil, fmt.Errorf(`the "category" field is missing`)
+	case raw.EstimatedMinutes == nil:
+		return nil, fmt.Errorf(`the "estimated_minutes" field is missing`)
+	}
+
+	s := &StructuredSuggestion{
+		Suggestion:       strings.Join(strings.Fields(*raw.Suggestion), " "),
+		Rationale:        strings.Join(strings.Fields(*raw.Rationale), " "),
+		Category:         strings.ToLower(strings.TrimSpace(*raw.Category)),
+		EstimatedMinutes: *raw.EstimatedMinutes,
+	}
+
+	if n := len([]rune(s.Suggestion)); n < minSuggestionChars || n > maxSuggestionChars {
+		return nil, fmt.Errorf(`"suggestion" must be %d to %d characters, not %d`, minSuggestionChars, maxSuggestionChars, n)
+	}
+	if n := len([]rune(s.Rationale)); n > maxRationaleChars {
+		return nil, fmt.Errorf(`"rationale" must be at most %d characters, not %d`, maxRationaleChars, n)
+	}
+	if !validSuggestionCategory(s.Category) {
+		return nil, fmt.Errorf(`"category" must be one of %s`, strings.Join(suggestionCategories, ", "))
+	}
+	if s.EstimatedMinutes < 1 || s.EstimatedMinutes > maxSuggestionMinutes {
+		return nil, fmt.Errorf(`"estimated_minutes" must be from 1 to %d`, maxSuggestionMinutes)
+	}
+
+	return s, nil
+}
+
+func validSuggestionCategory(category string) bool {
+	for _, c := range suggestionCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a suggestion reply, asking the model to repair it when it doesn't
+// match the schema
+func parseOrRepairSuggestion(ctx context.Context, userID int, output string) (*StructuredSuggestion, error) {
+	s, err := parseStructuredSuggestion(output)
+	for attempt := 0; err != nil && attempt < suggestionRepairAttempts; attempt++ {
+		log.Printf("Suggestion reply rejected, asking for a repair: %v", err)
+
+		prompt, promptErr := renderPrompt("suggestion_repair", userID, struct {
+			Output  string
+			Problem string
+		}{output, err.Error()})
+		if promptErr != nil {
+			return nil, promptErr
+		}
+		repaired, genErr := generateText(ctx, prompt)
+		if genErr != nil {
+			return nil, genErr
+		}
+
+		output = repaired
+		s, err = parseStructuredSuggestion(output)
+	}
+	return s, err
+}
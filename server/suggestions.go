@@ -0,0 +1,252 @@
+// suggestions.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Outcomes a user can report for a suggestion
+const (
+	outcomeHelped     = "helped"
+	outcomeDidNotHelp = "did_not_help"
+	outcomeTried      = "tried" // tried it, verdict not in yet
+)
+
+// The user's rating of the suggestion given with one analysis
+type SuggestionFeedback struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	EntryID    int       `json:"entry_id"`
+	AnalysisID int       `json:"analysis_id"`
+	Suggestion string    `json:"suggestion"`
+	Outcome    string    `json:"outcome"`
+	FollowUp   string    `json:"follow_up"` // what happened, in the user's words
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	key string
+}
+
+type SuggestionFeedbackRequest struct {
+	Outcome  string `json:"outcome"`
+	FollowUp string `json:"follow_up"`
+}
+
+// Ratings of one suggestion across the user's entries
+type SuggestionStats struct {
+	Suggestion    string  `json:"suggestion"`
+	Helped        int     `json:"helped"`
+	DidNotHelp    int     `json:"did_not_help"`
+	Tried         int     `json:"tried"`
+	Effectiveness float64 `json:"effectiveness"`
+
+	key string
+}
+
+// Effectiveness of a suggestion nobody has rated
+const unratedEffectiveness = 0.5
+
+const maxFollowUpChars = 1000
+
+// Prefix generateRAGSuggestions puts on a suggestion it repeats
+const repeatedSuggestionPrefix = "Previously, you found this helpful: "
+
+// Author of suggestions the generative model didn't write
+const templateSuggestion = "template"
+
+// Whether the generative model wrote a suggestion. Without a recorded
+// author, one with a structured form or repeating an earlier suggestion
+// counts as written by the model.
+func suggestionGenerated(by, suggestion string, structured bool) bool {
+	if by != "" {
+		return by != templateSuggestion
+	}
+	return structured || strings.HasPrefix(suggestion, repeatedSuggestionPrefix)
+}
+
+// Key identifying a suggestion across analyses: without the repeat
+// prefix, lowercased, with whitespace and a final full stop normalised
+func suggestionKey(suggestion string) string {
+	for strings.HasPrefix(suggestion, repeatedSuggestionPrefix) {
+		suggestion = strings.TrimPrefix(suggestion, repeatedSuggestionPrefix)
+	}
+	suggestion = strings.Join(strings.Fields(strings.ToLower(suggestion)), " ")
+	return strings.TrimSuffix(suggestion, ".")
+}
+
+// Mean of a Beta(1, 1) posterior over "helped" vs "didn't help". Tried
+// without a verdict counts as neither.
+func effectiveness(helped, didNotHelp int) float64 {
+	return float64(helped+1) / float64(helped+didNotHelp+2)
+}
+
+// The user's rating stats keyed by suggestionKey
+func loadSuggestionStats(userID int) map[string]SuggestionStats {
+	stats, err := store.SuggestionFeedback.Stats(userID)
+	if err != nil {
+		return map[string]SuggestionStats{}
+	}
+	byKey := make(map[string]SuggestionStats, len(stats))
+	for _, s := range stats {
+		byKey[s.key] = s
+	}
+	return byKey
+}
+
+// Effectiveness of a suggestion for the user
+func suggestionEffectiveness(stats map[string]SuggestionStats, suggestion string) float64 {
+	if s, ok := stats[suggestionKey(suggestion)]; ok {
+		return s.Effectiveness
+	}
+	return unratedEffectiveness
+}
+
+// Order candidate suggestions by the user's ratings, best first. Unrated
+// candidates keep their relative order.
+func rankSuggestions(candidates []string, stats map[string]SuggestionStats) []string {
+	ranked := append([]string{}, candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return suggestionEffectiveness(stats, ranked[i]) > suggestionEffectiveness(stats, ranked[j])
+	})
+	return ranked
+}
+
+func validOutcome(outcome string) bool {
+	return outcome == outcomeHelped || outcome == outcomeDidNotHelp || outcome == outcomeTried
+}
+
+// Rate the suggestion of the entry's current analysis. Rating it again, for
+// example after trying it, replaces the earlier rating.
+func rateSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	entry, ok := loadOwnedEntry(w, r)
+	if !ok {
+		return
+	}
+
+	var req SuggestionFeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	outcome := strings.ToLower(strings.TrimSpace(req.Outcome))
+	if !validOutcome(outcome) {
+		http.Error(w, "Outcome must be helped, did_not_help or tried", http.StatusBadRequest)
+		return
+	}
+	followUp := strings.TrimSpace(req.FollowUp)
+	if len([]rune(followUp)) > maxFollowUpChars {
+		http.Error(w, fmt.Sprintf("Follow-up must be at most %d characters", maxFollowUpChars), http.StatusBadRequest)
+		return
+	}
+
+	analysis, err := getMoodAnalysis(entry.ID)
+	if err != nil {
+		http.Error(w, "Mood analysis not found", http.StatusNotFound)
+		return
+	}
+	// Support messages for flagged entries aren't suggestions to rank
+	if analysis.RiskLevel != "" && analysis.RiskLevel != riskNone {
+		http.Error(w, "This analysis has no suggestion to rate", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(analysis.Suggestions) == "" {
+		http.Error(w, "This analysis has no suggestion to rate", http.StatusBadRequest)
+		return
+	}
+
+	feedback := &SuggestionFeedback{
+		UserID:     entry.UserID,
+		EntryID:    entry.ID,
+		AnalysisID: analysis.ID,
+		Suggestion: analysis.Suggestions,
+		Outcome:    outcome,
+		FollowUp:   followUp,
+		key:        suggestionKey(analysis.Suggestions),
+	}
+	if err := store.SuggestionFeedback.Save(feedback); err != nil {
+		http.Error(w, "Failed to save feedback", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedback)
+}
+
+// List the user's suggestion ratings, most recently changed first
+func listSuggestionFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	feedback, err := store.SuggestionFeedback.ListByUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch feedback", http.StatusInternalServerError)
+		return
+	}
+	if feedback == nil {
+		feedback = []SuggestionFeedback{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedback)
+}
+
+func deleteSuggestionFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	feedbackID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid feedback ID", http.StatusBadRequest)
+		return
+	}
+
+	feedback, err := store.SuggestionFeedback.GetByID(feedbackID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Feedback not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch feedback", http.StatusInternalServerError)
+		return
+	}
+	if feedback.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	if err := store.SuggestionFeedback.Delete(feedback.ID); err != nil {
+		http.Error(w, "Failed to delete feedback", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Every suggestion the user has rated, most effective first
+func getSuggestionEffectivenessHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	stats, err := store.SuggestionFeedback.Stats(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch suggestion ratings", http.StatusInternalServerError)
+		return
+	}
+	if stats == nil {
+		stats = []SuggestionStats{}
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].Effectiveness != stats[j].Effectiveness {
+			return stats[i].Effectiveness > stats[j].Effectiveness
+		}
+		return stats[i].Helped+stats[i].DidNotHelp > stats[j].Helped+stats[j].DidNotHelp
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
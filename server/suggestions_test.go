@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSuggestionGenerated(t *testing.T) {
+	model := withPromptVersion(generationModel, "suggestion_v1")
+	tests := []struct {
+		name       string
+		by         string
+		suggestion string
+		structured bool
+		want       bool
+	}{
+		{"model", model, "Take a walk.", true, true},
+		{"repeat of a model suggestion", model, repeatedSuggestionPrefix + "Take a walk.", false, true},
+		{"template", templateSuggestion, "Take a walk.", false, false},
+		{"repeat of a template suggestion", templateSuggestion, repeatedSuggestionPrefix + "Take a walk.", false, false},
+		{"unrecorded with a structured form", "", "Take a walk.", true, true},
+		{"unrecorded repeat", "", repeatedSuggestionPrefix + "Fais une pause 🌿", false, true},
+		{"unrecorded", "", "Fais une pause 🌿", false, false},
+		{"unrecorded and empty", "", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := suggestionGenerated(tt.by, tt.suggestion, tt.structured); got != tt.want {
+				t.Errorf("suggestionGenerated(%q, %q, %v) = %v, want %v", tt.by, tt.suggestion, tt.structured, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClearGeneratedSuggestions(t *testing.T) {
+	model := withPromptVersion(generationModel, "suggestion_v1")
+	structured := &StructuredSuggestion{Suggestion: "Take a short walk outside.", Category: "movement", EstimatedMinutes: 10}
+	analyses := []struct {
+		name    string
+		result  MoodResult
+		cleared bool
+	}{
+		{"model", MoodResult{Suggestions: structured.Suggestion, SuggestionBy: model, Structured: structured}, true},
+		{"repeat of a model suggestion", MoodResult{Suggestions: repeatedSuggestionPrefix + structured.Suggestion, SuggestionBy: model}, true},
+		{"template", MoodResult{Suggestions: "Écris trois choses positives.", SuggestionBy: templateSuggestion}, false},
+		{"repeat of a template suggestion", MoodResult{Suggestions: repeatedSuggestionPrefix + "Écris trois choses positives.", SuggestionBy: templateSuggestion}, false},
+		{"unrecorded repeat", MoodResult{Suggestions: repeatedSuggestionPrefix + "Call a friend."}, true},
+		{"unrecorded", MoodResult{Suggestions: "Call a friend."}, false},
+	}
+
+	for name, keys := range map[string]*masterKeys{"plaintext": {}, "encrypted": {current: newTestMasterKey(t)}} {
+		t.Run(name, func(t *testing.T) {
+			_, s := openTestStore(t, filepath.Join(t.TempDir(), "journal.db"), keys)
+			user, err := s.Users.Create("Zoë", "zoe@example.com", "hash", "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entryIDs := make([]int, len(analyses))
+			for i, a := range analyses {
+				entry := &Entry{UserID: user.ID, Title: a.name, Text: "Journée calme ☕", Date: "2026-10-18", Timezone: "UTC"}
+				if err := s.Entries.Create(entry); err != nil {
+					t.Fatal(err)
+				}
+				result := a.result
+				result.Analyzer = basicAnalyzer
+				result.EntryRevision = 1
+				result.OverallSentiment = "neutral"
+				if err := s.MoodAnalyses.Save(entry.ID, &result); err != nil {
+					t.Fatal(err)
+				}
+				feedback := &SuggestionFeedback{UserID: user.ID, EntryID: entry.ID, AnalysisID: result.ID,
+					Suggestion: result.Suggestions, Outcome: "helped", key: suggestionKey(result.Suggestions)}
+				if err := s.SuggestionFeedback.Save(feedback); err != nil {
+					t.Fatal(err)
+				}
+				entryIDs[i] = entry.ID
+			}
+
+			cleared, err := s.MoodAnalyses.ClearGeneratedSuggestions(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cleared != 3 {
+				t.Errorf("cleared %d suggestions, want 3", cleared)
+			}
+
+			feedback, err := s.SuggestionFeedback.ListByUser(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rated := make(map[int]bool)
+			for _, f := range feedback {
+				rated[f.EntryID] = true
+			}
+			for i, a := range analyses {
+				got, err := s.MoodAnalyses.GetByEntry(entryIDs[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a.cleared && (got.Suggestions != "" || got.Structured != nil || rated[entryIDs[i]]) {
+					t.Errorf("%s: suggestion %q, structured %v, rated %v; want all cleared", a.name, got.Suggestions, got.Structured, rated[entryIDs[i]])
+				}
+				if !a.cleared && (got.Suggestions != a.result.Suggestions || !rated[entryIDs[i]]) {
+					t.Errorf("%s: suggestion %q, rated %v; want it kept", a.name, got.Suggestions, rated[entryIDs[i]])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// trash.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Days an entry stays in the trash before it is purged
+const defaultTrashRetentionDays = 30
+
+// How often the purge job runs
+const trashPurgeInterval = time.Hour
+
+// Retention period from TRASH_RETENTION_DAYS, falling back to the default
+func trashRetention() time.Duration {
+	days := defaultTrashRetentionDays
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		} else {
+			log.Printf("Invalid TRASH_RETENTION_DAYS %q, using %d", v, defaultTrashRetentionDays)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// List the current user's trashed entries, most recently deleted first
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	entries, err := store.Entries.ListDeleted(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch trash", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Move an entry out of the trash
+func restoreEntryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	entryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.Entries.Restore(entryID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Entry not found in trash", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to restore entry", http.StatusInternalServerError)
+		return
+	}
+
+	entry, err := store.Entries.GetByID(entryID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve restored entry", http.StatusInternalServerError)
+		return
+	}
+	if moodAnalysis, err := getMoodAnalysis(entry.ID); err == nil {
+		entry.MoodAnalysis = moodAnalysis
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// Purge entries that have been in the trash longer than the retention period
+func purgeTrash() {
+	cutoff := time.Now().UTC().Add(-trashRetention())
+	purged, err := store.Entries.PurgeDeleted(cutoff)
+	if err != nil {
+		log.Printf("Trash purge failed: %v", err)
+		return
+	}
+	if purged > 0 {
+		log.Printf("Purged %d entries from trash", purged)
+	}
+}
+
+// Schedule the trash purge, running once at startup
+func scheduleTrashPurge() {
+	purgeTrash()
+
+	ticker := time.NewTicker(trashPurgeInterval)
+	go func() {
+		for range ticker.C {
+			purgeTrash()
+		}
+	}()
+}
@@ -0,0 +1,255 @@
+// triggers.go
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A term or tag that shows up disproportionately in the user's entries of
+// one sentiment compared to the rest of their entries
+type TriggerKeyword struct {
+	Term         string  `json:"term"`
+	Kind         string  `json:"kind"` // "term" or "tag"
+	LogOdds      float64 `json:"log_odds"`
+	ZScore       float64 `json:"z_score"`
+	Entries      int     `json:"entries"`       // entries of this sentiment containing it
+	TotalEntries int     `json:"total_entries"` // all analysed entries containing it
+}
+
+type TriggerReport struct {
+	EntryCount      int              `json:"entry_count"`
+	NegativeEntries int              `json:"negative_entries"`
+	PositiveEntries int              `json:"positive_entries"`
+	Negative        []TriggerKeyword `json:"negative"`
+	Positive        []TriggerKeyword `json:"positive"`
+}
+
+// An entry's text and current sentiment, as input to trigger detection
+type AnalysedEntry struct {
+	EntryID   int
+	Text      string
+	Sentiment string
+	Language  string // as detected by the analysis; empty for older ones
+}
+
+// A term must appear in at least this many entries of a sentiment to count
+const minTriggerSupport = 2
+
+// One-sided 95% significance for the log-odds z-score
+const minTriggerZScore = 1.645
+
+// Words: a letter followed by letters, apostrophes or hyphens
+var wordPattern = regexp.MustCompile(`\p{L}[\p{L}'’-]*`)
+
+var englishStopwords = makeWordSet(`a about above after again against all also am an and any are aren't as at
+	be because been before being below between both but by can can't cannot could couldn't
+	did didn't do does doesn't doing don't down during each even ever every few for from further
+	get got had hadn't has hasn't have haven't having he he'd he'll he's her here here's hers
+	herself him himself his how how's i i'd i'll i'm i've if in into is isn't it it's its itself
+	just let's like made make many me more most much mustn't my myself no nor not now of off on
+	once only or other ought our ours ourselves out over own really same shan't she she'd she'll
+	she's should shouldn't so some still such than that that's the their theirs them themselves
+	then there there's these they they'd they'll they're they've this those though through to
+	too today under until up us very was wasn't we we'd we'll we're we've were weren't what
+	what's when when's where where's which while who who's whom why why's will with won't would
+	wouldn't yet you you'd you'll you're you've your yours yourself yourselves`)
+
+func makeWordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+// Distinct content words in text: lowercased, stopwords of the text's
+// detected language and words shorter than three letters dropped
+func contentTerms(text string) map[string]bool {
+	return contentTermsIn(text, detectLanguage(text))
+}
+
+// Content words of text known to be in a language; empty detects it
+func contentTermsIn(text, language string) map[string]bool {
+	if language == "" {
+		language = detectLanguage(text)
+	}
+	stopwords := stopwordsFor(language)
+
+	terms := make(map[string]bool)
+	for _, word := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+		word = strings.Trim(strings.ReplaceAll(word, "’", "'"), "'-")
+		if len([]rune(word)) < 3 || stopwords[word] {
+			continue
+		}
+		terms[word] = true
+	}
+	return terms
+}
+
+// Smoothed log-odds ratio of a feature between entries with and without a
+// sentiment, and its z-score. in/inTotal count entries with the sentiment,
+// out/outTotal the rest.
+func logOddsRatio(in, inTotal, out, outTotal int) (float64, float64) {
+	// Add 0.5 to every cell so unseen combinations don't divide by zero
+	a := float64(in) + 0.5
+	b := float64(inTotal-in) + 0.5
+	c := float64(out) + 0.5
+	d := float64(outTotal-out) + 0.5
+
+	lor := math.Log(a*d) - math.Log(b*c)
+	se := math.Sqrt(1/a + 1/b + 1/c + 1/d)
+	return lor, lor / se
+}
+
+// Find the terms and tags associated with negative and positive sentiment
+// in the user's history, strongest first
+func detectTriggerKeywords(userID, limit int) (*TriggerReport, error) {
+	entries, err := store.Insights.AnalysedEntries(userID)
+	if err != nil {
+		return nil, err
+	}
+	entryTags, err := store.Tags.ListForUserEntries(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	type feature struct{ term, kind string }
+	// Entries containing each feature, by sentiment
+	counts := make(map[feature]map[string]int)
+	totals := make(map[string]int)
+
+	for _, entry := range entries {
+		totals[entry.Sentiment]++
+
+		features := make(map[feature]bool)
+		for term := range contentTermsIn(entry.Text, entry.Language) {
+			features[feature{term, "term"}] = true
+		}
+		for _, tag := range entryTags[entry.EntryID] {
+			features[feature{tag, "tag"}] = true
+		}
+
+		for f := range features {
+			if counts[f] == nil {
+				counts[f] = make(map[string]int)
+			}
+			counts[f][entry.Sentiment]++
+		}
+	}
+
+	report := &TriggerReport{
+		EntryCount:      len(entries),
+		NegativeEntries: totals["negative"],
+		PositiveEntries: totals["positive"],
+		Negative:        []TriggerKeyword{},
+		Positive:        []TriggerKeyword{},
+	}
+
+	for _, sentiment := range []string{"negative", "positive"} {
+		inTotal := totals[sentiment]
+		outTotal := len(entries) - inTotal
+		if inTotal == 0 || outTotal == 0 {
+			continue
+		}
+
+		var keywords []TriggerKeyword
+		for f, bySentiment := range counts {
+			in := bySentiment[sentiment]
+			if in < minTriggerSupport {
+				continue
+			}
+			total := 0
+			for _, n := range bySentiment {
+				total += n
+			}
+
+			lor, z := logOddsRatio(in, inTotal, total-in, outTotal)
+			if z < minTriggerZScore {
+				continue
+			}
+			keywords = append(keywords, TriggerKeyword{
+				Term:         f.term,
+				Kind:         f.kind,
+				LogOdds:      lor,
+				ZScore:       z,
+				Entries:      in,
+				TotalEntries: total,
+			})
+		}
+
+		sort.Slice(keywords, func(i, j int) bool {
+			if keywords[i].ZScore != keywords[j].ZScore {
+				return keywords[i].ZScore > keywords[j].ZScore
+			}
+			return keywords[i].Term < keywords[j].Term
+		})
+		if len(keywords) > limit {
+			keywords = keywords[:limit]
+		}
+
+		if sentiment == "negative" {
+			report.Negative = append(report.Negative, keywords...)
+		} else {
+			report.Positive = append(report.Positive, keywords...)
+		}
+	}
+
+	return report, nil
+}
+
+// Keyword strings for UserPatterns; tags are written as "#tag"
+func triggerTerms(keywords []TriggerKeyword) []string {
+	terms := []string{}
+	for _, k := range keywords {
+		if k.Kind == "tag" {
+			terms = append(terms, "#"+k.Term)
+		} else {
+			terms = append(terms, k.Term)
+		}
+	}
+	return terms
+}
+
+// Keywords from the list that occur in the text, or as "#tag" among its tags
+func matchTriggerKeywords(keywords []string, text string, tags []string) []string {
+	present := contentTerms(text)
+	for _, tag := range tags {
+		present["#"+tag] = true
+	}
+
+	var matched []string
+	for _, k := range keywords {
+		if present[k] {
+			matched = append(matched, k)
+		}
+	}
+	return matched
+}
+
+// Terms and tags associated with the user's negative and positive entries:
+// ?limit=10
+func getTriggersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 50 {
+			limit = n
+		}
+	}
+
+	report, err := detectTriggerKeywords(userID, limit)
+	if err != nil {
+		http.Error(w, "Failed to detect trigger keywords", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
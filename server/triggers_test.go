@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLogOddsRatio(t *testing.T) {
+	tests := []struct {
+		name                       string
+		in, inTotal, out, outTotal int
+		wantLogOdds, wantZScore    float64
+	}{
+		{"no entries", 0, 0, 0, 0, 0, 0},
+		{"same rate on both sides", 2, 4, 3, 6, 0, 0},
+		{"more common with the sentiment", 3, 4, 1, 6, 2.146581, 1.599582},
+		{"in every entry with the sentiment only", 5, 5, 0, 5, 4.795791, 2.295810},
+		{"more common without the sentiment", 1, 10, 9, 10, -3.691653, -2.971098},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lor, z := logOddsRatio(tt.in, tt.inTotal, tt.out, tt.outTotal)
+			if math.IsNaN(lor) || math.IsInf(lor, 0) || math.IsNaN(z) || math.IsInf(z, 0) {
+				t.Fatalf("logOddsRatio(%d, %d, %d, %d) = %v, %v, want finite values",
+					tt.in, tt.inTotal, tt.out, tt.outTotal, lor, z)
+			}
+			if math.Abs(lor-tt.wantLogOdds) > 1e-6 || math.Abs(z-tt.wantZScore) > 1e-6 {
+				t.Errorf("logOddsRatio(%d, %d, %d, %d) = %.6f, %.6f, want %.6f, %.6f",
+					tt.in, tt.inTotal, tt.out, tt.outTotal, lor, z, tt.wantLogOdds, tt.wantZScore)
+			}
+		})
+	}
+}
+
+// Swapping the sides of the table flips the sign and keeps the magnitude
+func TestLogOddsRatioSymmetry(t *testing.T) {
+	tests := []struct{ in, inTotal, out, outTotal int }{
+		{3, 4, 1, 6},
+		{0, 7, 4, 9},
+		{12, 40, 2, 30},
+	}
+
+	for _, tt := range tests {
+		lor, z := logOddsRatio(tt.in, tt.inTotal, tt.out, tt.outTotal)
+		swappedLor, swappedZ := logOddsRatio(tt.out, tt.outTotal, tt.in, tt.inTotal)
+		if math.Abs(lor+swappedLor) > 1e-9 || math.Abs(z+swappedZ) > 1e-9 {
+			t.Errorf("%v: got %v, %v and swapped %v, %v", tt, lor, z, swappedLor, swappedZ)
+		}
+	}
+}
+
+func sortedTerms(terms map[string]bool) []string {
+	list := []string{}
+	for term := range terms {
+		list = append(list, term)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestContentTermsIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		language string
+		want     []string
+	}{
+		{"empty", "", "en", []string{}},
+		{"only stopwords and short words", "I am so in it", "en", []string{}},
+		{"lowercased and deduplicated", "Work, work and WORK meetings", "en", []string{"meetings", "work"}},
+		{"curly apostrophes and hyphens", "Mom’s well-being", "en", []string{"mom's", "well-being"}},
+		{"digits are not words", "Slept 8 hours", "en", []string{"hours", "slept"}},
+		{"multibyte letters", "Très fatigué après l'été", "fr", []string{"après", "fatigué", "l'été"}},
+		{"short multibyte words dropped", "ça va où", "fr", []string{}},
+		{"stopwords of the language", "Estoy cansado con mucho trabajo", "es", []string{"cansado", "trabajo"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortedTerms(contentTermsIn(tt.text, tt.language))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("contentTermsIn(%q, %q) = %q, want %q", tt.text, tt.language, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchTriggerKeywords(t *testing.T) {
+	tests := []struct {
+		name     string
+		keywords []string
+		text     string
+		tags     []string
+		want     []string
+	}{
+		{"nothing to match", nil, "Deadline at work", nil, nil},
+		{"empty text", []string{"work"}, "", nil, nil},
+		{"terms in keyword order", []string{"work", "deadline", "family"}, "Deadline at work", nil, []string{"work", "deadline"}},
+		{"tags match with a hash", []string{"#office", "office"}, "A quiet day", []string{"office"}, []string{"#office"}},
+		{"multibyte term", []string{"fatigué"}, "Très fatigué", nil, []string{"fatigué"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchTriggerKeywords(tt.keywords, tt.text, tt.tags)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matchTriggerKeywords(%q, %q, %q) = %q, want %q", tt.keywords, tt.text, tt.tags, got, tt.want)
+			}
+		})
+	}
+}
@@ -157,7 +157,8 @@ const AddEntry = ({ onAddEntry }) => {
       const newEntry = {
         title: title.trim(),
         text: text.trim(),
-        date: new Date().toLocaleDateString("en-US"), // MM/DD/YYYY format to match backend
+        date: new Date().toLocaleDateString("en-CA"), // YYYY-MM-DD in the browser's timezone
+        timezone: Intl.DateTimeFormat().resolvedOptions().timeZone,
       };
 
       const response = await fetch("http://localhost:8080/api/entries", {
@@ -22,6 +22,13 @@ const formatDate = (dateString) => {
     }
   }
 
+  // Handle YYYY-MM-DD format
+  const iso = dateString.match(/^(\d{4})-(\d{2})-(\d{2})$/);
+  if (iso) {
+    const [, year, month, day] = iso;
+    return `${day}/${month}/${year}`;
+  }
+
   // Handle MM/DD/YYYY format
   if (dateString.includes("/")) {
     const parts = dateString.split(" ")[0].split("/"); // Take only date part before space
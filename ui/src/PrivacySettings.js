@@ -3,6 +3,35 @@ import React, { useEffect, useState } from "react";
 import { useNavigate } from "react-router-dom";
 import "./PrivacySettings.css"; // Optional: for styles
 
+// AI processing preferences, as named by /api/user/privacy. Turning off one
+// with a "deletes" note removes what it produced.
+const PRIVACY_OPTIONS = [
+  {
+    key: "mood_analysis",
+    label: "Analyze the mood of my entries",
+    deletes: "mood analyses, corrections, suggestion ratings and digests",
+  },
+  {
+    key: "embeddings",
+    label: "Find related entries (embeddings)",
+    deletes: "entry embeddings",
+  },
+  {
+    key: "generative_suggestions",
+    label: "AI-written suggestions and digests",
+    deletes:
+      "AI-written suggestions and your chat history; digests switch to plain summaries",
+  },
+  {
+    key: "external_processing",
+    label: "Allow external AI providers (text is redacted first)",
+  },
+  {
+    key: "local_analysis",
+    label: "Analyze on this server only (less accurate)",
+  },
+];
+
 const PrivacySettings = () => {
   const navigate = useNavigate();
   const [name, setName] = useState("");
@@ -13,6 +42,8 @@ const PrivacySettings = () => {
   const [loading, setLoading] = useState(false);
   const [message, setMessage] = useState("");
   const [error, setError] = useState("");
+  const [privacy, setPrivacy] = useState(null);
+  const [savedPrivacy, setSavedPrivacy] = useState(null);
 
   // Password visibility states
   const [showCurrentPassword, setShowCurrentPassword] = useState(false);
@@ -83,6 +114,7 @@ const PrivacySettings = () => {
         const userData = await response.json();
         setName(userData.name);
         setEmail(userData.email);
+        await fetchPrivacy(token);
       } else if (response.status === 401) {
         localStorage.removeItem("token");
         navigate("/login");
@@ -94,6 +126,71 @@ const PrivacySettings = () => {
     }
   };
 
+  const fetchPrivacy = async (token) => {
+    const response = await fetch("http://localhost:8080/api/user/privacy", {
+      headers: {
+        Authorization: `Bearer ${token}`,
+      },
+    });
+    if (response.ok) {
+      const settings = await response.json();
+      setPrivacy(settings);
+      setSavedPrivacy(settings);
+    } else {
+      setError("Failed to fetch privacy settings");
+    }
+  };
+
+  // Save changed privacy settings, after confirming any deletions. Returns
+  // false if the user cancelled or saving failed.
+  const savePrivacy = async (token) => {
+    if (!privacy || !savedPrivacy) {
+      return true;
+    }
+
+    const changes = {};
+    const deletions = [];
+    PRIVACY_OPTIONS.forEach(({ key, deletes }) => {
+      if (privacy[key] !== savedPrivacy[key]) {
+        changes[key] = privacy[key];
+        if (deletes && !privacy[key]) {
+          deletions.push(deletes);
+        }
+      }
+    });
+    if (Object.keys(changes).length === 0) {
+      return true;
+    }
+
+    if (
+      deletions.length > 0 &&
+      !window.confirm(
+        `This permanently deletes your ${deletions.join(", ")}. Continue?`
+      )
+    ) {
+      return false;
+    }
+
+    const response = await fetch("http://localhost:8080/api/user/privacy", {
+      method: "PUT",
+      headers: {
+        "Content-Type": "application/json",
+        Authorization: `Bearer ${token}`,
+      },
+      body: JSON.stringify(changes),
+    });
+    if (!response.ok) {
+      const errorData = await response.text();
+      setError(errorData || "Failed to save privacy settings");
+      return false;
+    }
+
+    const { deleted, ...settings } = await response.json();
+    setPrivacy(settings);
+    setSavedPrivacy(settings);
+    return true;
+  };
+
   const validateForm = () => {
     if (!name.trim()) {
       setError("Name is required");
@@ -135,6 +232,10 @@ const PrivacySettings = () => {
         return;
       }
 
+      if (!(await savePrivacy(token))) {
+        return;
+      }
+
       const updateData = {
         name: name.trim(),
       };
@@ -255,6 +356,25 @@ const PrivacySettings = () => {
         </div>
       </div>
 
+      {privacy && (
+        <div className="settings-group privacy-options">
+          <label className="settings-label">AI Processing</label>
+          {PRIVACY_OPTIONS.map(({ key, label }) => (
+            <label key={key} className="privacy-option">
+              <input
+                type="checkbox"
+                checked={privacy[key]}
+                onChange={(e) =>
+                  setPrivacy({ ...privacy, [key]: e.target.checked })
+                }
+                disabled={loading}
+              />
+              {label}
+            </label>
+          ))}
+        </div>
+      )}
+
       <div className="settings-actions">
         <button
           className="save-button"